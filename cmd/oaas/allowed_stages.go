@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/exp/slices"
+)
+
+var (
+	ErrStageNotAllowed = errors.New("stage not allowed")
+)
+
+type manifestStage struct {
+	Type string `json:"type"`
+	// v1
+	Name string `json:"name"`
+}
+
+// manifestV1Pipeline is a v1 pipeline, the build pipeline is nested
+type manifestV1Pipeline struct {
+	Build *struct {
+		Pipeline *manifestV1Pipeline `json:"pipeline"`
+	} `json:"build"`
+	Stages    []manifestStage `json:"stages"`
+	Assembler *manifestStage  `json:"assembler"`
+}
+
+// manifestStages is the part of an osbuild manifest (v1 and v2)
+// that lists the stages
+type manifestStages struct {
+	// v2
+	Pipelines []struct {
+		Stages []manifestStage `json:"stages"`
+	} `json:"pipelines"`
+	// v1
+	Pipeline *manifestV1Pipeline `json:"pipeline"`
+}
+
+func (p *manifestV1Pipeline) stageTypes() []string {
+	var types []string
+	if p.Build != nil && p.Build.Pipeline != nil {
+		types = append(types, p.Build.Pipeline.stageTypes()...)
+	}
+	for _, stage := range p.Stages {
+		types = append(types, stage.Name)
+	}
+	if p.Assembler != nil {
+		types = append(types, p.Assembler.Name)
+	}
+	return types
+}
+
+// checkManifestStages ensures that the manifest only uses the allowed
+// stage types, no allowed stages means no restriction
+func checkManifestStages(config *Config, manifestPath string) error {
+	if len(config.AllowedStages) == 0 {
+		return nil
+	}
+	data, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+	var manifest manifestStages
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("cannot decode manifest stages: %v", err)
+	}
+
+	var types []string
+	for _, pipeline := range manifest.Pipelines {
+		for _, stage := range pipeline.Stages {
+			types = append(types, stage.Type)
+		}
+	}
+	if manifest.Pipeline != nil {
+		types = append(types, manifest.Pipeline.stageTypes()...)
+	}
+	for _, typ := range types {
+		if !slices.Contains(config.AllowedStages, typ) {
+			return fmt.Errorf("%w: %q", ErrStageNotAllowed, typ)
+		}
+	}
+	return nil
+}
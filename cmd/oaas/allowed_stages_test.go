@@ -0,0 +1,62 @@
+package main_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+const manifestWithStages = `{
+  "version": "2",
+  "pipelines": [
+    {"name": "build", "stages": [{"type": "org.osbuild.rpm"}]},
+    {"name": "image", "stages": [{"type": "org.osbuild.rpm"}, {"type": "%s"}]}
+  ]
+}`
+
+func TestBuildStagesAllowed(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-allowed-stages", "org.osbuild.rpm,org.osbuild.mkdir")
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, fmt.Sprintf(manifestWithStages, "org.osbuild.mkdir"))
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+}
+
+func TestBuildStagesNotAllowed(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-allowed-stages", "org.osbuild.rpm,org.osbuild.mkdir")
+	endpoint := baseURL + "api/v1/build"
+
+	for _, tc := range []struct {
+		manifest string
+		expected string
+	}{
+		{fmt.Sprintf(manifestWithStages, "org.osbuild.script"), "stage not allowed: \"org.osbuild.script\"\n"},
+		{`{"pipeline": {"build": {"pipeline": {"stages": [{"name": "org.osbuild.script"}]}}, "stages": [{"name": "org.osbuild.rpm"}]}}`, "stage not allowed: \"org.osbuild.script\"\n"},
+		{`{"pipeline": {"stages": [{"name": "org.osbuild.rpm"}], "assembler": {"name": "org.osbuild.qemu"}}}`, "stage not allowed: \"org.osbuild.qemu\"\n"},
+	} {
+		buf := makeTestPost(t, `{"exports": ["image"]}`, tc.manifest)
+		rsp, err := http.Post(endpoint, "application/x-tar", buf)
+		assert.NoError(t, err)
+		defer rsp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, rsp.StatusCode)
+		body, err := ioutil.ReadAll(rsp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, string(body))
+		// the build never starts
+		assert.NoDirExists(t, filepath.Join(baseBuildDir, "build"))
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+var (
+	gpgBinary    = "gpg"
+	cosignBinary = "cosign"
+
+	artifactSigners = []string{"gpg", "cosign"}
+)
+
+// signatureName is the name of the detached signature of a result
+func signatureName(name string) string {
+	return name + ".sig"
+}
+
+// signArtifact writes a detached signature of the given file next to
+// it, Config.ArtifactSigningKey is the gpg key id or the cosign key
+// file
+func signArtifact(config *Config, path string) (digest string, err error) {
+	sigPath := signatureName(path)
+	var cmd *exec.Cmd
+	switch config.ArtifactSigner {
+	case "gpg":
+		cmd = exec.Command(gpgBinary, "--batch", "--yes", "--local-user", config.ArtifactSigningKey, "--output", sigPath, "--detach-sign", path)
+	case "cosign":
+		// the key password is taken from COSIGN_PASSWORD
+		cmd = exec.Command(cosignBinary, "sign-blob", "--yes", "--key", config.ArtifactSigningKey, "--output-signature", sigPath, path)
+	default:
+		return "", fmt.Errorf("unsupported artifact signer %q", config.ArtifactSigner)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("cannot sign %v: %v, output:\n%s", path, err, out)
+	}
+	sig, err := os.ReadFile(sigPath)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(sig)
+	return "sha256:" + hex.EncodeToString(h[:]), nil
+}
@@ -0,0 +1,139 @@
+package main_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+// makeGPGHome creates a gpg home with a fresh signing key, the path
+// is kept short because of the gpg-agent socket path limit
+func makeGPGHome(t *testing.T) string {
+	home, err := os.MkdirTemp("", "gpg")
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		exec.Command("gpgconf", "--homedir", home, "--kill", "gpg-agent").Run()
+		os.RemoveAll(home)
+	})
+	return home
+}
+
+func gpg(t *testing.T, home string, args ...string) []byte {
+	out, err := exec.Command("gpg", append([]string{"--homedir", home, "--batch"}, args...)...).CombinedOutput()
+	assert.NoError(t, err, string(out))
+	return out
+}
+
+func getResult(t *testing.T, baseURL, name string) []byte {
+	rsp, err := http.Get(baseURL + "api/v1/result/" + name)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	return body
+}
+
+func TestBuildArtifactSignedWithGPG(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("no gpg")
+	}
+	signingHome := makeGPGHome(t)
+	gpg(t, signingHome, "--passphrase", "", "--quick-gen-key", "oaas test <oaas@example.com>", "ed25519", "sign", "never")
+	publicKey := gpg(t, signingHome, "--armor", "--export", "oaas@example.com")
+	t.Setenv("GNUPGHOME", signingHome)
+
+	baseURL, baseBuildDir, _ := runTestServer(t, "-provenance", "-artifact-signer", "gpg", "-artifact-signing-key", "oaas@example.com")
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+echo "fake-build-result" > %[1]s/build/output/image/disk.img
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+
+	outputTar := getResult(t, baseURL, "output.tar")
+	sig := getResult(t, baseURL, "output.tar.sig")
+
+	// verify with only the public key
+	verifyHome := makeGPGHome(t)
+	keyPath := filepath.Join(verifyHome, "public.asc")
+	err = ioutil.WriteFile(keyPath, publicKey, 0644)
+	assert.NoError(t, err)
+	gpg(t, verifyHome, "--import", keyPath)
+	for name, content := range map[string][]byte{"output.tar": outputTar, "output.tar.sig": sig} {
+		err := ioutil.WriteFile(filepath.Join(verifyHome, name), content, 0644)
+		assert.NoError(t, err)
+	}
+	gpg(t, verifyHome, "--verify", filepath.Join(verifyHome, "output.tar.sig"), filepath.Join(verifyHome, "output.tar"))
+
+	resultJSON, err := ioutil.ReadFile(filepath.Join(baseBuildDir, "build/result.json"))
+	assert.NoError(t, err)
+	var summary struct {
+		SignatureDigest string `json:"signature_digest"`
+	}
+	err = json.Unmarshal(resultJSON, &summary)
+	assert.NoError(t, err)
+	digest := sha256.Sum256(sig)
+	assert.Equal(t, "sha256:"+hex.EncodeToString(digest[:]), summary.SignatureDigest)
+	// the provenance is signed too
+	assert.NotEmpty(t, getResult(t, baseURL, "provenance.json.sig"))
+}
+
+func TestBuildArtifactSignedWithCosign(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-provenance", "-artifact-signer", "cosign", "-artifact-signing-key", "/etc/oaas/cosign.key")
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+echo "fake-build-result" > %[1]s/build/output/image/disk.img
+`, baseBuildDir))
+	defer restore()
+	// the fake signature contains the arguments
+	restore = main.MockCosignBinary(t, `#!/bin/sh -e
+while [ $# -gt 0 ]; do
+    case "$1" in
+        --output-signature) sig="$2"; shift;;
+        *) args="$args $1";;
+    esac
+    shift
+done
+echo "cosign$args" > "$sig"
+`)
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+
+	outputDir := filepath.Join(baseBuildDir, "build/output")
+	for _, name := range []string{"output.tar", "provenance.json"} {
+		sig := getResult(t, baseURL, name+".sig")
+		assert.Equal(t, fmt.Sprintf("cosign sign-blob --yes --key /etc/oaas/cosign.key %s\n", filepath.Join(outputDir, name)), string(sig))
+	}
+}
+
+func TestRunArtifactSignerRequiresKey(t *testing.T) {
+	err := main.Run(context.Background(), []string{"-artifact-signer", "cosign", "-signing-key", "provenance.pem", "-provenance"}, os.Getenv)
+	assert.EqualError(t, err, "-artifact-signer requires -artifact-signing-key")
+}
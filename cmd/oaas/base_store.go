@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+// linkBaseStore makes the sources of the base store available in the
+// build store via symlinks, sources that got uploaded are kept
+func linkBaseStore(baseStore, storeDir string) error {
+	baseSources := filepath.Join(baseStore, "sources")
+	return filepath.Walk(baseSources, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == baseSources {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(baseStore, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(storeDir, rel)
+		if _, err := os.Lstat(target); err == nil {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		return os.Symlink(path, target)
+	})
+}
+
+// setupBaseStore layers the read-only base store below the build
+// store, an overlay is used if possible
+func setupBaseStore(baseStore, buildDir string) (cleanup func() error, err error) {
+	storeDir := filepath.Join(buildDir, "store")
+	if err := os.MkdirAll(storeDir, 0755); err != nil {
+		return nil, err
+	}
+	baseStore, err = filepath.Abs(baseStore)
+	if err != nil {
+		return nil, err
+	}
+	cleanup, err = mountBaseStore(baseStore, buildDir)
+	if err == nil {
+		return cleanup, nil
+	}
+	logrus.Infof("cannot mount base store overlay, using links: %v", err)
+	if err := linkBaseStore(baseStore, storeDir); err != nil {
+		return nil, err
+	}
+	return func() error { return nil }, nil
+}
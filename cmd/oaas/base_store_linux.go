@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// mountBaseStore mounts an overlay with the base store as the lower
+// and the build store as the upper dir at the build store path
+func mountBaseStore(baseStore, buildDir string) (unmount func() error, err error) {
+	storeDir := filepath.Join(buildDir, "store")
+	upperDir := filepath.Join(buildDir, "store-upper")
+	workDir := filepath.Join(buildDir, "store-work")
+
+	if err := os.Rename(storeDir, upperDir); err != nil {
+		return nil, err
+	}
+	undo := func() {
+		os.Remove(storeDir)
+		os.RemoveAll(workDir)
+		os.Rename(upperDir, storeDir)
+	}
+	if err := os.Mkdir(workDir, 0700); err != nil {
+		undo()
+		return nil, err
+	}
+	if err := os.Mkdir(storeDir, 0755); err != nil {
+		undo()
+		return nil, err
+	}
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", baseStore, upperDir, workDir)
+	if err := unix.Mount("overlay", storeDir, "overlay", 0, opts); err != nil {
+		undo()
+		return nil, fmt.Errorf("cannot mount overlay: %w", err)
+	}
+
+	return func() error {
+		return unix.Unmount(storeDir, 0)
+	}, nil
+}
@@ -0,0 +1,75 @@
+package main_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+const baseSourceName = "sha256:0c9a4d07c37b0ba2c9a3a6da9fd5a4e428fd4b4d8b6bba6e1c1bc1b8d1db5a68"
+
+func makeBaseStore(t *testing.T) string {
+	baseStore := t.TempDir()
+	sourcesDir := filepath.Join(baseStore, "sources/org.osbuild.files")
+	err := os.MkdirAll(sourcesDir, 0755)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(sourcesDir, baseSourceName), []byte("base-source"), 0644)
+	assert.NoError(t, err)
+	return baseStore
+}
+
+func TestBuildUsesBaseStore(t *testing.T) {
+	baseStore := makeBaseStore(t)
+	baseURL, baseBuildDir, _ := runTestServer(t, "-base-store", baseStore)
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+store=%[1]s/build/store
+cat "$store/sources/org.osbuild.files/%[2]s"
+cat "$store/sources/org.osbuild.files/sha256:ff800c5263b915d8a0776be5620575df2d478332ad35e8dd18def6a8c720f9c7"
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir, baseSourceName))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["tree"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	// the source only in the base store and the uploaded one
+	assert.Equal(t, "base-sourcerandom-data", string(body))
+	// and the base store is not modified
+	entries, err := os.ReadDir(filepath.Join(baseStore, "sources/org.osbuild.files"))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestLinkBaseStoreKeepsUploadedSources(t *testing.T) {
+	baseStore := makeBaseStore(t)
+	storeDir := t.TempDir()
+	uploaded := filepath.Join(storeDir, "sources/org.osbuild.files", baseSourceName)
+	err := os.MkdirAll(filepath.Dir(uploaded), 0755)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(uploaded, []byte("uploaded"), 0644)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(baseStore, "sources/org.osbuild.files/sha256:other"), []byte("other"), 0644)
+	assert.NoError(t, err)
+
+	err = main.LinkBaseStore(baseStore, storeDir)
+	assert.NoError(t, err)
+	content, err := ioutil.ReadFile(uploaded)
+	assert.NoError(t, err)
+	assert.Equal(t, "uploaded", string(content))
+	content, err = ioutil.ReadFile(filepath.Join(storeDir, "sources/org.osbuild.files/sha256:other"))
+	assert.NoError(t, err)
+	assert.Equal(t, "other", string(content))
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+func mountBaseStore(baseStore, buildDir string) (unmount func() error, err error) {
+	return nil, errors.New("overlay not supported")
+}
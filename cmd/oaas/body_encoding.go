@@ -0,0 +1,78 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrUnsupportedContentEncoding = errors.New("unsupported Content-Encoding")
+	ErrBodyTooLarge               = errors.New("decompressed request body too large")
+)
+
+// bodyDecompressor decompresses a gzip encoded request body, the
+// ratio and size limits are checked while reading so that a bomb is
+// stopped before it reaches the disk
+type bodyDecompressor struct {
+	zr         *gzip.Reader
+	compressed *countingReader
+	n          int64
+
+	maxRatio int64
+	maxSize  int64
+
+	err error
+}
+
+func (d *bodyDecompressor) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	n, err := d.zr.Read(p)
+	d.n += int64(n)
+	switch {
+	case d.maxSize > 0 && d.n > d.maxSize:
+		d.err = fmt.Errorf("%w: more than %v bytes", ErrBodyTooLarge, d.maxSize)
+	case d.maxRatio > 0 && d.n > d.compressed.n*d.maxRatio:
+		d.err = fmt.Errorf("%w: more than %v times the compressed size", ErrDecompressRatio, d.maxRatio)
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	return n, err
+}
+
+// Err returns the error if the body exceeded one of the limits, a
+// nil bodyDecompressor never fails
+func (d *bodyDecompressor) Err() error {
+	if d == nil {
+		return nil
+	}
+	return d.err
+}
+
+// decodeRequestBody undoes the given Content-Encoding of the request
+// body, the returned bodyDecompressor is nil for identity bodies
+func decodeRequestBody(config *Config, r io.Reader, encoding string) (io.Reader, *bodyDecompressor, error) {
+	switch encoding {
+	case "", "identity":
+		return r, nil, nil
+	case "gzip":
+		compressed := &countingReader{r: r}
+		zr, err := gzip.NewReader(compressed)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot decompress request body: %w", err)
+		}
+		d := &bodyDecompressor{
+			zr:         zr,
+			compressed: compressed,
+			maxRatio:   config.MaxDecompressRatio,
+			maxSize:    config.MaxDecompressedBodySize,
+		}
+		return d, d, nil
+	default:
+		return nil, nil, fmt.Errorf("%w: %q", ErrUnsupportedContentEncoding, encoding)
+	}
+}
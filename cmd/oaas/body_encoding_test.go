@@ -0,0 +1,99 @@
+package main_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+func gzipBody(t *testing.T, r io.Reader) *bytes.Buffer {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := io.Copy(zw, r)
+	assert.NoError(t, err)
+	err = zw.Close()
+	assert.NoError(t, err)
+	return &buf
+}
+
+func postEncoded(t *testing.T, endpoint, encoding string, body io.Reader) (int, string) {
+	req, err := http.NewRequest(http.MethodPost, endpoint, body)
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-tar")
+	req.Header.Set("Content-Encoding", encoding)
+	rsp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	data, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	return rsp.StatusCode, string(data)
+}
+
+func TestBuildGzipEncodedBody(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+# the manifest is the last argument
+for arg; do :; done
+cat "$arg"
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	manifest := fmt.Sprintf(`{"fake": "manifest", "padding": %q}`, strings.Repeat("x", 64*1024))
+	body := gzipBody(t, makeTestPost(t, `{"exports": ["image"]}`, manifest))
+	status, output := postEncoded(t, endpoint, "gzip", body)
+	assert.Equal(t, http.StatusCreated, status, output)
+	assert.Contains(t, output, manifest)
+}
+
+func TestBuildGzipEncodedBodyRatio(t *testing.T) {
+	baseURL, _, _ := runTestServer(t, "-max-decompress-ratio", "10")
+	endpoint := baseURL + "api/v1/build"
+
+	manifest := fmt.Sprintf(`{"fake": "manifest", "padding": %q}`, strings.Repeat("x", 64*1024))
+	body := gzipBody(t, makeTestPost(t, `{"exports": ["image"]}`, manifest))
+	status, output := postEncoded(t, endpoint, "gzip", body)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	assert.Equal(t, "decompression ratio exceeded: more than 10 times the compressed size\n", output)
+}
+
+func TestBuildGzipEncodedBodySize(t *testing.T) {
+	baseURL, _, _ := runTestServer(t, "-max-decompressed-body-size", "4096")
+	endpoint := baseURL + "api/v1/build"
+
+	manifest := fmt.Sprintf(`{"fake": "manifest", "padding": %q}`, strings.Repeat("x", 64*1024))
+	body := gzipBody(t, makeTestPost(t, `{"exports": ["image"]}`, manifest))
+	status, output := postEncoded(t, endpoint, "gzip", body)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	assert.Equal(t, "decompressed request body too large: more than 4096 bytes\n", output)
+}
+
+func TestBuildInvalidContentEncoding(t *testing.T) {
+	baseURL, _, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	for _, tc := range []struct {
+		encoding       string
+		body           io.Reader
+		expectedStatus int
+		expectedErr    string
+	}{
+		{"br", makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`), http.StatusUnsupportedMediaType, `unsupported Content-Encoding: "br"`},
+		{"gzip", makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`), http.StatusBadRequest, "cannot decompress request body: gzip: invalid header"},
+	} {
+		status, output := postEncoded(t, endpoint, tc.encoding, tc.body)
+		assert.Equal(t, tc.expectedStatus, status, tc.encoding)
+		assert.Equal(t, tc.expectedErr+"\n", output)
+	}
+}
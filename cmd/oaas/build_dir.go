@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultBuildDirPattern is the build dir name of a build dir base
+// that is not shared with other nodes
+const defaultBuildDirPattern = "build"
+
+var buildDirTokenRegexp = regexp.MustCompile(`{[^}]*}`)
+
+// expandBuildDirPattern expands the Config.BuildDirPattern tokens,
+// the pattern is expanded once so {timestamp} is the server start
+// time and the single build per node is kept
+func expandBuildDirPattern(pattern string, now time.Time) (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("cannot get hostname: %v", err)
+	}
+	tokens := map[string]string{
+		"{hostname}":  hostname,
+		"{pid}":       strconv.Itoa(os.Getpid()),
+		"{timestamp}": now.UTC().Format("20060102T150405Z"),
+	}
+	var unknown []string
+	name := buildDirTokenRegexp.ReplaceAllStringFunc(pattern, func(token string) string {
+		value, ok := tokens[token]
+		if !ok {
+			unknown = append(unknown, token)
+		}
+		return value
+	})
+	if len(unknown) > 0 {
+		return "", fmt.Errorf("unknown build dir pattern tokens %v", strings.Join(unknown, ","))
+	}
+	if name == "" || !filepath.IsLocal(name) || filepath.Clean(name) != name {
+		return "", fmt.Errorf("build dir pattern %q must expand to a clean relative path, got %q", pattern, name)
+	}
+	return name, nil
+}
+
+// buildDirPath returns the path of the build dir, it is the lock
+// that ensures only a single build runs at a time
+func buildDirPath(config *Config) string {
+	name := config.buildDirName
+	if name == "" {
+		name = defaultBuildDirPattern
+	}
+	return filepath.Join(config.BuildDirBase, name)
+}
+
+// resultMarkerPath returns the path of the "good" or "bad" result
+// marker that belongs to the build dir
+func resultMarkerPath(config *Config, result string) string {
+	name := config.buildDirName
+	if name == "" || name == defaultBuildDirPattern {
+		return filepath.Join(config.BuildDirBase, "result."+result)
+	}
+	return filepath.Join(config.BuildDirBase, name+".result."+result)
+}
+
+// memoryBuildDirPrefix is the name prefix of the memory build dirs of
+// this instance, the memory build dir can be shared with other
+// instances that must not see them as stale
+func memoryBuildDirPrefix(config *Config) string {
+	base, err := filepath.Abs(config.BuildDirBase)
+	if err != nil {
+		base = config.BuildDirBase
+	}
+	h := sha256.Sum256([]byte(base + "\x00" + config.BuildDirPattern))
+	return "oaas-build-" + hex.EncodeToString(h[:4]) + "-"
+}
@@ -0,0 +1,71 @@
+package main_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+func TestBuildDirPatternHostname(t *testing.T) {
+	hostname, err := os.Hostname()
+	assert.NoError(t, err)
+	baseURL, baseBuildDir, _ := runTestServer(t, "-build-dir-pattern", "oaas-{hostname}")
+	buildDir := filepath.Join(baseBuildDir, "oaas-"+hostname)
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/output/image
+echo "fake-build-result" > %[1]s/output/image/disk.img
+`, buildDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+
+	assert.NoDirExists(t, filepath.Join(baseBuildDir, "build"))
+	assert.FileExists(t, filepath.Join(buildDir, "manifest.json"))
+	assert.FileExists(t, filepath.Join(baseBuildDir, "oaas-"+hostname+".result.good"))
+
+	rsp, err = http.Get(baseURL + "api/v1/result/image/disk.img")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "fake-build-result\n", string(body))
+
+	// the single build per node is still enforced
+	buf = makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err = http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusConflict, rsp.StatusCode)
+}
+
+func TestRunInvalidBuildDirPattern(t *testing.T) {
+	for _, tc := range []struct {
+		pattern     string
+		expectedErr string
+	}{
+		{"../{hostname}", `must expand to a clean relative path`},
+		{"/abs/{pid}", `must expand to a clean relative path`},
+		{"a//{pid}", `must expand to a clean relative path`},
+		{"", `must expand to a clean relative path`},
+		{"build-{uuid}", `unknown build dir pattern tokens {uuid}`},
+	} {
+		err := main.Run(context.Background(), []string{"-build-dir-pattern", tc.pattern}, os.Getenv)
+		assert.ErrorContains(t, err, tc.expectedErr, tc.pattern)
+	}
+}
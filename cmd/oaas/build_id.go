@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+var (
+	ErrInvalidBuildID   = errors.New("invalid build id")
+	ErrDuplicateBuildID = errors.New("duplicate build id")
+
+	buildIDRegexp = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+)
+
+// newBuildID returns a random (version 4) UUID
+func newBuildID() (string, error) {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		return "", err
+	}
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:]), nil
+}
+
+// applyBuildID validates the control.json "build_id" of clients that
+// manage their own ids and generates one otherwise
+func applyBuildID(config *Config, control *controlJSON) error {
+	if control.BuildID == "" {
+		id, err := newBuildID()
+		if err != nil {
+			return fmt.Errorf("cannot generate build id: %w", err)
+		}
+		control.BuildID = id
+		return nil
+	}
+	if !buildIDRegexp.MatchString(control.BuildID) {
+		return fmt.Errorf("%w %q, must be a lowercase UUID", ErrInvalidBuildID, control.BuildID)
+	}
+	// the ids of the builds that are still around must stay unique
+	buildDir, err := findBuildDir(config, control.BuildID)
+	if err != nil {
+		return err
+	}
+	if buildDir != "" {
+		return fmt.Errorf("%w %q", ErrDuplicateBuildID, control.BuildID)
+	}
+	return nil
+}
+
+// findBuildDir returns the dir of the build with the given id or ""
+// when no such build is around
+func findBuildDir(config *Config, id string) (string, error) {
+	entries, err := ioutil.ReadDir(config.BuildDirBase)
+	// the build dir base is only created with the first build
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		buildDir := filepath.Join(config.BuildDirBase, entry.Name())
+		info, err := readBuildInfo(buildDir)
+		if err == nil && info.BuildID == id {
+			return buildDir, nil
+		}
+	}
+	return "", nil
+}
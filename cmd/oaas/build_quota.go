@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var ErrQuotaExceeded = errors.New("build aborted: disk quota exceeded")
+
+// quotaPollInterval is how often the soft quota watchdog checks the
+// used space
+var quotaPollInterval = 500 * time.Millisecond
+
+// mountQuotaFS provisions the build dir inside a size limited
+// filesystem, it is a variable so that tests can force the watchdog
+var mountQuotaFS = mountQuotaImage
+
+// quotaImagePath is the filesystem image of a build dir with a quota,
+// it is next to the build dir so that it outlives the mount
+func quotaImagePath(buildDir string) string {
+	return buildDir + ".quota.img"
+}
+
+func hasQuotaFS(buildDir string) bool {
+	return fileExists(quotaImagePath(buildDir))
+}
+
+func quotaError(quota int64) error {
+	return fmt.Errorf("%w: limit is %v bytes", ErrQuotaExceeded, quota)
+}
+
+// setupBuildQuota enforces the quota with a hard limit when possible,
+// otherwise runOsbuild falls back to the watchdog
+func setupBuildQuota(config *Config, buildDir string) {
+	if config.BuildQuotaBytes <= 0 {
+		return
+	}
+	if err := mountQuotaFS(buildDir, config.BuildQuotaBytes); err != nil {
+		os.Remove(quotaImagePath(buildDir))
+		logrus.Warnf("cannot provision quota filesystem, using the watchdog: %v", err)
+	}
+}
+
+// quotaWatchdog is a soft quota, it polls the used space of the
+// filesystem of the build dir so other writers to the same
+// filesystem are counted too
+type quotaWatchdog struct {
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	mu       sync.Mutex
+	exceeded bool
+}
+
+func startQuotaWatchdog(buildDir string, quota int64, abort func()) *quotaWatchdog {
+	qw := &quotaWatchdog{stop: make(chan struct{})}
+	baseline, err := fsUsedBytes(buildDir)
+	if err != nil {
+		logrus.Warnf("cannot start quota watchdog: %v", err)
+		return qw
+	}
+	qw.wg.Add(1)
+	go func() {
+		defer qw.wg.Done()
+		for {
+			select {
+			case <-qw.stop:
+				return
+			case <-time.After(quotaPollInterval):
+			}
+			used, err := fsUsedBytes(buildDir)
+			if err != nil {
+				logrus.Warnf("cannot check quota: %v", err)
+				continue
+			}
+			if used-baseline > quota {
+				qw.mu.Lock()
+				qw.exceeded = true
+				qw.mu.Unlock()
+				abort()
+				return
+			}
+		}
+	}()
+	return qw
+}
+
+// Stop stops the watchdog and returns true if the quota was exceeded
+func (qw *quotaWatchdog) Stop() bool {
+	close(qw.stop)
+	qw.wg.Wait()
+
+	qw.mu.Lock()
+	defer qw.mu.Unlock()
+	return qw.exceeded
+}
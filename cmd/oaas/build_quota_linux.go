@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// mountQuotaImage mounts a sparse ext4 image of the quota size on
+// the build dir
+func mountQuotaImage(buildDir string, size int64) error {
+	image := quotaImagePath(buildDir)
+	f, err := os.OpenFile(image, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(size)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	// no blocks are reserved as osbuild runs as root
+	if out, err := exec.Command("mkfs.ext4", "-q", "-F", "-m", "0", image).CombinedOutput(); err != nil {
+		return fmt.Errorf("cannot create quota filesystem: %v, output:\n%s", err, out)
+	}
+	if out, err := exec.Command("mount", "-o", "loop", image, buildDir).CombinedOutput(); err != nil {
+		return fmt.Errorf("cannot mount quota filesystem: %v, output:\n%s", err, out)
+	}
+	if err := os.Remove(filepath.Join(buildDir, "lost+found")); err != nil {
+		unmountQuotaImage(buildDir)
+		return err
+	}
+	return os.Chmod(buildDir, 0700)
+}
+
+func unmountQuotaImage(buildDir string) error {
+	if err := unix.Unmount(buildDir, 0); err != nil && err != unix.EINVAL {
+		return fmt.Errorf("cannot unmount quota filesystem: %w", err)
+	}
+	return os.Remove(quotaImagePath(buildDir))
+}
+
+func fsUsedBytes(path string) (int64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Blocks-st.Bfree) * st.Bsize, nil
+}
+
+// fsFull is true if less than one percent of the filesystem is free
+func fsFull(path string) bool {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return false
+	}
+	return st.Bavail < st.Blocks/100
+}
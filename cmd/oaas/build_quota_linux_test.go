@@ -0,0 +1,84 @@
+package main_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+// runawayOsbuild writes 1MiB files until it is stopped
+const runawayOsbuild = `#!/bin/sh -e
+grep -q " %[1]s/build " /proc/mounts && echo "quota filesystem mounted"
+for i in $(seq 100); do
+    dd if=/dev/zero of=%[1]s/build/big.$i bs=1M count=1 status=none
+    sync
+    sleep 0.02
+done
+echo "build done"
+`
+
+func TestBuildQuotaWatchdogAbortsRunawayBuild(t *testing.T) {
+	restore := main.MockQuotaFSUnavailable()
+	defer restore()
+	restore = main.MockQuotaPollInterval(10 * time.Millisecond)
+	defer restore()
+
+	baseURL, baseBuildDir, _ := runTestServer(t, "-build-quota", "5242880")
+	restore = main.MockOsbuildBinary(t, fmt.Sprintf(runawayOsbuild, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "build aborted: disk quota exceeded: limit is 5242880 bytes\n", string(body))
+	assert.Equal(t, "user", rsp.Trailer.Get("Osbuild-Failure-Class"))
+	assert.FileExists(t, filepath.Join(baseBuildDir, "result.bad"))
+	assert.NoFileExists(t, filepath.Join(baseBuildDir, "build/big.100"))
+}
+
+func TestBuildQuotaFilesystem(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("mounting the quota filesystem needs root")
+	}
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+
+	baseURL, baseBuildDir, _ := runTestServer(t, "-build-quota", "20971520")
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(runawayOsbuild, baseBuildDir))
+	defer restore()
+	buildDir := filepath.Join(baseBuildDir, "build")
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(body), "quota filesystem mounted\n"), string(body))
+	assert.True(t, strings.HasSuffix(string(body), "build aborted: disk quota exceeded: limit is 20971520 bytes\n"), string(body))
+	assert.FileExists(t, buildDir+".quota.img")
+
+	err = main.RemoveBuildDir(buildDir)
+	assert.NoError(t, err)
+	assert.NoDirExists(t, buildDir)
+	assert.NoFileExists(t, buildDir+".quota.img")
+	mounts, err := ioutil.ReadFile("/proc/mounts")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(mounts), buildDir)
+}
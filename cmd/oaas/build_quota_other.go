@@ -0,0 +1,23 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+func mountQuotaImage(buildDir string, size int64) error {
+	return errors.New("quota filesystem not supported")
+}
+
+func unmountQuotaImage(buildDir string) error {
+	return errors.New("quota filesystem not supported")
+}
+
+func fsUsedBytes(path string) (int64, error) {
+	return 0, errors.New("filesystem usage not supported")
+}
+
+func fsFull(path string) bool {
+	return false
+}
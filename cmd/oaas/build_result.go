@@ -1,29 +1,113 @@
 package main
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 )
 
+// buildSummary contains the details of a finished build, it is stored
+// as result.json in the build dir
+type buildSummary struct {
+	Error        string `json:"error,omitempty"`
+	FailureClass string `json:"failure_class,omitempty"`
+	CachedStages int    `json:"cached_stages"`
+	BuiltStages  int    `json:"built_stages"`
+	// Warnings are the osbuild warnings that did not fail the
+	// build
+	Warnings []string `json:"warnings,omitempty"`
+	// SignatureDigest is the digest of the output.tar signature
+	SignatureDigest string `json:"signature_digest,omitempty"`
+	// CrashSignal is the signal that killed osbuild
+	CrashSignal string `json:"crash_signal,omitempty"`
+	// Fingerprint is the build environment
+	Fingerprint *buildFingerprint `json:"fingerprint,omitempty"`
+	// OutputDigest is the sha256 of the content addressed output.tar
+	OutputDigest string `json:"output_digest,omitempty"`
+}
+
+// buildInfo contains the details of a build that are known when it
+// starts, it is stored as build.json in the build dir
+type buildInfo struct {
+	Started time.Time `json:"started"`
+	Exports []string  `json:"exports"`
+	BuildID string    `json:"build_id,omitempty"`
+}
+
+func writeBuildInfo(buildDir string, info *buildInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(buildDir, "build.json"), data, 0600)
+}
+
+func readBuildInfo(buildDir string) (*buildInfo, error) {
+	data, err := ioutil.ReadFile(filepath.Join(buildDir, "build.json"))
+	if err != nil {
+		return nil, err
+	}
+	var info buildInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
 type buildResult struct {
 	resultGood string
 	resultBad  string
+	resultJSON string
 }
 
 func newBuildResult(config *Config) *buildResult {
 	return &buildResult{
-		resultGood: filepath.Join(config.BuildDirBase, "result.good"),
-		resultBad:  filepath.Join(config.BuildDirBase, "result.bad"),
+		resultGood: resultMarkerPath(config, "good"),
+		resultBad:  resultMarkerPath(config, "bad"),
+		resultJSON: filepath.Join(buildDirPath(config), "result.json"),
+	}
+}
+
+func (br *buildResult) writeSummary(summary *buildSummary) error {
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return err
 	}
+	return ioutil.WriteFile(br.resultJSON, data, 0600)
 }
 
-func (br *buildResult) Mark(err error) error {
+func (br *buildResult) Mark(err error, summary *buildSummary) error {
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	// the summary is written first so that it is available as soon
+	// as the result is marked
+	serr := br.writeSummary(summary)
+
+	var merr error
 	if err == nil {
-		return ioutil.WriteFile(br.resultGood, nil, 0600)
+		merr = ioutil.WriteFile(br.resultGood, nil, 0600)
 	} else {
-		return ioutil.WriteFile(br.resultBad, nil, 0600)
+		merr = ioutil.WriteFile(br.resultBad, nil, 0600)
+	}
+	if merr != nil {
+		return merr
+	}
+	return serr
+}
+
+func (br *buildResult) Summary() (*buildSummary, error) {
+	data, err := ioutil.ReadFile(br.resultJSON)
+	if err != nil {
+		return nil, err
+	}
+	var summary buildSummary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		return nil, err
 	}
+	return &summary, nil
 }
 
 // todo: switch to (Good, Bad, Unknown)
@@ -36,3 +120,15 @@ func (br *buildResult) Bad() bool {
 	_, err := os.Stat(br.resultBad)
 	return err == nil
 }
+
+// cleanupBuild removes the build dir and the result markers so that
+// a new build can be started
+func cleanupBuild(config *Config) error {
+	br := newBuildResult(config)
+	for _, p := range []string{br.resultGood, br.resultBad} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return removeBuildDir(buildDirPath(config))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// replaceTimeout limits how long a replacing build waits for the
+// canceled build to finish
+var replaceTimeout = 30 * time.Second
+
+var (
+	ErrBuildCanceled  = errors.New("build canceled: replaced by a new build")
+	ErrReplaceTimeout = errors.New("timeout waiting for the replaced build")
+)
+
+// activeBuild is the build that holds the build dir lock in this
+// process
+type activeBuild struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// buildTracker knows the active build so that it can be replaced
+type buildTracker struct {
+	// acquireMu serializes acquiring the build dir so that a
+	// replace cannot race with another build, the Mkdir of the
+	// build dir stays the lock across processes
+	acquireMu sync.Mutex
+
+	mu     sync.Mutex
+	active *activeBuild
+}
+
+func newBuildTracker() *buildTracker {
+	return &buildTracker{}
+}
+
+// Acquire creates the build dir, with replace a running build is
+// canceled and removed first, this is only tried once
+func (bt *buildTracker) Acquire(config *Config, size int64, replace bool) (string, *activeBuild, error) {
+	bt.acquireMu.Lock()
+	defer bt.acquireMu.Unlock()
+
+	buildDir, err := createBuildDir(config, size)
+	if err == ErrAlreadyBuilding && replace {
+		if err := bt.cancelActive(); err != nil {
+			return "", nil, err
+		}
+		if err := cleanupBuild(config); err != nil {
+			return "", nil, err
+		}
+		buildDir, err = createBuildDir(config, size)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	build := &activeBuild{ctx: ctx, cancel: cancel, done: make(chan struct{})}
+	bt.mu.Lock()
+	bt.active = build
+	bt.mu.Unlock()
+	return buildDir, build, nil
+}
+
+// Release must be called when the build is done, including the
+// removal of the build dir of a build that never started
+func (bt *buildTracker) Release(build *activeBuild) {
+	bt.mu.Lock()
+	if bt.active == build {
+		bt.active = nil
+	}
+	bt.mu.Unlock()
+	build.cancel()
+	close(build.done)
+}
+
+func (bt *buildTracker) cancelActive() error {
+	bt.mu.Lock()
+	build := bt.active
+	bt.mu.Unlock()
+	if build == nil {
+		// a finished build that is not cleaned up yet
+		return nil
+	}
+
+	build.cancel()
+	select {
+	case <-build.done:
+		return nil
+	case <-time.After(replaceTimeout):
+		return ErrReplaceTimeout
+	}
+}
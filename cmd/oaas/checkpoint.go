@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var checkpointNamespaceRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+func validateCheckpointNamespace(config *Config, control *controlJSON) error {
+	if control.CheckpointNamespace == "" {
+		return nil
+	}
+	if config.CheckpointDir == "" {
+		return fmt.Errorf("checkpoint namespaces are not enabled")
+	}
+	if !checkpointNamespaceRegexp.MatchString(control.CheckpointNamespace) {
+		return fmt.Errorf("invalid checkpoint namespace %q", control.CheckpointNamespace)
+	}
+	return nil
+}
+
+// verifyFilesSource checks that an uploaded files source matches
+// its name, the store is shared by all builds of a namespace so a
+// wrong source would break all later builds
+func verifyFilesSource(path string) error {
+	expected, ok := strings.CutPrefix(filepath.Base(path), "sha256:")
+	if !ok {
+		return fmt.Errorf("cannot verify source %v, only sha256 sources can be kept", filepath.Base(path))
+	}
+	actual, err := sha256File(path)
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return fmt.Errorf("%w: %v has sha256:%v", ErrChecksumMismatch, filepath.Base(path), actual)
+	}
+	return nil
+}
+
+// moveUploadedSources moves the sources from the build store into
+// the given store, sources that are already there are kept
+func moveUploadedSources(buildDir, storeDir string) error {
+	buildStore := filepath.Join(buildDir, "store")
+	uploaded := filepath.Join(buildStore, "sources")
+	return filepath.Walk(uploaded, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == uploaded {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(buildStore, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(storeDir, rel)
+		if _, err := os.Lstat(target); err == nil {
+			return nil
+		}
+		if filepath.Dir(rel) == filesSourceDir {
+			if err := verifyFilesSource(path); err != nil {
+				return err
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		return os.Rename(path, target)
+	})
+}
+
+// prepareCheckpointStore returns the store of the checkpoint
+// namespace, it is kept between builds so that the checkpointed
+// pipelines of earlier builds are reused
+func prepareCheckpointStore(config *Config, buildDir, namespace string) (string, error) {
+	storeDir := filepath.Join(config.CheckpointDir, namespace)
+	if err := os.MkdirAll(storeDir, 0755); err != nil {
+		return "", err
+	}
+	if err := moveUploadedSources(buildDir, storeDir); err != nil {
+		return "", fmt.Errorf("cannot move sources to checkpoint store: %v", err)
+	}
+	if config.BaseStore != "" {
+		baseStore, err := filepath.Abs(config.BaseStore)
+		if err != nil {
+			return "", err
+		}
+		if err := linkBaseStore(baseStore, storeDir); err != nil {
+			return "", fmt.Errorf("cannot link base store: %v", err)
+		}
+	}
+	return storeDir, nil
+}
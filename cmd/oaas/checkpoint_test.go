@@ -0,0 +1,146 @@
+package main_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+var (
+	earlyStageID = strings.Repeat("0", 64)
+	lateStageID  = strings.Repeat("1", 64)
+)
+
+// makeNamespacePost creates a test post with a source that matches
+// its digest, only those are kept in the namespace store
+func makeNamespacePost(t *testing.T, namespace string) *bytes.Buffer {
+	buf := bytes.NewBuffer(nil)
+	archive := tar.NewWriter(buf)
+	for _, entry := range []tarEntry{
+		{"control.json", fmt.Sprintf(`{"exports": ["image"], "checkpoint_namespace": %q}`, namespace)},
+		{"manifest.json", `{"fake": "manifest"}`},
+		{"store/sources/org.osbuild.files/" + sha256Name("random-data"), "random-data"},
+	} {
+		err := writeToTar(archive, entry.name, entry.content)
+		assert.NoError(t, err)
+	}
+	return buf
+}
+
+func buildInNamespace(t *testing.T, baseURL, baseBuildDir, namespace string) string {
+	buf := makeNamespacePost(t, namespace)
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+
+	// make room for the next build
+	err = os.RemoveAll(filepath.Join(baseBuildDir, "build"))
+	assert.NoError(t, err)
+	err = os.Remove(filepath.Join(baseBuildDir, "result.good"))
+	assert.NoError(t, err)
+	return string(body)
+}
+
+func TestBuildCheckpointNamespaceReusesStages(t *testing.T) {
+	checkpointDir := t.TempDir()
+	baseURL, baseBuildDir, _ := runTestServer(t, "-checkpoint-dir", checkpointDir)
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+while [ $# -gt 0 ]; do
+    case "$1" in
+        --store) store="$2"; shift;;
+        --checkpoint) echo "checkpoint $2"; shift;;
+    esac
+    shift
+done
+if [ -e "$store/stage-checkpoint" ]; then
+    echo "org.osbuild.rpm: %[2]s (cached)"
+else
+    echo "org.osbuild.rpm: %[2]s {"
+    touch "$store/stage-checkpoint"
+fi
+echo "org.osbuild.qemu: %[3]s {"
+# the uploaded sources are in the checkpoint store
+cat "$store/sources/org.osbuild.files/%[4]s"
+echo
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir, earlyStageID, lateStageID, sha256Name("random-data")))
+	defer restore()
+
+	built := fmt.Sprintf(`checkpoint *
+org.osbuild.rpm: %s {
+org.osbuild.qemu: %s {
+random-data
+`, earlyStageID, lateStageID)
+	cached := fmt.Sprintf(`checkpoint *
+org.osbuild.rpm: %s (cached)
+org.osbuild.qemu: %s {
+random-data
+`, earlyStageID, lateStageID)
+
+	assert.Equal(t, built, buildInNamespace(t, baseURL, baseBuildDir, "my-image"))
+	// the second build in the namespace reuses the early stage
+	assert.Equal(t, cached, buildInNamespace(t, baseURL, baseBuildDir, "my-image"))
+	// but other namespaces do not
+	assert.Equal(t, built, buildInNamespace(t, baseURL, baseBuildDir, "other-image"))
+	assert.DirExists(t, filepath.Join(checkpointDir, "my-image"))
+}
+
+func TestBuildCheckpointNamespaceRejectsWrongSource(t *testing.T) {
+	checkpointDir := t.TempDir()
+	baseURL, baseBuildDir, _ := runTestServer(t, "-checkpoint-dir", checkpointDir)
+
+	restore := main.MockOsbuildBinary(t, `#!/bin/sh -e
+echo "osbuild called"
+`)
+	defer restore()
+
+	// the sources of the default test post do not match their names
+	buf := makeTestPost(t, `{"exports": ["image"], "checkpoint_namespace": "my-image"}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "cannot move sources to checkpoint store: checksum mismatch: sha256:aabbcc5263b915d8a0776be5620575df2d478332ad35e8dd18def6a8c720f9c7 has sha256:"+strings.TrimPrefix(sha256Name("other-data"), "sha256:"), string(body))
+	assert.FileExists(t, filepath.Join(baseBuildDir, "result.bad"))
+	assert.NoFileExists(t, filepath.Join(checkpointDir, "my-image/sources/org.osbuild.files/sha256:ff800c5263b915d8a0776be5620575df2d478332ad35e8dd18def6a8c720f9c7"))
+}
+
+func TestBuildCheckpointNamespaceErrors(t *testing.T) {
+	for _, tc := range []struct {
+		args      []string
+		namespace string
+		expected  string
+	}{
+		{nil, "my-image", "checkpoint namespaces are not enabled\n"},
+		{[]string{"-checkpoint-dir", "/tmp"}, "../escape", "invalid checkpoint namespace \"../escape\"\n"},
+	} {
+		t.Run(tc.namespace, func(t *testing.T) {
+			baseURL, _, _ := runTestServer(t, tc.args...)
+
+			control := fmt.Sprintf(`{"exports": ["image"], "checkpoint_namespace": %q}`, tc.namespace)
+			buf := makeTestPost(t, control, `{"fake": "manifest"}`)
+			rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+			assert.NoError(t, err)
+			defer rsp.Body.Close()
+			assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+			body, err := ioutil.ReadAll(rsp.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, string(body))
+		})
+	}
+}
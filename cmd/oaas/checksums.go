@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	checksumModeOff   = "off"
+	checksumModeEager = "eager"
+	checksumModeLazy  = "lazy"
+
+	checksumExt = ".sha256"
+)
+
+var checksumModes = []string{checksumModeOff, checksumModeEager, checksumModeLazy}
+
+func checksumsEnabled(config *Config) bool {
+	return config.ChecksumMode == checksumModeEager || config.ChecksumMode == checksumModeLazy
+}
+
+// checksumCachePath returns where the checksum of the given output
+// file is cached, the cache lives next to the output so that it is
+// removed with the build
+func checksumCachePath(buildDir, outputDir, path string) (string, error) {
+	rel, err := filepath.Rel(outputDir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%v is not an output", path)
+	}
+	return filepath.Join(buildDir, "checksums", rel+checksumExt), nil
+}
+
+// outputChecksum returns the checksum line of the given output file in
+// the format of sha256sum, it is computed on the first call and
+// cached after that
+func outputChecksum(buildDir, outputDir, path string) ([]byte, error) {
+	cachePath, err := checksumCachePath(buildDir, outputDir, path)
+	if err != nil {
+		return nil, err
+	}
+	if line, err := ioutil.ReadFile(cachePath); err == nil {
+		return line, nil
+	}
+	digest, err := sha256File(path)
+	if err != nil {
+		return nil, err
+	}
+	line := []byte(fmt.Sprintf("%s  %s\n", digest, filepath.Base(path)))
+
+	// concurrent requests may both compute it, the rename ensures
+	// readers never see a partial cache entry
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(cachePath), ".checksum-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(line); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), cachePath); err != nil {
+		return nil, err
+	}
+	return line, nil
+}
+
+// computeOutputChecksums fills the checksum cache for all output
+// files at the end of the build
+func computeOutputChecksums(buildDir, outputDir string) error {
+	return filepath.Walk(outputDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		_, err = outputChecksum(buildDir, outputDir, path)
+		return err
+	})
+}
+
+// serveOutputChecksum serves "<file>.sha256" for an output file, it
+// returns false if the request is not for a checksum
+func serveOutputChecksum(w http.ResponseWriter, r *http.Request, buildDir, outputDir, resultPath string) (bool, error) {
+	target, ok := strings.CutSuffix(resultPath, checksumExt)
+	if !ok || fileExists(resultPath) {
+		return false, nil
+	}
+	if st, err := os.Stat(target); err != nil || !st.Mode().IsRegular() {
+		return false, nil
+	}
+	line, err := outputChecksum(buildDir, outputDir, target)
+	if err != nil {
+		return true, err
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(line)
+	return true, nil
+}
@@ -0,0 +1,94 @@
+package main_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+func buildWithDiskImage(t *testing.T, baseURL, baseBuildDir string) {
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+echo "fake-build-result" > %[1]s/build/output/image/disk.img
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+}
+
+func getChecksum(t *testing.T, url string) (int, string) {
+	rsp, err := http.Get(url)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	return rsp.StatusCode, string(body)
+}
+
+func TestResultChecksumLazy(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-checksum-mode", "lazy")
+	buildWithDiskImage(t, baseURL, baseBuildDir)
+
+	// nothing is computed at build time
+	cachePath := filepath.Join(baseBuildDir, "build/checksums/image/disk.img.sha256")
+	assert.NoFileExists(t, cachePath)
+
+	digest := sha256.Sum256([]byte("fake-build-result\n"))
+	expected := hex.EncodeToString(digest[:]) + "  disk.img\n"
+	status, body := getChecksum(t, baseURL+"api/v1/result/image/disk.img.sha256")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, expected, body)
+	assert.FileExists(t, cachePath)
+
+	// the cached checksum is served on the next request
+	err := ioutil.WriteFile(filepath.Join(baseBuildDir, "build/output/image/disk.img"), []byte("changed"), 0644)
+	assert.NoError(t, err)
+	status, body = getChecksum(t, baseURL+"api/v1/result/image/disk.img.sha256")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, expected, body)
+
+	status, _ = getChecksum(t, baseURL+"api/v1/result/image/missing.img.sha256")
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestResultChecksumEager(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-checksum-mode", "eager")
+	buildWithDiskImage(t, baseURL, baseBuildDir)
+
+	cached, err := ioutil.ReadFile(filepath.Join(baseBuildDir, "build/checksums/image/disk.img.sha256"))
+	assert.NoError(t, err)
+	status, body := getChecksum(t, baseURL+"api/v1/result/image/disk.img.sha256")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, string(cached), body)
+	assert.FileExists(t, filepath.Join(baseBuildDir, "build/checksums/output.tar.sha256"))
+}
+
+func TestResultChecksumOff(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	buildWithDiskImage(t, baseURL, baseBuildDir)
+
+	status, _ := getChecksum(t, baseURL+"api/v1/result/image/disk.img.sha256")
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.NoDirExists(t, filepath.Join(baseBuildDir, "build/checksums"))
+}
+
+func TestRunInvalidChecksumMode(t *testing.T) {
+	err := main.Run(context.Background(), []string{"-checksum-mode", "sometimes"}, os.Getenv)
+	assert.ErrorContains(t, err, `invalid checksum mode "sometimes", must be one of [off eager lazy]`)
+}
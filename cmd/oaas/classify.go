@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+)
+
+// the failure classes recorded in result.json
+const (
+	// the manifest or the sources are broken
+	failureUser = "user"
+	// the server cannot run the build
+	failureSystem = "system"
+	// the build did not finish in time
+	failureTimeout = "timeout"
+)
+
+var (
+	defaultUserErrorPatterns = []string{
+		`(?i)validation failed`,
+		`(?i)unsupported manifest version`,
+		`(?i)checksum mismatch`,
+	}
+	defaultSystemErrorPatterns = []string{
+		`ModuleNotFoundError`,
+		`No module named`,
+		`No space left on device`,
+		`Cannot allocate memory`,
+		`Read-only file system`,
+	}
+)
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// failureClassifier observes the osbuild output, system errors take
+// precedence because they usually cause follow-up errors that look
+// like user errors
+type failureClassifier struct {
+	user   []*regexp.Regexp
+	system []*regexp.Regexp
+
+	class string
+}
+
+func newFailureClassifier(config *Config) *failureClassifier {
+	return &failureClassifier{
+		user:   config.UserErrorPatterns,
+		system: config.SystemErrorPatterns,
+	}
+}
+
+func matchesAny(res []*regexp.Regexp, line string) bool {
+	for _, re := range res {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fc *failureClassifier) observe(line string) {
+	if fc.class == failureSystem {
+		return
+	}
+	if matchesAny(fc.system, line) {
+		fc.class = failureSystem
+		return
+	}
+	if fc.class == "" && matchesAny(fc.user, line) {
+		fc.class = failureUser
+	}
+}
+
+// failureStatus returns the http status for a failed build, only
+// failures that are known to be on the server side are reported as
+// a server error, everything else as a bad request
+func failureStatus(class string) int {
+	switch class {
+	case failureSystem, failureTimeout:
+		return http.StatusInternalServerError
+	default:
+		return http.StatusBadRequest
+	}
+}
@@ -0,0 +1,84 @@
+package main_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+func TestBuildFailureClassification(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		args   []string
+		output string
+		class  string
+		status int
+	}{
+		{"user", nil, "Manifest validation failed", "user", http.StatusBadRequest},
+		{"system", nil, "ModuleNotFoundError: No module named 'osbuild.stages'", "system", http.StatusInternalServerError},
+		{"system-wins", nil, "validation failed\nNo space left on device", "system", http.StatusInternalServerError},
+		{"unclassified", nil, "something odd", "", http.StatusBadRequest},
+		{"custom", []string{"-system-error-pattern", "flux capacitor, broken"}, "flux capacitor, broken", "system", http.StatusInternalServerError},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			baseURL, baseBuildDir, _ := runTestServer(t, tc.args...)
+
+			restore := main.MockOsbuildBinary(t, `#!/bin/sh
+echo "`+tc.output+`"
+exit 1
+`)
+			defer restore()
+
+			buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+			rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+			assert.NoError(t, err)
+			defer rsp.Body.Close()
+			assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+			_, err = ioutil.ReadAll(rsp.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.class, rsp.Trailer.Get("Osbuild-Failure-Class"))
+
+			var summary struct {
+				FailureClass string `json:"failure_class"`
+			}
+			data, err := ioutil.ReadFile(filepath.Join(baseBuildDir, "build/result.json"))
+			assert.NoError(t, err)
+			err = json.Unmarshal(data, &summary)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.class, summary.FailureClass)
+
+			rsp, err = http.Get(baseURL + "api/v1/result/image/disk.img")
+			assert.NoError(t, err)
+			defer rsp.Body.Close()
+			assert.Equal(t, tc.status, rsp.StatusCode)
+		})
+	}
+}
+
+func TestBuildFailureClassificationTimeout(t *testing.T) {
+	baseURL, _, _ := runTestServer(t, "-build-timeout", "100ms")
+
+	restore := main.MockOsbuildBinary(t, `#!/bin/sh
+sleep 10
+`)
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "timeout", rsp.Trailer.Get("Osbuild-Failure-Class"))
+
+	rsp, err = http.Get(baseURL + "api/v1/result/image/disk.img")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, rsp.StatusCode)
+}
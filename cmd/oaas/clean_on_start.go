@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// procDir is where the running processes are inspected
+const procDir = "/proc"
+
+// liveBuildProcess returns the pid of a process that has an
+// argument pointing into one of the given dirs, e.g. an osbuild that
+// survived the crash of the server
+func liveBuildProcess(dirs ...string) (int, error) {
+	entries, err := os.ReadDir(procDir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		// processes can go away any time
+		cmdline, err := os.ReadFile(filepath.Join(procDir, entry.Name(), "cmdline"))
+		if err != nil {
+			continue
+		}
+		for _, arg := range bytes.Split(cmdline, []byte{0}) {
+			for _, dir := range dirs {
+				if string(arg) == dir || strings.HasPrefix(string(arg), dir+"/") {
+					return pid, nil
+				}
+			}
+		}
+	}
+	return 0, nil
+}
+
+// cleanOnStart removes what a crashed server left behind, i.e. the
+// build dir, the result markers, the quota image and the unused
+// memory build dirs of this instance
+func cleanOnStart(logger *logrus.Logger, config *Config) error {
+	buildDir := buildDirPath(config)
+	dirs := []string{buildDir}
+	if target, err := os.Readlink(buildDir); err == nil {
+		dirs = append(dirs, target)
+	}
+	pid, err := liveBuildProcess(dirs...)
+	if err != nil {
+		return fmt.Errorf("cannot check for running builds: %v", err)
+	}
+	if pid != 0 {
+		return fmt.Errorf("cannot clean on start: process %v still uses %v", pid, buildDir)
+	}
+
+	if _, err := os.Lstat(buildDir); err == nil {
+		if err := removeBuildDir(buildDir); err != nil {
+			return fmt.Errorf("cannot remove stale build dir: %v", err)
+		}
+		logger.Infof("removed stale build dir %v", buildDir)
+	}
+	stale := []string{
+		resultMarkerPath(config, "good"),
+		resultMarkerPath(config, "bad"),
+		quotaImagePath(buildDir),
+	}
+	if config.MemoryBuildDir != "" {
+		memDirs, err := filepath.Glob(filepath.Join(config.MemoryBuildDir, memoryBuildDirPrefix(config)+"*"))
+		if err != nil {
+			return err
+		}
+		stale = append(stale, memDirs...)
+	}
+	for _, p := range stale {
+		if _, err := os.Lstat(p); err != nil {
+			continue
+		}
+		if err := os.RemoveAll(p); err != nil {
+			return fmt.Errorf("cannot remove stale %v: %v", p, err)
+		}
+		logger.Infof("removed stale %v", p)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+// clientLimiter counts the builds (including uploads) per client so
+// that a single client cannot take all build slots
+type clientLimiter struct {
+	mu sync.Mutex
+
+	max    int
+	builds map[string]int
+}
+
+func newClientLimiter(max int) *clientLimiter {
+	return &clientLimiter{
+		max:    max,
+		builds: make(map[string]int),
+	}
+}
+
+// Acquire returns false if the client already has the maximum
+// number of builds, a zero max means no limit
+func (cl *clientLimiter) Acquire(client string) bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.max > 0 && cl.builds[client] >= cl.max {
+		return false
+	}
+	cl.builds[client]++
+	return true
+}
+
+func (cl *clientLimiter) Release(client string) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	cl.builds[client]--
+	if cl.builds[client] <= 0 {
+		delete(cl.builds, client)
+	}
+}
+
+// clientID is the identity of the client certificate if there is
+// one and the remote host otherwise
+func clientID(r *http.Request) string {
+	if id := clientCertIdentity(r); id != "" {
+		return id
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
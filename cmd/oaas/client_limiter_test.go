@@ -0,0 +1,73 @@
+package main_test
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+func TestClientLimiter(t *testing.T) {
+	cl := main.NewClientLimiter(2)
+
+	assert.True(t, cl.Acquire("client-a"))
+	assert.True(t, cl.Acquire("client-a"))
+	// client a is over the limit
+	assert.False(t, cl.Acquire("client-a"))
+	// but client b can still proceed
+	assert.True(t, cl.Acquire("client-b"))
+
+	cl.Release("client-a")
+	assert.True(t, cl.Acquire("client-a"))
+}
+
+func TestClientLimiterUnlimited(t *testing.T) {
+	cl := main.NewClientLimiter(0)
+	for i := 0; i < 100; i++ {
+		assert.True(t, cl.Acquire("client-a"))
+	}
+}
+
+func TestBuildMaxBuildsPerClient(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-max-builds-per-client", "1")
+	endpoint := baseURL + "api/v1/build"
+
+	continueBuild := filepath.Join(baseBuildDir, "continue-build")
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+echo "started"
+for i in $(seq 100); do
+    test -e %[2]s && break
+    sleep 0.1
+done
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir, continueBuild))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["tree"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	reader := bufio.NewReader(rsp.Body)
+	line, err := reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "started\n", line)
+
+	// the client already has a build in progress
+	buf = makeTestPost(t, `{"exports": ["tree"]}`, `{"fake": "manifest"}`)
+	rsp2, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp2.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, rsp2.StatusCode)
+
+	err = ioutil.WriteFile(continueBuild, nil, 0644)
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+}
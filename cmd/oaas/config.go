@@ -2,6 +2,17 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/exp/slices"
 )
 
 type Config struct {
@@ -9,17 +20,583 @@ type Config struct {
 	Port string
 
 	BuildDirBase string
+
+	// OutputDirMode is the mode of the osbuild "output" dir, zero
+	// means the default mode is used
+	OutputDirMode os.FileMode
+
+	// UploadHosts are the hosts that build results may be uploaded to
+	UploadHosts []string
+	// UploadCredentialsDir contains the credentials that a
+	// control.json "result_upload" can reference by name
+	UploadCredentialsDir string
+	// UploadTimeout is the maximum duration of a result upload,
+	// zero means no limit
+	UploadTimeout time.Duration
+
+	// BuildTimeout is the maximum runtime of osbuild, zero means
+	// no limit
+	BuildTimeout time.Duration
+
+	// ReadTimeout is the maximum time the client can stop sending
+	// the build request body, zero means no limit
+	ReadTimeout time.Duration
+
+	// CleanupAfterResult removes the build once a result file was
+	// downloaded so that the next build can start
+	CleanupAfterResult bool
+	// ResultCleanupTTL is the time after a partial download of a
+	// result after which the build is cleaned up even if the
+	// client never resumed, zero means never
+	ResultCleanupTTL time.Duration
+
+	// OsbuildBinaries maps a version label that clients can select
+	// via control.json to an osbuild binary
+	OsbuildBinaries map[string]string
+
+	// AllowedExports restricts the exports clients can request,
+	// empty means all exports are allowed
+	AllowedExports []string
+
+	// DefaultExports are used when control.json does not request
+	// any exports
+	DefaultExports []string
+
+	// MaxExports limits the number of exports of a build, zero
+	// means no limit
+	MaxExports int
+
+	// PostBuildHook is an executable that is run after the build
+	// finished, it gets the build dir and the osbuild exit status
+	PostBuildHook string
+	// PostBuildHookTimeout is the maximum runtime of the post build
+	// hook, zero means no limit
+	PostBuildHookTimeout time.Duration
+
+	// EnableUI serves a small web UI to submit builds
+	EnableUI bool
+
+	// BaseStore is a read-only osbuild store with common sources
+	// that is layered below the store of each build
+	BaseStore string
+
+	// MaxBuildsPerClient limits the builds a single client can have
+	// in progress, zero means no limit
+	MaxBuildsPerClient int
+
+	// OutputRoots are the dirs below which clients can request
+	// osbuild to write the output directly
+	OutputRoots []string
+
+	// AllowedOrigins are the origins that browser clients can call
+	// the API from, "*" allows all origins, empty disables CORS
+	AllowedOrigins []string
+
+	// AllowedSourceHosts are the hosts the manifest sources can be
+	// fetched from, empty means all hosts are allowed
+	AllowedSourceHosts []string
+
+	// MissingSources is "warn" or "error" to check that sources
+	// were uploaded when the manifest uses sources, empty means no
+	// check
+	MissingSources string
+
+	// AllowedStages are the stage types the manifest can use, empty
+	// means all stages are allowed
+	AllowedStages []string
+
+	// Provenance writes a SLSA provenance of the build to the
+	// output dir
+	Provenance bool
+	// SigningKey is a PEM encoded PKCS8 private key that is used to
+	// sign the build provenance
+	SigningKey string
+	// ArtifactSigner creates detached signatures of the output.tar
+	// and the provenance with gpg or cosign
+	ArtifactSigner string
+	// ArtifactSigningKey is the gpg key id or the cosign key file
+	// of the ArtifactSigner
+	ArtifactSigningKey string
+
+	// MemoryBuildDir is a (tmpfs) dir that small builds are run in,
+	// builds are small if their request is at most
+	// MemoryBuildMaxSize bytes
+	MemoryBuildDir     string
+	MemoryBuildMaxSize int64
+
+	// Debug shows the osbuild command line in the build output
+	Debug bool
+
+	// CheckpointDir contains the osbuild stores of the checkpoint
+	// namespaces that clients can select via control.json
+	CheckpointDir string
+
+	// ExposeBuildDir reports the build dir to clients, this is
+	// useful for local clients but leaks the filesystem layout
+	ExposeBuildDir bool
+
+	// MaxPathDepth limits the number of path elements of the
+	// uploaded store entries, zero means no limit
+	MaxPathDepth int
+
+	// Nice is the niceness of the osbuild process, zero means
+	// normal priority
+	Nice int
+
+	// UserNamespace runs osbuild in a user namespace where the
+	// user of the server is mapped to root
+	UserNamespace bool
+
+	// CPUAffinity are the cpus that osbuild is pinned to, empty
+	// means all cpus
+	CPUAffinity []int
+
+	// IONiceClass is the ionice scheduling class of the osbuild
+	// process, empty means the default class
+	IONiceClass string
+
+	// UserErrorPatterns and SystemErrorPatterns classify the
+	// osbuild output of failed builds
+	UserErrorPatterns   []*regexp.Regexp
+	SystemErrorPatterns []*regexp.Regexp
+
+	// BuildDirPattern is the name of the build dir below
+	// BuildDirBase, see expandBuildDirPattern for the tokens
+	BuildDirPattern string
+	buildDirName    string
+
+	// ChecksumMode selects when the sha256 of the output files is
+	// computed, one of "eager", "lazy" or "off", empty means off
+	ChecksumMode string
+
+	// OutputCompression compresses the output.tar, empty means
+	// no compression
+	OutputCompression string
+
+	// MaxLogLinesPerSecond and MaxLogLines limit the osbuild
+	// output lines, zero means no limit
+	MaxLogLinesPerSecond int
+	MaxLogLines          int
+
+	// BuildQuotaBytes limits the disk space of a build, zero means
+	// no limit
+	BuildQuotaBytes int64
+
+	// MaxDecompressRatio limits the size of a decompressed source
+	// to this multiple of its compressed size, zero means no limit
+	MaxDecompressRatio int64
+
+	// MaxDecompressedBodySize limits the size of a gzip encoded
+	// request body after decompression, zero means no limit
+	MaxDecompressedBodySize int64
+
+	// PackageRetries is the number of retries of a failed
+	// output.tar packaging
+	PackageRetries int
+
+	// StreamResult allows downloading the output.tar while it is
+	// still packaged
+	StreamResult bool
+
+	// CleanOnStart removes the leftovers of a crashed server
+	// before serving
+	CleanOnStart bool
+
+	// Heartbeat is the interval of silence in the osbuild output
+	// after which an empty line is streamed to keep proxies from
+	// closing the connection, zero means no heartbeat
+	Heartbeat time.Duration
+
+	// PassthroughEnv names the environment variables of the
+	// server that are passed to osbuild (e.g. HTTP_PROXY)
+	PassthroughEnv []string
+
+	// TLSCertFile and TLSKeyFile enable https
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// ClientCAFile requires clients to authenticate with a
+	// certificate signed by one of the CAs in this PEM file
+	ClientCAFile string
+
+	// CollectCores keeps the core of a crashed osbuild in the
+	// build dir
+	CollectCores bool
+
+	// Fingerprint records the build environment in result.json
+	Fingerprint bool
+	fingerprint *hostFingerprint
+
+	// ManifestViaStdin feeds the manifest to osbuild on stdin
+	// instead of passing its path
+	ManifestViaStdin bool
+
+	// XAccelRedirect is the internal nginx location of the output
+	// dir, result files are then served by nginx via the
+	// X-Accel-Redirect header
+	XAccelRedirect string
+
+	// EnvValuePatterns restricts the values of the given
+	// environment keys, the patterns are anchored
+	EnvValuePatterns map[string]*regexp.Regexp
+
+	// AdminTokenFile contains the bearer token for the admin
+	// endpoints, they are disabled without it
+	AdminTokenFile string
+	adminToken     string
+	maintenance    *atomic.Bool
+
+	// PrescanUpload checks the structure of the whole upload
+	// before anything is extracted, the upload is buffered in a
+	// spill file below BuildDirBase for this
+	PrescanUpload bool
+
+	// MaxSourceSizeByType limits the size of all sources of a
+	// source type (e.g. org.osbuild.files) in an upload
+	MaxSourceSizeByType map[string]int64
+	// MaxDeltaOutputSize limits the size of all sources that are
+	// reconstructed from the source deltas of an upload
+	MaxDeltaOutputSize int64
+
+	// TrailingEntries are the names of metadata entries that
+	// clients may send next to the sources, "signature" must be
+	// the digest of the manifest.json
+	TrailingEntries []string
+
+	// ContentAddressedResults stores the output tars under their
+	// sha256 and redirects the result endpoint there
+	ContentAddressedResults bool
+	// ContentAddressedDir keeps the content addressed output
+	// tars, it must be outside of the build path as that is
+	// removed on shutdown
+	ContentAddressedDir string
+	// ContentAddressedMaxSize is the size in bytes above which
+	// the least recently built output tars are evicted
+	ContentAddressedMaxSize int64
+
+	// SupportedManifestVersions are the manifest versions the
+	// osbuild of this node can build, empty means all
+	SupportedManifestVersions []string
+
+	// OsbuildSHA256 is the expected sha256 of the osbuild binary,
+	// the server does not start if it does not match and refuses
+	// builds if it no longer matches on SIGHUP
+	OsbuildSHA256   string
+	osbuildVerified *atomic.Bool
+
+	// FailedResultStatus is the status of the result endpoint
+	// after a failed build, zero means it depends on the failure
+	// class
+	FailedResultStatus int
 }
 
-func newConfigFromCmdline(args []string) (*Config, error) {
+var ioniceClasses = []string{"idle", "best-effort", "realtime"}
+
+var failedResultStatuses = []int{http.StatusConflict, http.StatusUnprocessableEntity}
+
+func listFlag(fs *flag.FlagSet, name, usage string, l *[]string) {
+	fs.Func(name, usage, func(s string) error {
+		for _, v := range strings.Split(s, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				*l = append(*l, v)
+			}
+		}
+		return nil
+	})
+}
+
+// patternFlag appends a regexp for every use of the flag, the
+// patterns can contain commas so they are not split
+func patternFlag(fs *flag.FlagSet, name, usage string, l *[]*regexp.Regexp) {
+	fs.Func(name, usage, func(s string) error {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return err
+		}
+		*l = append(*l, re)
+		return nil
+	})
+}
+
+// envValuePatternFlag parses "KEY=REGEXP", the regexp has to match
+// the whole value
+func envValuePatternFlag(fs *flag.FlagSet, name, usage string, m *map[string]*regexp.Regexp) {
+	fs.Func(name, usage, func(s string) error {
+		key, pattern, ok := strings.Cut(s, "=")
+		if !ok || !envKeyRegexp.MatchString(key) {
+			return fmt.Errorf("expected KEY=REGEXP, got %q", s)
+		}
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return err
+		}
+		if *m == nil {
+			*m = make(map[string]*regexp.Regexp)
+		}
+		(*m)[key] = re
+		return nil
+	})
+}
+
+// sourceSizeFlag parses "TYPE=BYTES"
+func sourceSizeFlag(fs *flag.FlagSet, name, usage string, m *map[string]int64) {
+	fs.Func(name, usage, func(s string) error {
+		typ, value, ok := strings.Cut(s, "=")
+		if !ok {
+			return fmt.Errorf("expected TYPE=BYTES, got %q", s)
+		}
+		if _, ok := sourceValidators[typ]; !ok {
+			return fmt.Errorf("%w %q", ErrUnknownSourceType, typ)
+		}
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size < 0 {
+			return fmt.Errorf("invalid size %q for source type %v", value, typ)
+		}
+		if *m == nil {
+			*m = make(map[string]int64)
+		}
+		(*m)[typ] = size
+		return nil
+	})
+}
+
+func parseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse mode %q: %v", s, err)
+	}
+	if mode&^uint64(os.ModePerm) != 0 {
+		return 0, fmt.Errorf("invalid mode %q: only permission bits are supported", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+func mapFlag(fs *flag.FlagSet, name, usage string, m *map[string]string) {
+	fs.Func(name, usage, func(s string) error {
+		for _, v := range strings.Split(s, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(v), "=")
+			if !ok || key == "" {
+				return fmt.Errorf("expected key=value, got %q", v)
+			}
+			if *m == nil {
+				*m = make(map[string]string)
+			}
+			(*m)[key] = value
+		}
+		return nil
+	})
+}
+
+// newConfigFromCmdline returns the config and the remaining
+// positional arguments
+func newConfigFromCmdline(args []string) (*Config, []string, error) {
 	var config Config
 
 	fs := flag.NewFlagSet("oaas", flag.ContinueOnError)
 	fs.StringVar(&config.Host, "host", "localhost", "host to listen on")
 	fs.StringVar(&config.Port, "port", "8001", "port to listen on")
 	fs.StringVar(&config.BuildDirBase, "build-path", "/var/tmp/oaas", "base dir to run the builds in")
+	fs.Func("output-dir-mode", "octal mode of the output dir (e.g. 0750)", func(s string) (err error) {
+		config.OutputDirMode, err = parseFileMode(s)
+		return err
+	})
+	listFlag(fs, "upload-hosts", "comma separated list of hosts that results can be uploaded to", &config.UploadHosts)
+	fs.StringVar(&config.UploadCredentialsDir, "upload-credentials-dir", "", "dir with the credentials for result uploads")
+	fs.DurationVar(&config.UploadTimeout, "upload-timeout", time.Hour, "maximum duration of a result upload (0 means no limit)")
+	fs.DurationVar(&config.BuildTimeout, "build-timeout", 0, "maximum duration of an osbuild run (0 means no limit)")
+	fs.DurationVar(&config.ReadTimeout, "read-timeout", 0, "maximum idle time while reading the build request (0 means no limit)")
+	fs.BoolVar(&config.CleanupAfterResult, "cleanup-after-result", false, "remove the build after a result was downloaded")
+	fs.DurationVar(&config.ResultCleanupTTL, "result-cleanup-ttl", 10*time.Minute, "remove the build this long after a partial result download (0 means never)")
+	mapFlag(fs, "osbuild-binaries", "comma separated list of label=path osbuild binaries", &config.OsbuildBinaries)
+	listFlag(fs, "allowed-exports", "comma separated list of exports that clients can request", &config.AllowedExports)
+	fs.BoolVar(&config.ContentAddressedResults, "content-addressed-results", false, "store reproducible output tars under their sha256 and serve them from /api/v1/result/by-digest/")
+	fs.StringVar(&config.ContentAddressedDir, "content-addressed-dir", "", "dir to keep the content addressed output tars in (required by -content-addressed-results)")
+	fs.Int64Var(&config.ContentAddressedMaxSize, "content-addressed-max-size", 10*1024*1024*1024, "maximum size in bytes of the content addressed output tars, the least recently built are removed")
+	fs.BoolVar(&config.PrescanUpload, "prescan-upload", false, "check the structure of the whole upload before extracting it (buffers the upload on disk)")
+	sourceSizeFlag(fs, "max-source-size", "TYPE=BYTES maximum size of all sources of the given source type in an upload (can be repeated)", &config.MaxSourceSizeByType)
+	fs.Int64Var(&config.MaxDeltaOutputSize, "max-delta-output-size", 4*1024*1024*1024, "maximum size in bytes of all sources reconstructed from the source deltas of an upload")
+	listFlag(fs, "trailing-entries", "comma separated list of metadata entries allowed after the sources (e.g. signature,README)", &config.TrailingEntries)
+	listFlag(fs, "supported-manifest-versions", "comma separated list of the manifest versions that can be built (e.g. 2)", &config.SupportedManifestVersions)
+	listFlag(fs, "default-exports", "comma separated list of exports used when control.json has none", &config.DefaultExports)
+	fs.IntVar(&config.MaxExports, "max-exports", 0, "maximum number of exports of a build (0 means no limit)")
+	fs.StringVar(&config.PostBuildHook, "post-build-hook", "", "executable to run after a build")
+	fs.DurationVar(&config.PostBuildHookTimeout, "post-build-hook-timeout", 10*time.Minute, "maximum duration of the post build hook (0 means no limit)")
+	fs.BoolVar(&config.EnableUI, "enable-ui", false, "serve a web UI to submit builds")
+	fs.StringVar(&config.BaseStore, "base-store", "", "read-only osbuild store layered below the build store")
+	fs.IntVar(&config.MaxBuildsPerClient, "max-builds-per-client", 0, "maximum number of builds per client (0 means no limit)")
+	listFlag(fs, "output-roots", "comma separated list of dirs that can be used for direct output", &config.OutputRoots)
+	listFlag(fs, "allowed-origins", "comma separated list of origins allowed to use the API from a browser", &config.AllowedOrigins)
+	listFlag(fs, "allowed-source-hosts", "comma separated list of hosts that manifest sources can be fetched from", &config.AllowedSourceHosts)
+	listFlag(fs, "allowed-stages", "comma separated list of stage types that manifests can use", &config.AllowedStages)
+	fs.BoolVar(&config.Provenance, "provenance", false, "write a SLSA provenance.json of the build to the output dir")
+	fs.StringVar(&config.SigningKey, "signing-key", "", "PEM private key to sign the build provenance with")
+	fs.Func("artifact-signer", fmt.Sprintf("sign the results with the -artifact-signing-key of this signer (one of %v)", artifactSigners), func(s string) error {
+		if !slices.Contains(artifactSigners, s) {
+			return fmt.Errorf("invalid artifact signer %q, must be one of %v", s, artifactSigners)
+		}
+		config.ArtifactSigner = s
+		return nil
+	})
+	fs.StringVar(&config.ArtifactSigningKey, "artifact-signing-key", "", "gpg key id or cosign key file of the -artifact-signer")
+	fs.StringVar(&config.MemoryBuildDir, "memory-build-dir", "", "tmpfs dir to run small builds in")
+	fs.Int64Var(&config.MemoryBuildMaxSize, "memory-build-max-size", 64*1024*1024, "maximum request size in bytes of builds that run in the memory build dir")
+	fs.BoolVar(&config.Debug, "debug", false, "show the osbuild command line in the build output")
+	fs.StringVar(&config.CheckpointDir, "checkpoint-dir", "", "dir for the stores of the checkpoint namespaces")
+	fs.BoolVar(&config.ExposeBuildDir, "expose-build-dir", false, "report the build dir in the X-Build-Dir response header")
+	fs.IntVar(&config.MaxPathDepth, "max-path-depth", 0, "maximum number of path elements of uploaded store entries (0 means no limit)")
+	fs.IntVar(&config.Nice, "nice", 0, "niceness of the osbuild process (0 means normal priority)")
+	fs.BoolVar(&config.UserNamespace, "user-namespace", false, "run osbuild in a user namespace that maps the server user to root")
+	fs.Func("cpu-affinity", "cpuset that osbuild is pinned to (e.g. 0-3,8)", func(s string) error {
+		cpus, err := parseCPUSet(s)
+		if err != nil {
+			return err
+		}
+		config.CPUAffinity = cpus
+		return nil
+	})
+	fs.Func("ionice-class", fmt.Sprintf("ionice scheduling class of the osbuild process (one of %v)", ioniceClasses), func(s string) error {
+		if !slices.Contains(ioniceClasses, s) {
+			return fmt.Errorf("invalid ionice class %q, must be one of %v", s, ioniceClasses)
+		}
+		config.IONiceClass = s
+		return nil
+	})
+	patternFlag(fs, "user-error-pattern", "regexp of osbuild output caused by the client, replaces the defaults (can be repeated)", &config.UserErrorPatterns)
+	patternFlag(fs, "system-error-pattern", "regexp of osbuild output caused by the server, replaces the defaults (can be repeated)", &config.SystemErrorPatterns)
+	fs.StringVar(&config.BuildDirPattern, "build-dir-pattern", defaultBuildDirPattern, "name of the build dir below the build path, supports {hostname}, {pid} and {timestamp}")
+	fs.Func("output-compression", "compression of the output tar (gzip)", func(s string) error {
+		if _, ok := outputCompressions[s]; !ok {
+			return fmt.Errorf("unsupported output compression %q", s)
+		}
+		config.OutputCompression = s
+		return nil
+	})
+	fs.Func("checksum-mode", fmt.Sprintf("when the sha256 of the output files is computed for <file>.sha256 (one of %v)", checksumModes), func(s string) error {
+		if !slices.Contains(checksumModes, s) {
+			return fmt.Errorf("invalid checksum mode %q, must be one of %v", s, checksumModes)
+		}
+		config.ChecksumMode = s
+		return nil
+	})
+	fs.Func("missing-sources", fmt.Sprintf("check that sources were uploaded when the manifest uses sources (one of %v)", missingSourcesModes), func(s string) error {
+		if !slices.Contains(missingSourcesModes, s) {
+			return fmt.Errorf("invalid missing sources mode %q, must be one of %v", s, missingSourcesModes)
+		}
+		config.MissingSources = s
+		return nil
+	})
+	fs.IntVar(&config.MaxLogLinesPerSecond, "max-log-lines-per-second", 0, "maximum number of osbuild output lines per second (0 means no limit)")
+	fs.IntVar(&config.MaxLogLines, "max-log-lines", 0, "maximum number of osbuild output lines (0 means no limit)")
+	fs.Int64Var(&config.BuildQuotaBytes, "build-quota", 0, "maximum disk space in bytes of a build (0 means no limit)")
+	fs.Int64Var(&config.MaxDecompressRatio, "max-decompress-ratio", 0, "maximum ratio of decompressed to compressed source size (0 means no limit)")
+	fs.Int64Var(&config.MaxDecompressedBodySize, "max-decompressed-body-size", 0, "maximum size in bytes of a gzip encoded request body after decompression (0 means no limit)")
+	fs.IntVar(&config.PackageRetries, "package-retries", 0, "number of retries of a failed output packaging")
+	fs.BoolVar(&config.StreamResult, "stream-result", false, "allow downloading the output.tar while it is packaged")
+	fs.BoolVar(&config.CleanOnStart, "clean-on-start", false, "remove stale builds before serving, fails if a build is still running")
+	fs.DurationVar(&config.Heartbeat, "heartbeat", 0, "stream an empty line when osbuild was silent this long (0 means never)")
+	listFlag(fs, "passthrough-env", "comma separated list of server environment variables passed to osbuild", &config.PassthroughEnv)
+	fs.StringVar(&config.TLSCertFile, "tls-cert", "", "PEM certificate to serve https with")
+	fs.StringVar(&config.TLSKeyFile, "tls-key", "", "PEM private key of the https certificate")
+	fs.StringVar(&config.ClientCAFile, "client-ca", "", "PEM CA that client certificates must be signed by (requires -tls-cert)")
+	fs.Func("failed-result-status", fmt.Sprintf("status of the result endpoint after a failed build (one of %v, default depends on the failure class)", failedResultStatuses), func(s string) error {
+		status, err := strconv.Atoi(s)
+		if err != nil || !slices.Contains(failedResultStatuses, status) {
+			return fmt.Errorf("invalid failed result status %q, must be one of %v", s, failedResultStatuses)
+		}
+		config.FailedResultStatus = status
+		return nil
+	})
+	fs.StringVar(&config.AdminTokenFile, "admin-token-file", "", "file with the bearer token for the admin endpoints (e.g. maintenance mode)")
+	fs.StringVar(&config.OsbuildSHA256, "osbuild-sha256", "", "expected sha256 of the osbuild binary, checked at startup and on SIGHUP")
+	fs.BoolVar(&config.Fingerprint, "fingerprint", false, "record the osbuild, kernel and package versions and the hostname in result.json")
+	envValuePatternFlag(fs, "env-value-pattern", "KEY=REGEXP that the value of an osbuild environment key must fully match (can be repeated)", &config.EnvValuePatterns)
+	fs.StringVar(&config.XAccelRedirect, "x-accel-redirect", "", "internal nginx location of the output dir, result files are then served by nginx (e.g. /oaas-output/)")
+	fs.BoolVar(&config.ManifestViaStdin, "manifest-via-stdin", false, "pass the manifest to osbuild on stdin")
+	fs.BoolVar(&config.CollectCores, "collect-cores", false, "keep the core of a crashed osbuild in the build dir (requires an absolute -build-path)")
 	if err := fs.Parse(args); err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if config.UserNamespace {
+		if err := checkUserNamespace(); err != nil {
+			return nil, nil, fmt.Errorf("cannot use -user-namespace: %w", err)
+		}
+	}
+	if len(config.CPUAffinity) > 0 {
+		if err := validateCPUAffinity(config.CPUAffinity); err != nil {
+			return nil, nil, fmt.Errorf("invalid -cpu-affinity: %w", err)
+		}
+	}
+	if config.OsbuildSHA256 != "" && !sha256Regexp.MatchString(config.OsbuildSHA256) {
+		return nil, nil, fmt.Errorf("invalid -osbuild-sha256 %q, expected 64 lowercase hex digits", config.OsbuildSHA256)
+	}
+	// a single digest cannot match different binaries
+	if config.OsbuildSHA256 != "" && len(config.OsbuildBinaries) > 0 {
+		return nil, nil, fmt.Errorf("cannot use -osbuild-sha256 with -osbuild-binaries")
+	}
+	for _, name := range config.TrailingEntries {
+		if !validTrailingEntryName(name) {
+			return nil, nil, fmt.Errorf("invalid trailing entry name %q", name)
+		}
+	}
+	if config.ContentAddressedResults {
+		if config.OutputCompression != "" {
+			return nil, nil, fmt.Errorf("-content-addressed-results cannot be used with -output-compression")
+		}
+		if err := validateContentAddressedDir(&config); err != nil {
+			return nil, nil, err
+		}
+	}
+	if config.CollectCores && !filepath.IsAbs(config.BuildDirBase) {
+		// osbuild runs in the build dir to get the core there
+		return nil, nil, fmt.Errorf("-collect-cores requires an absolute -build-path")
+	}
+	if config.XAccelRedirect != "" {
+		if !strings.HasPrefix(config.XAccelRedirect, "/") {
+			return nil, nil, fmt.Errorf("-x-accel-redirect must be an absolute location")
+		}
+		// the server never learns when nginx finished sending
+		if config.CleanupAfterResult {
+			return nil, nil, fmt.Errorf("-x-accel-redirect cannot be used with -cleanup-after-result")
+		}
+	}
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return nil, nil, fmt.Errorf("-tls-cert and -tls-key must be used together")
+	}
+	if config.ArtifactSigner != "" && config.ArtifactSigningKey == "" {
+		return nil, nil, fmt.Errorf("-artifact-signer requires -artifact-signing-key")
+	}
+	if config.SigningKey != "" && !config.Provenance {
+		return nil, nil, fmt.Errorf("-signing-key requires -provenance")
+	}
+	if config.ClientCAFile != "" && config.TLSCertFile == "" {
+		return nil, nil, fmt.Errorf("-client-ca requires -tls-cert and -tls-key")
+	}
+	for _, name := range config.PassthroughEnv {
+		if !envKeyRegexp.MatchString(name) {
+			return nil, nil, fmt.Errorf("invalid passthrough environment variable %q", name)
+		}
+	}
+	var err error
+	if config.AdminTokenFile != "" {
+		if config.adminToken, err = readAdminToken(config.AdminTokenFile); err != nil {
+			return nil, nil, fmt.Errorf("cannot read admin token: %w", err)
+		}
+	}
+	config.maintenance = &atomic.Bool{}
+	config.osbuildVerified = &atomic.Bool{}
+	config.osbuildVerified.Store(true)
+	if config.buildDirName, err = expandBuildDirPattern(config.BuildDirPattern, time.Now()); err != nil {
+		return nil, nil, err
+	}
+	if config.UserErrorPatterns == nil {
+		if config.UserErrorPatterns, err = compilePatterns(defaultUserErrorPatterns); err != nil {
+			return nil, nil, err
+		}
+	}
+	if config.SystemErrorPatterns == nil {
+		if config.SystemErrorPatterns, err = compilePatterns(defaultSystemErrorPatterns); err != nil {
+			return nil, nil, err
+		}
 	}
-	return &config, nil
+	return &config, fs.Args(), nil
 }
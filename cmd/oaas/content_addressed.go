@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// byDigestURLPath is where the content addressed results are served
+const byDigestURLPath = "/api/v1/result/by-digest/"
+
+// byDigestDir keeps the output tars under their sha256, it is
+// outside of the build path so it survives a restart
+func byDigestDir(config *Config) string {
+	return config.ContentAddressedDir
+}
+
+func validateContentAddressedDir(config *Config) error {
+	if config.ContentAddressedDir == "" {
+		return fmt.Errorf("-content-addressed-results requires -content-addressed-dir")
+	}
+	if config.ContentAddressedMaxSize <= 0 {
+		return fmt.Errorf("-content-addressed-max-size must be positive")
+	}
+	base, err := filepath.Abs(config.BuildDirBase)
+	if err != nil {
+		return err
+	}
+	dir, err := filepath.Abs(config.ContentAddressedDir)
+	if err != nil {
+		return err
+	}
+	// the build path is removed on shutdown
+	if rel, err := filepath.Rel(base, dir); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("-content-addressed-dir cannot be inside -build-path")
+	}
+	return nil
+}
+
+// storeByDigest links the output tar into the by-digest dir, an
+// identical output of an earlier build is kept as is
+func storeByDigest(config *Config, tarPath string) (string, error) {
+	digest, err := sha256File(tarPath)
+	if err != nil {
+		return "", err
+	}
+	dir := byDigestDir(config)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	dst := filepath.Join(dir, digest)
+	err = os.Link(tarPath, dst)
+	switch {
+	case err == nil:
+	case errors.Is(err, os.ErrExist):
+		// it was just built again, keep it longest
+		now := time.Now()
+		if err := os.Chtimes(dst, now, now); err != nil {
+			return "", err
+		}
+	default:
+		// e.g. the build dir is on a different filesystem
+		if err := copyToByDigest(tarPath, dst); err != nil {
+			return "", err
+		}
+	}
+	if err := evictByDigest(config, digest); err != nil {
+		logrus.Warningf("cannot evict content addressed results: %v", err)
+	}
+	return digest, nil
+}
+
+// evictByDigest removes the least recently built output tars until
+// the dir fits into ContentAddressedMaxSize, keep is never removed
+func evictByDigest(config *Config, keep string) error {
+	entries, err := os.ReadDir(byDigestDir(config))
+	if err != nil {
+		return err
+	}
+	var total int64
+	var tars []os.FileInfo
+	for _, entry := range entries {
+		if !sha256Regexp.MatchString(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		total += info.Size()
+		if entry.Name() != keep {
+			tars = append(tars, info)
+		}
+	}
+	sort.Slice(tars, func(i, j int) bool {
+		return tars[i].ModTime().Before(tars[j].ModTime())
+	})
+	for _, info := range tars {
+		if total <= config.ContentAddressedMaxSize {
+			break
+		}
+		if err := os.Remove(filepath.Join(byDigestDir(config), info.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= info.Size()
+	}
+	return nil
+}
+
+func copyToByDigest(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(filepath.Dir(dst), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(out.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), dst)
+}
+
+// handleResultByDigest serves the content addressed output tars, their
+// content never changes but they can be evicted so they are not
+// marked immutable
+func handleResultByDigest(logger *logrus.Logger, config *Config) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			logger.Debugf("handleResultByDigest called on %s", r.URL.Path)
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				http.Error(w, "result endpoint only supports Get", http.StatusMethodNotAllowed)
+				return
+			}
+			digest := r.URL.Path
+			if !config.ContentAddressedResults || !sha256Regexp.MatchString(digest) {
+				http.NotFound(w, r)
+				return
+			}
+			f, err := os.Open(filepath.Join(byDigestDir(config), digest))
+			if os.IsNotExist(err) {
+				http.NotFound(w, r)
+				return
+			}
+			if err != nil {
+				logger.Errorf("cannot open result %v: %v", digest, err)
+				http.Error(w, "cannot open result", http.StatusInternalServerError)
+				return
+			}
+			defer f.Close()
+			st, err := f.Stat()
+			if err != nil {
+				logger.Errorf("cannot stat result %v: %v", digest, err)
+				http.Error(w, "cannot stat result", http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/x-tar")
+			w.Header().Set("Cache-Control", "public, max-age=86400")
+			w.Header().Set("ETag", `"sha256:`+digest+`"`)
+			http.ServeContent(w, r, "output.tar", st.ModTime(), f)
+		},
+	)
+}
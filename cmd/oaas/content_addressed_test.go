@@ -0,0 +1,131 @@
+package main_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+func buildAndGetDigestURL(t *testing.T, baseURL string) string {
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	_, err = io.Copy(io.Discard, rsp.Body)
+	assert.NoError(t, err)
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	rsp, err = client.Get(baseURL + "api/v1/result/output.tar")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusFound, rsp.StatusCode)
+	return rsp.Header.Get("Location")
+}
+
+func TestResultContentAddressedIdenticalBuilds(t *testing.T) {
+	byDigestDir := t.TempDir()
+	baseURL, baseBuildDir, _ := runTestServer(t, "-content-addressed-results", "-content-addressed-dir", byDigestDir)
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+echo "fake-build-result" > %[1]s/build/output/image/disk.img
+`, baseBuildDir))
+	defer restore()
+
+	digestURL := buildAndGetDigestURL(t, baseURL)
+	assert.True(t, strings.HasPrefix(digestURL, "/api/v1/result/by-digest/"), digestURL)
+
+	// a second build with the same output gets the same digest
+	for _, p := range []string{"build", "result.good"} {
+		err := os.RemoveAll(filepath.Join(baseBuildDir, p))
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, digestURL, buildAndGetDigestURL(t, baseURL))
+	entries, err := os.ReadDir(byDigestDir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	rsp, err := http.Get(strings.TrimSuffix(baseURL, "/") + digestURL)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Equal(t, "public, max-age=86400", rsp.Header.Get("Cache-Control"))
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	localTar, err := ioutil.ReadFile(filepath.Join(baseBuildDir, "build/output/output.tar"))
+	assert.NoError(t, err)
+	assert.Equal(t, localTar, body)
+}
+
+func TestResultContentAddressedEviction(t *testing.T) {
+	byDigestDir := t.TempDir()
+	// an output tar is 10KiB, only one fits
+	baseURL, baseBuildDir, _ := runTestServer(t, "-content-addressed-results", "-content-addressed-dir", byDigestDir, "-content-addressed-max-size", "15000")
+
+	var digestURLs []string
+	for _, content := range []string{"first", "second"} {
+		restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+echo %[2]s > %[1]s/build/output/image/disk.img
+`, baseBuildDir, content))
+		defer restore()
+		for _, p := range []string{"build", "result.good"} {
+			err := os.RemoveAll(filepath.Join(baseBuildDir, p))
+			assert.NoError(t, err)
+		}
+		digestURLs = append(digestURLs, buildAndGetDigestURL(t, baseURL))
+	}
+	assert.NotEqual(t, digestURLs[0], digestURLs[1])
+
+	entries, err := os.ReadDir(byDigestDir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	for i, expectedStatus := range []int{http.StatusNotFound, http.StatusOK} {
+		rsp, err := http.Get(strings.TrimSuffix(baseURL, "/") + digestURLs[i])
+		assert.NoError(t, err)
+		defer rsp.Body.Close()
+		assert.Equal(t, expectedStatus, rsp.StatusCode)
+	}
+}
+
+func TestRunContentAddressedDir(t *testing.T) {
+	buildBaseDir := t.TempDir()
+	for _, tc := range []struct {
+		args        []string
+		expectedErr string
+	}{
+		{nil, "-content-addressed-results requires -content-addressed-dir"},
+		{[]string{"-content-addressed-dir", filepath.Join(buildBaseDir, "by-digest")}, "-content-addressed-dir cannot be inside -build-path"},
+		{[]string{"-content-addressed-dir", t.TempDir(), "-content-addressed-max-size", "0"}, "-content-addressed-max-size must be positive"},
+	} {
+		args := append([]string{"-build-path", buildBaseDir, "-content-addressed-results"}, tc.args...)
+		err := main.Run(context.Background(), args, os.Getenv)
+		assert.EqualError(t, err, tc.expectedErr)
+	}
+}
+
+func TestResultByDigestNotFound(t *testing.T) {
+	baseURL, _, _ := runTestServer(t, "-content-addressed-results", "-content-addressed-dir", t.TempDir())
+
+	for _, digest := range []string{strings.Repeat("0", 64), "output.tar"} {
+		rsp, err := http.Get(baseURL + "api/v1/result/by-digest/" + digest)
+		assert.NoError(t, err)
+		defer rsp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, rsp.StatusCode, digest)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	corsAllowedMethods = "GET, POST, OPTIONS"
+	// the admin endpoints need the bearer token
+	corsAllowedHeaders = "Authorization, Content-Type"
+	// the result headers and trailers that browser clients can read
+	corsExposedHeaders = "Osbuild-Cached-Stages, Osbuild-Built-Stages, Osbuild-Failure-Class, X-Content-SHA256"
+)
+
+// corsOrigin returns the value for Access-Control-Allow-Origin or ""
+// if the origin is not allowed
+func corsOrigin(config *Config, origin string) string {
+	if slices.Contains(config.AllowedOrigins, origin) {
+		return origin
+	}
+	if slices.Contains(config.AllowedOrigins, "*") {
+		return "*"
+	}
+	return ""
+}
+
+// handleCORS adds the CORS headers for allowed origins and answers
+// preflight requests, without allowed origins it does nothing
+func handleCORS(config *Config, next http.Handler) http.Handler {
+	if len(config.AllowedOrigins) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		allowOrigin := corsOrigin(config, origin)
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if allowOrigin == "" {
+			if preflight {
+				http.Error(w, "origin not allowed", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+		// credentials can only be used with an explicit origin
+		if allowOrigin != "*" {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
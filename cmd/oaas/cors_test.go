@@ -0,0 +1,90 @@
+package main_test
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+func doPreflight(t *testing.T, endpoint, origin string) *http.Response {
+	req, err := http.NewRequest(http.MethodOptions, endpoint, nil)
+	assert.NoError(t, err)
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	req.Header.Set("Access-Control-Request-Headers", "Content-Type")
+	rsp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	rsp.Body.Close()
+	return rsp
+}
+
+func TestCORSExplicitOrigin(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-allowed-origins", "https://ui.example.com")
+	endpoint := baseURL + "api/v1/build"
+
+	rsp := doPreflight(t, endpoint, "https://ui.example.com")
+	assert.Equal(t, http.StatusNoContent, rsp.StatusCode)
+	assert.Equal(t, "https://ui.example.com", rsp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "GET, POST, OPTIONS", rsp.Header.Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "Authorization, Content-Type", rsp.Header.Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "true", rsp.Header.Get("Access-Control-Allow-Credentials"))
+
+	rsp = doPreflight(t, endpoint, "https://evil.example.com")
+	assert.Equal(t, http.StatusForbidden, rsp.StatusCode)
+	assert.Equal(t, "", rsp.Header.Get("Access-Control-Allow-Origin"))
+
+	// the actual request
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+	req, err := http.NewRequest(http.MethodPost, endpoint, makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-tar")
+	req.Header.Set("Origin", "https://ui.example.com")
+	rsp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	assert.Equal(t, "https://ui.example.com", rsp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", rsp.Header.Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "Osbuild-Cached-Stages, Osbuild-Built-Stages, Osbuild-Failure-Class, X-Content-SHA256", rsp.Header.Get("Access-Control-Expose-Headers"))
+}
+
+func TestCORSWildcardOrigin(t *testing.T) {
+	baseURL, _, _ := runTestServer(t, "-allowed-origins", "*")
+
+	rsp := doPreflight(t, baseURL+"api/v1/result/disk.img", "https://any.example.com")
+	assert.Equal(t, http.StatusNoContent, rsp.StatusCode)
+	assert.Equal(t, "*", rsp.Header.Get("Access-Control-Allow-Origin"))
+	// no credentials for the wildcard
+	assert.Equal(t, "", rsp.Header.Get("Access-Control-Allow-Credentials"))
+}
+
+func TestCORSDisabledByDefault(t *testing.T) {
+	baseURL, _, _ := runTestServer(t)
+
+	rsp := doPreflight(t, baseURL+"api/v1/build", "https://ui.example.com")
+	assert.Equal(t, http.StatusMethodNotAllowed, rsp.StatusCode)
+	assert.Equal(t, "", rsp.Header.Get("Access-Control-Allow-Origin"))
+}
+
+func TestCORSAdminMaintenance(t *testing.T) {
+	baseURL, _, _ := runTestServer(t, "-allowed-origins", "https://ui.example.com")
+
+	req, err := http.NewRequest(http.MethodOptions, baseURL+"api/v1/admin/maintenance", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Origin", "https://ui.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	req.Header.Set("Access-Control-Request-Headers", "Authorization")
+	rsp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, rsp.StatusCode)
+	assert.Equal(t, "https://ui.example.com", rsp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, rsp.Header.Get("Access-Control-Allow-Headers"), "Authorization")
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// validateCPUAffinity checks that the server itself may run on all
+// the given cpus, osbuild could not run on the others anyway
+func validateCPUAffinity(cpus []int) error {
+	var available unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &available); err != nil {
+		return err
+	}
+	for _, cpu := range cpus {
+		if cpu >= len(available)*64 || !available.IsSet(cpu) {
+			return fmt.Errorf("cpu %v is not available", cpu)
+		}
+	}
+	return nil
+}
+
+// setBuildAffinity pins the osbuild process to the given cpus, the
+// processes it starts later inherit it
+func setBuildAffinity(pid int, cpus []int) error {
+	var set unix.CPUSet
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+	return unix.SchedSetaffinity(pid, &set)
+}
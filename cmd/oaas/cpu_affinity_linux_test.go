@@ -0,0 +1,69 @@
+package main_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+func TestBuildCPUAffinity(t *testing.T) {
+	// pin to the last cpu we can run on so that the mask differs
+	// from the inherited one on machines with more than one cpu
+	var available unix.CPUSet
+	err := unix.SchedGetaffinity(0, &available)
+	assert.NoError(t, err)
+	cpu := -1
+	for i := 0; i < len(available)*64; i++ {
+		if available.IsSet(i) {
+			cpu = i
+		}
+	}
+	assert.NotEqual(t, -1, cpu)
+
+	baseURL, baseBuildDir, _ := runTestServer(t, "-cpu-affinity", strconv.Itoa(cpu))
+	endpoint := baseURL + "api/v1/build"
+
+	// the affinity is set right after the start
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+for i in $(seq 100); do
+    [ "$(grep Cpus_allowed_list /proc/$$/status | cut -f2)" = %[2]d ] && break
+    sleep 0.01
+done
+grep Cpus_allowed_list /proc/$$/status
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir, cpu))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), fmt.Sprintf("Cpus_allowed_list:\t%d\n", cpu))
+}
+
+func TestRunInvalidCPUAffinity(t *testing.T) {
+	for _, tc := range []struct {
+		arg    string
+		expErr string
+	}{
+		{"0-", `invalid cpuset "0-"`},
+		{"3-1", `invalid cpuset "3-1"`},
+		{"x", `invalid cpuset "x"`},
+		{"4096", "invalid -cpu-affinity: cpu 4096 is not available"},
+	} {
+		err := main.Run(context.Background(), []string{"-cpu-affinity", tc.arg}, os.Getenv)
+		assert.ErrorContains(t, err, tc.expErr, tc.arg)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+func validateCPUAffinity(cpus []int) error {
+	return errors.New("cpu affinity not supported")
+}
+
+func setBuildAffinity(pid int, cpus []int) error {
+	return errors.New("cpu affinity not supported")
+}
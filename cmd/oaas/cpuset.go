@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parseCPUSet parses a cpuset list like "0-3,8" as used by the
+// kernel and taskset
+func parseCPUSet(s string) ([]int, error) {
+	seen := make(map[int]bool)
+	var cpus []int
+	for _, part := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		from, err := strconv.Atoi(first)
+		if err != nil || from < 0 {
+			return nil, fmt.Errorf("invalid cpuset %q", s)
+		}
+		to := from
+		if isRange {
+			to, err = strconv.Atoi(last)
+			if err != nil || to < from {
+				return nil, fmt.Errorf("invalid cpuset %q", s)
+			}
+		}
+		for cpu := from; cpu <= to; cpu++ {
+			if !seen[cpu] {
+				seen[cpu] = true
+				cpus = append(cpus, cpu)
+			}
+		}
+	}
+	sort.Ints(cpus)
+	return cpus, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const coreName = "osbuild.core"
+
+var (
+	ErrBuildCrashed = errors.New("build crashed")
+)
+
+// crashSignal returns the signal that killed osbuild, a non-zero
+// exit of osbuild is not a crash
+func crashSignal(err error) (syscall.Signal, bool) {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return 0, false
+	}
+	ws, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		return 0, false
+	}
+	return ws.Signal(), true
+}
+
+func signalName(sig syscall.Signal) string {
+	if name := unix.SignalName(sig); name != "" {
+		return name
+	}
+	return fmt.Sprintf("%d", sig)
+}
+
+// enableCoreDumps raises the core size limit of the server to the
+// hard limit, osbuild inherits it
+func enableCoreDumps() error {
+	var rlim unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_CORE, &rlim); err != nil {
+		return err
+	}
+	rlim.Cur = rlim.Max
+	return unix.Setrlimit(unix.RLIMIT_CORE, &rlim)
+}
+
+// collectCore moves the core that the kernel wrote into the build
+// dir (the cwd of osbuild) to a well-known name, with a systemd
+// core_pattern there is no core file and the core is in coredumpctl
+func collectCore(buildDir string) (string, error) {
+	entries, err := os.ReadDir(buildDir)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if name != "core" && !strings.HasPrefix(name, "core.") {
+			continue
+		}
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		dst := filepath.Join(buildDir, coreName)
+		if err := os.Rename(filepath.Join(buildDir, name), dst); err != nil {
+			return "", err
+		}
+		return dst, nil
+	}
+	return "", nil
+}
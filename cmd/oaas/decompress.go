@@ -0,0 +1,97 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrDecompressRatio = errors.New("decompression ratio exceeded")
+)
+
+// decompressSource replaces the given gzip compressed source with
+// its decompressed content, if the name is a sha256 digest it has to
+// match the decompressed content
+func decompressSource(gzPath string, maxRatio int64) error {
+	target := strings.TrimSuffix(gzPath, ".gz")
+
+	gzf, err := os.Open(gzPath)
+	if err != nil {
+		return err
+	}
+	defer gzf.Close()
+	st, err := gzf.Stat()
+	if err != nil {
+		return err
+	}
+	zr, err := gzip.NewReader(gzf)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, st.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	// the ratio is checked while decompressing so that a bomb is
+	// stopped before it fills the disk
+	var src io.Reader = zr
+	var limit int64
+	if maxRatio > 0 {
+		limit = st.Size() * maxRatio
+		src = io.LimitReader(zr, limit+1)
+	}
+	n, err := io.Copy(io.MultiWriter(f, h), src)
+	if err != nil {
+		os.Remove(target)
+		return err
+	}
+	if maxRatio > 0 && n > limit {
+		os.Remove(target)
+		return fmt.Errorf("%w: more than %v times the compressed size", ErrDecompressRatio, maxRatio)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(target)
+		return err
+	}
+	if expected, ok := strings.CutPrefix(filepath.Base(target), "sha256:"); ok {
+		if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+			os.Remove(target)
+			return fmt.Errorf("%w: %v decompressed as sha256:%v", ErrChecksumMismatch, filepath.Base(target), actual)
+		}
+	}
+	if err := os.Chtimes(target, st.ModTime(), st.ModTime()); err != nil {
+		return err
+	}
+	return os.Remove(gzPath)
+}
+
+// decompressSources decompresses all "*.gz" files in the build store
+func decompressSources(buildDir string, maxRatio int64) error {
+	storeDir := filepath.Join(buildDir, "store")
+	return filepath.Walk(storeDir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == storeDir {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || !strings.HasSuffix(path, ".gz") {
+			return nil
+		}
+		if err := decompressSource(path, maxRatio); err != nil {
+			return fmt.Errorf("cannot decompress %v: %w", filepath.Base(path), err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,101 @@
+package main_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+func gzipString(t *testing.T, content string) string {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write([]byte(content))
+	assert.NoError(t, err)
+	err = zw.Close()
+	assert.NoError(t, err)
+	return buf.String()
+}
+
+func TestBuildDecompressSources(t *testing.T) {
+	for _, decompress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("decompress=%v", decompress), func(t *testing.T) {
+			baseURL, baseBuildDir, _ := runTestServer(t)
+
+			restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+			defer restore()
+
+			content := "uncompressed-source-content"
+			name := "store/sources/org.osbuild.files/" + sha256Name(content) + ".gz"
+			compressed := gzipString(t, content)
+			control := fmt.Sprintf(`{"exports": ["image"], "decompress_sources": %v}`, decompress)
+			buf := makeTestPostWithEntries(t, control, `{"fake": "manifest"}`, tarEntry{name, compressed})
+			rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+			assert.NoError(t, err)
+			defer rsp.Body.Close()
+			assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+
+			sourcesDir := filepath.Join(baseBuildDir, "build/store/sources/org.osbuild.files")
+			if decompress {
+				data, err := ioutil.ReadFile(filepath.Join(sourcesDir, sha256Name(content)))
+				assert.NoError(t, err)
+				assert.Equal(t, content, string(data))
+				assert.NoFileExists(t, filepath.Join(baseBuildDir, "build", name))
+			} else {
+				// written verbatim
+				data, err := ioutil.ReadFile(filepath.Join(baseBuildDir, "build", name))
+				assert.NoError(t, err)
+				assert.Equal(t, compressed, string(data))
+				assert.NoFileExists(t, filepath.Join(sourcesDir, sha256Name(content)))
+			}
+		})
+	}
+}
+
+func TestBuildDecompressSourcesDigestMismatch(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+
+	wrongName := sha256Name("something-else")
+	buf := makeTestPostWithEntries(t, `{"exports": ["image"], "decompress_sources": true}`, `{"fake": "manifest"}`, tarEntry{
+		name:    "store/sources/org.osbuild.files/" + wrongName + ".gz",
+		content: gzipString(t, "uncompressed-source-content"),
+	})
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("cannot decompress %[1]s.gz: checksum mismatch: %[1]s decompressed as %[2]s\n", wrongName, sha256Name("uncompressed-source-content")), string(body))
+	assert.NoDirExists(t, filepath.Join(baseBuildDir, "build"))
+}
+
+func TestBuildDecompressSourcesMaxRatio(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-max-decompress-ratio", "10")
+
+	// zeros compress to a tiny fraction of their size
+	content := strings.Repeat("\x00", 1024*1024)
+	name := sha256Name(content) + ".gz"
+	buf := makeTestPostWithEntries(t, `{"exports": ["image"], "decompress_sources": true}`, `{"fake": "manifest"}`, tarEntry{
+		name:    "store/sources/org.osbuild.files/" + name,
+		content: gzipString(t, content),
+	})
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("cannot decompress %v: decompression ratio exceeded: more than 10 times the compressed size\n", name), string(body))
+	assert.NoDirExists(t, filepath.Join(baseBuildDir, "build"))
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The delta format is a small rsync style format: clients fetch the
+// signature of a source the server has and upload only the parts of
+// the new source that cannot be copied from it. The librsync formats
+// are not used as their signatures need MD4 or BLAKE2 checksums that
+// the go standard library lacks and a delta is only useful with a
+// matching signature, the ops below are the librsync copy and
+// literal commands with fixed size integers. A delta is uploaded as
+// "<source-name>.oaas-delta" next to the sources and contains:
+//
+//	"OAASDELTA1\n" "<base-source-name>\n"
+//	'C' <uint64 offset> <uint32 length>  copy from the base source
+//	'L' <uint32 length> <data>           literal data
+//	'E'                                  end of the delta
+//
+// all integers are big endian.
+const (
+	deltaMagic     = "OAASDELTA1\n"
+	deltaSuffix    = ".oaas-delta"
+	filesSourceDir = "sources/org.osbuild.files"
+
+	maxDeltaLiteral = 16 * 1024 * 1024
+)
+
+var (
+	signatureBlockSize = 64 * 1024
+
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	ErrDeltaTooLarge    = errors.New("delta output too large")
+)
+
+type blockSignature struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+// sourceSignature describes the blocks of a source, the weak
+// checksum is adler32 and the strong one sha256
+type sourceSignature struct {
+	BlockSize int              `json:"block_size"`
+	Size      int64            `json:"size"`
+	Blocks    []blockSignature `json:"blocks"`
+}
+
+func computeSignature(r io.Reader, blockSize int) (*sourceSignature, error) {
+	sig := &sourceSignature{BlockSize: blockSize, Blocks: []blockSignature{}}
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			strong := sha256.Sum256(buf[:n])
+			sig.Blocks = append(sig.Blocks, blockSignature{
+				Weak:   adler32.Checksum(buf[:n]),
+				Strong: hex.EncodeToString(strong[:]),
+			})
+			sig.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func validSourceName(name string) bool {
+	return name != "" && name == filepath.Base(name) && !strings.HasPrefix(name, ".")
+}
+
+// readDeltaHeader returns the name of the base source of the delta
+func readDeltaHeader(r *bufio.Reader) (string, error) {
+	magic := make([]byte, len(deltaMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != deltaMagic {
+		return "", fmt.Errorf("invalid delta header")
+	}
+	base, err := r.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("cannot read delta base: %v", err)
+	}
+	base = strings.TrimSuffix(base, "\n")
+	if !validSourceName(base) {
+		return "", fmt.Errorf("invalid delta base %q", base)
+	}
+	return base, nil
+}
+
+// applyDelta writes the file described by the delta ops to w, a copy
+// op can repeat the whole base so the output is limited to max bytes
+func applyDelta(base io.ReaderAt, r *bufio.Reader, w io.Writer, max int64) (int64, error) {
+	var written int64
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return written, fmt.Errorf("cannot read delta op: %v", err)
+		}
+		switch op {
+		case 'C':
+			var copyOp struct {
+				Offset uint64
+				Length uint32
+			}
+			if err := binary.Read(r, binary.BigEndian, &copyOp); err != nil {
+				return written, fmt.Errorf("cannot read delta copy: %v", err)
+			}
+			if written+int64(copyOp.Length) > max {
+				return written, fmt.Errorf("%w: more than %v bytes", ErrDeltaTooLarge, max)
+			}
+			sr := io.NewSectionReader(base, int64(copyOp.Offset), int64(copyOp.Length))
+			n, err := io.Copy(w, sr)
+			written += n
+			if err != nil {
+				return written, err
+			}
+			if n != int64(copyOp.Length) {
+				return written, fmt.Errorf("delta copy outside of base")
+			}
+		case 'L':
+			var length uint32
+			if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+				return written, fmt.Errorf("cannot read delta literal: %v", err)
+			}
+			if length > maxDeltaLiteral {
+				return written, fmt.Errorf("delta literal too big: %v", length)
+			}
+			if written+int64(length) > max {
+				return written, fmt.Errorf("%w: more than %v bytes", ErrDeltaTooLarge, max)
+			}
+			n, err := io.CopyN(w, r, int64(length))
+			written += n
+			if err != nil {
+				return written, fmt.Errorf("cannot read delta literal: %v", err)
+			}
+		case 'E':
+			return written, nil
+		default:
+			return written, fmt.Errorf("unknown delta op %q", op)
+		}
+	}
+}
+
+// findDeltaBase looks for the base source in the uploaded sources
+// first and then in the base store
+func findDeltaBase(config *Config, buildDir, name string) (*os.File, error) {
+	candidates := []string{filepath.Join(buildDir, "store", filesSourceDir, name)}
+	if config.BaseStore != "" {
+		candidates = append(candidates, filepath.Join(config.BaseStore, filesSourceDir, name))
+	}
+	for _, p := range candidates {
+		f, err := os.Open(p)
+		if err == nil {
+			return f, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("cannot find delta base %q", name)
+}
+
+// applySourceDelta reconstructs the source of the delta with at most
+// max bytes and returns its size
+func applySourceDelta(config *Config, buildDir, deltaPath string, max int64) (int64, error) {
+	target := strings.TrimSuffix(deltaPath, deltaSuffix)
+	expected, ok := strings.CutPrefix(filepath.Base(target), "sha256:")
+	if !ok {
+		return 0, fmt.Errorf("delta target must be a sha256 source, got %q", filepath.Base(target))
+	}
+
+	df, err := os.Open(deltaPath)
+	if err != nil {
+		return 0, err
+	}
+	defer df.Close()
+	r := bufio.NewReader(df)
+	baseName, err := readDeltaHeader(r)
+	if err != nil {
+		return 0, err
+	}
+	base, err := findDeltaBase(config, buildDir, baseName)
+	if err != nil {
+		return 0, err
+	}
+	defer base.Close()
+
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := applyDelta(base, r, io.MultiWriter(f, h), max)
+	if err != nil {
+		os.Remove(target)
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(target)
+		return 0, err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+		os.Remove(target)
+		return 0, fmt.Errorf("%w: %v reconstructed as sha256:%v", ErrChecksumMismatch, filepath.Base(target), actual)
+	}
+	return size, os.Remove(deltaPath)
+}
+
+// maxDeltaOutput is the number of bytes that all deltas of an upload
+// can reconstruct, the files source size limit applies too
+func maxDeltaOutput(config *Config) int64 {
+	max := config.MaxDeltaOutputSize
+	if limit, ok := config.MaxSourceSizeByType["org.osbuild.files"]; ok && limit < max {
+		max = limit
+	}
+	return max
+}
+
+// applySourceDeltas reconstructs all uploaded source deltas
+func applySourceDeltas(config *Config, buildDir string) error {
+	deltas, err := filepath.Glob(filepath.Join(buildDir, "store", filesSourceDir, "*"+deltaSuffix))
+	if err != nil {
+		return err
+	}
+	remaining := maxDeltaOutput(config)
+	for _, deltaPath := range deltas {
+		size, err := applySourceDelta(config, buildDir, deltaPath, remaining)
+		if err != nil {
+			return fmt.Errorf("cannot apply delta %v: %w", filepath.Base(deltaPath), err)
+		}
+		remaining -= size
+	}
+	return nil
+}
+
+func handleSourceSignature(logger *logrus.Logger, config *Config) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			logger.Debugf("handleSourceSignature called on %s", r.URL.Path)
+			if r.Method != http.MethodGet {
+				http.Error(w, "signature endpoint only supports GET", http.StatusMethodNotAllowed)
+				return
+			}
+			name := r.URL.Path
+			if config.BaseStore == "" || !validSourceName(name) {
+				http.NotFound(w, r)
+				return
+			}
+			f, err := os.Open(filepath.Join(config.BaseStore, filesSourceDir, name))
+			if os.IsNotExist(err) {
+				http.NotFound(w, r)
+				return
+			}
+			if err != nil {
+				logger.Errorf("cannot open source: %v", err)
+				http.Error(w, "cannot open source", http.StatusInternalServerError)
+				return
+			}
+			defer f.Close()
+			sig, err := computeSignature(f, signatureBlockSize)
+			if err != nil {
+				logger.Errorf("cannot compute signature: %v", err)
+				http.Error(w, "cannot compute signature", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(sig); err != nil {
+				logger.Errorf("cannot write signature: %v", err)
+			}
+		},
+	)
+}
@@ -0,0 +1,192 @@
+package main_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+type testSignature struct {
+	BlockSize int `json:"block_size"`
+	Blocks    []struct {
+		Strong string `json:"strong"`
+	} `json:"blocks"`
+}
+
+func sha256Name(content string) string {
+	h := sha256.Sum256([]byte(content))
+	return "sha256:" + hex.EncodeToString(h[:])
+}
+
+// makeDelta is a trivial client that copies every block it finds at
+// any offset of the new content
+func makeDelta(sig *testSignature, baseName string, content []byte) []byte {
+	blocks := make(map[string]int)
+	for i, block := range sig.Blocks {
+		blocks[block.Strong] = i
+	}
+
+	delta := bytes.NewBufferString("OAASDELTA1\n" + baseName + "\n")
+	var literal []byte
+	flushLiteral := func() {
+		if len(literal) > 0 {
+			delta.WriteByte('L')
+			binary.Write(delta, binary.BigEndian, uint32(len(literal)))
+			delta.Write(literal)
+			literal = nil
+		}
+	}
+	for i := 0; i < len(content); {
+		if i+sig.BlockSize <= len(content) {
+			h := sha256.Sum256(content[i : i+sig.BlockSize])
+			if idx, ok := blocks[hex.EncodeToString(h[:])]; ok {
+				flushLiteral()
+				delta.WriteByte('C')
+				binary.Write(delta, binary.BigEndian, uint64(idx*sig.BlockSize))
+				binary.Write(delta, binary.BigEndian, uint32(sig.BlockSize))
+				i += sig.BlockSize
+				continue
+			}
+		}
+		literal = append(literal, content[i])
+		i++
+	}
+	flushLiteral()
+	delta.WriteByte('E')
+	return delta.Bytes()
+}
+
+func makeDeltaBaseStore(t *testing.T, content string) string {
+	baseStore := t.TempDir()
+	sourcesDir := filepath.Join(baseStore, "sources/org.osbuild.files")
+	err := os.MkdirAll(sourcesDir, 0755)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(sourcesDir, sha256Name(content)), []byte(content), 0644)
+	assert.NoError(t, err)
+	return baseStore
+}
+
+func getSignature(t *testing.T, endpoint string) *testSignature {
+	rsp, err := http.Get(endpoint)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	var sig testSignature
+	err = json.NewDecoder(rsp.Body).Decode(&sig)
+	assert.NoError(t, err)
+	return &sig
+}
+
+func TestBuildReconstructsSourceFromDelta(t *testing.T) {
+	restore := main.MockSignatureBlockSize(8)
+	defer restore()
+
+	baseContent := "aaaaaaaabbbbbbbbcccccccc"
+	newContent := "aaaaaaaaXXbbbbbbbbccccccccYY"
+	baseStore := makeDeltaBaseStore(t, baseContent)
+	baseURL, baseBuildDir, _ := runTestServer(t, "-base-store", baseStore)
+
+	sig := getSignature(t, baseURL+"api/v1/sources/signature/"+sha256Name(baseContent))
+	assert.Equal(t, 8, sig.BlockSize)
+	assert.Equal(t, 3, len(sig.Blocks))
+	delta := makeDelta(sig, sha256Name(baseContent), []byte(newContent))
+	// only the changed parts are uploaded
+	assert.Contains(t, string(delta), "XX")
+	assert.NotContains(t, string(delta), "bbbbbbbb")
+
+	restore = main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+cat "%[1]s/build/store/sources/org.osbuild.files/%[2]s"
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir, sha256Name(newContent)))
+	defer restore()
+
+	buf := makeTestPostWithEntries(t, `{"exports": ["tree"]}`, `{"fake": "manifest"}`, tarEntry{
+		name:    "store/sources/org.osbuild.files/" + sha256Name(newContent) + ".oaas-delta",
+		content: string(delta),
+	})
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, newContent, string(body))
+}
+
+func TestBuildSourceDeltaChecksumMismatch(t *testing.T) {
+	restore := main.MockSignatureBlockSize(8)
+	defer restore()
+
+	baseContent := "aaaaaaaabbbbbbbbcccccccc"
+	baseStore := makeDeltaBaseStore(t, baseContent)
+	baseURL, baseBuildDir, _ := runTestServer(t, "-base-store", baseStore)
+
+	sig := getSignature(t, baseURL+"api/v1/sources/signature/"+sha256Name(baseContent))
+	delta := makeDelta(sig, sha256Name(baseContent), []byte("aaaaaaaaXX"))
+	wrongName := sha256Name("something-else")
+	buf := makeTestPostWithEntries(t, `{"exports": ["tree"]}`, `{"fake": "manifest"}`, tarEntry{
+		name:    "store/sources/org.osbuild.files/" + wrongName + ".oaas-delta",
+		content: string(delta),
+	})
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("cannot apply delta %s.oaas-delta: checksum mismatch: %s reconstructed as %s\n", wrongName, wrongName, sha256Name("aaaaaaaaXX")), string(body))
+	assert.NoDirExists(t, filepath.Join(baseBuildDir, "build"))
+}
+
+func TestBuildSourceDeltaTooLarge(t *testing.T) {
+	baseContent := "aaaaaaaabbbbbbbbcccccccc"
+	baseStore := makeDeltaBaseStore(t, baseContent)
+	baseURL, baseBuildDir, _ := runTestServer(t, "-base-store", baseStore, "-max-delta-output-size", "100")
+
+	// every copy of the whole base is a few bytes of delta
+	delta := bytes.NewBufferString("OAASDELTA1\n" + sha256Name(baseContent) + "\n")
+	for i := 0; i < 5; i++ {
+		delta.WriteByte('C')
+		binary.Write(delta, binary.BigEndian, uint64(0))
+		binary.Write(delta, binary.BigEndian, uint32(len(baseContent)))
+	}
+	delta.WriteByte('E')
+	name := sha256Name(strings.Repeat(baseContent, 5))
+	buf := makeTestPostWithEntries(t, `{"exports": ["tree"]}`, `{"fake": "manifest"}`, tarEntry{
+		name:    "store/sources/org.osbuild.files/" + name + ".oaas-delta",
+		content: delta.String(),
+	})
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("cannot apply delta %s.oaas-delta: delta output too large: more than 100 bytes\n", name), string(body))
+	assert.NoDirExists(t, filepath.Join(baseBuildDir, "build"))
+}
+
+func TestSourceSignatureNotFound(t *testing.T) {
+	baseStore := makeDeltaBaseStore(t, "some-content")
+	baseURL, _, _ := runTestServer(t, "-base-store", baseStore)
+
+	for _, name := range []string{sha256Name("unknown"), ".hidden"} {
+		rsp, err := http.Get(baseURL + "api/v1/sources/signature/" + name)
+		assert.NoError(t, err)
+		rsp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, rsp.StatusCode, name)
+	}
+}
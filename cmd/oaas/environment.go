@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+var (
+	envKeyRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	// osbuild is written in python so the python variables would
+	// allow clients to inject code into the (privileged) build
+	envKeyDenylist = []string{
+		"PATH",
+		"LD_PRELOAD",
+		"LD_LIBRARY_PATH",
+		"LD_AUDIT",
+		"PYTHONPATH",
+		"PYTHONHOME",
+		"PYTHONSTARTUP",
+	}
+)
+
+func envKey(env string) string {
+	key, _, _ := strings.Cut(env, "=")
+	return key
+}
+
+func validateEnvironments(envs []string) error {
+	for _, env := range envs {
+		key := envKey(env)
+		if !strings.Contains(env, "=") {
+			return fmt.Errorf("expected KEY=VALUE, got %q", env)
+		}
+		if !envKeyRegexp.MatchString(key) {
+			return fmt.Errorf("invalid environment key %q", key)
+		}
+		if slices.Contains(envKeyDenylist, key) {
+			return fmt.Errorf("environment key %q not allowed", key)
+		}
+	}
+	return nil
+}
+
+// validateEnvironmentValues checks the values of the keys that have a
+// pattern, the pattern has to match the whole value
+func validateEnvironmentValues(patterns map[string]*regexp.Regexp, envs []string) error {
+	for _, env := range envs {
+		key, value, _ := strings.Cut(env, "=")
+		re, ok := patterns[key]
+		if ok && !re.MatchString(value) {
+			return fmt.Errorf("value of environment key %q not allowed", key)
+		}
+	}
+	return nil
+}
+
+// parseEnvFile reads KEY=VALUE lines, empty lines and comments
+// are skipped
+func parseEnvFile(r io.Reader) ([]string, error) {
+	var envs []string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		envs = append(envs, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := validateEnvironments(envs); err != nil {
+		return nil, err
+	}
+	return envs, nil
+}
+
+func readEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseEnvFile(f)
+}
+
+// mergeEnvironments merges the given environments, for duplicated
+// keys the value from the later environment wins
+func mergeEnvironments(envs ...[]string) []string {
+	var merged []string
+	idx := make(map[string]int)
+	for _, env := range envs {
+		for _, kv := range env {
+			if i, ok := idx[envKey(kv)]; ok {
+				merged[i] = kv
+				continue
+			}
+			idx[envKey(kv)] = len(merged)
+			merged = append(merged, kv)
+		}
+	}
+	return merged
+}
+
+// passthroughEnvironment returns the given variables from the
+// environment of the server, unset variables are skipped
+func passthroughEnvironment(names []string) []string {
+	var envs []string
+	for _, name := range names {
+		if value, ok := os.LookupEnv(name); ok {
+			envs = append(envs, name+"="+value)
+		}
+	}
+	return envs
+}
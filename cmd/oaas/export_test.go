@@ -1,18 +1,42 @@
 package main
 
 import (
+	"archive/tar"
+	"errors"
 	"io/ioutil"
 	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	logrusTest "github.com/sirupsen/logrus/hooks/test"
 )
 
 var (
-	Run = run
+	Run                  = run
+	NewServer            = newServer
+	NewConfigFromCmdline = newConfigFromCmdline
 
+	HandleControlJSON     = handleControlJSON
+	HandleManifestJSON    = handleManifestJSON
 	HandleIncludedSources = handleIncludedSources
+	CreateBuildDir        = createBuildDir
+	MemoryBuildDirPrefix  = memoryBuildDirPrefix
+	RemoveBuildDir        = removeBuildDir
+	LinkBaseStore         = linkBaseStore
+	NewClientLimiter      = newClientLimiter
+	FollowLineOutput      = followLineOutput
+	NewTLSConfig          = newTLSConfig
+	ClientID              = clientID
+	CreateSourceFile      = createSourceFile
+	MkdirSource           = mkdirSource
+	CreateBeneath         = createBeneath
+
+	ErrBeneathUnsupported = errBeneathUnsupported
+
+	ControlSchemaJSON = controlSchemaJSON
+	ControlJSONType   = reflect.TypeOf(controlJSON{})
 )
 
 func MockLogger() (hook *logrusTest.Hook, restore func()) {
@@ -43,3 +67,149 @@ func MockOsbuildBinary(t *testing.T, new string) (restore func()) {
 		osbuildBinary = saved
 	}
 }
+
+func MockTarBinary(t *testing.T, new string) (restore func()) {
+	t.Helper()
+
+	saved := tarBinary
+
+	tmpdir := t.TempDir()
+	tarBinary = filepath.Join(tmpdir, "fake-tar")
+	if err := ioutil.WriteFile(tarBinary, []byte(new), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		tarBinary = saved
+	}
+}
+
+func MockCosignBinary(t *testing.T, new string) (restore func()) {
+	t.Helper()
+
+	saved := cosignBinary
+
+	tmpdir := t.TempDir()
+	cosignBinary = filepath.Join(tmpdir, "fake-cosign")
+	if err := ioutil.WriteFile(cosignBinary, []byte(new), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		cosignBinary = saved
+	}
+}
+
+func MockRPMBinary(t *testing.T, new string) (restore func()) {
+	t.Helper()
+
+	saved := rpmBinary
+
+	tmpdir := t.TempDir()
+	rpmBinary = filepath.Join(tmpdir, "fake-rpm")
+	if err := ioutil.WriteFile(rpmBinary, []byte(new), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		rpmBinary = saved
+	}
+}
+
+func MockExportPollInterval(d time.Duration) (restore func()) {
+	saved := exportPollInterval
+	exportPollInterval = d
+	return func() {
+		exportPollInterval = saved
+	}
+}
+
+func MockSignatureBlockSize(size int) (restore func()) {
+	saved := signatureBlockSize
+	signatureBlockSize = size
+	return func() {
+		signatureBlockSize = saved
+	}
+}
+
+func MockAttachPollInterval(d time.Duration) (restore func()) {
+	saved := attachPollInterval
+	attachPollInterval = d
+	return func() {
+		attachPollInterval = saved
+	}
+}
+
+func MockUploadProgressInterval(n int64) (restore func()) {
+	saved := uploadProgressInterval
+	uploadProgressInterval = n
+	return func() {
+		uploadProgressInterval = saved
+	}
+}
+
+func MockMaxLineLength(n int) (restore func()) {
+	saved := maxLineLength
+	maxLineLength = n
+	return func() {
+		maxLineLength = saved
+	}
+}
+
+func MockQuotaFSUnavailable() (restore func()) {
+	saved := mountQuotaFS
+	mountQuotaFS = func(buildDir string, size int64) error {
+		return errors.New("quota filesystem unavailable")
+	}
+	return func() {
+		mountQuotaFS = saved
+	}
+}
+
+func MockQuotaPollInterval(d time.Duration) (restore func()) {
+	saved := quotaPollInterval
+	quotaPollInterval = d
+	return func() {
+		quotaPollInterval = saved
+	}
+}
+
+func MockSourceValidator(typ string, validate func(name string, hdr *tar.Header) error) (restore func()) {
+	saved, ok := sourceValidators[typ]
+	sourceValidators[typ] = validate
+	return func() {
+		if ok {
+			sourceValidators[typ] = saved
+		} else {
+			delete(sourceValidators, typ)
+		}
+	}
+}
+
+func MockPackageRetryBackoff(d time.Duration) (restore func()) {
+	saved := packageRetryBackoff
+	packageRetryBackoff = d
+	return func() {
+		packageRetryBackoff = saved
+	}
+}
+
+func MockMaxManifestSize(size int64) (restore func()) {
+	saved := maxManifestSize
+	maxManifestSize = size
+	return func() {
+		maxManifestSize = saved
+	}
+}
+
+func MockMaxManifestDiffStages(n int) (restore func()) {
+	saved := maxManifestDiffStages
+	maxManifestDiffStages = n
+	return func() {
+		maxManifestDiffStages = saved
+	}
+}
+
+func OsbuildBinary() string {
+	return osbuildBinary
+}
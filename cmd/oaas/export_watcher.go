@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var exportPollInterval = 250 * time.Millisecond
+
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
+}
+
+func availableExportsPath(buildDir string) string {
+	return filepath.Join(buildDir, "exports.available")
+}
+
+// availableExports returns the exports that are complete while the
+// build is still running
+func availableExports(buildDir string) []string {
+	f, err := os.Open(availableExportsPath(buildDir))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var exports []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		exports = append(exports, scanner.Text())
+	}
+	return exports
+}
+
+// exportWatcher watches the osbuild output dir and marks exports
+// that osbuild finished as available. osbuild writes the exports one
+// after the other in the order of the --export arguments so an export
+// is complete once the dir of the next export appears, the last one
+// is only complete with the build.
+type exportWatcher struct {
+	outputDir string
+	buildDir  string
+	exports   []string
+	output    io.Writer
+
+	done []string
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func startExportWatcher(buildDir, outputDir string, exports []string, output io.Writer) *exportWatcher {
+	ew := &exportWatcher{
+		outputDir: outputDir,
+		buildDir:  buildDir,
+		exports:   exports,
+		output:    output,
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	go ew.run()
+	return ew
+}
+
+func (ew *exportWatcher) Stop() {
+	close(ew.stop)
+	<-ew.stopped
+}
+
+func (ew *exportWatcher) run() {
+	defer close(ew.stopped)
+
+	ticker := time.NewTicker(exportPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ew.stop:
+			return
+		case <-ticker.C:
+			ew.poll()
+		}
+	}
+}
+
+func (ew *exportWatcher) poll() {
+	for i := len(ew.done); i+1 < len(ew.exports); i++ {
+		st, err := os.Stat(filepath.Join(ew.outputDir, ew.exports[i+1]))
+		if err != nil || !st.IsDir() {
+			return
+		}
+		ew.markAvailable(ew.exports[i])
+	}
+}
+
+func (ew *exportWatcher) markAvailable(name string) {
+	ew.done = append(ew.done, name)
+	content := strings.Join(ew.done, "\n") + "\n"
+	if err := os.WriteFile(availableExportsPath(ew.buildDir), []byte(content), 0600); err != nil {
+		fmt.Fprintf(ew.output, "cannot mark export %v available: %v\n", name, err)
+		return
+	}
+	fmt.Fprintf(ew.output, "export %v available\n", name)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+var errBeneathUnsupported = errors.New("openat2 not supported")
+
+// The extracted entries are created via openat2(RESOLVE_BENEATH)
+// so that the kernel guards against escaping the build dir even if
+// a symlink ended up in the store. The name checks of extractSources
+// are the only guard on kernels without openat2.
+
+// createSourceFile opens (or creates) an extracted file
+func createSourceFile(buildDir, name string, mode os.FileMode) (*os.File, error) {
+	f, err := createBeneath(buildDir, name, mode)
+	if errors.Is(err, errBeneathUnsupported) {
+		return os.OpenFile(filepath.Join(buildDir, name), os.O_RDWR|os.O_CREATE, mode)
+	}
+	return f, err
+}
+
+// mkdirSource creates an extracted dir
+func mkdirSource(buildDir, name string, mode os.FileMode) error {
+	err := mkdirBeneath(buildDir, name, mode)
+	if errors.Is(err, errBeneathUnsupported) {
+		return os.Mkdir(filepath.Join(buildDir, name), mode)
+	}
+	return err
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// openParentBeneath opens the parent dir of name below root, the
+// kernel refuses every path (including symlinks) that leaves root
+func openParentBeneath(root, name string) (int, string, error) {
+	rootFd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, "", &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	defer unix.Close(rootFd)
+
+	parent, base := filepath.Split(filepath.Clean(name))
+	if parent == "" {
+		parent = "."
+	}
+	how := &unix.OpenHow{
+		Flags:   unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_MAGICLINKS,
+	}
+	fd, err := unix.Openat2(rootFd, parent, how)
+	if errors.Is(err, unix.ENOSYS) {
+		// openat2 is only available since linux 5.6
+		return -1, "", errBeneathUnsupported
+	}
+	if err != nil {
+		return -1, "", &os.PathError{Op: "openat2", Path: filepath.Join(root, parent), Err: err}
+	}
+	return fd, base, nil
+}
+
+// createBeneath opens (or creates) the file name below root, the
+// file itself cannot be a symlink
+func createBeneath(root, name string, mode os.FileMode) (*os.File, error) {
+	parentFd, base, err := openParentBeneath(root, name)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(parentFd)
+
+	fd, err := unix.Openat(parentFd, base, unix.O_RDWR|unix.O_CREAT|unix.O_NOFOLLOW|unix.O_CLOEXEC, uint32(mode.Perm()))
+	if err != nil {
+		return nil, &os.PathError{Op: "openat", Path: filepath.Join(root, name), Err: err}
+	}
+	return os.NewFile(uintptr(fd), filepath.Join(root, name)), nil
+}
+
+// mkdirBeneath creates the dir name below root
+func mkdirBeneath(root, name string, mode os.FileMode) error {
+	parentFd, base, err := openParentBeneath(root, name)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(parentFd)
+
+	if err := unix.Mkdirat(parentFd, base, uint32(mode.Perm())); err != nil {
+		return &os.PathError{Op: "mkdirat", Path: filepath.Join(root, name), Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+// skipWithoutOpenat2 skips on kernels without openat2, the string
+// based checks are the only guard there
+func skipWithoutOpenat2(t *testing.T) {
+	f, err := main.CreateBeneath(t.TempDir(), "probe", 0644)
+	if errors.Is(err, main.ErrBeneathUnsupported) {
+		t.Skip("openat2 not supported")
+	}
+	assert.NoError(t, err)
+	f.Close()
+}
+
+func TestCreateSourceFileSymlinkEscape(t *testing.T) {
+	skipWithoutOpenat2(t)
+
+	buildDir := t.TempDir()
+	outside := t.TempDir()
+	err := os.MkdirAll(filepath.Join(buildDir, "store"), 0755)
+	assert.NoError(t, err)
+	// a string based check sees a clean store/ path here
+	err = os.Symlink(outside, filepath.Join(buildDir, "store/sources"))
+	assert.NoError(t, err)
+
+	_, err = main.CreateSourceFile(buildDir, "store/sources/escaped", 0644)
+	assert.ErrorIs(t, err, syscall.EXDEV)
+	err = main.MkdirSource(buildDir, "store/sources/escaped-dir", 0755)
+	assert.ErrorIs(t, err, syscall.EXDEV)
+	entries, err := os.ReadDir(outside)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 0)
+
+	// symlinks that stay below the build dir are fine
+	err = os.Mkdir(filepath.Join(buildDir, "store/real"), 0755)
+	assert.NoError(t, err)
+	err = os.Symlink("real", filepath.Join(buildDir, "store/inside"))
+	assert.NoError(t, err)
+	f, err := main.CreateSourceFile(buildDir, "store/inside/file", 0644)
+	assert.NoError(t, err)
+	f.Close()
+	assert.FileExists(t, filepath.Join(buildDir, "store/real/file"))
+}
+
+func TestCreateSourceFileNoFinalSymlink(t *testing.T) {
+	skipWithoutOpenat2(t)
+
+	buildDir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(buildDir, "store"), 0755)
+	assert.NoError(t, err)
+	err = os.Symlink("/etc/passwd", filepath.Join(buildDir, "store/file"))
+	assert.NoError(t, err)
+
+	_, err = main.CreateSourceFile(buildDir, "store/file", 0644)
+	assert.ErrorIs(t, err, syscall.ELOOP)
+}
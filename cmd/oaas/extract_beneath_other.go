@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+)
+
+func createBeneath(root, name string, mode os.FileMode) (*os.File, error) {
+	return nil, errBeneathUnsupported
+}
+
+func mkdirBeneath(root, name string, mode os.FileMode) error {
+	return errBeneathUnsupported
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+var rpmBinary = "rpm"
+
+// fingerprintPackages are the packages that osbuild runs tools from
+// on the build host
+var fingerprintPackages = []string{"osbuild", "python3", "rpm", "ostree", "skopeo"}
+
+// buildFingerprint describes the environment of a build, it explains
+// why the same inputs produced different outputs on different nodes
+type buildFingerprint struct {
+	OsbuildVersion string            `json:"osbuild_version,omitempty"`
+	Kernel         string            `json:"kernel"`
+	Hostname       string            `json:"hostname"`
+	Packages       map[string]string `json:"packages,omitempty"`
+}
+
+// hostFingerprint is gathered once at startup, only the osbuild
+// version depends on the build
+type hostFingerprint struct {
+	kernel          string
+	hostname        string
+	packages        map[string]string
+	osbuildVersions map[string]string
+}
+
+func osbuildVersion(binary string) string {
+	out, err := exec.Command(binary, "--version").Output()
+	if err != nil {
+		logrus.Warnf("cannot get version of %v: %v", binary, err)
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// packageVersions returns the installed versions of the given
+// packages, on hosts without rpm the result is empty
+func packageVersions(pkgs []string) map[string]string {
+	args := append([]string{"-q", "--queryformat", "%{NAME} %{VERSION}-%{RELEASE}\n"}, pkgs...)
+	// rpm exits non-zero when a package is not installed but still
+	// prints the installed ones
+	out, _ := exec.Command(rpmBinary, args...).Output()
+	versions := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			versions[fields[0]] = fields[1]
+		}
+	}
+	return versions
+}
+
+func gatherHostFingerprint(config *Config) *hostFingerprint {
+	hf := &hostFingerprint{
+		packages:        packageVersions(fingerprintPackages),
+		osbuildVersions: make(map[string]string),
+	}
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err == nil {
+		hf.kernel = unix.ByteSliceToString(uts.Release[:])
+	}
+	hf.hostname, _ = os.Hostname()
+	binaries := []string{osbuildBinary}
+	for _, binary := range config.OsbuildBinaries {
+		binaries = append(binaries, binary)
+	}
+	for _, binary := range binaries {
+		hf.osbuildVersions[binary] = osbuildVersion(binary)
+	}
+	return hf
+}
+
+// fingerprint returns the fingerprint of a build with the given
+// osbuild binary
+func (hf *hostFingerprint) fingerprint(binary string) *buildFingerprint {
+	fp := &buildFingerprint{
+		OsbuildVersion: hf.osbuildVersions[binary],
+		Kernel:         hf.kernel,
+		Hostname:       hf.hostname,
+	}
+	if len(hf.packages) > 0 {
+		fp.Packages = hf.packages
+	}
+	return fp
+}
@@ -0,0 +1,72 @@
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+func TestBuildSummaryNoBuild(t *testing.T) {
+	baseURL, _, _ := runTestServer(t)
+
+	rsp, err := http.Get(baseURL + "api/v1/build/summary")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, rsp.StatusCode)
+}
+
+func TestBuildFingerprint(t *testing.T) {
+	// the fingerprint is gathered at startup so mock first
+	buildBaseDir := t.TempDir()
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+if [ "$1" = "--version" ]; then
+    echo "osbuild 123"
+    exit 0
+fi
+mkdir -p %[1]s/build/output/image
+`, buildBaseDir))
+	defer restore()
+	restore = main.MockRPMBinary(t, `#!/bin/sh
+echo "osbuild 123-1.fc40"
+echo "package skopeo is not installed"
+exit 1
+`)
+	defer restore()
+	baseURL, _, _ := runTestServer(t, "-fingerprint", "-build-path", buildBaseDir)
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+
+	rsp, err = http.Get(baseURL + "api/v1/build/summary")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	var summary struct {
+		Fingerprint struct {
+			OsbuildVersion string            `json:"osbuild_version"`
+			Kernel         string            `json:"kernel"`
+			Hostname       string            `json:"hostname"`
+			Packages       map[string]string `json:"packages"`
+		} `json:"fingerprint"`
+	}
+	err = json.NewDecoder(rsp.Body).Decode(&summary)
+	assert.NoError(t, err)
+	hostname, err := os.Hostname()
+	assert.NoError(t, err)
+	assert.Equal(t, "osbuild 123", summary.Fingerprint.OsbuildVersion)
+	assert.NotEmpty(t, summary.Fingerprint.Kernel)
+	assert.Equal(t, hostname, summary.Fingerprint.Hostname)
+	assert.Equal(t, map[string]string{"osbuild": "123-1.fc40"}, summary.Fingerprint.Packages)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+type maintenanceState struct {
+	Maintenance bool `json:"maintenance"`
+}
+
+// readAdminToken reads the token that authenticates the admin
+// endpoints, surrounding whitespace is ignored
+func readAdminToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("empty admin token in %v", path)
+	}
+	return token, nil
+}
+
+// inMaintenance returns true when new builds are rejected, running
+// builds and all other endpoints are not affected
+func inMaintenance(config *Config) bool {
+	return config.maintenance != nil && config.maintenance.Load()
+}
+
+func adminAuthorized(config *Config, r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(config.adminToken)) == 1
+}
+
+// handleAdminMaintenance reports the maintenance mode on GET so that
+// load balancers can drain the server, POST with an admin token
+// changes it
+func handleAdminMaintenance(logger *logrus.Logger, config *Config) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			logger.Debugf("handleAdminMaintenance called on %s", r.URL.Path)
+			if config.adminToken == "" {
+				http.NotFound(w, r)
+				return
+			}
+			switch r.Method {
+			case http.MethodGet:
+			case http.MethodPost:
+				if !adminAuthorized(config, r) {
+					http.Error(w, "unauthorized", http.StatusUnauthorized)
+					return
+				}
+				var state maintenanceState
+				if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+					http.Error(w, fmt.Sprintf("cannot decode maintenance state: %v", err), http.StatusBadRequest)
+					return
+				}
+				config.maintenance.Store(state.Maintenance)
+				logger.Infof("maintenance mode set to %v", state.Maintenance)
+			default:
+				http.Error(w, "maintenance endpoint only supports GET and POST", http.StatusMethodNotAllowed)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(&maintenanceState{Maintenance: inMaintenance(config)}); err != nil {
+				logger.Errorf("cannot write maintenance state: %v", err)
+			}
+		},
+	)
+}
@@ -0,0 +1,103 @@
+package main_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setMaintenance(t *testing.T, baseURL, token, state string) *http.Response {
+	req, err := http.NewRequest(http.MethodPost, baseURL+"api/v1/admin/maintenance", strings.NewReader(state))
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rsp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	return rsp
+}
+
+func TestMaintenanceNoAdminToken(t *testing.T) {
+	baseURL, _, _ := runTestServer(t)
+
+	rsp := setMaintenance(t, baseURL, "", `{"maintenance": true}`)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, rsp.StatusCode)
+
+	rsp, err := http.Get(baseURL + "healthz")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"healthy":true,"maintenance":false}`+"\n", string(body))
+}
+
+func TestMaintenanceRejectsBuildsButServesResults(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "admin-token")
+	err := ioutil.WriteFile(tokenFile, []byte("s3cret\n"), 0600)
+	assert.NoError(t, err)
+	baseURL, buildBaseDir, _ := runTestServer(t, "-admin-token-file", tokenFile)
+	makeGoodResult(t, buildBaseDir, "disk.img", []byte("fake-build-result"))
+
+	rsp := setMaintenance(t, baseURL, "wrong", `{"maintenance": true}`)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, rsp.StatusCode)
+
+	rsp = setMaintenance(t, baseURL, "s3cret", `{"maintenance": true}`)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"maintenance":true}`+"\n", string(body))
+
+	// the state is visible without a token
+	rsp, err = http.Get(baseURL + "api/v1/admin/maintenance")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	body, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"maintenance":true}`+"\n", string(body))
+
+	// load balancers drain the server
+	rsp, err = http.Get(baseURL + "healthz")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, rsp.StatusCode)
+	body, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"healthy":false,"maintenance":true,"error":"maintenance"}`+"\n", string(body))
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err = http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, rsp.StatusCode)
+	body, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "maintenance\n", string(body))
+
+	rsp, err = http.Get(baseURL + "api/v1/result/disk.img")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	body, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "fake-build-result", string(body))
+
+	rsp = setMaintenance(t, baseURL, "s3cret", `{"maintenance": false}`)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	rsp, err = http.Get(baseURL + "api/v1/admin/maintenance")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	body, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"maintenance":false}`+"\n", string(body))
+	rsp, err = http.Get(baseURL + "healthz")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+}
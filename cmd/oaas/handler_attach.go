@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var attachPollInterval = 100 * time.Millisecond
+
+// followBuildLog copies the build log to w until the build is done
+func followBuildLog(stop <-chan struct{}, config *Config, w io.Writer) error {
+	buildResult := newBuildResult(config)
+	done := func() bool {
+		return buildResult.Good() || buildResult.Bad()
+	}
+	return followLog(stop, buildDirPath(config), done, w)
+}
+
+// followLog copies the build.log of the given build dir to w until
+// done returns true
+func followLog(stop <-chan struct{}, buildDir string, done func() bool, w io.Writer) error {
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	for {
+		// the result is marked after the log is written so check
+		// it before the final read
+		finished := done()
+		if f == nil {
+			var err error
+			f, err = os.Open(filepath.Join(buildDir, "build.log"))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if f != nil {
+			if _, err := io.Copy(w, f); err != nil {
+				return err
+			}
+		}
+		if finished {
+			return nil
+		}
+		if !fileExists(buildDir) {
+			return errors.New("build went away")
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(attachPollInterval):
+		}
+	}
+}
+
+func handleAttach(logger *logrus.Logger, config *Config) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			logger.Debugf("handleAttach called on %s", r.URL.Path)
+			if r.Method != http.MethodGet {
+				http.Error(w, "attach endpoint only supports GET", http.StatusMethodNotAllowed)
+				return
+			}
+			if !fileExists(buildDirPath(config)) {
+				http.Error(w, "no build", http.StatusNotFound)
+				return
+			}
+			flusher, ok := w.(http.Flusher)
+			if !ok {
+				http.Error(w, "cannot stream the output", http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			wf := &writeFlusher{w: w, flusher: flusher}
+			if err := followBuildLog(r.Context().Done(), config, wf); err != nil {
+				logger.Errorf("cannot follow build log: %v", err)
+			}
+		},
+	)
+}
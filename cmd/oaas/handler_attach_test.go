@@ -0,0 +1,73 @@
+package main_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+func TestAttachNoBuild(t *testing.T) {
+	baseURL, _, _ := runTestServer(t)
+
+	rsp, err := http.Get(baseURL + "api/v1/build/attach")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, rsp.StatusCode)
+}
+
+func TestAttachReplaysLogAndFollows(t *testing.T) {
+	restore := main.MockAttachPollInterval(10 * time.Millisecond)
+	defer restore()
+
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	flag := filepath.Join(t.TempDir(), "continue")
+	restore = main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+echo "early line"
+while [ ! -e %[2]s ]; do sleep 0.01; done
+echo "late line"
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir, flag))
+	defer restore()
+
+	buildDone := make(chan struct{})
+	go func() {
+		defer close(buildDone)
+		buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+		rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+		assert.NoError(t, err)
+		defer rsp.Body.Close()
+		io.Copy(io.Discard, rsp.Body)
+	}()
+	assert.Eventually(t, func() bool {
+		data, err := ioutil.ReadFile(filepath.Join(baseBuildDir, "build/build.log"))
+		return err == nil && strings.Contains(string(data), "early line")
+	}, defaultTimeout, 10*time.Millisecond)
+
+	rsp, err := http.Get(baseURL + "api/v1/build/attach")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	r := bufio.NewReader(rsp.Body)
+	// the log so far is replayed
+	line, err := r.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "early line\n", line)
+
+	// and then the live output follows until the build is done
+	err = ioutil.WriteFile(flag, nil, 0644)
+	assert.NoError(t, err)
+	rest, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "late line\n", string(rest))
+	<-buildDone
+}
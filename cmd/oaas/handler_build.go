@@ -2,6 +2,8 @@ package main
 
 import (
 	"archive/tar"
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,9 +12,14 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/template"
+	"time"
 
 	"golang.org/x/exp/slices"
+	"sigs.k8s.io/yaml"
 
 	"github.com/sirupsen/logrus"
 )
@@ -20,10 +27,32 @@ import (
 var (
 	supportedBuildContentTypes = []string{"application/x-tar"}
 	osbuildBinary              = "osbuild"
+	tarBinary                  = "tar"
+	ioniceBinary               = "ionice"
+
+	maxControlJSONSize int64 = 1024 * 1024
+	// manifests are read into memory for conversion and validation
+	maxManifestSize int64 = 16 * 1024 * 1024
 )
 
+// outputTarTmpName is the name output.tar has while it is written
+const outputTarTmpName = ".output.tar.tmp"
+
 var (
-	ErrAlreadyBuilding = errors.New("build already starte")
+	ErrAlreadyBuilding       = errors.New("build already starte")
+	ErrUnknownOsbuildVersion = errors.New("unknown osbuild version")
+	ErrExportNotAllowed      = errors.New("export not allowed")
+	ErrOutputNotAllowed      = errors.New("output dir not allowed")
+	ErrBuildTimeout          = errors.New("build aborted: timeout")
+	ErrEmptyUpload           = errors.New("empty upload")
+	ErrMultipleManifests     = errors.New("only one of manifest.json, manifest.yaml and manifest.json.tmpl can be sent")
+	ErrManifestTemplate      = errors.New("cannot render manifest.json.tmpl")
+	ErrInvalidManifest       = errors.New("invalid manifest.json")
+	ErrManifestTooLarge      = errors.New("manifest too large")
+	ErrManifestVersion       = errors.New("unsupported manifest version")
+	ErrPathTooDeep           = errors.New("path too deep")
+	ErrNoExports             = errors.New("no exports requested")
+	ErrTooManyExports        = errors.New("too many exports")
 )
 
 type writeFlusher struct {
@@ -39,11 +68,116 @@ func (wf *writeFlusher) Write(p []byte) (n int, err error) {
 	return n, err
 }
 
-func runOsbuild(buildDir string, control *controlJSON, output io.Writer) (string, error) {
+func createOutputDir(config *Config, outputDir string) error {
+	if config.OutputDirMode == 0 {
+		return nil
+	}
+	if err := os.Mkdir(outputDir, config.OutputDirMode); err != nil {
+		return fmt.Errorf("cannot create output dir: %v", err)
+	}
+	// ensure the umask does not interfere with the configured mode
+	return os.Chmod(outputDir, config.OutputDirMode)
+}
+
+// osbuildBinaryFor returns the osbuild binary selected by the
+// control.json "osbuild_version"
+func osbuildBinaryFor(config *Config, control *controlJSON) (string, error) {
+	if control.OsbuildVersion == "" {
+		return osbuildBinary, nil
+	}
+	binary, ok := config.OsbuildBinaries[control.OsbuildVersion]
+	if !ok {
+		return "", fmt.Errorf("%w %q", ErrUnknownOsbuildVersion, control.OsbuildVersion)
+	}
+	return binary, nil
+}
+
+// applyDefaultExports uses the configured default exports when the
+// client did not request any
+func applyDefaultExports(config *Config, control *controlJSON) error {
+	if len(control.Exports) > 0 {
+		return nil
+	}
+	if len(config.DefaultExports) == 0 {
+		return ErrNoExports
+	}
+	control.Exports = append([]string(nil), config.DefaultExports...)
+	return nil
+}
+
+// checkMaxExports guards against clients that use a huge number of
+// exports to blow up the osbuild commandline and runtime
+func checkMaxExports(config *Config, control *controlJSON) error {
+	if config.MaxExports > 0 && len(control.Exports) > config.MaxExports {
+		return fmt.Errorf("%w: %v (maximum %v)", ErrTooManyExports, len(control.Exports), config.MaxExports)
+	}
+	return nil
+}
+
+func checkAllowedExports(config *Config, control *controlJSON) error {
+	if len(config.AllowedExports) == 0 {
+		return nil
+	}
+	for _, exp := range control.Exports {
+		if !slices.Contains(config.AllowedExports, exp) {
+			return fmt.Errorf("%w: %v", ErrExportNotAllowed, exp)
+		}
+	}
+	return nil
+}
+
+// checkOutputDirect ensures that the direct output dir is inside one
+// of the configured output roots
+func checkOutputDirect(config *Config, control *controlJSON) error {
+	if control.OutputDirect == "" {
+		return nil
+	}
+	if control.ResultUpload != nil {
+		return fmt.Errorf("output_direct cannot be combined with result_upload")
+	}
+	dest := control.OutputDirect
+	if !filepath.IsAbs(dest) || filepath.Clean(dest) != dest {
+		return fmt.Errorf("output dir must be an absolute clean path, got %q", dest)
+	}
+	// resolve symlinks so that they cannot be used to escape
+	realDest, err := filepath.EvalSymlinks(dest)
+	if err != nil {
+		return fmt.Errorf("cannot use output dir: %v", err)
+	}
+	for _, root := range config.OutputRoots {
+		realRoot, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(realRoot, realDest)
+		if err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %v", ErrOutputNotAllowed, dest)
+}
+
+// writeDebugCommand writes the osbuild command line, the environment
+// values can contain secrets so only the keys are written
+func writeDebugCommand(w io.Writer, cmd *exec.Cmd) {
+	fmt.Fprintf(w, "osbuild command: %s\n", strings.Join(cmd.Args, " "))
+	if len(cmd.Env) > 0 {
+		keys := make([]string, 0, len(cmd.Env))
+		for _, env := range cmd.Env {
+			keys = append(keys, envKey(env))
+		}
+		fmt.Fprintf(w, "osbuild environment keys: %s\n", strings.Join(keys, " "))
+	}
+}
+
+func runOsbuild(ctx context.Context, config *Config, buildDir string, control *controlJSON, output io.Writer, summary *buildSummary) (string, error) {
+	// without a flusher (e.g. behind some middlewares) the client
+	// gets the output once the build is done
 	flusher, ok := output.(http.Flusher)
 	if !ok {
-		return "", fmt.Errorf("cannot stream the output")
+		logrus.Warnf("cannot stream the output, sending it when the build is done")
 	}
+	started := time.Now()
 	// stream output over http
 	wf := writeFlusher{w: output, flusher: flusher}
 	// and also write to our internal log
@@ -53,59 +187,433 @@ func runOsbuild(buildDir string, control *controlJSON, output io.Writer) (string
 	}
 	defer logf.Close()
 
-	// use multi writer to get same output for stream and log
-	mw := io.MultiWriter(&wf, logf)
+	// use multi writer to get same output for stream and log, the
+	// locks are needed as output is written from different goroutines
+	streamw := &lockedWriter{w: &wf}
+	logw := &lockedWriter{w: logf}
+	mw := io.MultiWriter(streamw, logw)
 	outputDir := filepath.Join(buildDir, "output")
 	storeDir := filepath.Join(buildDir, "store")
-	cmd := exec.Command(osbuildBinary)
-	cmd.Stdout = mw
-	cmd.Stderr = mw
+	if control.OutputDirect != "" {
+		outputDir = control.OutputDirect
+	} else if err := createOutputDir(config, outputDir); err != nil {
+		return "", err
+	}
+	if control.CheckpointNamespace != "" {
+		storeDir, err = prepareCheckpointStore(config, buildDir, control.CheckpointNamespace)
+		if err != nil {
+			logrus.Errorf(err.Error())
+			mw.Write([]byte(err.Error()))
+			return "", err
+		}
+	} else if config.BaseStore != "" {
+		cleanup, err := setupBaseStore(config.BaseStore, buildDir)
+		if err != nil {
+			return "", fmt.Errorf("cannot setup base store: %v", err)
+		}
+		defer func() {
+			if err := cleanup(); err != nil {
+				logrus.Errorf("cannot cleanup base store: %v", err)
+			}
+		}()
+	}
+	// the result upload is canceled with the build but it is not
+	// part of the osbuild runtime
+	buildCtx := ctx
+	// the quota watchdog aborts the build via the context
+	ctx, abort := context.WithCancel(ctx)
+	defer abort()
+	if config.BuildTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.BuildTimeout)
+		defer cancel()
+	}
+	binary, err := osbuildBinaryFor(config, control)
+	if err != nil {
+		return "", err
+	}
+	if config.fingerprint != nil {
+		summary.Fingerprint = config.fingerprint.fingerprint(binary)
+	}
+	cmd := exec.CommandContext(ctx, binary)
+	if config.IONiceClass != "" {
+		// ionice execs osbuild so the pid stays the same
+		cmd = exec.CommandContext(ctx, ioniceBinary, "-c", config.IONiceClass, binary)
+	}
+	// kill the whole process group, otherwise children of osbuild
+	// keep the output pipe open and Wait() will not return
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if config.UserNamespace {
+		useUserNamespace(cmd.SysProcAttr)
+	}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	if config.CollectCores {
+		// the kernel writes relative cores to the cwd
+		cmd.Dir = buildDir
+	}
 	for _, exp := range control.Exports {
 		cmd.Args = append(cmd.Args, []string{"--export", exp}...)
 	}
-	cmd.Env = append(cmd.Env, control.Environments...)
+	// control.json environments take precedence over build.env
+	// which takes precedence over the passthrough environment
+	fileEnv, err := readEnvFile(filepath.Join(buildDir, "build.env"))
+	if err != nil {
+		return "", fmt.Errorf("cannot read build.env: %v", err)
+	}
+	// a single pipe for stdout/stderr keeps the output ordered
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+	defer pr.Close()
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	cmd.Env = append(cmd.Env, mergeEnvironments(passthroughEnvironment(config.PassthroughEnv), fileEnv, control.Environments)...)
 	cmd.Args = append(cmd.Args, []string{"--output-dir", outputDir}...)
 	cmd.Args = append(cmd.Args, []string{"--store", storeDir}...)
+	if control.CheckpointNamespace != "" {
+		// the store is kept so checkpoint everything for the
+		// next build in the namespace
+		cmd.Args = append(cmd.Args, []string{"--checkpoint", "*"}...)
+	}
 	cmd.Args = append(cmd.Args, "--json")
-	cmd.Args = append(cmd.Args, filepath.Join(buildDir, "manifest.json"))
+	if config.ManifestViaStdin {
+		// manifest.json stays in the build dir, the provenance
+		// and the source checks need it
+		mf, err := os.Open(filepath.Join(buildDir, "manifest.json"))
+		if err != nil {
+			pw.Close()
+			return "", err
+		}
+		defer mf.Close()
+		cmd.Stdin = mf
+		cmd.Args = append(cmd.Args, "-")
+	} else {
+		cmd.Args = append(cmd.Args, filepath.Join(buildDir, "manifest.json"))
+	}
+	if config.Debug {
+		writeDebugCommand(mw, cmd)
+	}
 	if err := cmd.Start(); err != nil {
+		pw.Close()
+		if config.UserNamespace {
+			return "", fmt.Errorf("cannot start osbuild in user namespace: %w", err)
+		}
 		return "", err
 	}
+	pw.Close()
+	var watchdog *quotaWatchdog
+	if config.BuildQuotaBytes > 0 && !hasQuotaFS(buildDir) {
+		watchdog = startQuotaWatchdog(buildDir, config.BuildQuotaBytes, abort)
+	}
+	if config.Nice != 0 {
+		if err := setBuildPriority(cmd.Process.Pid, config.Nice); err != nil {
+			logrus.Errorf("cannot set build priority: %v", err)
+		}
+	}
+	if len(config.CPUAffinity) > 0 {
+		if err := setBuildAffinity(cmd.Process.Pid, config.CPUAffinity); err != nil {
+			logrus.Errorf("cannot set build cpu affinity: %v", err)
+		}
+	}
 
-	if err := cmd.Wait(); err != nil {
+	var watcher *exportWatcher
+	if control.IncrementalOutput {
+		watcher = startExportWatcher(buildDir, outputDir, control.Exports, mw)
+	}
+	results := newOsbuildResultCollector()
+	classifier := newFailureClassifier(config)
+	// the log always gets the full output, the stream only the
+	// lines the client is interested in
+	heartbeat := startHeartbeat(streamw, config.Heartbeat)
+	defer heartbeat.Stop()
+	filtered := &lineFilterWriter{w: &textStreamWriter{w: heartbeat}, accept: logLevelFilter(control.LogLevel)}
+	// a flood of output must neither stall the stream nor fill
+	// the disk via build.log
+	limited := newLineLimitWriter(io.MultiWriter(filtered, logw), config.MaxLogLinesPerSecond, config.MaxLogLines)
+	followErr := followLineOutput(pr, limited, results.observe, classifier.observe)
+	if err := limited.Flush(); err != nil && followErr == nil {
+		followErr = err
+	}
+	heartbeat.Stop()
+	// ensure osbuild does not block on a full pipe
+	pr.Close()
+	if watcher != nil {
+		watcher.Stop()
+	}
+	// the stage counts and warnings are informational, a build does
+	// not fail because of them
+	var warnings warningCollector
+	if res, err := results.Result(); err != nil {
+		logrus.Warnf("cannot use osbuild result: %v", err)
+	} else if res != nil {
+		res.collectWarnings(&warnings)
+		summary.CachedStages, summary.BuiltStages, err = res.stageCounts(filepath.Join(buildDir, "manifest.json"), control.Exports)
+		if err != nil {
+			logrus.Warnf("cannot count osbuild stages: %v", err)
+		}
+	}
+	summary.Warnings = warnings.Warnings()
+	err = cmd.Wait()
+	buildDuration.ObserveSince(started)
+	quotaExceeded := watchdog != nil && watchdog.Stop()
+	if err != nil && hasQuotaFS(buildDir) && fsFull(buildDir) {
+		quotaExceeded = true
+	}
+	if err == nil && followErr != nil {
+		err = fmt.Errorf("cannot follow output: %w", followErr)
+	}
+	if err != nil {
 		// we cannot use "http.Error()" here because the http
 		// header was already set to "201" when we started streaming
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			summary.FailureClass = failureTimeout
+			mw.Write([]byte(ErrBuildTimeout.Error() + "\n"))
+			return "", ErrBuildTimeout
+		}
+		if quotaExceeded {
+			// the build is too big for this server
+			summary.FailureClass = failureUser
+			qerr := quotaError(config.BuildQuotaBytes)
+			mw.Write([]byte(qerr.Error() + "\n"))
+			return "", qerr
+		}
+		if errors.Is(ctx.Err(), context.Canceled) {
+			mw.Write([]byte(ErrBuildCanceled.Error() + "\n"))
+			return "", ErrBuildCanceled
+		}
+		if sig, ok := crashSignal(err); ok {
+			summary.FailureClass = failureSystem
+			summary.CrashSignal = signalName(sig)
+			cerr := fmt.Errorf("%w (signal %v)", ErrBuildCrashed, summary.CrashSignal)
+			mw.Write([]byte(cerr.Error() + "\n"))
+			if config.CollectCores {
+				if core, err := collectCore(buildDir); err != nil {
+					logrus.Errorf("cannot collect core: %v", err)
+				} else if core != "" {
+					mw.Write([]byte(fmt.Sprintf("core written to %v\n", core)))
+				}
+			}
+			if herr := runPostBuildHook(config, buildDir, exitStatus(err), mw); herr != nil {
+				logrus.Errorf(herr.Error())
+			}
+			return "", cerr
+		}
+		summary.FailureClass = classifier.class
 		mw.Write([]byte(fmt.Sprintf("cannot run osbuild: %v", err)))
+		if herr := runPostBuildHook(config, buildDir, exitStatus(err), mw); herr != nil {
+			logrus.Errorf(herr.Error())
+		}
 		return "", err
 	}
 
-	cmd = exec.Command(
-		"tar",
-		"-Scf",
-		filepath.Join(outputDir, "output.tar"),
-		"output",
-	)
-	cmd.Dir = buildDir
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		err = fmt.Errorf("cannot tar output directory: %w, output:\n%s", err, out)
+	if err := renameOutputs(outputDir, control.OutputNames); err != nil {
+		summary.FailureClass = failureUser
+		logrus.Errorf(err.Error())
+		mw.Write([]byte(err.Error() + "\n"))
+		return "", err
+	}
+	// direct output is written to its final place by osbuild
+	if control.OutputDirect == "" {
+		packageStart := time.Now()
+		err := packageOutputWithRetries(config, buildDir, outputDir, control.TarBlockSize, mw)
+		packageDuration.ObserveSince(packageStart)
+		if err != nil {
+			summary.FailureClass = failureSystem
+			logrus.Errorf(err.Error())
+			mw.Write([]byte(err.Error()))
+			return "", err
+		}
+		if config.ContentAddressedResults {
+			digest, err := storeByDigest(config, filepath.Join(outputDir, outputTarName(config)))
+			if err != nil {
+				summary.FailureClass = failureSystem
+				err = fmt.Errorf("cannot store result by digest: %w", err)
+				logrus.Errorf(err.Error())
+				mw.Write([]byte(err.Error()))
+				return "", err
+			}
+			summary.OutputDigest = digest
+		}
+	}
+
+	if err := runPostBuildHook(config, buildDir, 0, mw); err != nil {
 		logrus.Errorf(err.Error())
 		mw.Write([]byte(err.Error()))
 		return "", err
 	}
-	logrus.Infof("tar output:\n%s", out)
+	// the provenance is informational, a good build stays good
+	// without it
+	provenanceWritten := false
+	if config.Provenance {
+		if err := writeProvenance(config, buildDir, storeDir, outputDir, control, started); err != nil {
+			logrus.Errorf("cannot write provenance: %v", err)
+		} else {
+			provenanceWritten = true
+		}
+	}
+	if config.ArtifactSigner != "" {
+		var signed []string
+		if control.OutputDirect == "" {
+			signed = append(signed, outputTarName(config))
+		}
+		if provenanceWritten {
+			signed = append(signed, provenanceName)
+		}
+		for _, name := range signed {
+			digest, err := signArtifact(config, filepath.Join(outputDir, name))
+			if err != nil {
+				summary.FailureClass = failureSystem
+				logrus.Errorf(err.Error())
+				mw.Write([]byte(err.Error()))
+				return "", err
+			}
+			if name == outputTarName(config) {
+				summary.SignatureDigest = digest
+			}
+		}
+	}
+
+	if config.ChecksumMode == checksumModeEager {
+		if err := computeOutputChecksums(buildDir, outputDir); err != nil {
+			summary.FailureClass = failureSystem
+			err = fmt.Errorf("cannot compute output checksums: %w", err)
+			logrus.Errorf(err.Error())
+			mw.Write([]byte(err.Error()))
+			return "", err
+		}
+	}
+
+	if control.ResultUpload != nil {
+		objectURL, err := uploadResult(buildCtx, config, control.ResultUpload, filepath.Join(outputDir, outputTarName(config)))
+		if err != nil {
+			logrus.Errorf(err.Error())
+			mw.Write([]byte(err.Error()))
+			return "", err
+		}
+		if err := writeUploadRecord(buildDir, []string{objectURL}); err != nil {
+			return "", err
+		}
+		mw.Write([]byte(fmt.Sprintf("result uploaded to %v\n", objectURL)))
+	}
+	if control.OutputDirect != "" {
+		mw.Write([]byte(fmt.Sprintf("output written to %v\n", outputDir)))
+	}
+
 	return outputDir, nil
 }
 
+// packageOutput creates the (compressed) output.tar with all exports, it is
+// written to a temporary name first so that the result endpoint never
+// sees a partial output.tar
+func packageOutput(config *Config, buildDir, outputDir string, tarBlockSize int) error {
+	tmpPath := filepath.Join(outputDir, outputTarTmpName)
+	cmd := exec.Command(tarBinary, "-Scf", tmpPath)
+	if tarBlockSize != 0 {
+		// the blocking factor is counted in 512 byte records
+		cmd.Args = append(cmd.Args, fmt.Sprintf("--blocking-factor=%d", tarBlockSize*2))
+	}
+	if compression, ok := outputCompressions[config.OutputCompression]; ok {
+		cmd.Args = append(cmd.Args, compression.tarFlag)
+	}
+	if config.ContentAddressedResults {
+		// identical outputs must give identical tars
+		cmd.Args = append(cmd.Args, "--sort=name", "--mtime=@0", "--owner=0", "--group=0", "--numeric-owner")
+	}
+	cmd.Args = append(cmd.Args, "output")
+	cmd.Dir = buildDir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("cannot tar output directory: %w, output:\n%s", err, out)
+	}
+	logrus.Infof("tar output:\n%s", out)
+	if config.OutputDirMode != 0 {
+		// the tar is a plain file so it never needs exec permissions
+		if err := os.Chmod(tmpPath, config.OutputDirMode&^0111); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	return os.Rename(tmpPath, filepath.Join(outputDir, outputTarName(config)))
+}
+
+// packageRetryBackoff is the wait before the first retry of the
+// packaging, it doubles with every retry
+var packageRetryBackoff = 1 * time.Second
+
+// packageOutputWithRetries retries the packaging as it can fail
+// transiently on a busy filesystem, the build is done at this point
+// so it is cheap compared to a rebuild
+func packageOutputWithRetries(config *Config, buildDir, outputDir string, tarBlockSize int, w io.Writer) error {
+	backoff := packageRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := packageOutput(config, buildDir, outputDir, tarBlockSize)
+		if err == nil || attempt > config.PackageRetries {
+			return err
+		}
+		logrus.Warnf("packaging failed (attempt %v): %v", attempt, err)
+		fmt.Fprintf(w, "retrying packaging in %v\n", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+const (
+	// maxTarBlockSize is the largest output tar block size in KiB,
+	// the default of tar is 10KiB
+	maxTarBlockSize = 1024
+)
+
+func validateTarBlockSize(control *controlJSON) error {
+	if control.TarBlockSize < 0 || control.TarBlockSize > maxTarBlockSize {
+		return fmt.Errorf("invalid tar block size %vKiB, must be between 1 and %vKiB", control.TarBlockSize, maxTarBlockSize)
+	}
+	if control.TarBlockSize != 0 && control.OutputDirect != "" {
+		return fmt.Errorf("tar block size cannot be used with output_direct")
+	}
+	return nil
+}
+
 type controlJSON struct {
-	Environments []string `json:"environments"`
-	Exports      []string `json:"exports"`
+	Environments        []string          `json:"environments"`
+	Exports             []string          `json:"exports"`
+	ResultUpload        *resultUpload     `json:"result_upload,omitempty"`
+	OsbuildVersion      string            `json:"osbuild_version,omitempty"`
+	IncrementalOutput   bool              `json:"incremental_output,omitempty"`
+	OutputDirect        string            `json:"output_direct,omitempty"`
+	LogLevel            string            `json:"log_level,omitempty"`
+	CheckpointNamespace string            `json:"checkpoint_namespace,omitempty"`
+	DecompressSources   bool              `json:"decompress_sources,omitempty"`
+	UploadProgress      bool              `json:"upload_progress,omitempty"`
+	Variables           map[string]string `json:"variables,omitempty"`
+	TarBlockSize        int               `json:"tar_block_size,omitempty"`
+	OutputNames         map[string]string `json:"output_names,omitempty"`
+	BuildID             string            `json:"build_id,omitempty"`
+}
+
+// nextEntry returns the next tar entry, PAX headers carry only
+// metadata (e.g. the record size) and are skipped
+func nextEntry(atar *tar.Reader) (*tar.Header, error) {
+	for {
+		hdr, err := atar.Next()
+		if err != nil {
+			return nil, err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeXGlobalHeader, tar.TypeXHeader:
+			continue
+		}
+		return hdr, nil
+	}
 }
 
 func mustRead(atar *tar.Reader, name string) error {
-	hdr, err := atar.Next()
+	hdr, err := nextEntry(atar)
 	if err != nil {
-		return fmt.Errorf("cannot read tar %v: %v", name, err)
+		return fmt.Errorf("cannot read tar %v: %w", name, err)
 	}
 	if hdr.Name != name {
 		return fmt.Errorf("expected tar %v, got %v", name, hdr.Name)
@@ -115,41 +623,134 @@ func mustRead(atar *tar.Reader, name string) error {
 
 func handleControlJSON(atar *tar.Reader) (*controlJSON, error) {
 	if err := mustRead(atar, "control.json"); err != nil {
+		// not even a single tar entry was sent
+		if errors.Is(err, io.EOF) {
+			return nil, ErrEmptyUpload
+		}
 		return nil, err
 	}
 
+	// control.json is small, anything bigger is not a valid control
+	data, err := io.ReadAll(io.LimitReader(atar, maxControlJSONSize))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read control.json: %w", err)
+	}
+	// validate first, the schema errors are more precise than the
+	// decoding errors
+	if err := validateControlJSON(data); err != nil {
+		return nil, err
+	}
 	var control controlJSON
-	if err := json.NewDecoder(atar).Decode(&control); err != nil {
+	if err := json.Unmarshal(data, &control); err != nil {
 		return nil, err
 	}
 	return &control, nil
 }
 
-func createBuildDir(config *Config) (string, error) {
-	buildDirBase := config.BuildDirBase
-
+// createBuildDir creates the build dir, small requests of the given
+// size are built in the memory build dir if that is configured
+func createBuildDir(config *Config, size int64) (string, error) {
 	// we could create a per-build dir here but the goal is to
 	// only have a single build only so we don't bother
-	if err := os.MkdirAll(buildDirBase, 0700); err != nil {
+	buildDir := buildDirPath(config)
+	if err := os.MkdirAll(filepath.Dir(buildDir), 0700); err != nil {
 		return "", fmt.Errorf("cannot create build base dir: %v", err)
 	}
 
 	// ensure there is only a single build
-	buildDir := filepath.Join(buildDirBase, "build")
+	if useMemoryBuildDir(config, size) {
+		if err := createMemoryBuildDir(config, buildDir); err != nil {
+			return "", err
+		}
+		return buildDir, nil
+	}
 	if err := os.Mkdir(buildDir, 0700); err != nil {
 		if os.IsExist(err) {
 			return "", ErrAlreadyBuilding
 		}
 		return "", err
 	}
+	setupBuildQuota(config, buildDir)
 
 	return buildDir, nil
 }
 
-func handleManifestJSON(atar *tar.Reader, buildDir string) error {
-	if err := mustRead(atar, "manifest.json"); err != nil {
+func useMemoryBuildDir(config *Config, size int64) bool {
+	// the size is unknown for chunked requests
+	return config.MemoryBuildDir != "" && size > 0 && size <= config.MemoryBuildMaxSize
+}
+
+// createMemoryBuildDir creates the build in the (tmpfs) memory build
+// dir, the build dir is a symlink to it so that it is still the lock
+func createMemoryBuildDir(config *Config, buildDir string) error {
+	memDir, err := os.MkdirTemp(config.MemoryBuildDir, memoryBuildDirPrefix(config))
+	if err != nil {
+		return fmt.Errorf("cannot create memory build dir: %v", err)
+	}
+	if err := os.Symlink(memDir, buildDir); err != nil {
+		os.RemoveAll(memDir)
+		if os.IsExist(err) {
+			return ErrAlreadyBuilding
+		}
 		return err
 	}
+	return nil
+}
+
+// removeBuildDir removes the build dir and, for builds in memory, the
+// dir it points to
+func removeBuildDir(buildDir string) error {
+	if hasQuotaFS(buildDir) {
+		if err := unmountQuotaImage(buildDir); err != nil {
+			return err
+		}
+	}
+	if target, err := os.Readlink(buildDir); err == nil {
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(buildDir)
+}
+
+// readManifest reads a manifest tar entry that must fit into memory
+func readManifest(r io.Reader, name string) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxManifestSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read body: %w", err)
+	}
+	if int64(len(data)) > maxManifestSize {
+		return nil, fmt.Errorf("%w: %v exceeds %v bytes", ErrManifestTooLarge, name, maxManifestSize)
+	}
+	return data, nil
+}
+
+// jsonEscapeVariables escapes the template variables for the use in
+// JSON strings so that a value cannot add to the manifest structure
+func jsonEscapeVariables(variables map[string]string) (map[string]string, error) {
+	escaped := make(map[string]string, len(variables))
+	for key, value := range variables {
+		quoted, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		escaped[key] = string(quoted[1 : len(quoted)-1])
+	}
+	return escaped, nil
+}
+
+// handleManifestJSON writes the manifest.json for osbuild, the
+// manifest can also be sent as manifest.yaml and is converted then
+// or as manifest.json.tmpl that is rendered with the control.json
+// variables
+func handleManifestJSON(atar *tar.Reader, buildDir string, variables map[string]string, progress *uploadProgress) error {
+	hdr, err := nextEntry(atar)
+	if err != nil {
+		return fmt.Errorf("cannot read tar manifest.json: %w", err)
+	}
+	if hdr.Name != "manifest.json" && hdr.Name != "manifest.yaml" && hdr.Name != "manifest.json.tmpl" {
+		return fmt.Errorf("expected tar manifest.json, got %v", hdr.Name)
+	}
 	manifestJSONPath := filepath.Join(buildDir, "manifest.json")
 
 	f, err := os.Create(manifestJSONPath)
@@ -158,25 +759,170 @@ func handleManifestJSON(atar *tar.Reader, buildDir string) error {
 	}
 	defer f.Close()
 
-	if _, err := io.Copy(f, atar); err != nil {
-		return fmt.Errorf("cannot read body: %v", err)
+	switch hdr.Name {
+	case "manifest.json.tmpl":
+		data, err := readManifest(atar, hdr.Name)
+		if err != nil {
+			return err
+		}
+		// referencing a variable that is not set is an error, an
+		// empty string in the manifest is never what was intended
+		tmpl, err := template.New("manifest.json.tmpl").Option("missingkey=error").Parse(string(data))
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrManifestTemplate, err)
+		}
+		escaped, err := jsonEscapeVariables(variables)
+		if err != nil {
+			return err
+		}
+		if err := tmpl.Execute(f, escaped); err != nil {
+			return fmt.Errorf("%w: %v", ErrManifestTemplate, err)
+		}
+	case "manifest.yaml":
+		data, err := readManifest(atar, hdr.Name)
+		if err != nil {
+			return err
+		}
+		// the key order is lost here but that does not matter for
+		// osbuild
+		data, err = yaml.YAMLToJSON(data)
+		if err != nil {
+			return fmt.Errorf("cannot convert manifest.yaml: %v", err)
+		}
+		if _, err := f.Write(data); err != nil {
+			return fmt.Errorf("cannot write manifest.json: %v", err)
+		}
+	default:
+		// anything over the limit is rejected by the validation
+		if _, err := io.Copy(f, io.LimitReader(atar, maxManifestSize+1)); err != nil {
+			return fmt.Errorf("cannot read body: %w", err)
+		}
 	}
 
 	if err := f.Close(); err != nil {
 		return err
 	}
+	if err := validateManifestJSON(manifestJSONPath); err != nil {
+		return err
+	}
+	progress.uploaded()
+
+	return nil
+}
+
+// validateManifestJSON checks the syntax of the manifest so that
+// clients get the position of the error instead of an osbuild failure
+func validateManifestJSON(manifestJSONPath string) error {
+	f, err := os.Open(manifestJSONPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := readManifest(f, "manifest.json")
+	if err != nil {
+		return err
+	}
+	var raw json.RawMessage
+	err = json.Unmarshal(data, &raw)
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		line, col := lineColumn(data, syntaxErr.Offset)
+		return fmt.Errorf("%w: line %v, column %v (offset %v): %v", ErrInvalidManifest, line, col, syntaxErr.Offset, syntaxErr)
+	}
+	return err
+}
+
+// checkManifestVersion rejects manifests that the osbuild of this
+// node cannot build, manifests without a version are version 1
+func checkManifestVersion(config *Config, manifestJSONPath string) error {
+	if len(config.SupportedManifestVersions) == 0 {
+		return nil
+	}
+	data, err := os.ReadFile(manifestJSONPath)
+	if err != nil {
+		return err
+	}
+	var manifest struct {
+		Version interface{} `json:"version"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("cannot decode manifest version: %v", err)
+	}
+	version := "1"
+	if manifest.Version != nil {
+		version = fmt.Sprint(manifest.Version)
+	}
+	if !slices.Contains(config.SupportedManifestVersions, version) {
+		return fmt.Errorf("%w %q, supported are %v", ErrManifestVersion, version, config.SupportedManifestVersions)
+	}
+	return nil
+}
 
+// lineColumn converts the offset of a json.SyntaxError (the number of
+// bytes read including the bad one) to a 1-based line and column
+func lineColumn(data []byte, offset int64) (line, col int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line = 1 + bytes.Count(before, []byte("\n"))
+	col = len(before) - bytes.LastIndexByte(before, '\n') - 1
+	return line, col
+}
+
+func handleBuildEnv(config *Config, atar *tar.Reader, buildDir string) error {
+	envs, err := parseEnvFile(atar)
+	if err != nil {
+		return fmt.Errorf("invalid build.env: %v", err)
+	}
+	if err := validateEnvironmentValues(config.EnvValuePatterns, envs); err != nil {
+		return fmt.Errorf("invalid build.env: %v", err)
+	}
+	content := strings.Join(envs, "\n") + "\n"
+	return os.WriteFile(filepath.Join(buildDir, "build.env"), []byte(content), 0600)
+}
+
+func handleIncludedSources(config *Config, atar *tar.Reader, buildDir string, progress *uploadProgress) error {
+	if err := extractSources(config, atar, buildDir, progress, sourceSizes{}, sourceTypeSizes{}, false); err != nil {
+		return err
+	}
+	progress.extractDone()
 	return nil
 }
 
-func handleIncludedSources(atar *tar.Reader, buildDir string) error {
+// extractSources extracts the store/ entries, a nested sources.tar
+// must only contain store/ entries
+func extractSources(config *Config, atar *tar.Reader, buildDir string, progress *uploadProgress, sizes sourceSizes, typeSizes sourceTypeSizes, nested bool) error {
 	for {
-		hdr, err := atar.Next()
+		hdr, err := nextEntry(atar)
 		if err == io.EOF {
 			return nil
 		}
 		if err != nil {
-			return fmt.Errorf("cannot read from tar %v", err)
+			return fmt.Errorf("cannot read from tar %w", err)
+		}
+
+		if !nested {
+			switch hdr.Name {
+			case "manifest.json", "manifest.yaml", "manifest.json.tmpl":
+				return ErrMultipleManifests
+			case "build.env":
+				if err := handleBuildEnv(config, atar, buildDir); err != nil {
+					return err
+				}
+				continue
+			case "sources.tar":
+				if err := extractSources(config, tar.NewReader(atar), buildDir, progress, sizes, typeSizes, true); err != nil {
+					return fmt.Errorf("sources.tar: %w", err)
+				}
+				continue
+			}
+			if slices.Contains(config.TrailingEntries, hdr.Name) {
+				if err := handleTrailingEntry(atar, hdr, buildDir); err != nil {
+					return err
+				}
+				continue
+			}
 		}
 
 		// ensure we only allow "store/" things
@@ -186,25 +932,58 @@ func handleIncludedSources(atar *tar.Reader, buildDir string) error {
 		if !strings.HasPrefix(hdr.Name, "store/") {
 			return fmt.Errorf("expected store/ prefix, got %v", hdr.Name)
 		}
+		if depth := len(strings.Split(filepath.Clean(hdr.Name), "/")); config.MaxPathDepth > 0 && depth > config.MaxPathDepth {
+			return fmt.Errorf("%w: %v has depth %v, maximum is %v", ErrPathTooDeep, hdr.Name, depth, config.MaxPathDepth)
+		}
 
-		// this assume "well" behaving tars, i.e. all dirs that lead
-		// up to the tar are included etc
+		if err := validateSourceEntry(hdr); err != nil {
+			return err
+		}
+		if hdr.Name == sourceSizesName && hdr.Typeflag == tar.TypeReg {
+			if err := sizes.read(atar); err != nil {
+				return err
+			}
+			progress.setExtractTotal(sizes.total())
+			continue
+		}
+
+		// tars do not always have the dirs before their content so
+		// missing parents are created, a later dir entry then only
+		// sets the mode
 		target := filepath.Join(buildDir, hdr.Name)
 		mode := os.FileMode(hdr.Mode)
 		switch hdr.Typeflag {
 		case tar.TypeDir:
-			if err := os.Mkdir(target, mode); err != nil {
+			if err := mkdirStoreParents(buildDir, hdr.Name); err != nil {
+				return fmt.Errorf("unpack: %w", err)
+			}
+			err := mkdirSource(buildDir, hdr.Name, mode)
+			if os.IsExist(err) {
+				err = chmodExistingDir(target, mode)
+			}
+			if err != nil {
 				return fmt.Errorf("unpack: %w", err)
 			}
 		case tar.TypeReg:
-			f, err := os.OpenFile(target, os.O_RDWR|os.O_CREATE, mode)
+			if err := sizes.check(hdr.Name, hdr.Size); err != nil {
+				return err
+			}
+			if err := typeSizes.add(config, hdr.Name, hdr.Size); err != nil {
+				return err
+			}
+			if err := mkdirStoreParents(buildDir, hdr.Name); err != nil {
+				return fmt.Errorf("unpack: %w", err)
+			}
+			progress.extracting(hdr.Name)
+			f, err := createSourceFile(buildDir, hdr.Name, mode)
 			if err != nil {
 				return fmt.Errorf("unpack: %w", err)
 			}
 			defer f.Close()
-			if _, err := io.Copy(f, atar); err != nil {
+			if _, err := io.Copy(&extractWriter{w: f, progress: progress}, atar); err != nil {
 				return fmt.Errorf("unpack: %w", err)
 			}
+			progress.uploaded()
 			if err := f.Close(); err != nil {
 				return fmt.Errorf("unpack: %w", err)
 			}
@@ -217,18 +996,101 @@ func handleIncludedSources(atar *tar.Reader, buildDir string) error {
 	}
 }
 
+// mkdirStoreParents creates the missing parent dirs of the given
+// store/ entry, nothing outside of store/ is ever created
+func mkdirStoreParents(buildDir, name string) error {
+	parent := filepath.Dir(filepath.Clean(name))
+	if parent != "store" && !strings.HasPrefix(parent, "store/") {
+		return nil
+	}
+	parts := strings.Split(parent, "/")
+	for i := range parts {
+		err := mkdirSource(buildDir, strings.Join(parts[:i+1], "/"), 0755)
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func chmodExistingDir(target string, mode os.FileMode) error {
+	st, err := os.Lstat(target)
+	if err != nil {
+		return err
+	}
+	if !st.IsDir() {
+		return fmt.Errorf("cannot create dir %v: exists and is not a dir", target)
+	}
+	return os.Chmod(target, mode.Perm())
+}
+
+func expectsContinue(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Expect"), "100-continue")
+}
+
+// buildInProgress checks the build lock without taking it
+func buildInProgress(config *Config) bool {
+	_, err := os.Lstat(buildDirPath(config))
+	return err == nil
+}
+
+// startResponse sends the http headers of a started build
+func startResponse(w http.ResponseWriter, config *Config, buildDir, buildID string) {
+	w.Header().Set("X-Build-Id", buildID)
+	if config.ExposeBuildDir {
+		if absBuildDir, err := filepath.Abs(buildDir); err == nil {
+			w.Header().Set("X-Build-Dir", absBuildDir)
+		}
+	}
+	// the stage stats are only known once the build is done
+	w.Header().Set("Trailer", "Osbuild-Cached-Stages, Osbuild-Built-Stages, Osbuild-Failure-Class")
+	w.WriteHeader(http.StatusCreated)
+}
+
 // test for real via:
 // curl -o - --data-binary "@./test.tar" -H "Content-Type: application/x-tar"  -X POST http://localhost:8001/api/v1/build
 func handleBuild(logger *logrus.Logger, config *Config) http.Handler {
+	clients := newClientLimiter(config.MaxBuildsPerClient)
+	builds := newBuildTracker()
+
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
 			logger.Debugf("handlerBuild called on %s", r.URL.Path)
 			defer r.Body.Close()
 
+			// HEAD lets clients check the build lock before
+			// uploading a big request
+			if r.Method == http.MethodHead {
+				switch {
+				case inMaintenance(config), !osbuildVerified(config):
+					w.WriteHeader(http.StatusServiceUnavailable)
+				case buildInProgress(config):
+					w.WriteHeader(http.StatusConflict)
+				default:
+					w.WriteHeader(http.StatusOK)
+				}
+				return
+			}
 			if r.Method != http.MethodPost {
 				http.Error(w, "build endpoint only supports POST", http.StatusMethodNotAllowed)
 				return
 			}
+			if inMaintenance(config) {
+				http.Error(w, "maintenance", http.StatusServiceUnavailable)
+				return
+			}
+			if !osbuildVerified(config) {
+				http.Error(w, ErrOsbuildChecksumMismatch.Error(), http.StatusServiceUnavailable)
+				return
+			}
+
+			client := clientID(r)
+			if !clients.Acquire(client) {
+				logger.Errorf("too many builds for client %v", client)
+				http.Error(w, "too many builds for client", http.StatusTooManyRequests)
+				return
+			}
+			defer clients.Release(client)
 
 			contentType := r.Header.Get("Content-Type")
 			if !slices.Contains(supportedBuildContentTypes, contentType) {
@@ -236,49 +1098,345 @@ func handleBuild(logger *logrus.Logger, config *Config) http.Handler {
 				return
 			}
 
+			// the body is only requested from clients that wait
+			// for "100 Continue" once it is read, so reject
+			// requests early that will fail anyway
+			if expectsContinue(r) && r.URL.Query().Get("replace") != "true" && buildInProgress(config) {
+				http.Error(w, "build already started", http.StatusConflict)
+				return
+			}
+
 			// control.json passes the build parameters
-			atar := tar.NewReader(r.Body)
+			body := newIdleTimeoutReader(w, r.Body, config.ReadTimeout)
+			upload, zbody, err := decodeRequestBody(config, body, r.Header.Get("Content-Encoding"))
+			if err != nil {
+				logger.Error(err)
+				switch {
+				case body.TimedOut():
+					http.Error(w, "timeout reading request", http.StatusRequestTimeout)
+				case errors.Is(err, ErrUnsupportedContentEncoding):
+					http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+				default:
+					http.Error(w, err.Error(), http.StatusBadRequest)
+				}
+				return
+			}
+			if config.PrescanUpload {
+				spill, err := prescanUpload(config, upload)
+				if err != nil {
+					logger.Error(err)
+					switch {
+					case body.TimedOut():
+						http.Error(w, "timeout reading request", http.StatusRequestTimeout)
+					case zbody.Err() != nil:
+						http.Error(w, zbody.Err().Error(), http.StatusRequestEntityTooLarge)
+					case errors.Is(err, ErrEmptyUpload):
+						http.Error(w, "empty upload", http.StatusBadRequest)
+					case errors.Is(err, io.ErrUnexpectedEOF):
+						http.Error(w, "truncated archive", http.StatusBadRequest)
+					case errors.Is(err, ErrInvalidUpload) || errors.Is(err, ErrMultipleManifests):
+						http.Error(w, err.Error(), http.StatusBadRequest)
+					default:
+						http.Error(w, "cannot read upload", http.StatusInternalServerError)
+					}
+					return
+				}
+				defer spill.Close()
+				upload = spill
+			}
+			counter := &countingReader{r: upload}
+			atar := tar.NewReader(counter)
 			control, err := handleControlJSON(atar)
 			if err != nil {
 				logger.Error(err)
+				if body.TimedOut() {
+					http.Error(w, "timeout reading request", http.StatusRequestTimeout)
+					return
+				}
+				if zbody.Err() != nil {
+					http.Error(w, zbody.Err().Error(), http.StatusRequestEntityTooLarge)
+					return
+				}
+				if errors.Is(err, ErrEmptyUpload) {
+					http.Error(w, "empty upload", http.StatusBadRequest)
+					return
+				}
+				if errors.Is(err, io.ErrUnexpectedEOF) {
+					http.Error(w, "truncated archive", http.StatusBadRequest)
+					return
+				}
+				var serr *schemaError
+				if errors.As(err, &serr) {
+					http.Error(w, fmt.Sprintf("invalid control.json: %v", serr), http.StatusBadRequest)
+					return
+				}
 				http.Error(w, "cannot decode control.json", http.StatusBadRequest)
 				return
 			}
+			if err := validateEnvironments(control.Environments); err != nil {
+				logger.Error(err)
+				http.Error(w, fmt.Sprintf("invalid environments: %v", err), http.StatusBadRequest)
+				return
+			}
+			if err := validateEnvironmentValues(config.EnvValuePatterns, control.Environments); err != nil {
+				logger.Error(err)
+				http.Error(w, fmt.Sprintf("invalid environments: %v", err), http.StatusBadRequest)
+				return
+			}
+			if err := applyDefaultExports(config, control); err != nil {
+				logger.Error(err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := checkMaxExports(config, control); err != nil {
+				logger.Error(err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := checkAllowedExports(config, control); err != nil {
+				logger.Error(err)
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			if err := checkOutputDirect(config, control); err != nil {
+				logger.Error(err)
+				status := http.StatusBadRequest
+				if errors.Is(err, ErrOutputNotAllowed) {
+					status = http.StatusForbidden
+				}
+				http.Error(w, err.Error(), status)
+				return
+			}
+			if err := validateCheckpointNamespace(config, control); err != nil {
+				logger.Error(err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := validateTarBlockSize(control); err != nil {
+				logger.Error(err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := validateOutputNames(control); err != nil {
+				logger.Error(err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := applyBuildID(config, control); err != nil {
+				logger.Error(err)
+				status := http.StatusBadRequest
+				if errors.Is(err, ErrDuplicateBuildID) {
+					status = http.StatusConflict
+				}
+				http.Error(w, err.Error(), status)
+				return
+			}
+			if _, err := osbuildBinaryFor(config, control); err != nil {
+				logger.Error(err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if control.ResultUpload != nil {
+				if err := validateResultUpload(config, control.ResultUpload); err != nil {
+					logger.Error(err)
+					status := http.StatusBadRequest
+					if errors.Is(err, ErrUploadHostNotAllowed) {
+						status = http.StatusForbidden
+					}
+					http.Error(w, fmt.Sprintf("result upload: %v", err), status)
+					return
+				}
+			}
 
-			buildDir, err := createBuildDir(config)
+			replace := r.URL.Query().Get("replace") == "true"
+			buildDir, build, err := builds.Acquire(config, r.ContentLength, replace)
 			if err != nil {
 				logger.Error(err)
-				if err == ErrAlreadyBuilding {
+				switch err {
+				case ErrAlreadyBuilding:
 					http.Error(w, "build already started", http.StatusConflict)
-				} else {
+				case ErrReplaceTimeout:
+					http.Error(w, err.Error(), http.StatusConflict)
+				default:
 					http.Error(w, "create build dir", http.StatusBadRequest)
 				}
 				return
 			}
+			defer builds.Release(build)
+			// the build dir is the build lock, so it must be removed
+			// again if the build never starts
+			buildStarted := false
+			defer func() {
+				if buildStarted {
+					return
+				}
+				if err := removeBuildDir(buildDir); err != nil {
+					logger.Errorf("cannot remove build dir: %v", err)
+				}
+			}()
+			if err := writeBuildControl(buildDir, control); err != nil {
+				logger.Error(err)
+				http.Error(w, "cannot write control.json", http.StatusInternalServerError)
+				return
+			}
+
+			var progress *uploadProgress
+			if control.UploadProgress {
+				progress, err = newUploadProgress(w, counter)
+				if err != nil {
+					logger.Error(err)
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				startResponse(w, config, buildDir, control.BuildID)
+			}
+			// once the upload progress is streamed the status is
+			// already sent and errors can only be reported inline
+			fail := func(msg string, status int) {
+				if progress != nil {
+					progress.fail(msg)
+					return
+				}
+				http.Error(w, msg, status)
+			}
 
 			// manifest.json is the osbuild input
-			if err := handleManifestJSON(atar, buildDir); err != nil {
+			if err := handleManifestJSON(atar, buildDir, control.Variables, progress); err != nil {
 				logger.Error(err)
-				http.Error(w, "manifest.json", http.StatusBadRequest)
+				if body.TimedOut() {
+					fail("timeout reading request", http.StatusRequestTimeout)
+					return
+				}
+				if zbody.Err() != nil {
+					fail(zbody.Err().Error(), http.StatusRequestEntityTooLarge)
+					return
+				}
+				if errors.Is(err, io.ErrUnexpectedEOF) {
+					fail("truncated archive", http.StatusBadRequest)
+					return
+				}
+				if errors.Is(err, ErrManifestTemplate) || errors.Is(err, ErrInvalidManifest) {
+					fail(err.Error(), http.StatusBadRequest)
+					return
+				}
+				if errors.Is(err, ErrManifestTooLarge) {
+					fail(err.Error(), http.StatusRequestEntityTooLarge)
+					return
+				}
+				fail("manifest.json", http.StatusBadRequest)
+				return
+			}
+			if err := checkManifestVersion(config, filepath.Join(buildDir, "manifest.json")); err != nil {
+				logger.Error(err)
+				fail(err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := checkManifestStages(config, filepath.Join(buildDir, "manifest.json")); err != nil {
+				logger.Error(err)
+				status := http.StatusBadRequest
+				if errors.Is(err, ErrStageNotAllowed) {
+					status = http.StatusForbidden
+				}
+				fail(err.Error(), status)
+				return
+			}
+			if err := checkManifestSources(config, filepath.Join(buildDir, "manifest.json")); err != nil {
+				logger.Error(err)
+				status := http.StatusBadRequest
+				if errors.Is(err, ErrSourceHostNotAllowed) {
+					status = http.StatusForbidden
+				}
+				fail(err.Error(), status)
 				return
 			}
 			// extract ".osbuild/sources" here too from the tar
-			if err := handleIncludedSources(atar, buildDir); err != nil {
+			extractStart := time.Now()
+			if err := handleIncludedSources(config, atar, buildDir, progress); err != nil {
+				logger.Error(err)
+				if body.TimedOut() {
+					fail("timeout reading request", http.StatusRequestTimeout)
+					return
+				}
+				if zbody.Err() != nil {
+					fail(zbody.Err().Error(), http.StatusRequestEntityTooLarge)
+					return
+				}
+				if errors.Is(err, io.ErrUnexpectedEOF) {
+					fail("truncated archive", http.StatusBadRequest)
+					return
+				}
+				if errors.Is(err, ErrSourceTypeTooLarge) {
+					fail(err.Error(), http.StatusRequestEntityTooLarge)
+					return
+				}
+				if errors.Is(err, ErrMultipleManifests) || errors.Is(err, ErrPathTooDeep) || errors.Is(err, ErrSizeMismatch) || errors.Is(err, ErrUnknownSourceType) || errors.Is(err, ErrInvalidSource) || errors.Is(err, ErrInvalidTrailingEntry) {
+					fail(err.Error(), http.StatusBadRequest)
+					return
+				}
+				fail("included sources/", http.StatusBadRequest)
+				return
+			}
+			extractDuration.ObserveSince(extractStart)
+			if control.DecompressSources {
+				if err := decompressSources(buildDir, config.MaxDecompressRatio); err != nil {
+					logger.Error(err)
+					fail(err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			if err := applySourceDeltas(config, buildDir); err != nil {
 				logger.Error(err)
-				http.Error(w, "included sources/", http.StatusBadRequest)
+				fail(err.Error(), http.StatusBadRequest)
 				return
 			}
+			var sourcesWarning string
+			switch err := checkMissingSources(config, buildDir); {
+			case err == nil:
+			case errors.Is(err, ErrMissingSources) && config.MissingSources == missingSourcesWarn:
+				logger.Warn(err)
+				sourcesWarning = err.Error()
+			default:
+				logger.Error(err)
+				fail(err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := materializeInlineSources(buildDir); err != nil {
+				logger.Error(err)
+				fail(err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := body.Done(); err != nil {
+				logger.Errorf("cannot reset read deadline: %v", err)
+			}
+
+			info := &buildInfo{Started: time.Now().UTC(), Exports: control.Exports, BuildID: control.BuildID}
+			if err := writeBuildInfo(buildDir, info); err != nil {
+				logger.Errorf("cannot write build info: %v", err)
+			}
 
-			w.WriteHeader(http.StatusCreated)
+			buildStarted = true
+			logger.Infof("build %v started", control.BuildID)
+			if progress == nil {
+				startResponse(w, config, buildDir, control.BuildID)
+			}
 
 			// run osbuild and stream the output to the client
 			buildResult := newBuildResult(config)
-			_, err = runOsbuild(buildDir, control, w)
-			if werr := buildResult.Mark(err); werr != nil {
+			var summary buildSummary
+			_, err = runOsbuild(build.ctx, config, buildDir, control, w, &summary)
+			if sourcesWarning != "" {
+				summary.Warnings = append([]string{sourcesWarning}, summary.Warnings...)
+			}
+			w.Header().Set("Osbuild-Cached-Stages", strconv.Itoa(summary.CachedStages))
+			w.Header().Set("Osbuild-Built-Stages", strconv.Itoa(summary.BuiltStages))
+			if summary.FailureClass != "" {
+				w.Header().Set("Osbuild-Failure-Class", summary.FailureClass)
+			}
+			if werr := buildResult.Mark(err, &summary); werr != nil {
 				logger.Errorf("cannot write result file %v", werr)
 			}
 			if err != nil {
-				logger.Errorf("canot run osbuild: %v", err)
+				logger.Errorf("canot run osbuild for build %v: %v", control.BuildID, err)
 				return
 			}
 		},
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+const redactedValue = "<redacted>"
+
+// writeBuildControl keeps the control.json of the build in the build
+// dir so that it can be inspected while the build runs
+func writeBuildControl(buildDir string, control *controlJSON) error {
+	data, err := json.Marshal(control)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(buildDir, "control.json"), data, 0600)
+}
+
+func readBuildControl(buildDir string) (*controlJSON, error) {
+	data, err := os.ReadFile(filepath.Join(buildDir, "control.json"))
+	if err != nil {
+		return nil, err
+	}
+	var control controlJSON
+	if err := json.Unmarshal(data, &control); err != nil {
+		return nil, err
+	}
+	return &control, nil
+}
+
+// redactEnvironments keeps only the keys, the values may contain
+// secrets (e.g. proxy credentials)
+func redactEnvironments(envs []string) []string {
+	redacted := make([]string, 0, len(envs))
+	for _, env := range envs {
+		redacted = append(redacted, envKey(env)+"="+redactedValue)
+	}
+	return redacted
+}
+
+func handleBuildControl(logger *logrus.Logger, config *Config) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			logger.Debugf("handleBuildControl called on %s", r.URL.Path)
+			if r.Method != http.MethodGet {
+				http.Error(w, "build control endpoint only supports GET", http.StatusMethodNotAllowed)
+				return
+			}
+			control, err := readBuildControl(buildDirPath(config))
+			if os.IsNotExist(err) {
+				http.Error(w, "no build", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				logger.Errorf("cannot read build control: %v", err)
+				http.Error(w, "cannot read build control", http.StatusInternalServerError)
+				return
+			}
+			control.Environments = redactEnvironments(control.Environments)
+
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(control); err != nil {
+				logger.Errorf("cannot write build control: %v", err)
+			}
+		},
+	)
+}
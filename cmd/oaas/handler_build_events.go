@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// sseWriter writes server-sent events, every event is flushed so
+// that clients see it right away
+type sseWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (sw *sseWriter) Event(event, data string) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "event: %s\n", event)
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(&buf, "data: %s\n", line)
+	}
+	buf.WriteString("\n")
+	if _, err := sw.w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	sw.flusher.Flush()
+	return nil
+}
+
+// sseLogWriter sends every complete line written to it as a "log"
+// event
+type sseLogWriter struct {
+	sse     *sseWriter
+	partial []byte
+}
+
+func (lw *sseLogWriter) Write(p []byte) (int, error) {
+	lw.partial = append(lw.partial, p...)
+	for {
+		idx := bytes.IndexByte(lw.partial, '\n')
+		if idx < 0 {
+			return len(p), nil
+		}
+		if err := lw.sse.Event("log", string(lw.partial[:idx])); err != nil {
+			return 0, err
+		}
+		lw.partial = lw.partial[idx+1:]
+	}
+}
+
+// Flush sends the last line of a log that does not end with a
+// newline
+func (lw *sseLogWriter) Flush() error {
+	if len(lw.partial) == 0 {
+		return nil
+	}
+	err := lw.sse.Event("log", string(lw.partial))
+	lw.partial = nil
+	return err
+}
+
+type buildResultEvent struct {
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
+// waitBuildStarted waits until the upload of the build is done, nil
+// is returned if the client went away
+func waitBuildStarted(stop <-chan struct{}, buildDir string) (*buildInfo, error) {
+	for {
+		info, err := readBuildInfo(buildDir)
+		if err == nil {
+			return info, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		if !fileExists(buildDir) {
+			return nil, fmt.Errorf("build went away")
+		}
+		select {
+		case <-stop:
+			return nil, nil
+		case <-time.After(attachPollInterval):
+		}
+	}
+}
+
+// streamBuildEvents sends "started", one "log" event per line of the
+// build log and a final "result", there are no "position" events as
+// builds are never queued
+func streamBuildEvents(stop <-chan struct{}, buildDir string, sse *sseWriter) error {
+	info, err := waitBuildStarted(stop, buildDir)
+	if err != nil || info == nil {
+		return err
+	}
+	if err := sse.Event("started", info.Started.Format(time.RFC3339)); err != nil {
+		return err
+	}
+
+	br := &buildResult{resultJSON: filepath.Join(buildDir, "result.json")}
+	done := func() bool {
+		return fileExists(br.resultJSON)
+	}
+	lw := &sseLogWriter{sse: sse}
+	if err := followLog(stop, buildDir, done, lw); err != nil {
+		return err
+	}
+	if err := lw.Flush(); err != nil {
+		return err
+	}
+	summary, err := br.Summary()
+	if err != nil {
+		// the client went away before the build finished
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	result := buildResultEvent{State: "succeeded"}
+	if summary.Error != "" {
+		result = buildResultEvent{State: "failed", Error: summary.Error}
+	}
+	data, err := json.Marshal(&result)
+	if err != nil {
+		return err
+	}
+	return sse.Event("result", string(data))
+}
+
+// handleBuildEvents streams the events of the build with the given
+// build id (the "X-Build-Id" header of the build) at "<id>/events",
+// the build is not affected when the client goes away
+func handleBuildEvents(logger *logrus.Logger, config *Config) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			logger.Debugf("handleBuildEvents called on %s", r.URL.Path)
+			id, rest, _ := strings.Cut(r.URL.Path, "/")
+			if rest != "events" || !buildIDRegexp.MatchString(id) {
+				http.NotFound(w, r)
+				return
+			}
+			if r.Method != http.MethodGet {
+				http.Error(w, "build events endpoint only supports GET", http.StatusMethodNotAllowed)
+				return
+			}
+			buildDir, err := findBuildDir(config, id)
+			if err != nil {
+				logger.Errorf("cannot find build %v: %v", id, err)
+				http.Error(w, "cannot find build", http.StatusInternalServerError)
+				return
+			}
+			if buildDir == "" {
+				http.Error(w, "no build", http.StatusNotFound)
+				return
+			}
+			flusher, ok := w.(http.Flusher)
+			if !ok {
+				http.Error(w, "cannot stream the events", http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusOK)
+			flusher.Flush()
+			sse := &sseWriter{w: w, flusher: flusher}
+			if err := streamBuildEvents(r.Context().Done(), buildDir, sse); err != nil {
+				logger.Errorf("cannot stream build events: %v", err)
+			}
+		},
+	)
+}
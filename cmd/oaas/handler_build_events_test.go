@@ -0,0 +1,107 @@
+package main_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+// readEvent reads a single server-sent event
+func readEvent(t *testing.T, r *bufio.Reader) (string, string) {
+	var event string
+	var data []string
+	for {
+		line, err := r.ReadString('\n')
+		assert.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			return event, strings.Join(data, "\n")
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		}
+	}
+}
+
+func TestBuildEventsNoBuild(t *testing.T) {
+	baseURL, _, _ := runTestServer(t)
+
+	for _, path := range []string{"build/events", ".build/events", "build/other", "0b7d5f3e-2a4c-4e1f-9c3b-6d8e2f1a4b5c/events"} {
+		rsp, err := http.Get(baseURL + "api/v1/build/" + path)
+		assert.NoError(t, err)
+		defer rsp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, rsp.StatusCode, path)
+	}
+}
+
+func TestBuildEventsSequence(t *testing.T) {
+	restore := main.MockAttachPollInterval(10 * time.Millisecond)
+	defer restore()
+
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	flag := filepath.Join(t.TempDir(), "continue")
+	restore = main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+echo "first"
+while [ ! -e %[2]s ]; do sleep 0.01; done
+echo "second"
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir, flag))
+	defer restore()
+
+	buildDone := make(chan struct{})
+	buildID := make(chan string, 1)
+	go func() {
+		defer close(buildDone)
+		buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+		rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+		assert.NoError(t, err)
+		defer rsp.Body.Close()
+		buildID <- rsp.Header.Get("X-Build-Id")
+		io.Copy(io.Discard, rsp.Body)
+	}()
+	assert.Eventually(t, func() bool {
+		data, err := ioutil.ReadFile(filepath.Join(baseBuildDir, "build/build.log"))
+		return err == nil && strings.Contains(string(data), "first")
+	}, defaultTimeout, 10*time.Millisecond)
+
+	// the events are found with the id that the client got
+	rsp, err := http.Get(baseURL + "api/v1/build/" + <-buildID + "/events")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Equal(t, "text/event-stream", rsp.Header.Get("Content-Type"))
+	r := bufio.NewReader(rsp.Body)
+
+	event, data := readEvent(t, r)
+	assert.Equal(t, "started", event)
+	_, err = time.Parse(time.RFC3339, data)
+	assert.NoError(t, err)
+	event, data = readEvent(t, r)
+	assert.Equal(t, "log", event)
+	assert.Equal(t, "first", data)
+
+	err = ioutil.WriteFile(flag, nil, 0644)
+	assert.NoError(t, err)
+	event, data = readEvent(t, r)
+	assert.Equal(t, "log", event)
+	assert.Equal(t, "second", data)
+	event, data = readEvent(t, r)
+	assert.Equal(t, "result", event)
+	assert.Equal(t, `{"state":"succeeded"}`, data)
+	rest, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "", string(rest))
+	<-buildDone
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// tailChunkSize is the size of the blocks that are read from the end
+// of the log when looking for the last lines
+const tailChunkSize = 64 * 1024
+
+// tailOffset returns the offset of the last n lines of the first size
+// bytes of r, the log is read backwards so that tailing a big log
+// does not need to scan all of it
+func tailOffset(r io.ReaderAt, size int64, n int) (int64, error) {
+	buf := make([]byte, tailChunkSize)
+	newlines := 0
+	for pos := size; pos > 0; {
+		chunk := min(int64(len(buf)), pos)
+		pos -= chunk
+		if _, err := r.ReadAt(buf[:chunk], pos); err != nil {
+			return 0, err
+		}
+		for i := chunk - 1; i >= 0; i-- {
+			// the final newline terminates the last line
+			if buf[i] != '\n' || pos+i == size-1 {
+				continue
+			}
+			newlines++
+			if newlines == n {
+				return pos + i + 1, nil
+			}
+		}
+	}
+	return 0, nil
+}
+
+// handleBuildLog serves the build.log, "?tail=N" limits it to the last
+// N lines
+func handleBuildLog(logger *logrus.Logger, config *Config) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			logger.Debugf("handleBuildLog called on %s", r.URL.Path)
+			if r.Method != http.MethodGet {
+				http.Error(w, "build log endpoint only supports GET", http.StatusMethodNotAllowed)
+				return
+			}
+			tail := 0
+			if s := r.URL.Query().Get("tail"); s != "" {
+				var err error
+				tail, err = strconv.Atoi(s)
+				if err != nil || tail < 1 {
+					http.Error(w, fmt.Sprintf("invalid tail %q, must be a positive number of lines", s), http.StatusBadRequest)
+					return
+				}
+			}
+			f, err := os.Open(filepath.Join(buildDirPath(config), "build.log"))
+			if os.IsNotExist(err) {
+				http.Error(w, "no build log", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				logger.Errorf("cannot open build log: %v", err)
+				http.Error(w, "cannot open build log", http.StatusInternalServerError)
+				return
+			}
+			defer f.Close()
+			// the log may still grow, only what is there now is served
+			st, err := f.Stat()
+			if err != nil {
+				logger.Errorf("cannot stat build log: %v", err)
+				http.Error(w, "cannot stat build log", http.StatusInternalServerError)
+				return
+			}
+			var start int64
+			if tail > 0 {
+				start, err = tailOffset(f, st.Size(), tail)
+				if err != nil {
+					logger.Errorf("cannot tail build log: %v", err)
+					http.Error(w, "cannot tail build log", http.StatusInternalServerError)
+					return
+				}
+			}
+
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("Content-Length", strconv.FormatInt(st.Size()-start, 10))
+			if _, err := io.Copy(w, io.NewSectionReader(f, start, st.Size()-start)); err != nil {
+				logger.Errorf("cannot write build log: %v", err)
+			}
+		},
+	)
+}
@@ -0,0 +1,71 @@
+package main_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeBuildLog(t *testing.T, buildBaseDir, content string) {
+	err := os.MkdirAll(filepath.Join(buildBaseDir, "build"), 0755)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(buildBaseDir, "build/build.log"), []byte(content), 0644)
+	assert.NoError(t, err)
+}
+
+func getBuildLog(t *testing.T, url string) (int, string) {
+	rsp, err := http.Get(url)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	return rsp.StatusCode, string(body)
+}
+
+func TestBuildLogNoBuild(t *testing.T) {
+	baseURL, _, _ := runTestServer(t)
+
+	status, _ := getBuildLog(t, baseURL+"api/v1/build/log")
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestBuildLogTail(t *testing.T) {
+	baseURL, buildBaseDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build/log"
+
+	// big enough to need multiple reads from the end
+	var lines []string
+	for i := 1; i <= 20000; i++ {
+		lines = append(lines, fmt.Sprintf("line %v", i))
+	}
+	log := strings.Join(lines, "\n") + "\n"
+	writeBuildLog(t, buildBaseDir, log)
+
+	status, body := getBuildLog(t, endpoint+"?tail=10")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, strings.Join(lines[len(lines)-10:], "\n")+"\n", body)
+
+	// the last line is unterminated while the build is running
+	writeBuildLog(t, buildBaseDir, "one\ntwo\nthree")
+	status, body = getBuildLog(t, endpoint+"?tail=2")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "two\nthree", body)
+
+	// asking for more lines than there are returns all
+	status, body = getBuildLog(t, endpoint+"?tail=10")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "one\ntwo\nthree", body)
+	status, body = getBuildLog(t, endpoint)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "one\ntwo\nthree", body)
+
+	status, body = getBuildLog(t, endpoint+"?tail=-1")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "invalid tail \"-1\", must be a positive number of lines\n", body)
+}
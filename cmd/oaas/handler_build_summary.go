@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// handleBuildSummary returns the result.json of the finished build
+func handleBuildSummary(logger *logrus.Logger, config *Config) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			logger.Debugf("handleBuildSummary called on %s", r.URL.Path)
+			if r.Method != http.MethodGet {
+				http.Error(w, "build summary endpoint only supports GET", http.StatusMethodNotAllowed)
+				return
+			}
+			summary, err := newBuildResult(config).Summary()
+			if os.IsNotExist(err) {
+				http.Error(w, "no build result", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				logger.Errorf("cannot read build summary: %v", err)
+				http.Error(w, "cannot read build summary", http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(summary); err != nil {
+				logger.Errorf("cannot write build summary: %v", err)
+			}
+		},
+	)
+}
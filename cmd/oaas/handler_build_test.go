@@ -4,15 +4,20 @@ import (
 	"archive/tar"
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	logrusTest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 
 	main "github.com/osbuild/oaas/cmd/oaas"
@@ -55,7 +60,17 @@ func TestBuildChecksContentType(t *testing.T) {
 	assert.Equal(t, string(body), "Content-Type must be [application/x-tar], got random/encoding\n")
 }
 
-func makeTestPost(t *testing.T, controlJSON, manifestJSON string) *bytes.Buffer {
+type tarEntry struct {
+	name, content string
+}
+
+func makeTestPost(t testing.TB, controlJSON, manifestJSON string) *bytes.Buffer {
+	return makeTestPostWithEntries(t, controlJSON, manifestJSON)
+}
+
+// makeTestPostWithEntries creates a test post with the extra entries
+// added after the default store entries
+func makeTestPostWithEntries(t testing.TB, controlJSON, manifestJSON string, entries ...tarEntry) *bytes.Buffer {
 	buf := bytes.NewBuffer(nil)
 	archive := tar.NewWriter(buf)
 	err := writeToTar(archive, "control.json", controlJSON)
@@ -77,6 +92,10 @@ func makeTestPost(t *testing.T, controlJSON, manifestJSON string) *bytes.Buffer
 	assert.NoError(t, err)
 	err = writeToTar(archive, "store/sources/org.osbuild.files/sha256:aabbcc5263b915d8a0776be5620575df2d478332ad35e8dd18def6a8c720f9c7", "other-data")
 	assert.NoError(t, err)
+	for _, entry := range entries {
+		err = writeToTar(archive, entry.name, entry.content)
+		assert.NoError(t, err)
+	}
 	return buf
 }
 
@@ -175,6 +194,127 @@ echo "fake-build-result" > %[1]s/build/output/image/disk.img
 	assert.Equal(t, loggerHook.LastEntry().Message, main.ErrAlreadyBuilding.Error())
 }
 
+func TestBuildConcurrentRequestsOnlyOneBuilds(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+	flag := filepath.Join(t.TempDir(), "continue")
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+while [ ! -e %[2]s ]; do sleep 0.01; done
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir, flag))
+	defer restore()
+
+	const n = 20
+	start := make(chan struct{})
+	statuses := make(chan int, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+			<-start
+			rsp, err := http.Post(endpoint, "application/x-tar", buf)
+			if !assert.NoError(t, err) {
+				statuses <- 0
+				return
+			}
+			defer rsp.Body.Close()
+			ioutil.ReadAll(rsp.Body)
+			statuses <- rsp.StatusCode
+		}()
+	}
+	close(start)
+
+	statusCount := make(map[int]int)
+	// the winner only finishes once all others got their answer
+	for i := 0; i < n-1; i++ {
+		statusCount[<-statuses]++
+	}
+	err := ioutil.WriteFile(flag, nil, 0644)
+	assert.NoError(t, err)
+	statusCount[<-statuses]++
+	assert.Equal(t, map[int]int{http.StatusCreated: 1, http.StatusConflict: n - 1}, statusCount)
+}
+
+func headBuild(t *testing.T, endpoint string) int {
+	rsp, err := http.Head(endpoint)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "", string(body))
+	return rsp.StatusCode
+}
+
+func TestBuildHeadReflectsBuildLock(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+	flag := filepath.Join(t.TempDir(), "continue")
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+while [ ! -e %[2]s ]; do sleep 0.01; done
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir, flag))
+	defer restore()
+
+	assert.Equal(t, http.StatusOK, headBuild(t, endpoint))
+
+	buildDone := make(chan struct{})
+	go func() {
+		defer close(buildDone)
+		buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+		rsp, err := http.Post(endpoint, "application/x-tar", buf)
+		assert.NoError(t, err)
+		defer rsp.Body.Close()
+		io.Copy(io.Discard, rsp.Body)
+	}()
+	assert.Eventually(t, func() bool {
+		return headBuild(t, endpoint) == http.StatusConflict
+	}, defaultTimeout, 10*time.Millisecond)
+
+	err := ioutil.WriteFile(flag, nil, 0644)
+	assert.NoError(t, err)
+	<-buildDone
+	// the build dir of the finished build is the lock until it
+	// gets cleaned up
+	assert.Equal(t, http.StatusConflict, headBuild(t, endpoint))
+	err = os.RemoveAll(filepath.Join(baseBuildDir, "build"))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, headBuild(t, endpoint))
+}
+
+// nonFlushingResponseWriter hides the http.Flusher of the wrapped
+// writer like some middlewares do
+type nonFlushingResponseWriter struct {
+	http.ResponseWriter
+}
+
+func TestBuildWithoutFlusherSendsOutputAtTheEnd(t *testing.T) {
+	baseBuildDir := t.TempDir()
+	config, _, err := main.NewConfigFromCmdline([]string{"-build-path", baseBuildDir})
+	assert.NoError(t, err)
+	logger, _ := logrusTest.NewNullLogger()
+	srv := main.NewServer(logger, config)
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+echo "line one"
+echo "line two"
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/build", buf)
+	req.Header.Set("Content-Type", "application/x-tar")
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(&nonFlushingResponseWriter{rec}, req)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.False(t, rec.Flushed)
+	assert.Equal(t, "line one\nline two\n", rec.Body.String())
+
+	buildLog, err := ioutil.ReadFile(filepath.Join(baseBuildDir, "build/build.log"))
+	assert.NoError(t, err)
+	assert.Equal(t, "line one\nline two\n", string(buildLog))
+	assert.FileExists(t, filepath.Join(baseBuildDir, "result.good"))
+}
+
 func TestHandleIncludedSourcesUnclean(t *testing.T) {
 	tmpdir := t.TempDir()
 
@@ -183,7 +323,7 @@ func TestHandleIncludedSourcesUnclean(t *testing.T) {
 	err := writeToTar(atar, "store/../../etc/passwd", "some-content")
 	assert.NoError(t, err)
 
-	err = main.HandleIncludedSources(tar.NewReader(buf), tmpdir)
+	err = main.HandleIncludedSources(&main.Config{}, tar.NewReader(buf), tmpdir, nil)
 	assert.EqualError(t, err, "name not clean: ../etc/passwd != store/../../etc/passwd")
 }
 
@@ -195,7 +335,7 @@ func TestHandleIncludedSourcesNotFromStore(t *testing.T) {
 	err := writeToTar(atar, "not-store", "some-content")
 	assert.NoError(t, err)
 
-	err = main.HandleIncludedSources(tar.NewReader(buf), tmpdir)
+	err = main.HandleIncludedSources(&main.Config{}, tar.NewReader(buf), tmpdir, nil)
 	assert.EqualError(t, err, "expected store/ prefix, got not-store")
 }
 
@@ -211,7 +351,7 @@ func TestHandleIncludedSourcesBadTypes(t *testing.T) {
 		})
 		assert.NoError(t, err)
 
-		err = main.HandleIncludedSources(tar.NewReader(buf), tmpdir)
+		err = main.HandleIncludedSources(&main.Config{}, tar.NewReader(buf), tmpdir, nil)
 		assert.EqualError(t, err, fmt.Sprintf("unsupported tar type %v", badType))
 	}
 }
@@ -253,7 +393,7 @@ cannot run osbuild: exit status 23`
 	reader = bufio.NewReader(rsp.Body)
 	content, err = ioutil.ReadAll(reader)
 	assert.NoError(t, err)
-	assert.Equal(t, "build failed\n"+expectedContent, string(content))
+	assert.Equal(t, "build failed: exit status 23\n"+expectedContent, string(content))
 }
 
 func TestBuildStreamsOutput(t *testing.T) {
@@ -319,3 +459,1892 @@ func TestBuildErrorHandlingTar(t *testing.T) {
 	assert.Contains(t, string(body), "cannot tar output directory:")
 	assert.Contains(t, loggerHook.LastEntry().Message, "cannot tar output directory:")
 }
+
+func TestBuildOutputDirMode(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-output-dir-mode", "0750")
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+echo "fake-build-result" > %[1]s/build/output/image/disk.img
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["tree"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+
+	stat, err := os.Stat(filepath.Join(baseBuildDir, "build/output"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0750), stat.Mode().Perm())
+	stat, err = os.Stat(filepath.Join(baseBuildDir, "build/output/output.tar"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), stat.Mode().Perm())
+}
+
+func TestBuildTimeoutReturnsPartialLog(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-build-timeout", "500ms")
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, `#!/bin/sh -e
+echo "partial-output"
+sleep 30
+echo "never-reached"
+`)
+	defer restore()
+
+	startTime := time.Now()
+	buf := makeTestPost(t, `{"exports": ["tree"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.True(t, time.Since(startTime) < 10*time.Second)
+	expectedContent := "partial-output\nbuild aborted: timeout\n"
+	assert.Equal(t, expectedContent, string(body))
+
+	logFileContent, err := ioutil.ReadFile(filepath.Join(baseBuildDir, "build/build.log"))
+	assert.NoError(t, err)
+	assert.Equal(t, expectedContent, string(logFileContent))
+
+	// the result is marked as failed
+	rsp, err = http.Get(baseURL + "api/v1/result/image/disk.img")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, rsp.StatusCode)
+}
+
+func TestBuildEnvFileMerged(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+echo "FROM_FILE=$FROM_FILE SHARED=$SHARED FROM_CONTROL=$FROM_CONTROL"
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	buildEnv := tarEntry{"build.env", "# comment\nFROM_FILE=file\n\nSHARED=file\n"}
+	buf := makeTestPostWithEntries(t, `{"exports": ["tree"], "environments": ["SHARED=control", "FROM_CONTROL=control"]}`, `{"fake": "manifest"}`, buildEnv)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "FROM_FILE=file SHARED=control FROM_CONTROL=control\n", string(body))
+}
+
+func TestBuildEnvironmentsValidated(t *testing.T) {
+	baseURL, _, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	buf := makeTestPost(t, `{"exports": ["tree"], "environments": ["LD_PRELOAD=/tmp/evil.so"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "invalid environments: environment key \"LD_PRELOAD\" not allowed\n", string(body))
+
+	// the same rules apply to build.env
+	buildEnv := tarEntry{"build.env", "PYTHONPATH=/tmp/evil\n"}
+	buf = makeTestPostWithEntries(t, `{"exports": ["tree"]}`, `{"fake": "manifest"}`, buildEnv)
+	rsp, err = http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+}
+
+func TestBuildEnvironmentValuePatterns(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-env-value-pattern", "REGISTRY_AUTH_FILE=/etc/oaas/auth/.*")
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+echo "MY=$MY REGISTRY_AUTH_FILE=$REGISTRY_AUTH_FILE"
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	// keys without a pattern can have any value
+	buf := makeTestPost(t, `{"exports": ["image"], "environments": ["MY=../../anything", "REGISTRY_AUTH_FILE=/etc/oaas/auth/registry.json"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "MY=../../anything REGISTRY_AUTH_FILE=/etc/oaas/auth/registry.json\n", string(body))
+
+	// the pattern must match the whole value
+	buf = makeTestPost(t, `{"exports": ["image"], "environments": ["REGISTRY_AUTH_FILE=/tmp/evil/etc/oaas/auth/registry.json"]}`, `{"fake": "manifest"}`)
+	rsp, err = http.Post(endpoint+"?replace=true", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+	body, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "invalid environments: value of environment key \"REGISTRY_AUTH_FILE\" not allowed\n", string(body))
+
+	// the same rules apply to build.env
+	buildEnv := tarEntry{"build.env", "REGISTRY_AUTH_FILE=/tmp/evil.json\n"}
+	buf = makeTestPostWithEntries(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`, buildEnv)
+	rsp, err = http.Post(endpoint+"?replace=true", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+}
+
+func TestBuildPassthroughEnv(t *testing.T) {
+	t.Setenv("OAAS_TEST_HTTP_PROXY", "http://proxy.example.com:3128")
+	t.Setenv("OAAS_TEST_OVERRIDDEN", "server")
+	baseURL, baseBuildDir, _ := runTestServer(t, "-passthrough-env", "OAAS_TEST_HTTP_PROXY,OAAS_TEST_OVERRIDDEN,OAAS_TEST_UNSET")
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+echo "proxy=$OAAS_TEST_HTTP_PROXY overridden=$OAAS_TEST_OVERRIDDEN unset=${OAAS_TEST_UNSET-none}"
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"], "environments": ["OAAS_TEST_OVERRIDDEN=client"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "proxy=http://proxy.example.com:3128 overridden=client unset=none\n", string(body))
+}
+
+func TestBuildSelectsOsbuildVersion(t *testing.T) {
+	newOsbuild := filepath.Join(t.TempDir(), "osbuild-new")
+	err := ioutil.WriteFile(newOsbuild, []byte(`#!/bin/sh
+echo "new osbuild"
+`), 0755)
+	assert.NoError(t, err)
+	restore := main.MockOsbuildBinary(t, `#!/bin/sh
+echo "default osbuild"
+`)
+	defer restore()
+
+	baseURL, _, _ := runTestServer(t, "-osbuild-binaries", "new="+newOsbuild)
+	endpoint := baseURL + "api/v1/build"
+
+	buf := makeTestPost(t, `{"exports": ["tree"], "osbuild_version": "new"}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(body), "new osbuild\n"), string(body))
+}
+
+func TestBuildUnknownOsbuildVersion(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-osbuild-binaries", "new=/opt/osbuild/bin/osbuild")
+	endpoint := baseURL + "api/v1/build"
+
+	buf := makeTestPost(t, `{"exports": ["tree"], "osbuild_version": "old"}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "unknown osbuild version \"old\"\n", string(body))
+	// no build was started
+	assert.NoDirExists(t, filepath.Join(baseBuildDir, "build"))
+}
+
+// osbuildResultMock returns an osbuild mock that prints the recorded
+// "osbuild --json" result of testdata/ and exits with the given status
+func osbuildResultMock(t *testing.T, baseBuildDir, result string, status int) string {
+	resultPath, err := filepath.Abs(filepath.Join("testdata", result))
+	assert.NoError(t, err)
+	return fmt.Sprintf(`#!/bin/sh -e
+echo "some output on stderr" >&2
+mkdir -p %[1]s/build/output/tree
+cat %[2]s
+exit %[3]v
+`, baseBuildDir, resultPath, status)
+}
+
+func TestBuildReportsStageCache(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, osbuildResultMock(t, baseBuildDir, "osbuild-result-success.json", 0))
+	defer restore()
+
+	manifest, err := ioutil.ReadFile("testdata/osbuild-manifest.json")
+	assert.NoError(t, err)
+	buf := makeTestPost(t, `{"exports": ["tree"]}`, string(manifest))
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	// trailers are available once the body is read, the "build"
+	// pipeline and the first two "os" stages came from the store,
+	// the "unused" pipeline is not needed for the "tree" export
+	assert.Equal(t, "3", rsp.Trailer.Get("Osbuild-Cached-Stages"))
+	assert.Equal(t, "2", rsp.Trailer.Get("Osbuild-Built-Stages"))
+
+	resultJSON, err := ioutil.ReadFile(filepath.Join(baseBuildDir, "build/result.json"))
+	assert.NoError(t, err)
+	var result struct {
+		CachedStages int `json:"cached_stages"`
+		BuiltStages  int `json:"built_stages"`
+	}
+	err = json.Unmarshal(resultJSON, &result)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, result.CachedStages)
+	assert.Equal(t, 2, result.BuiltStages)
+}
+
+func TestBuildReportsStageCacheLongResultLine(t *testing.T) {
+	// the result line is observed in many chunks
+	restore := main.MockMaxLineLength(64)
+	defer restore()
+	baseURL, baseBuildDir, _ := runTestServer(t)
+
+	restore = main.MockOsbuildBinary(t, osbuildResultMock(t, baseBuildDir, "osbuild-result-success.json", 0))
+	defer restore()
+
+	manifest, err := ioutil.ReadFile("testdata/osbuild-manifest.json")
+	assert.NoError(t, err)
+	buf := makeTestPost(t, `{"exports": ["tree"]}`, string(manifest))
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "3", rsp.Trailer.Get("Osbuild-Cached-Stages"))
+	assert.Equal(t, "2", rsp.Trailer.Get("Osbuild-Built-Stages"))
+}
+
+func TestBuildSummaryWarningsFromRecordedResult(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+
+	restore := main.MockOsbuildBinary(t, osbuildResultMock(t, baseBuildDir, "osbuild-result-success.json", 0))
+	defer restore()
+
+	manifest, err := ioutil.ReadFile("testdata/osbuild-manifest.json")
+	assert.NoError(t, err)
+	buf := makeTestPost(t, `{"exports": ["tree"]}`, string(manifest))
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+
+	resultJSON, err := ioutil.ReadFile(filepath.Join(baseBuildDir, "build/result.json"))
+	assert.NoError(t, err)
+	var result struct {
+		Warnings []string `json:"warnings"`
+	}
+	err = json.Unmarshal(resultJSON, &result)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"/usr/lib/osbuild/stages/org.osbuild.selinux:21: DeprecationWarning: the imp module is deprecated",
+		`WARNING: stage org.osbuild.tar option "acls" is deprecated`,
+	}, result.Warnings)
+}
+
+func TestBuildReportsStageCacheFailedBuild(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, osbuildResultMock(t, baseBuildDir, "osbuild-result-failure.json", 1))
+	defer restore()
+
+	manifest, err := ioutil.ReadFile("testdata/osbuild-manifest.json")
+	assert.NoError(t, err)
+	buf := makeTestPost(t, `{"exports": ["tree"]}`, string(manifest))
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	// a failed build does not tell if the stages that did not run
+	// were in the store
+	assert.Equal(t, "0", rsp.Trailer.Get("Osbuild-Cached-Stages"))
+	assert.Equal(t, "2", rsp.Trailer.Get("Osbuild-Built-Stages"))
+}
+
+func TestBuildAllowedExports(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-allowed-exports", "image,tree")
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+echo fake-osbuild "$1" "$2"
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["vmdk"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "export not allowed: vmdk\n", string(body))
+	// the check happens before the build dir is taken
+	assert.NoDirExists(t, filepath.Join(baseBuildDir, "build"))
+
+	buf = makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err = http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "fake-osbuild --export image\n", string(body))
+}
+
+func TestBuildMaxExports(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-max-exports", "2")
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+echo fake-osbuild "$@"
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image", "tree", "vmdk"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "too many exports: 3 (maximum 2)\n", string(body))
+	// the check happens before the build dir is taken
+	assert.NoDirExists(t, filepath.Join(baseBuildDir, "build"))
+
+	buf = makeTestPost(t, `{"exports": ["image", "tree"]}`, `{"fake": "manifest"}`)
+	rsp, err = http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), "fake-osbuild --export image --export tree ")
+}
+
+func TestBuildDefaultExports(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-default-exports", "image")
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+echo fake-osbuild "$1" "$2"
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": []}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "fake-osbuild --export image\n", string(body))
+}
+
+func TestBuildNoExports(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	buf := makeTestPost(t, `{}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "no exports requested\n", string(body))
+	assert.NoDirExists(t, filepath.Join(baseBuildDir, "build"))
+}
+
+func TestBuildManifestErrorFreesLock(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	buf := bytes.NewBuffer(nil)
+	archive := tar.NewWriter(buf)
+	err := writeToTar(archive, "control.json", `{"exports": ["tree"]}`)
+	assert.NoError(t, err)
+	err = writeToTar(archive, "not-a-manifest.json", `{}`)
+	assert.NoError(t, err)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+	assert.NoDirExists(t, filepath.Join(baseBuildDir, "build"))
+
+	// bad sources also free the lock
+	buf = makeTestPostWithEntries(t, `{"exports": ["tree"]}`, `{"fake": "manifest"}`, tarEntry{"not-store", "data"})
+	rsp, err = http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+	assert.NoDirExists(t, filepath.Join(baseBuildDir, "build"))
+
+	buf = makeTestPost(t, `{"exports": ["tree"]}`, `{"fake": "manifest"}`)
+	rsp, err = http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+}
+
+func makeHook(t *testing.T, content string) string {
+	hook := filepath.Join(t.TempDir(), "hook")
+	err := ioutil.WriteFile(hook, []byte(content), 0755)
+	assert.NoError(t, err)
+	return hook
+}
+
+func TestBuildPostBuildHook(t *testing.T) {
+	hook := makeHook(t, `#!/bin/sh -e
+test "$1" = "$OAAS_BUILD_DIR"
+echo "status: $OAAS_EXIT_STATUS"
+ls "$1/output/image"
+`)
+	baseURL, baseBuildDir, _ := runTestServer(t, "-post-build-hook", hook)
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+echo "osbuild-output"
+mkdir -p %[1]s/build/output/image
+echo "fake-build-result" > %[1]s/build/output/image/disk.img
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["tree"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "osbuild-output\nhook: status: 0\nhook: disk.img\n", string(body))
+
+	rsp, err = http.Get(baseURL + "api/v1/result/image/disk.img")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+}
+
+func TestBuildPostBuildHookTimeout(t *testing.T) {
+	// the background child keeps the output open
+	hook := makeHook(t, `#!/bin/sh
+echo "hook hanging"
+sleep 30 &
+sleep 30
+`)
+	baseURL, baseBuildDir, _ := runTestServer(t, "-post-build-hook", hook, "-post-build-hook-timeout", "200ms")
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	startTime := time.Now()
+	buf := makeTestPost(t, `{"exports": ["tree"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.True(t, time.Since(startTime) < 10*time.Second)
+	assert.Equal(t, "hook: hook hanging\npost build hook timed out after 200ms", string(body))
+}
+
+func TestBuildPostBuildHookFailureFailsBuild(t *testing.T) {
+	hook := makeHook(t, `#!/bin/sh
+echo "hook failing"
+exit 1
+`)
+	baseURL, baseBuildDir, _ := runTestServer(t, "-post-build-hook", hook)
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["tree"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "hook: hook failing\npost build hook failed: exit status 1", string(body))
+
+	rsp, err = http.Get(baseURL + "api/v1/result/image/disk.img")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+}
+
+func TestHandleIncludedSourcesSkipsPaxHeaders(t *testing.T) {
+	tmpdir := t.TempDir()
+
+	buf := bytes.NewBuffer(nil)
+	atar := tar.NewWriter(buf)
+	err := atar.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeXGlobalHeader,
+		PAXRecords: map[string]string{"comment": "generated by some-tool"},
+	})
+	assert.NoError(t, err)
+	err = atar.WriteHeader(&tar.Header{
+		Name:     "store/",
+		Mode:     0755,
+		Typeflag: tar.TypeDir,
+	})
+	assert.NoError(t, err)
+	err = writeToTar(atar, "store/some-source", "some-content")
+	assert.NoError(t, err)
+	assert.NoError(t, atar.Close())
+
+	err = main.HandleIncludedSources(&main.Config{}, tar.NewReader(buf), tmpdir, nil)
+	assert.NoError(t, err)
+	content, err := ioutil.ReadFile(filepath.Join(tmpdir, "store/some-source"))
+	assert.NoError(t, err)
+	assert.Equal(t, "some-content", string(content))
+}
+
+func TestBuildWithLeadingPaxGlobalHeader(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	buf := bytes.NewBuffer(nil)
+	archive := tar.NewWriter(buf)
+	err := archive.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeXGlobalHeader,
+		PAXRecords: map[string]string{"comment": "generated by some-tool"},
+	})
+	assert.NoError(t, err)
+	err = writeToTar(archive, "control.json", `{"exports": ["tree"]}`)
+	assert.NoError(t, err)
+	err = writeToTar(archive, "manifest.json", `{"fake": "manifest"}`)
+	assert.NoError(t, err)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+}
+
+func TestBuildOutputDirect(t *testing.T) {
+	outputRoot := t.TempDir()
+	baseURL, baseBuildDir, _ := runTestServer(t, "-output-roots", outputRoot)
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, `#!/bin/sh -e
+# parse the output dir from the commandline
+while [ $# -gt 0 ]; do
+    if [ "$1" = "--output-dir" ]; then
+        mkdir -p "$2"/image
+        echo "fake-build-result" > "$2"/image/disk.img
+    fi
+    shift
+done
+`)
+	defer restore()
+
+	dest := filepath.Join(outputRoot, "nfs-dest")
+	err := os.Mkdir(dest, 0755)
+	assert.NoError(t, err)
+	control := fmt.Sprintf(`{"exports": ["image"], "output_direct": %q}`, dest)
+	buf := makeTestPost(t, control, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("output written to %s\n", dest), string(body))
+
+	content, err := ioutil.ReadFile(filepath.Join(dest, "image/disk.img"))
+	assert.NoError(t, err)
+	assert.Equal(t, "fake-build-result\n", string(content))
+	// no repacking happens for direct output
+	assert.NoFileExists(t, filepath.Join(dest, "output.tar"))
+	assert.NoDirExists(t, filepath.Join(baseBuildDir, "build/output"))
+}
+
+func TestBuildOutputDirectNotAllowed(t *testing.T) {
+	outputRoot := t.TempDir()
+	baseURL, baseBuildDir, _ := runTestServer(t, "-output-roots", outputRoot)
+	endpoint := baseURL + "api/v1/build"
+
+	// a symlink inside the root must not allow escaping it
+	outside := t.TempDir()
+	escape := filepath.Join(outputRoot, "escape")
+	err := os.Symlink(outside, escape)
+	assert.NoError(t, err)
+
+	for _, dest := range []string{outside, escape, outputRoot} {
+		control := fmt.Sprintf(`{"exports": ["image"], "output_direct": %q}`, dest)
+		buf := makeTestPost(t, control, `{"fake": "manifest"}`)
+		rsp, err := http.Post(endpoint, "application/x-tar", buf)
+		assert.NoError(t, err)
+		defer rsp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, rsp.StatusCode)
+		body, err := ioutil.ReadAll(rsp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("output dir not allowed: %s\n", dest), string(body))
+		assert.NoDirExists(t, filepath.Join(baseBuildDir, "build"))
+	}
+}
+
+func TestBuildReadTimeoutFreesLock(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-read-timeout", "200ms")
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	// send control/manifest and then stall without closing the tar
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go func() {
+		archive := tar.NewWriter(pw)
+		writeToTar(archive, "control.json", `{"exports": ["tree"]}`)
+		writeToTar(archive, "manifest.json", `{"fake": "manifest"}`)
+		archive.Flush()
+	}()
+	rsp, err := http.Post(endpoint, "application/x-tar", pr)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusRequestTimeout, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "timeout reading request\n", string(body))
+	assert.NoDirExists(t, filepath.Join(baseBuildDir, "build"))
+
+	// and the next build can start
+	buf := makeTestPost(t, `{"exports": ["tree"]}`, `{"fake": "manifest"}`)
+	rsp, err = http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+}
+
+func TestBuildEmptyUpload(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	rsp, err := http.Post(endpoint, "application/x-tar", bytes.NewBuffer(nil))
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "empty upload\n", string(body))
+	assert.NoDirExists(t, filepath.Join(baseBuildDir, "build"))
+}
+
+func TestBuildTruncatedUpload(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	full := makeTestPost(t, `{"exports": ["tree"]}`, `{"fake": "manifest"}`).Bytes()
+	for _, size := range []int{
+		// in the control.json header
+		100,
+		// in the control.json content
+		512 + 5,
+		// in the manifest.json content
+		3*512 + 5,
+		// in the sources
+		6*512 + 100,
+	} {
+		rsp, err := http.Post(endpoint, "application/x-tar", bytes.NewReader(full[:size]))
+		assert.NoError(t, err)
+		defer rsp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, rsp.StatusCode, size)
+		body, err := ioutil.ReadAll(rsp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "truncated archive\n", string(body), size)
+		assert.NoDirExists(t, filepath.Join(baseBuildDir, "build"))
+	}
+}
+
+func TestBuildLogLevelFiltersStream(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+echo "DEBUG: resolving sources"
+echo "org.osbuild.rpm: 0000000000000000000000000000000000000000000000000000000000000000 {"
+echo "Warning: package foo is deprecated"
+echo "installing packages"
+echo "error: cannot find bar" >&2
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	fullLog := `DEBUG: resolving sources
+org.osbuild.rpm: 0000000000000000000000000000000000000000000000000000000000000000 {
+Warning: package foo is deprecated
+installing packages
+error: cannot find bar
+`
+	for _, tc := range []struct {
+		logLevel string
+		expected string
+	}{
+		{"", fullLog},
+		{"debug", fullLog},
+		{"info", `org.osbuild.rpm: 0000000000000000000000000000000000000000000000000000000000000000 {
+Warning: package foo is deprecated
+installing packages
+error: cannot find bar
+`},
+		{"warn", `Warning: package foo is deprecated
+error: cannot find bar
+`},
+	} {
+		control := `{"exports": ["image"]}`
+		if tc.logLevel != "" {
+			control = fmt.Sprintf(`{"exports": ["image"], "log_level": %q}`, tc.logLevel)
+		}
+		buf := makeTestPost(t, control, `{"fake": "manifest"}`)
+		rsp, err := http.Post(endpoint, "application/x-tar", buf)
+		assert.NoError(t, err)
+		defer rsp.Body.Close()
+		assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+		body, err := ioutil.ReadAll(rsp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, string(body), tc.logLevel)
+
+		// the log always has everything
+		buildLog, err := ioutil.ReadFile(filepath.Join(baseBuildDir, "build/build.log"))
+		assert.NoError(t, err)
+		assert.Equal(t, fullLog, string(buildLog))
+
+		err = os.RemoveAll(filepath.Join(baseBuildDir, "build"))
+		assert.NoError(t, err)
+		os.Remove(filepath.Join(baseBuildDir, "result.good"))
+	}
+}
+
+func TestBuildManifestYAML(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+cat %[1]s/build/manifest.json
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	manifestYAML := `version: "2"
+pipelines:
+  - name: build
+    stages:
+      - type: org.osbuild.rpm
+        options:
+          gpgkeys: []
+sources:
+  org.osbuild.curl:
+    items: {}
+`
+	buf := bytes.NewBuffer(nil)
+	archive := tar.NewWriter(buf)
+	err := writeToTar(archive, "control.json", `{"exports": ["image"]}`)
+	assert.NoError(t, err)
+	err = writeToTar(archive, "manifest.yaml", manifestYAML)
+	assert.NoError(t, err)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+  "version": "2",
+  "pipelines": [{"name": "build", "stages": [{"type": "org.osbuild.rpm", "options": {"gpgkeys": []}}]}],
+  "sources": {"org.osbuild.curl": {"items": {}}}
+}`, string(body))
+}
+
+func TestBuildManifestYAMLTooLarge(t *testing.T) {
+	restore := main.MockMaxManifestSize(16)
+	defer restore()
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	buf := bytes.NewBuffer(nil)
+	archive := tar.NewWriter(buf)
+	err := writeToTar(archive, "control.json", `{"exports": ["image"]}`)
+	assert.NoError(t, err)
+	err = writeToTar(archive, "manifest.yaml", "version: \"2\"\npipelines: []\n")
+	assert.NoError(t, err)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "manifest too large: manifest.yaml exceeds 16 bytes\n", string(body))
+	assert.NoDirExists(t, filepath.Join(baseBuildDir, "build"))
+}
+
+func TestBuildManifestJSONTooLarge(t *testing.T) {
+	restore := main.MockMaxManifestSize(16)
+	defer restore()
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"version": "2", "pipelines": []}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "manifest too large: manifest.json exceeds 16 bytes\n", string(body))
+	assert.NoDirExists(t, filepath.Join(baseBuildDir, "build"))
+}
+
+func TestBuildManifestTemplate(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+cat %[1]s/build/manifest.json
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	buf := bytes.NewBuffer(nil)
+	archive := tar.NewWriter(buf)
+	err := writeToTar(archive, "control.json", `{"exports": ["image"], "variables": {"release": "9.4"}}`)
+	assert.NoError(t, err)
+	err = writeToTar(archive, "manifest.json.tmpl", `{"version": "2", "release": "{{.release}}"}`)
+	assert.NoError(t, err)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"version": "2", "release": "9.4"}`, string(body))
+}
+
+func TestBuildManifestTemplateEscapesVariables(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+cat %[1]s/build/manifest.json
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	buf := bytes.NewBuffer(nil)
+	archive := tar.NewWriter(buf)
+	err := writeToTar(archive, "control.json", `{"exports": ["image"], "variables": {"release": "9.4\", \"pipelines\": [\"evil\"]"}}`)
+	assert.NoError(t, err)
+	err = writeToTar(archive, "manifest.json.tmpl", `{"version": "2", "release": "{{.release}}"}`)
+	assert.NoError(t, err)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"version": "2", "release": "9.4\", \"pipelines\": [\"evil\"]"}`, string(body))
+}
+
+func TestBuildManifestTemplateTooLarge(t *testing.T) {
+	restore := main.MockMaxManifestSize(16)
+	defer restore()
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	buf := bytes.NewBuffer(nil)
+	archive := tar.NewWriter(buf)
+	err := writeToTar(archive, "control.json", `{"exports": ["image"]}`)
+	assert.NoError(t, err)
+	err = writeToTar(archive, "manifest.json.tmpl", `{"version": "2", "pipelines": []}`)
+	assert.NoError(t, err)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "manifest too large: manifest.json.tmpl exceeds 16 bytes\n", string(body))
+	assert.NoDirExists(t, filepath.Join(baseBuildDir, "build"))
+}
+
+func TestBuildManifestTemplateUndefinedVariable(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	buf := bytes.NewBuffer(nil)
+	archive := tar.NewWriter(buf)
+	err := writeToTar(archive, "control.json", `{"exports": ["image"], "variables": {"release": "9.4"}}`)
+	assert.NoError(t, err)
+	err = writeToTar(archive, "manifest.json.tmpl", `{"arch": "{{.arch}}"}`)
+	assert.NoError(t, err)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), "cannot render manifest.json.tmpl: ")
+	assert.Contains(t, string(body), `map has no entry for key "arch"`)
+	assert.NoDirExists(t, filepath.Join(baseBuildDir, "build"))
+}
+
+func TestBuildManifestJSONSyntaxErrorPosition(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	// the trailing comma makes the "}" on line 4 (byte 38) invalid
+	manifest := "{\n  \"version\": \"2\",\n  \"sources\": {},\n}\n"
+	buf := makeTestPost(t, `{"exports": ["image"]}`, manifest)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "invalid manifest.json: line 4, column 1 (offset 38): invalid character '}' looking for beginning of object key string\n", string(body))
+	assert.NoDirExists(t, filepath.Join(baseBuildDir, "build"))
+}
+
+func TestBuildSupportedManifestVersion(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-supported-manifest-versions", "2")
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"version": "2", "pipelines": []}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+}
+
+func TestBuildUnsupportedManifestVersion(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-supported-manifest-versions", "2")
+	endpoint := baseURL + "api/v1/build"
+
+	for _, tc := range []struct {
+		manifest, version string
+	}{
+		{`{"version": "3"}`, "3"},
+		// manifests without a version are the old version 1
+		{`{"pipeline": {}}`, "1"},
+	} {
+		buf := makeTestPost(t, `{"exports": ["image"]}`, tc.manifest)
+		rsp, err := http.Post(endpoint, "application/x-tar", buf)
+		assert.NoError(t, err)
+		defer rsp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+		body, err := ioutil.ReadAll(rsp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("unsupported manifest version %q, supported are [2]\n", tc.version), string(body))
+		assert.NoDirExists(t, filepath.Join(baseBuildDir, "build"))
+	}
+}
+
+func TestBuildSourceTypeSizeCap(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-max-source-size", "org.osbuild.files=10")
+	endpoint := baseURL + "api/v1/build"
+
+	buf := makeTestPostWithEntries(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`, tarEntry{
+		name:    "store/sources/org.osbuild.files/sha256:1234",
+		content: "more-than-ten-bytes",
+	})
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "sources too large: sources of type org.osbuild.files exceed 10 bytes\n", string(body))
+	assert.NoDirExists(t, filepath.Join(baseBuildDir, "build"))
+}
+
+func TestBuildTrailingEntries(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-trailing-entries", "signature,README")
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+cat %[1]s/build/trailing/signature
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	manifest := `{"fake": "manifest"}`
+	buf := makeTestPostWithEntries(t, `{"exports": ["image"]}`, manifest, tarEntry{
+		name:    "store/sources/org.osbuild.files/sha256:1234",
+		content: "some-source",
+	}, tarEntry{
+		name:    "signature",
+		content: sha256Name(manifest) + "\n",
+	})
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, sha256Name(manifest)+"\n", string(body))
+}
+
+func TestBuildTrailingEntriesRejected(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-trailing-entries", "signature")
+	endpoint := baseURL + "api/v1/build"
+
+	for _, tc := range []struct {
+		entry       tarEntry
+		expectedErr string
+	}{
+		{tarEntry{name: "README", content: "hello"}, "included sources/"},
+		{tarEntry{name: "signature", content: "sha256:1234"}, fmt.Sprintf(`invalid trailing entry: signature "sha256:1234" does not match the manifest %v`, sha256Name(`{"fake": "manifest"}`))},
+	} {
+		buf := makeTestPostWithEntries(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`, tc.entry)
+		rsp, err := http.Post(endpoint, "application/x-tar", buf)
+		assert.NoError(t, err)
+		defer rsp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+		body, err := ioutil.ReadAll(rsp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expectedErr+"\n", string(body))
+		assert.NoDirExists(t, filepath.Join(baseBuildDir, "build"))
+	}
+}
+
+func TestBuildManifestJSONAndYAMLRejected(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	buf := makeTestPostWithEntries(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`, tarEntry{
+		name:    "manifest.yaml",
+		content: "fake: manifest\n",
+	})
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "only one of manifest.json, manifest.yaml and manifest.json.tmpl can be sent\n", string(body))
+	assert.NoDirExists(t, filepath.Join(baseBuildDir, "build"))
+}
+
+func TestBuildDebugShowsCommandLine(t *testing.T) {
+	for _, debug := range []bool{false, true} {
+		t.Run(fmt.Sprintf("debug=%v", debug), func(t *testing.T) {
+			var args []string
+			if debug {
+				args = append(args, "-debug")
+			}
+			baseURL, baseBuildDir, _ := runTestServer(t, args...)
+			endpoint := baseURL + "api/v1/build"
+
+			restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+echo "building"
+`, baseBuildDir))
+			defer restore()
+
+			buf := makeTestPost(t, `{"exports": ["image"], "environments": ["SECRET_TOKEN=hunter2", "OTHER=value"]}`, `{"fake": "manifest"}`)
+			rsp, err := http.Post(endpoint, "application/x-tar", buf)
+			assert.NoError(t, err)
+			defer rsp.Body.Close()
+			assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+			body, err := ioutil.ReadAll(rsp.Body)
+			assert.NoError(t, err)
+
+			if !debug {
+				assert.Equal(t, "building\n", string(body))
+				return
+			}
+			binary := strings.Fields(string(body))[2]
+			assert.Equal(t, fmt.Sprintf(`osbuild command: %[2]s --export image --output-dir %[1]s/build/output --store %[1]s/build/store --json %[1]s/build/manifest.json
+osbuild environment keys: SECRET_TOKEN OTHER
+building
+`, baseBuildDir, binary), string(body))
+			assert.NotContains(t, string(body), "hunter2")
+		})
+	}
+}
+
+func TestBuildExposeBuildDir(t *testing.T) {
+	for _, expose := range []bool{false, true} {
+		t.Run(fmt.Sprintf("expose=%v", expose), func(t *testing.T) {
+			var args []string
+			if expose {
+				args = append(args, "-expose-build-dir")
+			}
+			baseURL, baseBuildDir, _ := runTestServer(t, args...)
+
+			restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+			defer restore()
+
+			buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+			rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+			assert.NoError(t, err)
+			defer rsp.Body.Close()
+			assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+			if expose {
+				assert.Equal(t, filepath.Join(baseBuildDir, "build"), rsp.Header.Get("X-Build-Dir"))
+			} else {
+				_, ok := rsp.Header["X-Build-Dir"]
+				assert.False(t, ok)
+			}
+		})
+	}
+}
+
+func TestBuildMaxPathDepth(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-max-path-depth", "8")
+	endpoint := baseURL + "api/v1/build"
+
+	deepName := "store/sources/org.osbuild.files" + strings.Repeat("/a", 1000)
+	buf := makeTestPostWithEntries(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`, tarEntry{
+		name:    deepName,
+		content: "deep-data",
+	})
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("path too deep: %s has depth 1003, maximum is 8\n", deepName), string(body))
+	assert.NoDirExists(t, filepath.Join(baseBuildDir, "build"))
+}
+
+func TestHandleIncludedSourcesMaxPathDepth(t *testing.T) {
+	tmpdir := t.TempDir()
+	err := os.Mkdir(filepath.Join(tmpdir, "store"), 0755)
+	assert.NoError(t, err)
+
+	buf := bytes.NewBuffer(nil)
+	atar := tar.NewWriter(buf)
+	err = writeToTar(atar, "store/a", "some-content")
+	assert.NoError(t, err)
+
+	err = main.HandleIncludedSources(&main.Config{MaxPathDepth: 1}, tar.NewReader(bytes.NewReader(buf.Bytes())), tmpdir, nil)
+	assert.EqualError(t, err, "path too deep: store/a has depth 2, maximum is 1")
+	err = main.HandleIncludedSources(&main.Config{MaxPathDepth: 2}, tar.NewReader(bytes.NewReader(buf.Bytes())), tmpdir, nil)
+	assert.NoError(t, err)
+}
+
+func TestBuildUploadProgress(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockUploadProgressInterval(1)
+	defer restore()
+	restore = main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+echo "starting pipeline build"
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"], "upload_progress": true}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+
+	extractIdx := strings.Index(string(body), "extracting source store/sources/org.osbuild.files/sha256:ff800c5263b915d8a0776be5620575df2d478332ad35e8dd18def6a8c720f9c7\n")
+	uploadedIdx := strings.Index(string(body), "uploaded ")
+	startIdx := strings.Index(string(body), "starting pipeline build\n")
+	assert.True(t, extractIdx >= 0, string(body))
+	assert.True(t, uploadedIdx >= 0, string(body))
+	assert.True(t, extractIdx < startIdx, string(body))
+	assert.True(t, uploadedIdx < startIdx, string(body))
+}
+
+func TestBuildUploadProgressExtractedBytes(t *testing.T) {
+	for _, withSizes := range []bool{true, false} {
+		t.Run(fmt.Sprintf("sizes=%v", withSizes), func(t *testing.T) {
+			baseURL, baseBuildDir, _ := runTestServer(t)
+			endpoint := baseURL + "api/v1/build"
+
+			restore := main.MockUploadProgressInterval(4)
+			defer restore()
+			restore = main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+			defer restore()
+
+			buf := bytes.NewBuffer(nil)
+			archive := tar.NewWriter(buf)
+			err := writeToTar(archive, "control.json", `{"exports": ["image"], "upload_progress": true}`)
+			assert.NoError(t, err)
+			err = writeToTar(archive, "manifest.json", `{"fake": "manifest"}`)
+			assert.NoError(t, err)
+			if withSizes {
+				err = writeToTar(archive, "store/sources.sizes", `{"sha256:first": 5, "sha256:second": 6}`)
+				assert.NoError(t, err)
+			}
+			err = writeToTar(archive, "store/sources/org.osbuild.files/sha256:first", "12345")
+			assert.NoError(t, err)
+			err = writeToTar(archive, "store/sources/org.osbuild.files/sha256:second", "123456")
+			assert.NoError(t, err)
+			rsp, err := http.Post(endpoint, "application/x-tar", buf)
+			assert.NoError(t, err)
+			defer rsp.Body.Close()
+			assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+			body, err := ioutil.ReadAll(rsp.Body)
+			assert.NoError(t, err)
+
+			total := ""
+			if withSizes {
+				total = "/11"
+			}
+			firstIdx := strings.Index(string(body), fmt.Sprintf("extracted 5%s bytes\n", total))
+			secondIdx := strings.Index(string(body), fmt.Sprintf("extracted 11%s bytes\n", total))
+			assert.True(t, firstIdx >= 0, string(body))
+			assert.True(t, firstIdx < secondIdx, string(body))
+		})
+	}
+}
+
+func TestBuildUploadProgressErrorInline(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-max-path-depth", "4")
+	endpoint := baseURL + "api/v1/build"
+
+	buf := makeTestPostWithEntries(t, `{"exports": ["image"], "upload_progress": true}`, `{"fake": "manifest"}`, tarEntry{
+		name:    "store/sources/org.osbuild.files/a/b",
+		content: "deep-data",
+	})
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	// the status is sent before the upload is extracted
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(body), "path too deep: store/sources/org.osbuild.files/a/b has depth 5, maximum is 4\n"), string(body))
+	assert.NoDirExists(t, filepath.Join(baseBuildDir, "build"))
+}
+
+func makeNestedSourcesTar(t *testing.T, entries ...tarEntry) string {
+	buf := bytes.NewBuffer(nil)
+	archive := tar.NewWriter(buf)
+	for _, entry := range entries {
+		err := writeToTar(archive, entry.name, entry.content)
+		assert.NoError(t, err)
+	}
+	err := archive.Close()
+	assert.NoError(t, err)
+	return buf.String()
+}
+
+func TestBuildNestedSourcesTar(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+cat %[1]s/build/store/sources/org.osbuild.files/sha256:nested
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	nested := makeNestedSourcesTar(t, tarEntry{
+		name:    "store/sources/org.osbuild.files/sha256:nested",
+		content: "nested-data\n",
+	})
+	buf := makeTestPostWithEntries(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`, tarEntry{
+		name:    "sources.tar",
+		content: nested,
+	})
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "nested-data\n", string(body))
+}
+
+func TestHandleIncludedSourcesNestedChecks(t *testing.T) {
+	for _, tc := range []struct {
+		entries     []tarEntry
+		expectedErr string
+	}{
+		{[]tarEntry{{"store/../../etc/passwd", "content"}}, "sources.tar: name not clean: ../etc/passwd != store/../../etc/passwd"},
+		{[]tarEntry{{"build.env", "KEY=value"}}, "sources.tar: expected store/ prefix, got build.env"},
+		{[]tarEntry{{"manifest.json", "{}"}}, "sources.tar: expected store/ prefix, got manifest.json"},
+		{[]tarEntry{{"sources.tar", ""}}, "sources.tar: expected store/ prefix, got sources.tar"},
+		{[]tarEntry{{"store/a", "content"}}, "sources.tar: path too deep: store/a has depth 2, maximum is 1"},
+	} {
+		tmpdir := t.TempDir()
+
+		buf := bytes.NewBuffer(nil)
+		atar := tar.NewWriter(buf)
+		err := writeToTar(atar, "sources.tar", makeNestedSourcesTar(t, tc.entries...))
+		assert.NoError(t, err)
+
+		err = main.HandleIncludedSources(&main.Config{MaxPathDepth: 1}, tar.NewReader(buf), tmpdir, nil)
+		assert.EqualError(t, err, tc.expectedErr)
+	}
+}
+
+func TestBuildReplaceSupersedesRunningBuild(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	// the "slow" manifest never finishes on its own
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+for manifest; do true; done
+if grep -q slow "$manifest"; then
+    echo "slow build started"
+    sleep 30
+fi
+mkdir -p %[1]s/build/output/image
+echo "fast build done"
+`, baseBuildDir))
+	defer restore()
+
+	firstBody := make(chan string)
+	go func() {
+		buf := makeTestPost(t, `{"exports": ["image"]}`, `{"slow": "manifest"}`)
+		rsp, err := http.Post(endpoint, "application/x-tar", buf)
+		assert.NoError(t, err)
+		defer rsp.Body.Close()
+		body, err := ioutil.ReadAll(rsp.Body)
+		assert.NoError(t, err)
+		firstBody <- string(body)
+	}()
+	assert.Eventually(t, func() bool {
+		log, err := ioutil.ReadFile(filepath.Join(baseBuildDir, "build/build.log"))
+		return err == nil && strings.Contains(string(log), "slow build started")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// without replace the running build is kept
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusConflict, rsp.StatusCode)
+
+	buf = makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err = http.Post(endpoint+"?replace=true", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "fast build done\n", string(body))
+
+	select {
+	case body := <-firstBody:
+		assert.Equal(t, "slow build started\nbuild canceled: replaced by a new build\n", body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("replaced build did not finish")
+	}
+
+	manifest, err := ioutil.ReadFile(filepath.Join(baseBuildDir, "build/manifest.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"fake": "manifest"}`, string(manifest))
+	assert.FileExists(t, filepath.Join(baseBuildDir, "result.good"))
+	assert.NoFileExists(t, filepath.Join(baseBuildDir, "result.bad"))
+}
+
+func TestHandleIncludedSourcesSizeMismatch(t *testing.T) {
+	tmpdir := t.TempDir()
+	err := os.Mkdir(filepath.Join(tmpdir, "store"), 0755)
+	assert.NoError(t, err)
+
+	buf := bytes.NewBuffer(nil)
+	atar := tar.NewWriter(buf)
+	err = writeToTar(atar, "store/sources.sizes", `{"sha256:truncated": 100, "sha256:good": 4}`)
+	assert.NoError(t, err)
+	err = writeToTar(atar, "store/sha256:good", "good")
+	assert.NoError(t, err)
+	err = writeToTar(atar, "store/sha256:truncated", "only-part")
+	assert.NoError(t, err)
+	err = writeToTar(atar, "store/sha256:never", "never-extracted")
+	assert.NoError(t, err)
+
+	err = main.HandleIncludedSources(&main.Config{}, tar.NewReader(buf), tmpdir, nil)
+	assert.EqualError(t, err, "size mismatch: store/sha256:truncated has 9 bytes, expected 100")
+	assert.FileExists(t, filepath.Join(tmpdir, "store/sha256:good"))
+	assert.NoFileExists(t, filepath.Join(tmpdir, "store/sha256:truncated"))
+	assert.NoFileExists(t, filepath.Join(tmpdir, "store/sha256:never"))
+	// the index is only used for the extraction
+	assert.NoFileExists(t, filepath.Join(tmpdir, "store/sources.sizes"))
+}
+
+func TestHandleIncludedSourcesFileBeforeDir(t *testing.T) {
+	tmpdir := t.TempDir()
+
+	buf := bytes.NewBuffer(nil)
+	atar := tar.NewWriter(buf)
+	err := writeToTar(atar, "store/sources/org.osbuild.files/sha256:early", "early-data")
+	assert.NoError(t, err)
+	err = atar.WriteHeader(&tar.Header{
+		Name:     "store/sources/org.osbuild.files/",
+		Mode:     0700,
+		Typeflag: tar.TypeDir,
+	})
+	assert.NoError(t, err)
+
+	err = main.HandleIncludedSources(&main.Config{}, tar.NewReader(buf), tmpdir, nil)
+	assert.NoError(t, err)
+	content, err := ioutil.ReadFile(filepath.Join(tmpdir, "store/sources/org.osbuild.files/sha256:early"))
+	assert.NoError(t, err)
+	assert.Equal(t, "early-data", string(content))
+	st, err := os.Stat(filepath.Join(tmpdir, "store/sources/org.osbuild.files"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), st.Mode().Perm())
+}
+
+func TestBuildHeartbeatOnSilentOsbuild(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-heartbeat", "50ms")
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+echo "stage started"
+sleep 0.5
+echo "stage done"
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(body), "stage started\n\n\n"), string(body))
+	assert.True(t, strings.HasSuffix(string(body), "\nstage done\n"), string(body))
+	// the heartbeats are only sent to the client
+	logContent, err := ioutil.ReadFile(filepath.Join(baseBuildDir, "build/build.log"))
+	assert.NoError(t, err)
+	assert.Equal(t, "stage started\nstage done\n", string(logContent))
+}
+
+// readTracker records if the body was read
+type readTracker struct {
+	r    io.Reader
+	read bool
+}
+
+func (rt *readTracker) Read(p []byte) (int, error) {
+	rt.read = true
+	return rt.r.Read(p)
+}
+
+func postExpectContinue(t *testing.T, endpoint, contentType string, body *readTracker, size int) *http.Response {
+	req, err := http.NewRequest(http.MethodPost, endpoint, body)
+	assert.NoError(t, err)
+	req.ContentLength = int64(size)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Expect", "100-continue")
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: defaultTimeout}}
+	rsp, err := client.Do(req)
+	assert.NoError(t, err)
+	return rsp
+}
+
+func TestBuildExpectContinueRejectsEarly(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	for _, tc := range []struct {
+		contentType    string
+		busy           bool
+		expectedStatus int
+	}{
+		{"application/json", false, http.StatusUnsupportedMediaType},
+		{"application/x-tar", true, http.StatusConflict},
+	} {
+		if tc.busy {
+			err := os.Mkdir(filepath.Join(baseBuildDir, "build"), 0700)
+			assert.NoError(t, err)
+		}
+		buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+		body := &readTracker{r: buf}
+		rsp := postExpectContinue(t, endpoint, tc.contentType, body, buf.Len())
+		rsp.Body.Close()
+		assert.Equal(t, tc.expectedStatus, rsp.StatusCode)
+		// the body was never sent
+		assert.False(t, body.read)
+	}
+}
+
+func TestBuildExpectContinue(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	body := &readTracker{r: buf}
+	rsp := postExpectContinue(t, endpoint, "application/x-tar", body, buf.Len())
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	assert.True(t, body.read)
+}
+
+func TestBuildPackagingRetried(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-package-retries", "1")
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockPackageRetryBackoff(time.Millisecond)
+	defer restore()
+	restore = main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+echo "fake-build-result" > %[1]s/build/output/image/disk.img
+`, baseBuildDir))
+	defer restore()
+	failedOnce := filepath.Join(t.TempDir(), "failed-once")
+	restore = main.MockTarBinary(t, fmt.Sprintf(`#!/bin/sh -e
+if [ ! -e %[1]s ]; then
+    touch %[1]s
+    echo "device or resource busy" >&2
+    exit 1
+fi
+exec tar "$@"
+`, failedOnce))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "retrying packaging in 1ms\n", string(body))
+	assert.FileExists(t, filepath.Join(baseBuildDir, "build/output/output.tar"))
+	assert.FileExists(t, filepath.Join(baseBuildDir, "result.good"))
+}
+
+func TestBuildPackagingRetriesExhausted(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-package-retries", "1")
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockPackageRetryBackoff(time.Millisecond)
+	defer restore()
+	restore = main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+	restore = main.MockTarBinary(t, `#!/bin/sh
+echo "device or resource busy" >&2
+exit 1
+`)
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(body), "retrying packaging"), string(body))
+	assert.Contains(t, string(body), "cannot tar output directory: exit status 1")
+	assert.FileExists(t, filepath.Join(baseBuildDir, "result.bad"))
+}
+
+func TestBuildTarBlockSize(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	// each subtest replaces the result of the previous one
+	endpoint := baseURL + "api/v1/build?replace=true"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+echo "fake-build-result" > %[1]s/build/output/image/disk.img
+`, baseBuildDir))
+	defer restore()
+
+	for _, tc := range []struct {
+		control      string
+		expectedSize int64
+	}{
+		{`{"exports": ["image"]}`, 10 * 1024},
+		{`{"exports": ["image"], "tar_block_size": 16}`, 16 * 1024},
+		// three headers, one data record and the two end records
+		{`{"exports": ["image"], "tar_block_size": 1}`, 3 * 1024},
+	} {
+		t.Run(tc.control, func(t *testing.T) {
+			buf := makeTestPost(t, tc.control, `{"fake": "manifest"}`)
+			rsp, err := http.Post(endpoint, "application/x-tar", buf)
+			assert.NoError(t, err)
+			defer rsp.Body.Close()
+			assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+			_, err = ioutil.ReadAll(rsp.Body)
+			assert.NoError(t, err)
+
+			// tar pads the archive to a multiple of the block size
+			st, err := os.Stat(filepath.Join(baseBuildDir, "build/output/output.tar"))
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedSize, st.Size())
+		})
+	}
+}
+
+func TestBuildTarBlockSizeInvalid(t *testing.T) {
+	baseURL, _, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	buf := makeTestPost(t, `{"exports": ["image"], "tar_block_size": 2048}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "invalid tar block size 2048KiB, must be between 1 and 1024KiB\n", string(body))
+}
+
+func TestBuildOutputNames(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+echo "fake-build-result" > %[1]s/build/output/image/disk.img
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"], "output_names": {"image/disk.img": "disk-9.4.img"}}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+
+	rsp, err = http.Get(baseURL + "api/v1/result/image/disk-9.4.img")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "fake-build-result\n", string(body))
+	rsp, err = http.Get(baseURL + "api/v1/result/image/disk.img")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, rsp.StatusCode)
+
+	f, err := os.Open(filepath.Join(baseBuildDir, "build/output/output.tar"))
+	assert.NoError(t, err)
+	defer f.Close()
+	var names []string
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		names = append(names, hdr.Name)
+	}
+	assert.Contains(t, names, "output/image/disk-9.4.img")
+	assert.NotContains(t, names, "output/image/disk.img")
+}
+
+func TestBuildOutputNamesInvalid(t *testing.T) {
+	baseURL, _, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	for _, tc := range []struct {
+		outputNames string
+		expectedErr string
+	}{
+		{`{"image/disk.img": "../../disk.img"}`, `invalid output name: "../../disk.img" for "image/disk.img" must be a file name`},
+		{`{"image/../../etc/passwd": "passwd"}`, `invalid output name: artifact path "image/../../etc/passwd" must be below one of the exports`},
+		{`{"tree/disk.img": "disk-9.4.img"}`, `invalid output name: artifact path "tree/disk.img" must be below one of the exports`},
+		{`{"image": "other"}`, `invalid output name: artifact path "image" must be below one of the exports`},
+	} {
+		control := fmt.Sprintf(`{"exports": ["image"], "output_names": %s}`, tc.outputNames)
+		buf := makeTestPost(t, control, `{"fake": "manifest"}`)
+		rsp, err := http.Post(endpoint, "application/x-tar", buf)
+		assert.NoError(t, err)
+		defer rsp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+		body, err := ioutil.ReadAll(rsp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expectedErr+"\n", string(body))
+	}
+}
+
+func TestBuildCrashReportsSignal(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, `#!/bin/sh -e
+echo "starting"
+kill -SEGV $$
+`)
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["tree"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "starting\nbuild crashed (signal SIGSEGV)\n", string(body))
+	assert.Equal(t, "system", rsp.Trailer.Get("Osbuild-Failure-Class"))
+
+	resultJSON, err := ioutil.ReadFile(filepath.Join(baseBuildDir, "build/result.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"error":"build crashed (signal SIGSEGV)","failure_class":"system","cached_stages":0,"built_stages":0,"crash_signal":"SIGSEGV"}`, string(resultJSON))
+}
+
+func TestBuildCrashCollectsCore(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-collect-cores")
+	endpoint := baseURL + "api/v1/build"
+
+	// fake the core that the kernel writes to the cwd, SIGTERM
+	// ensures the kernel does not write a real one
+	restore := main.MockOsbuildBinary(t, `#!/bin/sh -e
+echo "fake-core" > core.$$
+kill -TERM $$
+`)
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["tree"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	corePath := filepath.Join(baseBuildDir, "build/osbuild.core")
+	assert.Equal(t, fmt.Sprintf("build crashed (signal SIGTERM)\ncore written to %v\n", corePath), string(body))
+	content, err := ioutil.ReadFile(corePath)
+	assert.NoError(t, err)
+	assert.Equal(t, "fake-core\n", string(content))
+}
+
+func TestBuildManifestViaStdin(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-manifest-via-stdin")
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+for arg; do last="$arg"; done
+echo "manifest arg: $last"
+cat
+echo
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "manifest arg: -\n{\"fake\": \"manifest\"}\n", string(body))
+}
+
+func TestBuildSummaryWarnings(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	// osbuild has the stage output in its --json result
+	output := []string{
+		"org.osbuild.rpm: starting",
+		"WARNING: stage org.osbuild.fstab is deprecated",
+		"/usr/lib/osbuild/stages/org.osbuild.rpm:12: DeprecationWarning: the imp module is deprecated",
+		"no warnings here",
+	}
+	for i := 1; i <= 200; i++ {
+		output = append(output, fmt.Sprintf("warning: noise %v", i))
+	}
+	quoted, err := json.Marshal(strings.Join(output, "\n"))
+	assert.NoError(t, err)
+	result := fmt.Sprintf(`{"type": "result", "success": true, "log": {"image": [{"id": "%s", "type": "org.osbuild.rpm", "output": %s}]}}`, strings.Repeat("a", 64), quoted)
+	resultPath := filepath.Join(t.TempDir(), "result.json")
+	err = os.WriteFile(resultPath, []byte(result+"\n"), 0644)
+	assert.NoError(t, err)
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+echo "WARNING: not part of a stage"
+mkdir -p %[1]s/build/output/image
+cat %[2]s
+`, baseBuildDir, resultPath))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+
+	rsp, err = http.Get(baseURL + "api/v1/build/summary")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	var summary struct {
+		Error    string   `json:"error"`
+		Warnings []string `json:"warnings"`
+	}
+	err = json.NewDecoder(rsp.Body).Decode(&summary)
+	assert.NoError(t, err)
+	assert.Equal(t, "", summary.Error)
+	// the number of collected warnings is bounded
+	assert.Len(t, summary.Warnings, 101)
+	assert.Equal(t, []string{
+		"WARNING: stage org.osbuild.fstab is deprecated",
+		"/usr/lib/osbuild/stages/org.osbuild.rpm:12: DeprecationWarning: the imp module is deprecated",
+		"warning: noise 1",
+	}, summary.Warnings[:3])
+	assert.Equal(t, "102 more warnings not shown", summary.Warnings[100])
+}
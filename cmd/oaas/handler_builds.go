@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"golang.org/x/exp/slices"
+
+	"github.com/sirupsen/logrus"
+)
+
+const defaultBuildsPerPage = 50
+
+var buildStates = []string{"running", "succeeded", "failed"}
+
+type buildListEntry struct {
+	ID      string    `json:"id"`
+	State   string    `json:"state"`
+	Started time.Time `json:"started"`
+	Exports []string  `json:"exports"`
+	BuildID string    `json:"build_id,omitempty"`
+}
+
+type buildList struct {
+	Builds []buildListEntry `json:"builds"`
+	Total  int              `json:"total"`
+}
+
+// listBuilds scans the build dir base for builds, a build without a
+// result.json is still running
+func listBuilds(config *Config) ([]buildListEntry, error) {
+	entries, err := ioutil.ReadDir(config.BuildDirBase)
+	// the build dir base is only created with the first build
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var builds []buildListEntry
+	for _, entry := range entries {
+		buildDir := filepath.Join(config.BuildDirBase, entry.Name())
+		info, err := readBuildInfo(buildDir)
+		if err != nil {
+			// not a (started) build
+			continue
+		}
+		build := buildListEntry{
+			ID:      entry.Name(),
+			State:   "running",
+			Started: info.Started,
+			Exports: info.Exports,
+			BuildID: info.BuildID,
+		}
+		br := &buildResult{resultJSON: filepath.Join(buildDir, "result.json")}
+		if summary, err := br.Summary(); err == nil {
+			if summary.Error != "" {
+				build.State = "failed"
+			} else {
+				build.State = "succeeded"
+			}
+		}
+		builds = append(builds, build)
+	}
+	// newest first
+	sort.SliceStable(builds, func(i, j int) bool {
+		return builds[i].Started.After(builds[j].Started)
+	})
+	return builds, nil
+}
+
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid %s %q", name, s)
+	}
+	return n, nil
+}
+
+func handleBuilds(logger *logrus.Logger, config *Config) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			logger.Debugf("handlerBuilds called on %s", r.URL.Path)
+			if r.Method != http.MethodGet {
+				http.Error(w, "builds endpoint only supports GET", http.StatusMethodNotAllowed)
+				return
+			}
+			state := r.URL.Query().Get("state")
+			if state != "" && !slices.Contains(buildStates, state) {
+				http.Error(w, fmt.Sprintf("invalid state %q, must be one of %v", state, buildStates), http.StatusBadRequest)
+				return
+			}
+			page, err := queryInt(r, "page", 1)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			perPage, err := queryInt(r, "per_page", defaultBuildsPerPage)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			builds, err := listBuilds(config)
+			if err != nil {
+				logger.Errorf("cannot list builds: %v", err)
+				http.Error(w, "cannot list builds", http.StatusInternalServerError)
+				return
+			}
+			list := buildList{Builds: []buildListEntry{}}
+			for _, build := range builds {
+				if state != "" && build.State != state {
+					continue
+				}
+				list.Total++
+				if list.Total > (page-1)*perPage && len(list.Builds) < perPage {
+					list.Builds = append(list.Builds, build)
+				}
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(&list); err != nil {
+				logger.Errorf("cannot write builds: %v", err)
+			}
+		},
+	)
+}
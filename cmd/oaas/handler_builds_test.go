@@ -0,0 +1,202 @@
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+type buildsListing struct {
+	Builds []struct {
+		ID      string   `json:"id"`
+		State   string   `json:"state"`
+		Exports []string `json:"exports"`
+		BuildID string   `json:"build_id"`
+	} `json:"builds"`
+	Total int `json:"total"`
+}
+
+func makeBuildDir(t *testing.T, buildBaseDir, id, started, result string) {
+	buildDir := filepath.Join(buildBaseDir, id)
+	err := os.MkdirAll(buildDir, 0755)
+	assert.NoError(t, err)
+	info := fmt.Sprintf(`{"started": %q, "exports": ["image"]}`, started)
+	err = ioutil.WriteFile(filepath.Join(buildDir, "build.json"), []byte(info), 0644)
+	assert.NoError(t, err)
+	if result != "" {
+		err = ioutil.WriteFile(filepath.Join(buildDir, "result.json"), []byte(result), 0644)
+		assert.NoError(t, err)
+	}
+}
+
+func getBuilds(t *testing.T, endpoint string) *buildsListing {
+	rsp, err := http.Get(endpoint)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	var listing buildsListing
+	err = json.NewDecoder(rsp.Body).Decode(&listing)
+	assert.NoError(t, err)
+	return &listing
+}
+
+func TestBuildsListing(t *testing.T) {
+	baseURL, buildBaseDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/builds"
+
+	makeBuildDir(t, buildBaseDir, "build-1", "2024-01-01T10:00:00Z", `{"cached_stages":0,"built_stages":3}`)
+	makeBuildDir(t, buildBaseDir, "build-2", "2024-01-02T10:00:00Z", `{"error":"exit status 1","cached_stages":0,"built_stages":1}`)
+	makeBuildDir(t, buildBaseDir, "build-3", "2024-01-03T10:00:00Z", `{"error":"build aborted: timeout","cached_stages":1,"built_stages":0}`)
+	makeBuildDir(t, buildBaseDir, "build-4", "2024-01-04T10:00:00Z", "")
+	// dirs without build info are ignored
+	err := os.MkdirAll(filepath.Join(buildBaseDir, "not-a-build"), 0755)
+	assert.NoError(t, err)
+
+	listing := getBuilds(t, endpoint)
+	assert.Equal(t, 4, listing.Total)
+	var ids, states []string
+	for _, build := range listing.Builds {
+		ids = append(ids, build.ID)
+		states = append(states, build.State)
+		assert.Equal(t, []string{"image"}, build.Exports)
+	}
+	assert.Equal(t, []string{"build-4", "build-3", "build-2", "build-1"}, ids)
+	assert.Equal(t, []string{"running", "failed", "failed", "succeeded"}, states)
+
+	listing = getBuilds(t, endpoint+"?state=failed")
+	assert.Equal(t, 2, listing.Total)
+	assert.Equal(t, 2, len(listing.Builds))
+	assert.Equal(t, "build-3", listing.Builds[0].ID)
+	assert.Equal(t, "build-2", listing.Builds[1].ID)
+
+	listing = getBuilds(t, endpoint+"?state=failed&per_page=1&page=2")
+	assert.Equal(t, 2, listing.Total)
+	assert.Equal(t, 1, len(listing.Builds))
+	assert.Equal(t, "build-2", listing.Builds[0].ID)
+}
+
+func TestBuildsListingBadState(t *testing.T) {
+	baseURL, _, _ := runTestServer(t)
+
+	rsp, err := http.Get(baseURL + "api/v1/builds?state=unknown")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "invalid state \"unknown\", must be one of [running succeeded failed]\n", string(body))
+}
+
+func TestBuildsFreshBuildPath(t *testing.T) {
+	buildBaseDir := filepath.Join(t.TempDir(), "not-created-yet")
+	baseURL, _, _ := runTestServer(t, "-build-path", buildBaseDir)
+
+	listing := getBuilds(t, baseURL+"api/v1/builds")
+	assert.Equal(t, 0, listing.Total)
+	assert.Len(t, listing.Builds, 0)
+}
+
+func TestBuildsClientBuildID(t *testing.T) {
+	baseURL, buildBaseDir, hook := runTestServer(t)
+	buildID := "0b7d5f3e-2a4c-4e1f-9c3b-6d8e2f1a4b5c"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+`, buildBaseDir))
+	defer restore()
+
+	buf := makeTestPost(t, fmt.Sprintf(`{"exports": ["image"], "build_id": %q}`, buildID), `{"fake": "manifest"}`)
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	assert.Equal(t, buildID, rsp.Header.Get("X-Build-Id"))
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+
+	listing := getBuilds(t, baseURL+"api/v1/builds")
+	assert.Equal(t, 1, listing.Total)
+	assert.Equal(t, buildID, listing.Builds[0].BuildID)
+	logged := false
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == fmt.Sprintf("build %v started", buildID) {
+			logged = true
+		}
+	}
+	assert.True(t, logged)
+
+	// the id of a build that is still around cannot be reused
+	buf = makeTestPost(t, fmt.Sprintf(`{"exports": ["image"], "build_id": %q}`, buildID), `{"fake": "manifest"}`)
+	rsp, err = http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusConflict, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("duplicate build id %q\n", buildID), string(body))
+}
+
+func TestBuildsClientBuildIDFreshBuildPath(t *testing.T) {
+	buildBaseDir := filepath.Join(t.TempDir(), "not-created-yet")
+	baseURL, _, _ := runTestServer(t, "-build-path", buildBaseDir)
+	buildID := "0b7d5f3e-2a4c-4e1f-9c3b-6d8e2f1a4b5c"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+`, buildBaseDir))
+	defer restore()
+
+	buf := makeTestPost(t, fmt.Sprintf(`{"exports": ["image"], "build_id": %q}`, buildID), `{"fake": "manifest"}`)
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	assert.Equal(t, buildID, rsp.Header.Get("X-Build-Id"))
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+}
+
+func TestBuildsGeneratedBuildID(t *testing.T) {
+	baseURL, buildBaseDir, _ := runTestServer(t)
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+`, buildBaseDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	buildID := rsp.Header.Get("X-Build-Id")
+	assert.Len(t, strings.Split(buildID, "-"), 5)
+	assert.Equal(t, "4", buildID[14:15])
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+
+	listing := getBuilds(t, baseURL+"api/v1/builds")
+	assert.Equal(t, buildID, listing.Builds[0].BuildID)
+}
+
+func TestBuildsInvalidBuildID(t *testing.T) {
+	baseURL, _, _ := runTestServer(t)
+
+	buf := makeTestPost(t, `{"exports": ["image"], "build_id": "../../etc"}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "invalid build id \"../../etc\", must be a lowercase UUID\n", string(body))
+}
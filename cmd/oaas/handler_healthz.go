@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+type healthState struct {
+	Healthy     bool   `json:"healthy"`
+	Maintenance bool   `json:"maintenance"`
+	Error       string `json:"error,omitempty"`
+}
+
+// handleHealthz reports if the server can run builds, load balancers
+// and probes use it, a server in maintenance is drained this way
+func handleHealthz(logger *logrus.Logger, config *Config) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			logger.Debugf("handleHealthz called on %s", r.URL.Path)
+			if r.Method != http.MethodGet {
+				http.Error(w, "healthz endpoint only supports GET", http.StatusMethodNotAllowed)
+				return
+			}
+			state := healthState{Healthy: true, Maintenance: inMaintenance(config)}
+			switch {
+			case !osbuildVerified(config):
+				state.Healthy = false
+				state.Error = ErrOsbuildChecksumMismatch.Error()
+			case state.Maintenance:
+				state.Healthy = false
+				state.Error = "maintenance"
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			if !state.Healthy {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			if err := json.NewEncoder(w).Encode(&state); err != nil {
+				logger.Errorf("cannot write health state: %v", err)
+			}
+		},
+	)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+var maxManifestDiffSize int64 = 16 * 1024 * 1024
+
+// maxManifestDiffStages limits the stages of a single pipeline, the
+// stage diff needs len(old)*len(new) memory and comparisons
+var maxManifestDiffStages = 1000
+
+var ErrTooManyDiffStages = errors.New("too many stages")
+
+type manifestDiffRequest struct {
+	Old json.RawMessage `json:"old"`
+	New json.RawMessage `json:"new"`
+}
+
+type diffManifest struct {
+	Pipelines []map[string]interface{} `json:"pipelines"`
+}
+
+type stageRef struct {
+	Type  string `json:"type"`
+	Index int    `json:"index"`
+}
+
+type stageMove struct {
+	Type     string `json:"type"`
+	OldIndex int    `json:"old_index"`
+	NewIndex int    `json:"new_index"`
+}
+
+type stageChange struct {
+	stageMove
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+type pipelineDiff struct {
+	Name          string        `json:"name"`
+	FieldsChanged []string      `json:"fields_changed,omitempty"`
+	StagesAdded   []stageRef    `json:"stages_added,omitempty"`
+	StagesRemoved []stageRef    `json:"stages_removed,omitempty"`
+	StagesChanged []stageChange `json:"stages_changed,omitempty"`
+	StagesMoved   []stageMove   `json:"stages_moved,omitempty"`
+}
+
+type manifestDiff struct {
+	PipelinesAdded   []string       `json:"pipelines_added"`
+	PipelinesRemoved []string       `json:"pipelines_removed"`
+	PipelinesChanged []pipelineDiff `json:"pipelines_changed"`
+}
+
+func pipelineName(p map[string]interface{}) string {
+	name, _ := p["name"].(string)
+	return name
+}
+
+func pipelineStages(p map[string]interface{}) []map[string]interface{} {
+	list, _ := p["stages"].([]interface{})
+	stages := make([]map[string]interface{}, 0, len(list))
+	for _, s := range list {
+		stage, _ := s.(map[string]interface{})
+		stages = append(stages, stage)
+	}
+	return stages
+}
+
+func stageType(s map[string]interface{}) string {
+	typ, _ := s["type"].(string)
+	return typ
+}
+
+// commonStages returns the index pairs of the longest common
+// subsequence of identical stages
+func commonStages(from, to []map[string]interface{}) [][2]int {
+	lcs := make([][]int, len(from)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(to)+1)
+	}
+	for i := len(from) - 1; i >= 0; i-- {
+		for j := len(to) - 1; j >= 0; j-- {
+			if reflect.DeepEqual(from[i], to[j]) {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var pairs [][2]int
+	for i, j := 0, 0; i < len(from) && j < len(to); {
+		switch {
+		case reflect.DeepEqual(from[i], to[j]):
+			pairs = append(pairs, [2]int{i, j})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return pairs
+}
+
+// diffStages keeps the stages in common order as unchanged, the
+// remaining identical stages were moved and the remaining stages of
+// the same type were changed
+func diffStages(pd *pipelineDiff, from, to []map[string]interface{}) {
+	fromUsed := make([]bool, len(from))
+	toUsed := make([]bool, len(to))
+	for _, pair := range commonStages(from, to) {
+		fromUsed[pair[0]] = true
+		toUsed[pair[1]] = true
+	}
+	pairUp := func(match func(o, n map[string]interface{}) bool, found func(i, j int)) {
+		for j, n := range to {
+			if toUsed[j] {
+				continue
+			}
+			for i, o := range from {
+				if !fromUsed[i] && match(o, n) {
+					fromUsed[i] = true
+					toUsed[j] = true
+					found(i, j)
+					break
+				}
+			}
+		}
+	}
+	pairUp(func(o, n map[string]interface{}) bool {
+		return reflect.DeepEqual(o, n)
+	}, func(i, j int) {
+		pd.StagesMoved = append(pd.StagesMoved, stageMove{Type: stageType(to[j]), OldIndex: i, NewIndex: j})
+	})
+	pairUp(func(o, n map[string]interface{}) bool {
+		return stageType(o) == stageType(n)
+	}, func(i, j int) {
+		pd.StagesChanged = append(pd.StagesChanged, stageChange{
+			stageMove: stageMove{Type: stageType(to[j]), OldIndex: i, NewIndex: j},
+			Old:       from[i],
+			New:       to[j],
+		})
+	})
+	for i, o := range from {
+		if !fromUsed[i] {
+			pd.StagesRemoved = append(pd.StagesRemoved, stageRef{Type: stageType(o), Index: i})
+		}
+	}
+	for j, n := range to {
+		if !toUsed[j] {
+			pd.StagesAdded = append(pd.StagesAdded, stageRef{Type: stageType(n), Index: j})
+		}
+	}
+}
+
+func diffPipeline(from, to map[string]interface{}) *pipelineDiff {
+	pd := &pipelineDiff{Name: pipelineName(to)}
+	keys := make(map[string]bool)
+	for k := range from {
+		keys[k] = true
+	}
+	for k := range to {
+		keys[k] = true
+	}
+	for k := range keys {
+		if k != "stages" && !reflect.DeepEqual(from[k], to[k]) {
+			pd.FieldsChanged = append(pd.FieldsChanged, k)
+		}
+	}
+	sort.Strings(pd.FieldsChanged)
+	diffStages(pd, pipelineStages(from), pipelineStages(to))
+
+	if pd.FieldsChanged == nil && pd.StagesAdded == nil && pd.StagesRemoved == nil && pd.StagesChanged == nil && pd.StagesMoved == nil {
+		return nil
+	}
+	return pd
+}
+
+// diffManifests compares the pipelines by name, the order of the
+// pipelines does not matter
+func diffManifests(from, to *diffManifest) *manifestDiff {
+	diff := &manifestDiff{
+		PipelinesAdded:   []string{},
+		PipelinesRemoved: []string{},
+		PipelinesChanged: []pipelineDiff{},
+	}
+	fromPipelines := make(map[string]map[string]interface{})
+	for _, p := range from.Pipelines {
+		fromPipelines[pipelineName(p)] = p
+	}
+	toNames := make(map[string]bool)
+	for _, p := range to.Pipelines {
+		name := pipelineName(p)
+		toNames[name] = true
+		op, ok := fromPipelines[name]
+		if !ok {
+			diff.PipelinesAdded = append(diff.PipelinesAdded, name)
+			continue
+		}
+		if pd := diffPipeline(op, p); pd != nil {
+			diff.PipelinesChanged = append(diff.PipelinesChanged, *pd)
+		}
+	}
+	for _, p := range from.Pipelines {
+		if !toNames[pipelineName(p)] {
+			diff.PipelinesRemoved = append(diff.PipelinesRemoved, pipelineName(p))
+		}
+	}
+	return diff
+}
+
+func decodeDiffManifest(data json.RawMessage, which string) (*diffManifest, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("missing %q manifest", which)
+	}
+	var m diffManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("cannot decode %q manifest: %v", which, err)
+	}
+	for _, p := range m.Pipelines {
+		if n := len(pipelineStages(p)); n > maxManifestDiffStages {
+			return nil, fmt.Errorf("%w: pipeline %q of %q manifest has %v stages (maximum %v)", ErrTooManyDiffStages, pipelineName(p), which, n, maxManifestDiffStages)
+		}
+	}
+	return &m, nil
+}
+
+func manifestDiffErrorStatus(err error) int {
+	if errors.Is(err, ErrTooManyDiffStages) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+func handleManifestDiff(logger *logrus.Logger, config *Config) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			logger.Debugf("handleManifestDiff called on %s", r.URL.Path)
+			if r.Method != http.MethodPost {
+				http.Error(w, "manifest diff endpoint only supports POST", http.StatusMethodNotAllowed)
+				return
+			}
+
+			var req manifestDiffRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxManifestDiffSize)).Decode(&req); err != nil {
+				logger.Error(err)
+				http.Error(w, fmt.Sprintf("cannot decode request: %v", err), http.StatusBadRequest)
+				return
+			}
+			from, err := decodeDiffManifest(req.Old, "old")
+			if err != nil {
+				http.Error(w, err.Error(), manifestDiffErrorStatus(err))
+				return
+			}
+			to, err := decodeDiffManifest(req.New, "new")
+			if err != nil {
+				http.Error(w, err.Error(), manifestDiffErrorStatus(err))
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(diffManifests(from, to)); err != nil {
+				logger.Errorf("cannot write manifest diff: %v", err)
+			}
+		},
+	)
+}
@@ -0,0 +1,138 @@
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+const diffOldManifest = `{
+  "version": "2",
+  "pipelines": [
+    {"name": "build", "stages": [{"type": "org.osbuild.rpm", "options": {"gpgkeys": []}}]},
+    {"name": "os", "build": "name:build", "stages": [
+      {"type": "org.osbuild.rpm", "options": {"gpgkeys": []}},
+      {"type": "org.osbuild.locale", "options": {"language": "en_US"}},
+      {"type": "org.osbuild.hostname", "options": {"hostname": "old"}}
+    ]}
+  ]
+}`
+
+func postManifestDiff(t *testing.T, baseURL, from, to string) (int, string) {
+	body := fmt.Sprintf(`{"old": %s, "new": %s}`, from, to)
+	rsp, err := http.Post(baseURL+"api/v1/manifest/diff", "application/json", strings.NewReader(body))
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	data, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	return rsp.StatusCode, string(data)
+}
+
+func TestManifestDiffOneStageAdded(t *testing.T) {
+	baseURL, _, _ := runTestServer(t)
+
+	to := strings.Replace(diffOldManifest, `{"type": "org.osbuild.locale"`, `{"type": "org.osbuild.timezone", "options": {"zone": "UTC"}},
+      {"type": "org.osbuild.locale"`, 1)
+	status, body := postManifestDiff(t, baseURL, diffOldManifest, to)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{
+  "pipelines_added": [],
+  "pipelines_removed": [],
+  "pipelines_changed": [
+    {"name": "os", "stages_added": [{"type": "org.osbuild.timezone", "index": 1}]}
+  ]
+}`, body)
+}
+
+func TestManifestDiffReorderAndOptions(t *testing.T) {
+	baseURL, _, _ := runTestServer(t)
+
+	// pipelines reordered (no change), stages reordered and the
+	// hostname options changed, a new pipeline
+	to := `{
+  "version": "2",
+  "pipelines": [
+    {"name": "os", "build": "name:build", "stages": [
+      {"type": "org.osbuild.locale", "options": {"language": "en_US"}},
+      {"type": "org.osbuild.rpm", "options": {"gpgkeys": []}},
+      {"type": "org.osbuild.hostname", "options": {"hostname": "new"}}
+    ]},
+    {"name": "build", "stages": [{"type": "org.osbuild.rpm", "options": {"gpgkeys": []}}]},
+    {"name": "image", "build": "name:build", "stages": []}
+  ]
+}`
+	status, body := postManifestDiff(t, baseURL, diffOldManifest, to)
+	assert.Equal(t, http.StatusOK, status)
+
+	var diff struct {
+		PipelinesAdded   []string `json:"pipelines_added"`
+		PipelinesRemoved []string `json:"pipelines_removed"`
+		PipelinesChanged []struct {
+			Name          string            `json:"name"`
+			StagesAdded   []json.RawMessage `json:"stages_added"`
+			StagesRemoved []json.RawMessage `json:"stages_removed"`
+			StagesMoved   []struct {
+				Type     string `json:"type"`
+				OldIndex int    `json:"old_index"`
+				NewIndex int    `json:"new_index"`
+			} `json:"stages_moved"`
+			StagesChanged []struct {
+				Type string          `json:"type"`
+				Old  json.RawMessage `json:"old"`
+				New  json.RawMessage `json:"new"`
+			} `json:"stages_changed"`
+		} `json:"pipelines_changed"`
+	}
+	err := json.Unmarshal([]byte(body), &diff)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"image"}, diff.PipelinesAdded)
+	assert.Equal(t, []string{}, diff.PipelinesRemoved)
+	assert.Equal(t, 1, len(diff.PipelinesChanged))
+	pd := diff.PipelinesChanged[0]
+	assert.Equal(t, "os", pd.Name)
+	assert.Nil(t, pd.StagesAdded)
+	assert.Nil(t, pd.StagesRemoved)
+	assert.Equal(t, 1, len(pd.StagesMoved))
+	assert.Equal(t, "org.osbuild.rpm", pd.StagesMoved[0].Type)
+	assert.Equal(t, 0, pd.StagesMoved[0].OldIndex)
+	assert.Equal(t, 1, pd.StagesMoved[0].NewIndex)
+	assert.Equal(t, 1, len(pd.StagesChanged))
+	assert.Equal(t, "org.osbuild.hostname", pd.StagesChanged[0].Type)
+	assert.JSONEq(t, `{"type": "org.osbuild.hostname", "options": {"hostname": "old"}}`, string(pd.StagesChanged[0].Old))
+	assert.JSONEq(t, `{"type": "org.osbuild.hostname", "options": {"hostname": "new"}}`, string(pd.StagesChanged[0].New))
+}
+
+func TestManifestDiffErrors(t *testing.T) {
+	baseURL, _, _ := runTestServer(t)
+
+	rsp, err := http.Get(baseURL + "api/v1/manifest/diff")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, rsp.StatusCode)
+
+	rsp, err = http.Post(baseURL+"api/v1/manifest/diff", "application/json", strings.NewReader(`{"old": {}}`))
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "missing \"new\" manifest\n", string(body))
+}
+
+func TestManifestDiffTooManyStages(t *testing.T) {
+	restore := main.MockMaxManifestDiffStages(2)
+	defer restore()
+	baseURL, _, _ := runTestServer(t)
+
+	// the "os" pipeline has 3 stages
+	status, body := postManifestDiff(t, baseURL, diffOldManifest, diffOldManifest)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	assert.Equal(t, "too many stages: pipeline \"os\" of \"old\" manifest has 3 stages (maximum 2)\n", body)
+}
@@ -1,27 +1,83 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+
+	"golang.org/x/exp/slices"
 
 	"github.com/sirupsen/logrus"
 )
 
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func isAvailableExport(config *Config, urlPath string) bool {
+	elem := strings.SplitN(strings.TrimPrefix(path.Clean("/"+urlPath), "/"), "/", 2)[0]
+	elem = strings.TrimSuffix(elem, ".tar")
+	buildDir := buildDirPath(config)
+	return elem != "" && slices.Contains(availableExports(buildDir), elem)
+}
+
+// serveXAccelRedirect lets nginx serve the result file from disk,
+// the response carries no body
+func serveXAccelRedirect(w http.ResponseWriter, config *Config, outputDir, resultPath string) {
+	rel, err := filepath.Rel(outputDir, resultPath)
+	if err != nil {
+		http.Error(w, "cannot find result", http.StatusInternalServerError)
+		return
+	}
+	location := &url.URL{Path: path.Join(config.XAccelRedirect, filepath.ToSlash(rel))}
+	w.Header().Set("X-Accel-Redirect", location.EscapedPath())
+	w.WriteHeader(http.StatusOK)
+}
+
 func handleResult(logger *logrus.Logger, config *Config) http.Handler {
+	files := newResultFiles(func() {
+		if err := cleanupBuild(config); err != nil {
+			logger.Errorf("cannot cleanup build: %v", err)
+		}
+	})
+
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
 			logger.Debugf("handlerResult called on %s", r.URL.Path)
-			if r.Method != http.MethodGet {
-				http.Error(w, "result endpoint only supports Get", http.StatusMethodNotAllowed)
+			// HEAD lets clients probe the size and type of a
+			// result before downloading it
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				http.Error(w, "result endpoint only supports Get and Head", http.StatusMethodNotAllowed)
+				return
+			}
+			// only the final output.tar is ever served
+			if path.Base(path.Clean("/"+r.URL.Path)) == outputTarTmpName {
+				http.NotFound(w, r)
 				return
 			}
 			buildResult := newBuildResult(config)
+			running := false
 			switch {
 			case buildResult.Bad():
-				http.Error(w, "build failed", http.StatusBadRequest)
-				f, err := os.Open(filepath.Join(config.BuildDirBase, "build/build.log"))
+				status := http.StatusBadRequest
+				msg := "build failed"
+				if summary, err := buildResult.Summary(); err == nil {
+					status = failureStatus(summary.FailureClass)
+					if summary.Error != "" {
+						msg = fmt.Sprintf("build failed: %v", summary.Error)
+					}
+				}
+				if config.FailedResultStatus != 0 {
+					status = config.FailedResultStatus
+				}
+				http.Error(w, msg, status)
+				f, err := os.Open(filepath.Join(buildDirPath(config), "build.log"))
 				if err != nil {
 					logger.Errorf("cannot open log: %v", err)
 					return
@@ -32,12 +88,157 @@ func handleResult(logger *logrus.Logger, config *Config) http.Handler {
 			case buildResult.Good():
 				// good result
 			default:
-				http.Error(w, "build still running", http.StatusTooEarly)
+				// the output.tar can be downloaded while it is
+				// packaged
+				if config.StreamResult && r.URL.Path == "output.tar" && r.Method == http.MethodGet {
+					pr, err := openPackagingOutput(r.Context(), config, filepath.Join(buildDirPath(config), "output"))
+					if err != nil {
+						logger.Errorf("cannot open packaging output: %v", err)
+						http.Error(w, "cannot open result", http.StatusInternalServerError)
+						return
+					}
+					if pr != nil {
+						if err := streamPackagingOutput(w, r, config, pr); err != nil {
+							logger.Errorf("cannot stream output.tar: %v", err)
+							// ensure the client sees a broken download
+							panic(http.ErrAbortHandler)
+						}
+						return
+					}
+				}
+				// exports can be complete before the build is done
+				if !isAvailableExport(config, r.URL.Path) {
+					http.Error(w, "build still running", http.StatusTooEarly)
+					return
+				}
+				running = true
+			}
+
+			// results that got uploaded are referenced by their
+			// object urls instead of being served from here
+			uploadRecordPath := filepath.Join(buildDirPath(config), "upload.json")
+			if r.URL.Path == "output.tar" && fileExists(uploadRecordPath) {
+				w.Header().Set("Content-Type", "application/json")
+				http.ServeFile(w, r, uploadRecordPath)
 				return
 			}
 
-			fss := http.FileServer(http.Dir(filepath.Join(config.BuildDirBase, "build/output")))
-			fss.ServeHTTP(w, r)
+			// the output.tar of a finished build is served from
+			// its immutable content addressed location
+			if config.ContentAddressedResults && r.URL.Path == "output.tar" && !running {
+				if summary, err := buildResult.Summary(); err == nil && summary.OutputDigest != "" {
+					http.Redirect(w, r, byDigestURLPath+summary.OutputDigest, http.StatusFound)
+					return
+				}
+			}
+
+			outputDir := filepath.Join(buildDirPath(config), "output")
+			resultPath := filepath.Join(outputDir, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+			if checksumsEnabled(config) {
+				served, err := serveOutputChecksum(w, r, buildDirPath(config), outputDir, resultPath)
+				if err != nil {
+					logger.Errorf("cannot compute checksum: %v", err)
+					http.Error(w, "cannot compute checksum", http.StatusInternalServerError)
+					return
+				}
+				if served {
+					return
+				}
+			}
+			// a compressed output.tar is passed through to clients
+			// that accept the encoding
+			decompress := false
+			if stored := storedCompressedOutput(config, outputDir, resultPath); stored != "" {
+				resultPath = stored
+				encoding := outputCompressions[config.OutputCompression].encoding
+				w.Header().Set("Vary", "Accept-Encoding")
+				w.Header().Set("Content-Type", "application/x-tar")
+				if acceptsEncoding(r, encoding) {
+					w.Header().Set("Content-Encoding", encoding)
+				} else {
+					decompress = true
+				}
+			}
+			// directories can be downloaded as "<dir>.tar"
+			exportDir := strings.TrimSuffix(resultPath, ".tar")
+			if exportDir != resultPath && exportDir != outputDir && !fileExists(resultPath) {
+				if st, err := os.Stat(exportDir); err == nil && st.IsDir() {
+					// the tar is generated on the fly so its
+					// size is unknown
+					if r.Method == http.MethodHead {
+						w.Header().Set("Content-Type", "application/x-tar")
+						w.WriteHeader(http.StatusOK)
+						return
+					}
+					if err := serveDirTar(w, exportDir); err != nil {
+						logger.Errorf("cannot stream %v: %v", exportDir, err)
+						// ensure the client sees a broken download
+						panic(http.ErrAbortHandler)
+					}
+					return
+				}
+			}
+
+			if st, err := os.Stat(resultPath); err != nil || !st.Mode().IsRegular() {
+				// let the fileserver deal with dirs and errors
+				fss := http.FileServer(http.Dir(outputDir))
+				fss.ServeHTTP(w, r)
+				return
+			}
+
+			if config.XAccelRedirect != "" && !decompress {
+				serveXAccelRedirect(w, config, outputDir, resultPath)
+				return
+			}
+
+			sf, err := files.Open(resultPath)
+			if err != nil {
+				logger.Errorf("cannot open result: %v", err)
+				http.Error(w, "cannot open result", http.StatusInternalServerError)
+				return
+			}
+			st, err := sf.Stat()
+			if err != nil {
+				files.Release(sf, false)
+				logger.Errorf("cannot stat result: %v", err)
+				http.Error(w, "cannot stat result", http.StatusInternalServerError)
+				return
+			}
+			// use a section reader so that concurrent downloads
+			// can share the file
+			content := io.NewSectionReader(sf, 0, st.Size())
+			if decompress && r.Method == http.MethodHead {
+				files.Release(sf, false)
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			if decompress {
+				err := decompressTo(w, content)
+				files.Release(sf, err == nil && config.CleanupAfterResult && !running)
+				if err != nil {
+					logger.Errorf("cannot decompress %v: %v", resultPath, err)
+					// ensure the client sees a broken download
+					panic(http.ErrAbortHandler)
+				}
+				return
+			}
+			// with range requests the cleanup has to wait until
+			// all ranges got downloaded so that clients can resume
+			w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, st.ModTime().UnixNano(), st.Size()))
+			rr := &rangeRecorder{ResponseWriter: w}
+			http.ServeContent(rr, r, st.Name(), st.ModTime(), content)
+			servedKey := fmt.Sprintf("%s@%d", resultPath, st.ModTime().UnixNano())
+			complete := files.Served(servedKey, rr, st.Size())
+			if config.CleanupAfterResult && !running && !complete && rr.written > 0 && config.ResultCleanupTTL > 0 {
+				marker, err := os.Stat(resultMarkerPath(config, "good"))
+				if err == nil {
+					files.CleanupAfter(config.ResultCleanupTTL, func() bool {
+						st, err := os.Stat(resultMarkerPath(config, "good"))
+						return err == nil && os.SameFile(st, marker) && st.ModTime().Equal(marker.ModTime())
+					})
+				}
+			}
+			files.Release(sf, config.CleanupAfterResult && !running && complete)
 		},
 	)
 }
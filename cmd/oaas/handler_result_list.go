@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+type resultListEntry struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// listOutputFiles returns the regular files in the output dir, the
+// names are relative to the output dir so that they can be fetched
+// from the result endpoint
+func listOutputFiles(outputDir string) ([]resultListEntry, error) {
+	files := []resultListEntry{}
+	err := filepath.Walk(outputDir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == outputDir {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || info.Name() == outputTarTmpName {
+			return nil
+		}
+		name, err := filepath.Rel(outputDir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, resultListEntry{Name: filepath.ToSlash(name), Size: info.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// handleResultList lists the output files that exist right now,
+// this works while the build is still running
+func handleResultList(logger *logrus.Logger, config *Config) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			logger.Debugf("handleResultList called on %s", r.URL.Path)
+			if r.Method != http.MethodGet {
+				http.Error(w, "result list endpoint only supports GET", http.StatusMethodNotAllowed)
+				return
+			}
+			files, err := listOutputFiles(filepath.Join(buildDirPath(config), "output"))
+			if err != nil {
+				logger.Errorf("cannot list output files: %v", err)
+				http.Error(w, "cannot list output files", http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(files); err != nil {
+				logger.Errorf("cannot write result list: %v", err)
+			}
+		},
+	)
+}
@@ -0,0 +1,71 @@
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+type testResultListEntry struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+func getResultList(t *testing.T, baseURL string) []testResultListEntry {
+	rsp, err := http.Get(baseURL + "api/v1/result/list")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Equal(t, "application/json", rsp.Header.Get("Content-Type"))
+	var files []testResultListEntry
+	err = json.NewDecoder(rsp.Body).Decode(&files)
+	assert.NoError(t, err)
+	return files
+}
+
+func TestResultListIdle(t *testing.T) {
+	baseURL, _, _ := runTestServer(t)
+
+	assert.Equal(t, []testResultListEntry{}, getResultList(t, baseURL))
+}
+
+func TestResultListMidBuild(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	flag := filepath.Join(t.TempDir(), "continue")
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+echo "fake-build-result" > %[1]s/build/disk.img
+mv %[1]s/build/disk.img %[1]s/build/output/image/disk.img
+while [ ! -e %[2]s ]; do sleep 0.01; done
+`, baseBuildDir, flag))
+	defer restore()
+
+	buildDone := make(chan struct{})
+	go func() {
+		defer close(buildDone)
+		buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+		rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+		assert.NoError(t, err)
+		defer rsp.Body.Close()
+		io.Copy(io.Discard, rsp.Body)
+	}()
+	defer func() {
+		ioutil.WriteFile(flag, nil, 0644)
+		<-buildDone
+	}()
+
+	assert.Eventually(t, func() bool {
+		return len(getResultList(t, baseURL)) > 0
+	}, defaultTimeout, 10*time.Millisecond)
+	// the output.tar does not exist yet
+	assert.Equal(t, []testResultListEntry{{Name: "image/disk.img", Size: 18}}, getResultList(t, baseURL))
+}
@@ -1,13 +1,24 @@
 package main_test
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
 )
 
 func TestResultTooEarly(t *testing.T) {
@@ -40,6 +51,31 @@ func TestResultBad(t *testing.T) {
 	assert.Equal(t, "build failed\nfailure log", string(body))
 }
 
+func TestResultBadFailedResultStatus(t *testing.T) {
+	baseURL, _, _ := runTestServer(t, "-failed-result-status", "422")
+
+	restore := main.MockOsbuildBinary(t, `#!/bin/sh -e
+echo "validation failed"
+exit 1
+`)
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["tree"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+
+	rsp, err = http.Get(baseURL + "api/v1/result/image/disk.img")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusUnprocessableEntity, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "build failed: exit status 1\nvalidation failed\ncannot run osbuild: exit status 1", string(body))
+}
+
 func TestResultGood(t *testing.T) {
 	baseURL, buildBaseDir, _ := runTestServer(t)
 	endpoint := baseURL + "api/v1/result/disk.img"
@@ -60,3 +96,412 @@ func TestResultGood(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "fake-build-result", string(body))
 }
+
+func makeGoodResult(t *testing.T, buildBaseDir, name string, content []byte) {
+	err := os.MkdirAll(filepath.Join(buildBaseDir, "build/output"), 0755)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(buildBaseDir, "result.good"), nil, 0644)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(buildBaseDir, "build/output", name), content, 0644)
+	assert.NoError(t, err)
+}
+
+func TestResultXAccelRedirect(t *testing.T) {
+	baseURL, buildBaseDir, _ := runTestServer(t, "-x-accel-redirect", "/oaas-output/")
+	makeGoodResult(t, buildBaseDir, "disk image.img", []byte("fake-build-result"))
+
+	rsp, err := http.Get(baseURL + "api/v1/result/disk%20image.img")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Equal(t, "/oaas-output/disk%20image.img", rsp.Header.Get("X-Accel-Redirect"))
+	// nginx sends the content
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "", string(body))
+}
+
+func TestRunXAccelRedirectWithCleanup(t *testing.T) {
+	err := main.Run(context.Background(), []string{"-x-accel-redirect", "/oaas-output/", "-cleanup-after-result"}, os.Getenv)
+	assert.EqualError(t, err, "-x-accel-redirect cannot be used with -cleanup-after-result")
+}
+
+func TestResultConcurrentDownloadsDeferCleanup(t *testing.T) {
+	baseURL, buildBaseDir, _ := runTestServer(t, "-cleanup-after-result")
+	endpoint := baseURL + "api/v1/result/disk.img"
+
+	// big enough so that the first download cannot finish while we
+	// do not read from it
+	content := bytes.Repeat([]byte("1234567890abcdef"), 4*1024*1024)
+	makeGoodResult(t, buildBaseDir, "disk.img", content)
+
+	slowRsp, err := http.Get(endpoint)
+	assert.NoError(t, err)
+	defer slowRsp.Body.Close()
+	assert.Equal(t, http.StatusOK, slowRsp.StatusCode)
+
+	rsp, err := http.Get(endpoint)
+	assert.NoError(t, err)
+	body, err := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, content, body)
+
+	// the cleanup is pending until the slow download is done
+	assert.DirExists(t, filepath.Join(buildBaseDir, "build"))
+	body, err = ioutil.ReadAll(slowRsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, content, body)
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(buildBaseDir, "build"))
+		return os.IsNotExist(err)
+	}, defaultTimeout, 10*time.Millisecond)
+	assert.NoFileExists(t, filepath.Join(buildBaseDir, "result.good"))
+}
+
+func getRange(t *testing.T, endpoint, byteRange string) []byte {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	assert.NoError(t, err)
+	req.Header.Set("Range", byteRange)
+	rsp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusPartialContent, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	return body
+}
+
+func TestResultRangedDownloadDefersCleanup(t *testing.T) {
+	baseURL, buildBaseDir, _ := runTestServer(t, "-cleanup-after-result")
+	endpoint := baseURL + "api/v1/result/disk.img"
+
+	makeGoodResult(t, buildBaseDir, "disk.img", []byte("0123456789"))
+
+	assert.Equal(t, []byte("01234"), getRange(t, endpoint, "bytes=0-4"))
+	// give a premature cleanup the chance to happen
+	time.Sleep(100 * time.Millisecond)
+	assert.DirExists(t, filepath.Join(buildBaseDir, "build"))
+	assert.FileExists(t, filepath.Join(buildBaseDir, "result.good"))
+
+	// resuming completes the download and triggers the cleanup
+	assert.Equal(t, []byte("56789"), getRange(t, endpoint, "bytes=5-"))
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(buildBaseDir, "build"))
+		return os.IsNotExist(err)
+	}, defaultTimeout, 10*time.Millisecond)
+	assert.NoFileExists(t, filepath.Join(buildBaseDir, "result.good"))
+}
+
+func TestResultRangedDownloadCleanupTTL(t *testing.T) {
+	baseURL, buildBaseDir, _ := runTestServer(t, "-cleanup-after-result", "-result-cleanup-ttl", "200ms")
+	endpoint := baseURL + "api/v1/result/disk.img"
+
+	makeGoodResult(t, buildBaseDir, "disk.img", []byte("0123456789"))
+
+	assert.Equal(t, []byte("01234"), getRange(t, endpoint, "bytes=0-4"))
+	assert.DirExists(t, filepath.Join(buildBaseDir, "build"))
+	// the client never resumes
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(buildBaseDir, "build"))
+		return os.IsNotExist(err)
+	}, defaultTimeout, 10*time.Millisecond)
+}
+
+func TestResultDirAsTarWithDigestTrailer(t *testing.T) {
+	baseURL, buildBaseDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/result/image.tar"
+
+	makeGoodResult(t, buildBaseDir, "disk.img", nil)
+	err := os.MkdirAll(filepath.Join(buildBaseDir, "build/output/image"), 0755)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(buildBaseDir, "build/output/image/disk.img"), []byte("fake-disk"), 0644)
+	assert.NoError(t, err)
+
+	rsp, err := http.Get(endpoint)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Equal(t, int64(-1), rsp.ContentLength)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+
+	digest := sha256.Sum256(body)
+	assert.Equal(t, hex.EncodeToString(digest[:]), rsp.Trailer.Get("X-Content-SHA256"))
+
+	atar := tar.NewReader(bytes.NewReader(body))
+	var names []string
+	for {
+		hdr, err := atar.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		names = append(names, hdr.Name)
+	}
+	assert.Equal(t, []string{"image/", "image/disk.img"}, names)
+}
+
+func TestResultIncrementalExports(t *testing.T) {
+	restore := main.MockExportPollInterval(50 * time.Millisecond)
+	defer restore()
+	baseURL, buildBaseDir, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	continueBuild := filepath.Join(buildBaseDir, "continue-build")
+	restore = main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/first
+echo "first-result" > %[1]s/build/output/first/disk.img
+# osbuild starts the second export once the first is done
+mkdir -p %[1]s/build/output/second
+# wait for the test to check the first export
+for i in $(seq 100); do
+    test -e %[2]s && break
+    sleep 0.1
+done
+echo "second-result" > %[1]s/build/output/second/disk.img
+`, buildBaseDir, continueBuild))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["first", "second"], "incremental_output": true}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	reader := bufio.NewReader(rsp.Body)
+	line, err := reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "export first available\n", line)
+
+	// the first export can be fetched while the build is running
+	rsp2, err := http.Get(baseURL + "api/v1/result/first/disk.img")
+	assert.NoError(t, err)
+	defer rsp2.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp2.StatusCode)
+	body, err := ioutil.ReadAll(rsp2.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "first-result\n", string(body))
+	rsp2, err = http.Get(baseURL + "api/v1/result/second/disk.img")
+	assert.NoError(t, err)
+	defer rsp2.Body.Close()
+	assert.Equal(t, http.StatusTooEarly, rsp2.StatusCode)
+
+	err = ioutil.WriteFile(continueBuild, nil, 0644)
+	assert.NoError(t, err)
+	rest, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "", string(rest))
+	rsp2, err = http.Get(baseURL + "api/v1/result/second/disk.img")
+	assert.NoError(t, err)
+	defer rsp2.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp2.StatusCode)
+}
+
+func TestResultOutputTarOnlyServedWhenComplete(t *testing.T) {
+	baseURL, buildBaseDir, _ := runTestServer(t)
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+`, buildBaseDir))
+	defer restore()
+	flag := filepath.Join(t.TempDir(), "packaging-done")
+	restore = main.MockTarBinary(t, fmt.Sprintf(`#!/bin/sh -e
+printf "partial" > "$2"
+while [ ! -e %[1]s ]; do sleep 0.01; done
+printf -- "-complete" >> "$2"
+`, flag))
+	defer restore()
+
+	buildDone := make(chan struct{})
+	go func() {
+		defer close(buildDone)
+		buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+		rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+		assert.NoError(t, err)
+		defer rsp.Body.Close()
+		io.Copy(io.Discard, rsp.Body)
+	}()
+
+	tmpTar := filepath.Join(buildBaseDir, "build/output/.output.tar.tmp")
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(tmpTar)
+		return err == nil
+	}, defaultTimeout, 10*time.Millisecond)
+	rsp, err := http.Get(baseURL + "api/v1/result/.output.tar.tmp")
+	assert.NoError(t, err)
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, rsp.StatusCode)
+	assert.NoFileExists(t, filepath.Join(buildBaseDir, "build/output/output.tar"))
+
+	err = ioutil.WriteFile(flag, nil, 0644)
+	assert.NoError(t, err)
+	<-buildDone
+
+	rsp, err = http.Get(baseURL + "api/v1/result/output.tar")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "partial-complete", string(body))
+	assert.NoFileExists(t, tmpTar)
+}
+
+func TestResultOutputTarStreamedWhilePackaging(t *testing.T) {
+	baseURL, buildBaseDir, _ := runTestServer(t, "-stream-result")
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+`, buildBaseDir))
+	defer restore()
+	flag := filepath.Join(t.TempDir(), "packaging-done")
+	restore = main.MockTarBinary(t, fmt.Sprintf(`#!/bin/sh -e
+printf "partial" > "$2"
+while [ ! -e %[1]s ]; do sleep 0.01; done
+printf -- "-complete" >> "$2"
+`, flag))
+	defer restore()
+
+	buildDone := make(chan struct{})
+	go func() {
+		defer close(buildDone)
+		buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+		rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+		assert.NoError(t, err)
+		defer rsp.Body.Close()
+		io.Copy(io.Discard, rsp.Body)
+	}()
+
+	tmpTar := filepath.Join(buildBaseDir, "build/output/.output.tar.tmp")
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(tmpTar)
+		return err == nil
+	}, defaultTimeout, 10*time.Millisecond)
+
+	// the download starts before the packaging is done
+	rsp, err := http.Get(baseURL + "api/v1/result/output.tar")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Equal(t, "application/x-tar", rsp.Header.Get("Content-Type"))
+	partial := make([]byte, len("partial"))
+	_, err = io.ReadFull(rsp.Body, partial)
+	assert.NoError(t, err)
+	assert.Equal(t, "partial", string(partial))
+	assert.NoFileExists(t, filepath.Join(buildBaseDir, "build/output/output.tar"))
+
+	err = ioutil.WriteFile(flag, nil, 0644)
+	assert.NoError(t, err)
+	rest, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "-complete", string(rest))
+	<-buildDone
+}
+
+func TestResultOutputTarStreamAbortedWhenPackagingFails(t *testing.T) {
+	baseURL, buildBaseDir, _ := runTestServer(t, "-stream-result", "-package-retries", "0")
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+`, buildBaseDir))
+	defer restore()
+	flag := filepath.Join(t.TempDir(), "packaging-failed")
+	restore = main.MockTarBinary(t, fmt.Sprintf(`#!/bin/sh -e
+printf "partial" > "$2"
+while [ ! -e %[1]s ]; do sleep 0.01; done
+exit 1
+`, flag))
+	defer restore()
+
+	buildDone := make(chan struct{})
+	go func() {
+		defer close(buildDone)
+		buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+		rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+		assert.NoError(t, err)
+		defer rsp.Body.Close()
+		io.Copy(io.Discard, rsp.Body)
+	}()
+
+	tmpTar := filepath.Join(buildBaseDir, "build/output/.output.tar.tmp")
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(tmpTar)
+		return err == nil
+	}, defaultTimeout, 10*time.Millisecond)
+
+	rsp, err := http.Get(baseURL + "api/v1/result/output.tar")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+
+	err = ioutil.WriteFile(flag, nil, 0644)
+	assert.NoError(t, err)
+	// the client sees a broken download instead of a short tar
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Equal(t, "partial", string(body))
+	<-buildDone
+}
+
+func TestResultHead(t *testing.T) {
+	baseURL, buildBaseDir, _ := runTestServer(t, "-cleanup-after-result")
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+echo "fake-build-result" > %[1]s/build/output/image/disk.img
+`, buildBaseDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+
+	head, err := http.Head(baseURL + "api/v1/result/image/disk.img")
+	assert.NoError(t, err)
+	defer head.Body.Close()
+	assert.Equal(t, http.StatusOK, head.StatusCode)
+	body, err := ioutil.ReadAll(head.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "", string(body))
+	assert.Equal(t, int64(len("fake-build-result\n")), head.ContentLength)
+	assert.NotEqual(t, "", head.Header.Get("ETag"))
+	assert.NotEqual(t, "", head.Header.Get("Last-Modified"))
+	// probing does not count as a download
+	assert.FileExists(t, filepath.Join(buildBaseDir, "build/output/image/disk.img"))
+
+	get, err := http.Get(baseURL + "api/v1/result/image/disk.img")
+	assert.NoError(t, err)
+	defer get.Body.Close()
+	body, err = ioutil.ReadAll(get.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "fake-build-result\n", string(body))
+	for _, name := range []string{"Content-Length", "Content-Type", "Last-Modified", "ETag"} {
+		assert.Equal(t, get.Header.Get(name), head.Header.Get(name), name)
+	}
+}
+
+func TestResultHeadNotFound(t *testing.T) {
+	baseURL, buildBaseDir, _ := runTestServer(t)
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+`, buildBaseDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+
+	head, err := http.Head(baseURL + "api/v1/result/image/missing.img")
+	assert.NoError(t, err)
+	defer head.Body.Close()
+	assert.Equal(t, http.StatusNotFound, head.StatusCode)
+}
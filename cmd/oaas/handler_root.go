@@ -6,11 +6,24 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func handleRoot(logger *logrus.Logger, _ *Config) http.Handler {
+func handleRoot(logger *logrus.Logger, config *Config) http.Handler {
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
-			// we just return ok here
 			logger.Info("/ handler called")
+
+			// without the ui there is nothing to serve here
+			if !config.EnableUI || r.URL.Path != "/" {
+				http.NotFound(w, r)
+				return
+			}
+			index, err := uiAssets.ReadFile("ui/index.html")
+			if err != nil {
+				logger.Errorf("cannot read ui: %v", err)
+				http.Error(w, "cannot read ui", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write(index)
 		},
 	)
 }
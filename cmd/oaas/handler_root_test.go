@@ -13,6 +13,11 @@ func TestTrivialRootEndpoint(t *testing.T) {
 	endpoint := baseURL
 	resp, err := http.Get(endpoint)
 	assert.NoError(t, err)
-	assert.Equal(t, resp.StatusCode, 200)
+	assert.Equal(t, resp.StatusCode, 404)
 	assert.Equal(t, loggerHook.LastEntry().Message, "/ handler called")
+
+	// probes use the health endpoint instead
+	resp, err = http.Get(baseURL + "healthz")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
 }
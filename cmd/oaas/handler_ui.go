@@ -0,0 +1,31 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+//go:embed ui
+var uiAssets embed.FS
+
+func handleUI(logger *logrus.Logger, config *Config) http.Handler {
+	assets, err := fs.Sub(uiAssets, "ui")
+	if err != nil {
+		panic(err)
+	}
+	fss := http.FileServer(http.FS(assets))
+
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			logger.Debugf("handlerUI called on %s", r.URL.Path)
+			if !config.EnableUI {
+				http.NotFound(w, r)
+				return
+			}
+			fss.ServeHTTP(w, r)
+		},
+	)
+}
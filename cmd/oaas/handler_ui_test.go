@@ -0,0 +1,44 @@
+package main_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUIEnabled(t *testing.T) {
+	baseURL, _, _ := runTestServer(t, "-enable-ui")
+
+	rsp, err := http.Get(baseURL)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", rsp.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), `<form id="build-form">`)
+
+	rsp, err = http.Get(baseURL + "ui/app.js")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	body, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), `fetch("/api/v1/build"`)
+}
+
+func TestUIDisabled(t *testing.T) {
+	baseURL, _, _ := runTestServer(t)
+
+	rsp, err := http.Get(baseURL + "ui/index.html")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, rsp.StatusCode)
+
+	rsp, err = http.Get(baseURL)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, rsp.StatusCode)
+}
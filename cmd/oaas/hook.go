@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+var ErrPostBuildHookTimeout = errors.New("post build hook timed out")
+
+type linePrefixWriter struct {
+	prefix string
+	w      io.Writer
+}
+
+// Write expects to be called once per line (as done by
+// followLineOutput)
+func (lw *linePrefixWriter) Write(p []byte) (int, error) {
+	if _, err := lw.w.Write(append([]byte(lw.prefix), p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// runPostBuildHook runs the configured hook, its output is streamed
+// with a "hook: " prefix
+func runPostBuildHook(config *Config, buildDir string, osbuildStatus int, output io.Writer) error {
+	if config.PostBuildHook == "" {
+		return nil
+	}
+
+	// the hook also runs after a build timeout so it gets its own
+	ctx := context.Background()
+	if config.PostBuildHookTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.PostBuildHookTimeout)
+		defer cancel()
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer pr.Close()
+	cmd := exec.CommandContext(ctx, config.PostBuildHook, buildDir)
+	// kill the whole process group, otherwise children of the hook
+	// keep the output pipe open
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.Env = append(os.Environ(),
+		"OAAS_BUILD_DIR="+buildDir,
+		"OAAS_EXIT_STATUS="+strconv.Itoa(osbuildStatus),
+	)
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	if err := cmd.Start(); err != nil {
+		pw.Close()
+		return fmt.Errorf("cannot run post build hook: %v", err)
+	}
+	pw.Close()
+	followErr := followLineOutput(pr, &linePrefixWriter{prefix: "hook: ", w: output})
+	pr.Close()
+	if err := cmd.Wait(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("%w after %v", ErrPostBuildHookTimeout, config.PostBuildHookTimeout)
+		}
+		return fmt.Errorf("post build hook failed: %v", err)
+	}
+	return followErr
+}
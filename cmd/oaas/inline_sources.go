@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const inlineSourceType = "org.osbuild.inline"
+
+// inlineDigests are the digest algorithms that inline sources can be
+// verified with
+var inlineDigests = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+type inlineSourceItem struct {
+	Encoding string `json:"encoding"`
+	Data     string `json:"data"`
+}
+
+// inlineSourcesManifest is the part of the manifest with the inline
+// sources, the rest is only interesting to osbuild
+type inlineSourcesManifest struct {
+	Sources map[string]struct {
+		Items map[string]inlineSourceItem `json:"items"`
+	} `json:"sources"`
+}
+
+// materializeInlineSource decodes the item into the files sources,
+// the content must match the digest in the name
+func materializeInlineSource(sourcesDir, name string, item inlineSourceItem) error {
+	algo, expected, ok := strings.Cut(name, ":")
+	newHash := inlineDigests[algo]
+	if !ok || newHash == nil || !validSourceName(name) {
+		return fmt.Errorf("unsupported inline source digest %q", name)
+	}
+	data, err := base64.StdEncoding.DecodeString(item.Data)
+	if err != nil {
+		return fmt.Errorf("cannot decode inline source %v: %v", name, err)
+	}
+	h := newHash()
+	h.Write(data)
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+		return fmt.Errorf("%w: inline source %v decoded as %v:%v", ErrChecksumMismatch, name, algo, actual)
+	}
+
+	// an uploaded source has the same (verified) content
+	target := filepath.Join(sourcesDir, name)
+	if _, err := os.Stat(target); err == nil {
+		return nil
+	}
+	tmpPath := target + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, target)
+}
+
+// materializeInlineSources writes the base64 inline sources of the
+// manifest into the store so that clients can send small sources
+// as part of the manifest, other encodings are left to osbuild
+func materializeInlineSources(buildDir string) error {
+	f, err := os.Open(filepath.Join(buildDir, "manifest.json"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := readManifest(f, "manifest.json")
+	if err != nil {
+		return err
+	}
+	// most manifests have no inline sources, no need to decode them
+	if !bytes.Contains(data, []byte(`"`+inlineSourceType+`"`)) {
+		return nil
+	}
+	var manifest inlineSourcesManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		// osbuild reports broken manifests
+		return nil
+	}
+	items := manifest.Sources[inlineSourceType].Items
+	if len(items) == 0 {
+		return nil
+	}
+	sourcesDir := filepath.Join(buildDir, "store", filesSourceDir)
+	if err := os.MkdirAll(sourcesDir, 0755); err != nil {
+		return err
+	}
+	for name, item := range items {
+		if item.Encoding != "base64" {
+			continue
+		}
+		if err := materializeInlineSource(sourcesDir, name, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
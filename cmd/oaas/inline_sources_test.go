@@ -0,0 +1,53 @@
+package main_test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+func inlineManifest(name, content string) string {
+	return fmt.Sprintf(`{"version": "2", "sources": {"org.osbuild.inline": {"items": {%q: {"encoding": "base64", "data": %q}}}}}`, name, base64.StdEncoding.EncodeToString([]byte(content)))
+}
+
+func TestBuildInlineSourcesMaterialized(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	content := "inline-source-content"
+	buf := makeTestPost(t, `{"exports": ["image"]}`, inlineManifest(sha256Name(content), content))
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+
+	data, err := ioutil.ReadFile(filepath.Join(baseBuildDir, "build/store/sources/org.osbuild.files", sha256Name(content)))
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(data))
+}
+
+func TestBuildInlineSourcesDigestMismatch(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+
+	wrongName := sha256Name("something-else")
+	buf := makeTestPost(t, `{"exports": ["image"]}`, inlineManifest(wrongName, "inline-source-content"))
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("checksum mismatch: inline source %v decoded as %v\n", wrongName, sha256Name("inline-source-content")), string(body))
+	assert.NoDirExists(t, filepath.Join(baseBuildDir, "build"))
+}
@@ -22,6 +22,9 @@ func newServer(logger *logrus.Logger, config *Config) http.Handler {
 	mux := http.NewServeMux()
 	addRoutes(mux, logger, config)
 	var handler http.Handler = mux
+	if config.ClientCAFile != "" {
+		handler = clientLoggingMiddleware(logger, handler)
+	}
 	// todo: consider centralize logginer here?
 	//handler = loggingMiddleware(handler)
 	return handler
@@ -32,19 +35,58 @@ func run(ctx context.Context, args []string, getenv func(string) string) error {
 	defer cancel()
 
 	logger := logrusNew()
-	config, err := newConfigFromCmdline(args)
+	config, cmdArgs, err := newConfigFromCmdline(args)
 	if err != nil {
 		return err
 	}
+	switch {
+	case len(cmdArgs) == 0:
+		// serve
+	case len(cmdArgs) == 1 && cmdArgs[0] == "selftest":
+		return runSelftest(ctx, logger, config, os.Stdout)
+	default:
+		return fmt.Errorf("unknown command %q", cmdArgs)
+	}
+
+	if config.CleanOnStart {
+		if err := cleanOnStart(logger, config); err != nil {
+			return err
+		}
+	}
+
+	if err := verifyOsbuildBinary(config); err != nil {
+		return err
+	}
+	reverifyOsbuildOnHangup(ctx, logger, config)
+	if config.Fingerprint {
+		config.fingerprint = gatherHostFingerprint(config)
+	}
+	if config.CollectCores {
+		if err := enableCoreDumps(); err != nil {
+			return fmt.Errorf("cannot enable core dumps: %w", err)
+		}
+	}
 
 	srv := newServer(logger, config)
 	httpServer := &http.Server{
 		Addr:    net.JoinHostPort(config.Host, config.Port),
 		Handler: srv,
 	}
+	if config.TLSCertFile != "" {
+		httpServer.TLSConfig, err = newTLSConfig(config)
+		if err != nil {
+			return err
+		}
+	}
 	go func() {
 		logger.Printf("listening on %s\n", httpServer.Addr)
-		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		listenAndServe := httpServer.ListenAndServe
+		if config.TLSCertFile != "" {
+			listenAndServe = func() error {
+				return httpServer.ListenAndServeTLS(config.TLSCertFile, config.TLSKeyFile)
+			}
+		}
+		if err := listenAndServe(); err != nil && err != http.ErrServerClosed {
 			fmt.Fprintf(os.Stderr, "error listening and serving: %s\n", err)
 		}
 	}()
@@ -66,6 +108,17 @@ func run(ctx context.Context, args []string, getenv func(string) string) error {
 	wg.Wait()
 
 	// cleanup
+	if config.BuildDirPattern != defaultBuildDirPattern {
+		// the build dir base may be shared with other nodes
+		if err := cleanupBuild(config); err != nil {
+			logger.Errorf("cannot cleanup build: %v", err)
+			return err
+		}
+		return nil
+	}
+	if err := removeBuildDir(buildDirPath(config)); err != nil {
+		logger.Errorf("cannot cleanup build: %v", err)
+	}
 	if err := os.RemoveAll(config.BuildDirBase); err != nil {
 		logger.Errorf("cannot cleanup: %v", err)
 		return err
@@ -76,7 +129,7 @@ func run(ctx context.Context, args []string, getenv func(string) string) error {
 
 func main() {
 	ctx := context.Background()
-	if err := run(ctx, os.Args, os.Getenv); err != nil {
+	if err := run(ctx, os.Args[1:], os.Getenv); err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
 	}
@@ -3,8 +3,11 @@ package main_test
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -48,14 +51,20 @@ func waitReady(ctx context.Context, timeout time.Duration, endpoint string) erro
 	}
 }
 
-func runTestServer(t *testing.T) (baseURL, buildBaseDir string, loggerHook *logrusTest.Hook) {
+func runTestServer(t *testing.T, extraArgs ...string) (baseURL, buildBaseDir string, loggerHook *logrusTest.Hook) {
 	host := "localhost"
 	port := "18002"
 	buildBaseDir = t.TempDir()
 	baseURL = fmt.Sprintf("http://%s:%s/", host, port)
 
 	ctx, cancel := context.WithCancel(context.Background())
-	t.Cleanup(cancel)
+	// the port is shared by all tests, wait for the server to be
+	// gone before the next test starts a new one
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
 
 	loggerHook, restore := main.MockLogger()
 	defer restore()
@@ -65,10 +74,84 @@ func runTestServer(t *testing.T) (baseURL, buildBaseDir string, loggerHook *logr
 		"-port", port,
 		"-build-path", buildBaseDir,
 	}
-	go main.Run(ctx, args, os.Getenv)
+	args = append(args, extraArgs...)
+	go func() {
+		defer close(done)
+		main.Run(ctx, args, os.Getenv)
+	}()
 
-	err := waitReady(ctx, defaultTimeout, baseURL)
+	// the root endpoint is only served with the ui, probes use the
+	// health endpoint
+	err := waitReady(ctx, defaultTimeout, baseURL+"healthz")
 	assert.NoError(t, err)
 
 	return baseURL, buildBaseDir, loggerHook
 }
+
+func TestRunInvalidOutputDirMode(t *testing.T) {
+	for _, mode := range []string{"rwx", "99", "04755"} {
+		err := main.Run(context.Background(), []string{"-output-dir-mode", mode}, os.Getenv)
+		assert.ErrorContains(t, err, "mode")
+	}
+}
+
+func TestRunCleanOnStartRemovesStaleBuild(t *testing.T) {
+	buildBaseDir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(buildBaseDir, "build/store"), 0700)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(buildBaseDir, "result.bad"), nil, 0644)
+	assert.NoError(t, err)
+
+	baseURL, _, hook := runTestServer(t, "-build-path", buildBaseDir, "-clean-on-start")
+	assert.NoDirExists(t, filepath.Join(buildBaseDir, "build"))
+	assert.NoFileExists(t, filepath.Join(buildBaseDir, "result.bad"))
+	var msgs []string
+	for _, entry := range hook.AllEntries() {
+		msgs = append(msgs, entry.Message)
+	}
+	assert.Contains(t, msgs, "removed stale build dir "+filepath.Join(buildBaseDir, "build"))
+
+	// and the server is up without a build
+	rsp, err := http.Get(baseURL + "api/v1/result/disk.img")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusTooEarly, rsp.StatusCode)
+}
+
+func TestRunCleanOnStartOnlyRemovesOwnMemoryBuildDirs(t *testing.T) {
+	buildBaseDir := t.TempDir()
+	memDir := t.TempDir()
+	config := &main.Config{BuildDirBase: buildBaseDir, BuildDirPattern: "build"}
+	own := filepath.Join(memDir, main.MemoryBuildDirPrefix(config)+"stale")
+	// a memory build dir of another instance on the same host
+	other := filepath.Join(memDir, main.MemoryBuildDirPrefix(&main.Config{BuildDirBase: t.TempDir(), BuildDirPattern: "build"})+"running")
+	for _, dir := range []string{own, other} {
+		err := os.Mkdir(dir, 0700)
+		assert.NoError(t, err)
+	}
+
+	runTestServer(t, "-build-path", buildBaseDir, "-memory-build-dir", memDir, "-clean-on-start")
+	assert.NoDirExists(t, own)
+	assert.DirExists(t, other)
+}
+
+func TestRunCleanOnStartRefusesWithLiveBuild(t *testing.T) {
+	buildBaseDir := t.TempDir()
+	buildDir := filepath.Join(buildBaseDir, "build")
+	err := os.MkdirAll(buildDir, 0700)
+	assert.NoError(t, err)
+	// a leftover osbuild still works on the build dir
+	cmd := exec.Command("sh", "-c", "sleep 30; true", "osbuild", filepath.Join(buildDir, "manifest.json"))
+	err = cmd.Start()
+	assert.NoError(t, err)
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	err = main.Run(ctx, []string{"-build-path", buildBaseDir, "-port", "18003", "-clean-on-start"}, os.Getenv)
+	assert.EqualError(t, err, fmt.Sprintf("cannot clean on start: process %v still uses %v", cmd.Process.Pid, buildDir))
+	assert.DirExists(t, buildDir)
+}
@@ -0,0 +1,130 @@
+package main_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+func runMemoryModeBuild(t *testing.T, extraArgs ...string) (output string, buildBaseDir string) {
+	baseURL, buildBaseDir, _ := runTestServer(t, extraArgs...)
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+cd %[1]s/build
+pwd -P > %[1]s/build-realpath
+cat manifest.json
+cat store/sources/org.osbuild.files/*
+mkdir -p output/image
+echo "fake-build-result" > output/image/disk.img
+`, buildBaseDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+
+	rsp, err = http.Get(baseURL + "api/v1/result/image/disk.img")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	result, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+
+	return string(body) + string(result), buildBaseDir
+}
+
+func TestBuildMemoryModeMatchesDiskMode(t *testing.T) {
+	var diskOutput, memOutput string
+	t.Run("disk", func(t *testing.T) {
+		var buildBaseDir string
+		diskOutput, buildBaseDir = runMemoryModeBuild(t)
+		st, err := os.Lstat(filepath.Join(buildBaseDir, "build"))
+		assert.NoError(t, err)
+		assert.True(t, st.IsDir())
+	})
+	t.Run("memory", func(t *testing.T) {
+		memDir := t.TempDir()
+		var buildBaseDir string
+		memOutput, buildBaseDir = runMemoryModeBuild(t, "-memory-build-dir", memDir, "-cleanup-after-result")
+		realpath, err := ioutil.ReadFile(filepath.Join(buildBaseDir, "build-realpath"))
+		assert.NoError(t, err)
+		assert.Equal(t, memDir, filepath.Dir(string(bytes.TrimSpace(realpath))))
+		// the build happened in the memory dir and got cleaned up
+		assert.Eventually(t, func() bool {
+			entries, err := os.ReadDir(memDir)
+			return err == nil && len(entries) == 0
+		}, defaultTimeout, 10*time.Millisecond)
+		assert.NoFileExists(t, filepath.Join(buildBaseDir, "build"))
+	})
+	assert.Equal(t, `{"fake": "manifest"}other-datarandom-datafake-build-result
+`, diskOutput)
+	assert.Equal(t, diskOutput, memOutput)
+}
+
+func TestBuildMemoryModeFallsBackToDisk(t *testing.T) {
+	memDir := t.TempDir()
+	_, buildBaseDir := runMemoryModeBuild(t, "-memory-build-dir", memDir, "-memory-build-max-size", "100")
+	realpath, err := ioutil.ReadFile(filepath.Join(buildBaseDir, "build-realpath"))
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(buildBaseDir, "build"), string(bytes.TrimSpace(realpath)))
+
+	st, err := os.Lstat(filepath.Join(buildBaseDir, "build"))
+	assert.NoError(t, err)
+	assert.True(t, st.IsDir())
+	entries, err := os.ReadDir(memDir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 0)
+}
+
+func benchmarkUnpack(b *testing.B, config *main.Config) {
+	data := makeTestPost(b, `{"exports": ["image"]}`, `{"fake": "manifest"}`).Bytes()
+	for i := 0; i < b.N; i++ {
+		buildDir, err := main.CreateBuildDir(config, int64(len(data)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		atar := tar.NewReader(bytes.NewReader(data))
+		if _, err := main.HandleControlJSON(atar); err != nil {
+			b.Fatal(err)
+		}
+		if err := main.HandleManifestJSON(atar, buildDir, nil, nil); err != nil {
+			b.Fatal(err)
+		}
+		if err := main.HandleIncludedSources(config, atar, buildDir, nil); err != nil {
+			b.Fatal(err)
+		}
+		if err := main.RemoveBuildDir(buildDir); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnpackDisk(b *testing.B) {
+	benchmarkUnpack(b, &main.Config{BuildDirBase: b.TempDir()})
+}
+
+func BenchmarkUnpackMemory(b *testing.B) {
+	memDir := "/dev/shm"
+	if _, err := os.Stat(memDir); err != nil {
+		b.Skip("no /dev/shm")
+	}
+	benchmarkUnpack(b, &main.Config{
+		BuildDirBase:       b.TempDir(),
+		MemoryBuildDir:     memDir,
+		MemoryBuildMaxSize: 1024 * 1024,
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// durationBuckets are the histogram upper bounds in seconds
+var durationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 1800, 3600}
+
+// histogram is a minimal prometheus histogram
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// writeText writes the histogram in the prometheus text format, the
+// bucket counts are cumulative
+func (h *histogram) writeText(w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name); err != nil {
+		return err
+	}
+	for i, le := range h.buckets {
+		if _, err := fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, strconv.FormatFloat(le, 'g', -1, 64), h.counts[i]); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%[1]s_bucket{le=\"+Inf\"} %[2]d\n%[1]s_sum %[3]s\n%[1]s_count %[2]d\n", h.name, h.count, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	return err
+}
+
+var (
+	buildDuration   = newHistogram("oaas_build_duration_seconds", "Duration of the osbuild runs.", durationBuckets)
+	extractDuration = newHistogram("oaas_extract_duration_seconds", "Duration of extracting the uploaded sources.", durationBuckets)
+	packageDuration = newHistogram("oaas_package_duration_seconds", "Duration of packaging the output tar.", durationBuckets)
+
+	metrics = []*histogram{buildDuration, extractDuration, packageDuration}
+)
+
+func handleMetrics(logger *logrus.Logger, config *Config) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			logger.Debugf("handleMetrics called on %s", r.URL.Path)
+			if r.Method != http.MethodGet {
+				http.Error(w, "metrics endpoint only supports GET", http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			for _, h := range metrics {
+				if err := h.writeText(w); err != nil {
+					logger.Errorf("cannot write metrics: %v", err)
+					return
+				}
+			}
+		},
+	)
+}
@@ -0,0 +1,64 @@
+package main_test
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+func getMetrics(t *testing.T, baseURL string) map[string]float64 {
+	rsp, err := http.Get(baseURL + "metrics")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+
+	values := make(map[string]float64)
+	scanner := bufio.NewScanner(rsp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, " ")
+		assert.True(t, ok, line)
+		v, err := strconv.ParseFloat(value, 64)
+		assert.NoError(t, err)
+		values[name] = v
+	}
+	assert.NoError(t, scanner.Err())
+	return values
+}
+
+func TestMetricsPhaseDurations(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+	before := getMetrics(t, baseURL)
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+echo "fake-build-result" > %[1]s/build/output/image/disk.img
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+
+	after := getMetrics(t, baseURL)
+	for _, name := range []string{"oaas_build_duration_seconds", "oaas_extract_duration_seconds", "oaas_package_duration_seconds"} {
+		assert.Equal(t, before[name+"_count"]+1, after[name+"_count"], name)
+		assert.Greater(t, after[name+"_sum"], before[name+"_sum"], name)
+		assert.Equal(t, after[name+"_count"], after[name+`_bucket{le="+Inf"}`], name)
+	}
+}
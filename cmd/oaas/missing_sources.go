@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	missingSourcesWarn  = "warn"
+	missingSourcesError = "error"
+)
+
+var (
+	ErrMissingSources = errors.New("missing sources")
+
+	missingSourcesModes = []string{missingSourcesWarn, missingSourcesError}
+)
+
+// declaredSourceTypes returns the source types the manifest fetches
+// items for, inline sources are part of the manifest itself
+func declaredSourceTypes(manifestPath string) ([]string, error) {
+	data, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	var manifest manifestSources
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("cannot decode manifest sources: %v", err)
+	}
+	var types []string
+	for sourceType, source := range manifest.Sources {
+		if sourceType == "org.osbuild.inline" {
+			continue
+		}
+		if len(source.Items)+len(source.URLs)+len(source.Mirrors) > 0 {
+			types = append(types, sourceType)
+		}
+	}
+	sort.Strings(types)
+	return types, nil
+}
+
+// hasUploadedSources checks if the upload put any source into the
+// build store
+func hasUploadedSources(buildDir string) (bool, error) {
+	found := false
+	err := filepath.WalkDir(filepath.Join(buildDir, "store", "sources"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			found = true
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return found, err
+}
+
+// checkMissingSources catches uploads that forgot the sources of the
+// manifest, it cannot know about sources that osbuild can fetch or
+// that are in a base or checkpoint store so it is opt-in
+func checkMissingSources(config *Config, buildDir string) error {
+	if config.MissingSources == "" {
+		return nil
+	}
+	types, err := declaredSourceTypes(filepath.Join(buildDir, "manifest.json"))
+	if err != nil || len(types) == 0 {
+		return err
+	}
+	uploaded, err := hasUploadedSources(buildDir)
+	if err != nil || uploaded {
+		return err
+	}
+	return fmt.Errorf("%w: manifest uses %v sources but none were uploaded", ErrMissingSources, types)
+}
@@ -0,0 +1,111 @@
+package main_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+const manifestWithCurlSources = `{"version": "2", "sources": {"org.osbuild.curl": {"items": {"sha256:aaaa": "https://mirror.example.com/pkg-a.rpm"}}}}`
+
+// makeTestPostWithoutSources creates a post without any store entries
+func makeTestPostWithoutSources(t *testing.T, controlJSON, manifestJSON string) *bytes.Buffer {
+	buf := bytes.NewBuffer(nil)
+	archive := tar.NewWriter(buf)
+	err := writeToTar(archive, "control.json", controlJSON)
+	assert.NoError(t, err)
+	err = writeToTar(archive, "manifest.json", manifestJSON)
+	assert.NoError(t, err)
+	err = archive.Close()
+	assert.NoError(t, err)
+	return buf
+}
+
+func TestBuildMissingSourcesError(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-missing-sources", "error")
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPostWithoutSources(t, `{"exports": ["image"]}`, manifestWithCurlSources)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "missing sources: manifest uses [org.osbuild.curl] sources but none were uploaded\n", string(body))
+	assert.NoDirExists(t, filepath.Join(baseBuildDir, "build/output"))
+}
+
+func TestBuildMissingSourcesUploaded(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-missing-sources", "error")
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	for _, tc := range []struct {
+		manifest string
+		buf      *bytes.Buffer
+	}{
+		{manifestWithCurlSources, makeTestPost(t, `{"exports": ["image"]}`, manifestWithCurlSources)},
+		// manifests without sources need no upload
+		{`{"version": "2", "sources": {"org.osbuild.inline": {"items": {"sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824": {"encoding": "base64", "data": "aGVsbG8="}}}}}`, nil},
+		{`{"fake": "manifest"}`, nil},
+	} {
+		buf := tc.buf
+		if buf == nil {
+			buf = makeTestPostWithoutSources(t, `{"exports": ["image"]}`, tc.manifest)
+		}
+		// replace the build of the previous case
+		rsp, err := http.Post(endpoint+"?replace=true", "application/x-tar", buf)
+		assert.NoError(t, err)
+		defer rsp.Body.Close()
+		out, err := ioutil.ReadAll(rsp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, rsp.StatusCode, string(out))
+	}
+}
+
+func TestBuildMissingSourcesWarn(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-missing-sources", "warn")
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPostWithoutSources(t, `{"exports": ["image"]}`, manifestWithCurlSources)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+
+	rsp, err = http.Get(baseURL + "api/v1/build/summary")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	var summary struct {
+		Warnings []string `json:"warnings"`
+	}
+	err = json.NewDecoder(rsp.Body).Decode(&summary)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"missing sources: manifest uses [org.osbuild.curl] sources but none were uploaded"}, summary.Warnings)
+}
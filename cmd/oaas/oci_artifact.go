@@ -0,0 +1,222 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The OCI artifact is served as an OCI image layout tar, it can be
+// pushed to a registry with e.g. "oras cp --from-oci-layout"
+const (
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	ociIndexMediaType    = "application/vnd.oci.image.index.v1+json"
+	ociArtifactType      = "application/vnd.osbuild.oaas.result.v1"
+	ociConfigMediaType   = "application/vnd.oci.empty.v1+json"
+	ociLayerMediaType    = "application/octet-stream"
+	// the provenance is an in-toto statement
+	ociProvenanceMediaType = "application/vnd.in-toto+json"
+
+	// ociTitleAnnotation is the file name of a layer for ORAS
+	ociTitleAnnotation = "org.opencontainers.image.title"
+)
+
+var ociEmptyConfig = []byte("{}")
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	ArtifactType  string          `json:"artifactType"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+func bytesDescriptor(mediaType string, data []byte) ociDescriptor {
+	h := sha256.Sum256(data)
+	return ociDescriptor{
+		MediaType: mediaType,
+		Digest:    "sha256:" + hex.EncodeToString(h[:]),
+		Size:      int64(len(data)),
+	}
+}
+
+func fileDescriptor(p, title string) (ociDescriptor, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	return ociDescriptor{
+		MediaType:   ociLayerMediaType,
+		Digest:      "sha256:" + hex.EncodeToString(h.Sum(nil)),
+		Size:        n,
+		Annotations: map[string]string{ociTitleAnnotation: title},
+	}, nil
+}
+
+// ociLayers describes every output file but the output.tar, it has
+// the same content as the layers
+func ociLayers(config *Config, outputDir string) ([]ociDescriptor, []string, error) {
+	files, err := listOutputFiles(outputDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	layers := []ociDescriptor{}
+	var paths []string
+	for _, file := range files {
+		if file.Name == outputTarName(config) {
+			continue
+		}
+		p := filepath.Join(outputDir, filepath.FromSlash(file.Name))
+		desc, err := fileDescriptor(p, file.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if file.Name == provenanceName {
+			desc.MediaType = ociProvenanceMediaType
+		}
+		layers = append(layers, desc)
+		paths = append(paths, p)
+	}
+	return layers, paths, nil
+}
+
+func writeOCIBlob(atar *tar.Writer, digest string, size int64, r io.Reader) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     path.Join("blobs/sha256", digest[len("sha256:"):]),
+		Mode:     0644,
+		Size:     size,
+	}
+	if err := atar.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.Copy(atar, r)
+	return err
+}
+
+func writeOCIBytes(atar *tar.Writer, name string, data []byte) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(data)),
+	}
+	if err := atar.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := atar.Write(data)
+	return err
+}
+
+// writeOCILayout writes the outputs as an OCI image layout with a
+// single artifact manifest
+func writeOCILayout(w io.Writer, config *Config, outputDir string) error {
+	layers, paths, err := ociLayers(config, outputDir)
+	if err != nil {
+		return err
+	}
+	manifest, err := json.Marshal(&ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		ArtifactType:  ociArtifactType,
+		Config:        bytesDescriptor(ociConfigMediaType, ociEmptyConfig),
+		Layers:        layers,
+	})
+	if err != nil {
+		return err
+	}
+	manifestDesc := bytesDescriptor(ociManifestMediaType, manifest)
+	index, err := json.Marshal(&ociIndex{
+		SchemaVersion: 2,
+		MediaType:     ociIndexMediaType,
+		Manifests:     []ociDescriptor{manifestDesc},
+	})
+	if err != nil {
+		return err
+	}
+
+	atar := tar.NewWriter(w)
+	if err := writeOCIBytes(atar, "oci-layout", []byte(`{"imageLayoutVersion": "1.0.0"}`)); err != nil {
+		return err
+	}
+	if err := writeOCIBytes(atar, "index.json", index); err != nil {
+		return err
+	}
+	configDesc := bytesDescriptor(ociConfigMediaType, ociEmptyConfig)
+	if err := writeOCIBlob(atar, configDesc.Digest, configDesc.Size, bytes.NewReader(ociEmptyConfig)); err != nil {
+		return err
+	}
+	if err := writeOCIBlob(atar, manifestDesc.Digest, manifestDesc.Size, bytes.NewReader(manifest)); err != nil {
+		return err
+	}
+	for i, layer := range layers {
+		f, err := os.Open(paths[i])
+		if err != nil {
+			return err
+		}
+		// the blob size must match the descriptor from the digest
+		// pass, the outputs do not change after the build
+		err = writeOCIBlob(atar, layer.Digest, layer.Size, io.LimitReader(f, layer.Size))
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return atar.Close()
+}
+
+func handleResultOCI(logger *logrus.Logger, config *Config) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			logger.Debugf("handleResultOCI called on %s", r.URL.Path)
+			if r.Method != http.MethodGet {
+				http.Error(w, "oci endpoint only supports GET", http.StatusMethodNotAllowed)
+				return
+			}
+			buildResult := newBuildResult(config)
+			switch {
+			case buildResult.Bad():
+				http.Error(w, "build failed", http.StatusBadRequest)
+				return
+			case !buildResult.Good():
+				http.Error(w, "build still running", http.StatusTooEarly)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/x-tar")
+			if err := writeOCILayout(w, config, filepath.Join(buildDirPath(config), "output")); err != nil {
+				logger.Errorf("cannot write oci layout: %v", err)
+				// ensure the client sees a broken download
+				panic(http.ErrAbortHandler)
+			}
+		},
+	)
+}
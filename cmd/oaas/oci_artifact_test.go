@@ -0,0 +1,102 @@
+package main_test
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+type testOCIDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+func TestResultOCILayout(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-provenance")
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+echo "fake-build-result" > %[1]s/build/output/image/disk.img
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+
+	rsp, err = http.Get(baseURL + "api/v1/result/oci.tar")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	files := make(map[string][]byte)
+	atar := tar.NewReader(rsp.Body)
+	for {
+		hdr, err := atar.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		files[hdr.Name], err = ioutil.ReadAll(atar)
+		assert.NoError(t, err)
+	}
+	blob := func(digest string) []byte {
+		// every blob is stored under its digest
+		data, ok := files["blobs/sha256/"+strings.TrimPrefix(digest, "sha256:")]
+		assert.True(t, ok, digest)
+		assert.Equal(t, digest, sha256Name(string(data)))
+		return data
+	}
+
+	assert.Equal(t, `{"imageLayoutVersion": "1.0.0"}`, string(files["oci-layout"]))
+	var index struct {
+		Manifests []testOCIDescriptor `json:"manifests"`
+	}
+	err = json.Unmarshal(files["index.json"], &index)
+	assert.NoError(t, err)
+	assert.Len(t, index.Manifests, 1)
+	var manifest struct {
+		ArtifactType string              `json:"artifactType"`
+		Config       testOCIDescriptor   `json:"config"`
+		Layers       []testOCIDescriptor `json:"layers"`
+	}
+	err = json.Unmarshal(blob(index.Manifests[0].Digest), &manifest)
+	assert.NoError(t, err)
+	assert.Equal(t, "application/vnd.osbuild.oaas.result.v1", manifest.ArtifactType)
+	assert.Equal(t, "{}", string(blob(manifest.Config.Digest)))
+	// output.tar is not a layer, it has the same content
+	assert.Len(t, manifest.Layers, 2)
+	assert.Equal(t, testOCIDescriptor{
+		MediaType:   "application/octet-stream",
+		Digest:      sha256Name("fake-build-result\n"),
+		Size:        18,
+		Annotations: map[string]string{"org.opencontainers.image.title": "image/disk.img"},
+	}, manifest.Layers[0])
+	assert.Equal(t, "fake-build-result\n", string(blob(manifest.Layers[0].Digest)))
+	assert.Equal(t, "application/vnd.in-toto+json", manifest.Layers[1].MediaType)
+	assert.Equal(t, "provenance.json", manifest.Layers[1].Annotations["org.opencontainers.image.title"])
+	blob(manifest.Layers[1].Digest)
+}
+
+func TestResultOCILayoutTooEarly(t *testing.T) {
+	baseURL, _, _ := runTestServer(t)
+
+	rsp, err := http.Get(baseURL + "api/v1/result/oci.tar")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusTooEarly, rsp.StatusCode)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrOsbuildChecksumMismatch = errors.New("osbuild binary checksum mismatch")
+
+	sha256Regexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyOsbuildBinary checks the osbuild binary against the
+// configured digest to detect a swapped or corrupted binary
+func verifyOsbuildBinary(config *Config) error {
+	if config.OsbuildSHA256 == "" {
+		return nil
+	}
+	path, err := exec.LookPath(osbuildBinary)
+	if err != nil {
+		return fmt.Errorf("cannot find osbuild binary: %w", err)
+	}
+	digest, err := sha256File(path)
+	if err != nil {
+		return fmt.Errorf("cannot hash osbuild binary: %w", err)
+	}
+	if digest != config.OsbuildSHA256 {
+		return fmt.Errorf("%w: %v has sha256:%v, expected sha256:%v", ErrOsbuildChecksumMismatch, path, digest, config.OsbuildSHA256)
+	}
+	return nil
+}
+
+// osbuildVerified returns false when the osbuild binary no longer
+// matches the configured digest, no builds are run then
+func osbuildVerified(config *Config) bool {
+	return config.osbuildVerified == nil || config.osbuildVerified.Load()
+}
+
+// reverifyOsbuildOnHangup verifies the osbuild binary again on every
+// SIGHUP, e.g. after a package update was rolled out
+func reverifyOsbuildOnHangup(ctx context.Context, logger *logrus.Logger, config *Config) {
+	if config.OsbuildSHA256 == "" {
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				err := verifyOsbuildBinary(config)
+				config.osbuildVerified.Store(err == nil)
+				if err != nil {
+					logger.Errorf("%v, refusing builds", err)
+				} else {
+					logger.Infof("osbuild binary verified")
+				}
+			}
+		}
+	}()
+}
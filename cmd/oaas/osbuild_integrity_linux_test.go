@@ -0,0 +1,63 @@
+package main_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+func TestRunOsbuildSHA256ReverifiedOnHangup(t *testing.T) {
+	restore := main.MockOsbuildBinary(t, fakeOsbuildForIntegrity)
+	defer restore()
+	digest := sha256.Sum256([]byte(fakeOsbuildForIntegrity))
+	baseURL, _, _ := runTestServer(t, "-osbuild-sha256", hex.EncodeToString(digest[:]))
+
+	// the binary gets swapped while the server runs
+	err := os.WriteFile(main.OsbuildBinary(), []byte("#!/bin/sh\necho swapped\n"), 0755)
+	assert.NoError(t, err)
+	err = syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		rsp, err := http.Get(baseURL + "healthz")
+		assert.NoError(t, err)
+		defer rsp.Body.Close()
+		return rsp.StatusCode == http.StatusServiceUnavailable
+	}, defaultTimeout, 10*time.Millisecond)
+	rsp, err := http.Get(baseURL + "healthz")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"healthy":false,"maintenance":false,"error":"osbuild binary checksum mismatch"}`+"\n", string(body))
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err = http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, rsp.StatusCode)
+	body, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "osbuild binary checksum mismatch\n", string(body))
+
+	// and is fixed again
+	err = os.WriteFile(main.OsbuildBinary(), []byte(fakeOsbuildForIntegrity), 0755)
+	assert.NoError(t, err)
+	err = syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		rsp, err := http.Get(baseURL + "healthz")
+		assert.NoError(t, err)
+		defer rsp.Body.Close()
+		return rsp.StatusCode == http.StatusOK
+	}, defaultTimeout, 10*time.Millisecond)
+}
@@ -0,0 +1,53 @@
+package main_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+const fakeOsbuildForIntegrity = `#!/bin/sh -e
+echo "fake osbuild"
+`
+
+func TestRunOsbuildSHA256Matching(t *testing.T) {
+	restore := main.MockOsbuildBinary(t, fakeOsbuildForIntegrity)
+	defer restore()
+	digest := sha256.Sum256([]byte(fakeOsbuildForIntegrity))
+
+	baseURL, _, _ := runTestServer(t, "-osbuild-sha256", hex.EncodeToString(digest[:]))
+	rsp, err := http.Get(baseURL + "healthz")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+}
+
+func TestRunOsbuildSHA256WithOsbuildBinaries(t *testing.T) {
+	digest := sha256.Sum256([]byte(fakeOsbuildForIntegrity))
+	err := main.Run(context.Background(), []string{"-osbuild-sha256", hex.EncodeToString(digest[:]), "-osbuild-binaries", "new=/opt/osbuild/bin/osbuild"}, os.Getenv)
+	assert.EqualError(t, err, "cannot use -osbuild-sha256 with -osbuild-binaries")
+}
+
+func TestRunOsbuildSHA256Mismatch(t *testing.T) {
+	restore := main.MockOsbuildBinary(t, fakeOsbuildForIntegrity)
+	defer restore()
+	digest := sha256.Sum256([]byte("something else"))
+	expected := hex.EncodeToString(digest[:])
+
+	err := main.Run(context.Background(), []string{"-osbuild-sha256", expected}, os.Getenv)
+	assert.ErrorIs(t, err, main.ErrOsbuildChecksumMismatch)
+	assert.ErrorContains(t, err, fmt.Sprintf("expected sha256:%v", expected))
+}
+
+func TestRunOsbuildSHA256Invalid(t *testing.T) {
+	err := main.Run(context.Background(), []string{"-osbuild-sha256", "sha256:1234"}, os.Getenv)
+	assert.EqualError(t, err, `invalid -osbuild-sha256 "sha256:1234", expected 64 lowercase hex digits`)
+}
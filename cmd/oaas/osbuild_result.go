@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/exp/maps"
+)
+
+// maxOsbuildResultSize bounds the memory of the "osbuild --json"
+// result, it contains the output of all stages that were run
+var maxOsbuildResultSize = 64 * 1024 * 1024
+
+// osbuildResultPrefix is how the json.dump() of the result starts
+const osbuildResultPrefix = `{"type": "`
+
+type osbuildStageLog struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Output string `json:"output"`
+}
+
+// osbuildResult is the part of the (manifest version 2) result that
+// "osbuild --json" prints as a single line at the end of the build,
+// the log has the stages that were run by pipeline name, stages that
+// were taken from the store are not part of it
+type osbuildResult struct {
+	Type    string                       `json:"type"`
+	Success bool                         `json:"success"`
+	Log     map[string][]osbuildStageLog `json:"log"`
+}
+
+// osbuildResultCollector finds the result line in the osbuild
+// output, long lines are observed in chunks
+type osbuildResultCollector struct {
+	buf       []byte
+	collect   bool
+	lineStart bool
+	tooLarge  bool
+	line      []byte
+}
+
+func newOsbuildResultCollector() *osbuildResultCollector {
+	return &osbuildResultCollector{lineStart: true}
+}
+
+func (rc *osbuildResultCollector) observe(chunk string) {
+	if rc.lineStart && strings.HasPrefix(chunk, osbuildResultPrefix) {
+		rc.collect = true
+		rc.tooLarge = false
+		rc.buf = rc.buf[:0]
+	}
+	rc.lineStart = strings.HasSuffix(chunk, "\n")
+	if !rc.collect {
+		return
+	}
+	if len(rc.buf)+len(chunk) > maxOsbuildResultSize {
+		rc.tooLarge = true
+		rc.buf = nil
+	}
+	if !rc.tooLarge {
+		rc.buf = append(rc.buf, chunk...)
+	}
+	if rc.lineStart {
+		rc.collect = false
+		if !rc.tooLarge {
+			rc.line, rc.buf = rc.buf, nil
+		}
+	}
+}
+
+// Result returns the parsed result, nil if osbuild printed none
+func (rc *osbuildResultCollector) Result() (*osbuildResult, error) {
+	if rc.tooLarge {
+		return nil, fmt.Errorf("osbuild result exceeds %v bytes", maxOsbuildResultSize)
+	}
+	if rc.line == nil {
+		return nil, nil
+	}
+	var res osbuildResult
+	if err := json.Unmarshal(rc.line, &res); err != nil {
+		return nil, fmt.Errorf("cannot decode osbuild result: %v", err)
+	}
+	return &res, nil
+}
+
+// collectWarnings feeds the output of the stages that were run to
+// the warning collector
+func (res *osbuildResult) collectWarnings(wc *warningCollector) {
+	// the order of the pipelines is lost in the log
+	names := maps.Keys(res.Log)
+	sort.Strings(names)
+	for _, name := range names {
+		for _, stage := range res.Log[name] {
+			for _, line := range strings.Split(stage.Output, "\n") {
+				wc.observe(line)
+			}
+		}
+	}
+}
+
+// pipelineDependencies returns the names of the pipelines that a
+// pipeline references, either as its build pipeline or as input
+func pipelineDependencies(v interface{}, deps map[string]bool) {
+	switch v := v.(type) {
+	case string:
+		if name, ok := strings.CutPrefix(v, "name:"); ok {
+			deps[name] = true
+		}
+	case []interface{}:
+		for _, e := range v {
+			pipelineDependencies(e, deps)
+		}
+	case map[string]interface{}:
+		for k, e := range v {
+			pipelineDependencies(k, deps)
+			pipelineDependencies(e, deps)
+		}
+	}
+}
+
+// stageCounts returns the number of stages that were taken from the
+// store and that were run to build the exports. Only a successful
+// build tells that the stages that did not run came from the store.
+func (res *osbuildResult) stageCounts(manifestPath string, exports []string) (cached, built int, err error) {
+	for _, stages := range res.Log {
+		built += len(stages)
+	}
+	if !res.Success {
+		return 0, built, nil
+	}
+
+	f, err := os.Open(manifestPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	data, err := readManifest(f, "manifest.json")
+	if err != nil {
+		return 0, 0, err
+	}
+	var manifest diffManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return 0, 0, fmt.Errorf("cannot decode manifest: %v", err)
+	}
+	pipelines := make(map[string]map[string]interface{})
+	for _, p := range manifest.Pipelines {
+		pipelines[pipelineName(p)] = p
+	}
+	needed := make(map[string]bool)
+	todo := append([]string(nil), exports...)
+	for len(todo) > 0 {
+		name := todo[0]
+		todo = todo[1:]
+		p, ok := pipelines[name]
+		if !ok || needed[name] {
+			continue
+		}
+		needed[name] = true
+		deps := make(map[string]bool)
+		pipelineDependencies(p, deps)
+		todo = append(todo, maps.Keys(deps)...)
+	}
+	for name := range needed {
+		if n := len(pipelineStages(pipelines[name])) - len(res.Log[name]); n > 0 {
+			cached += n
+		}
+	}
+	return cached, built, nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// maxLineLength limits the memory used for output without newlines,
+// longer lines are passed on in chunks
+var maxLineLength = 1024 * 1024
+
+// followLineOutput copies the output of osbuild line by line to w
+// and calls all the line observers for each line
+func followLineOutput(r io.Reader, w io.Writer, observers ...func(line string)) error {
+	br := bufio.NewReaderSize(r, maxLineLength)
+	for {
+		chunk, err := br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			err = nil
+		}
+		if len(chunk) > 0 {
+			line := string(chunk)
+			for _, observe := range observers {
+				observe(line)
+			}
+			if _, werr := w.Write(chunk); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// binaryOutputNotice is streamed instead of non-text output
+const binaryOutputNotice = "binary output detected, not streaming the remaining output, see build.log\n"
+
+func isText(p []byte) bool {
+	return utf8.Valid(p) && bytes.IndexByte(p, 0) == -1
+}
+
+// incompleteRuneLen returns the number of bytes at the end of p that
+// start a multi-byte rune but do not complete it
+func incompleteRuneLen(p []byte) int {
+	for i := 1; i < utf8.UTFMax && i <= len(p); i++ {
+		if utf8.RuneStart(p[len(p)-i]) {
+			if utf8.FullRune(p[len(p)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
+
+// textStreamWriter stops writing once it gets non-text output, the
+// client stream would be garbage otherwise. Long lines are written in
+// chunks that can split a rune, the start of it is held back until
+// the next write.
+type textStreamWriter struct {
+	w       io.Writer
+	binary  bool
+	pending []byte
+}
+
+func (tw *textStreamWriter) Write(p []byte) (int, error) {
+	if tw.binary {
+		return len(p), nil
+	}
+	data := append(tw.pending, p...)
+	n := incompleteRuneLen(data)
+	tw.pending = append([]byte(nil), data[len(data)-n:]...)
+	data = data[:len(data)-n]
+	if !isText(data) {
+		tw.binary = true
+		if _, err := io.WriteString(tw.w, binaryOutputNotice); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if len(data) == 0 {
+		return len(p), nil
+	}
+	if _, err := tw.w.Write(data); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// lineLimitWriter drops lines beyond the per second and the total
+// limits, a zero limit means no limit, the number of dropped lines is
+// reported at most once per second and by Flush
+type lineLimitWriter struct {
+	w            io.Writer
+	maxPerSecond int
+	maxTotal     int
+	now          func() time.Time
+
+	window      time.Time
+	windowLines int
+	total       int
+	suppressed  int
+}
+
+func newLineLimitWriter(w io.Writer, maxPerSecond, maxTotal int) *lineLimitWriter {
+	return &lineLimitWriter{
+		w:            w,
+		maxPerSecond: maxPerSecond,
+		maxTotal:     maxTotal,
+		now:          time.Now,
+	}
+}
+
+func (lw *lineLimitWriter) Write(p []byte) (int, error) {
+	now := lw.now()
+	if now.Sub(lw.window) >= time.Second {
+		if err := lw.Flush(); err != nil {
+			return 0, err
+		}
+		lw.window = now
+		lw.windowLines = 0
+	}
+	if (lw.maxTotal > 0 && lw.total >= lw.maxTotal) || (lw.maxPerSecond > 0 && lw.windowLines >= lw.maxPerSecond) {
+		lw.suppressed++
+		return len(p), nil
+	}
+	lw.windowLines++
+	lw.total++
+	return lw.w.Write(p)
+}
+
+// Flush reports the lines dropped since the last report
+func (lw *lineLimitWriter) Flush() error {
+	if lw.suppressed == 0 {
+		return nil
+	}
+	_, err := fmt.Fprintf(lw.w, "...(%v lines suppressed)...\n", lw.suppressed)
+	lw.suppressed = 0
+	return err
+}
+
+// heartbeatLine is sent when the stream was silent for the
+// heartbeat interval, an empty line is the least surprising thing
+// for clients that parse the output
+const heartbeatLine = "\n"
+
+// heartbeatWriter keeps proxies from timing out the stream while
+// osbuild is silent, e.g. during a long stage
+type heartbeatWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	last    time.Time
+	midLine bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startHeartbeat returns a writer that sends a heartbeat to w when
+// nothing was written for the given interval, a zero interval
+// disables the heartbeat
+func startHeartbeat(w io.Writer, interval time.Duration) *heartbeatWriter {
+	hb := &heartbeatWriter{
+		w:    w,
+		last: time.Now(),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if interval <= 0 {
+		close(hb.done)
+		return hb
+	}
+	go hb.run(interval)
+	return hb
+}
+
+func (hb *heartbeatWriter) run(interval time.Duration) {
+	defer close(hb.done)
+
+	ticker := time.NewTicker(interval / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hb.stop:
+			return
+		case <-ticker.C:
+			hb.beat(interval)
+		}
+	}
+}
+
+func (hb *heartbeatWriter) beat(interval time.Duration) {
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+
+	// never break up a partial line
+	if hb.midLine || time.Since(hb.last) < interval {
+		return
+	}
+	io.WriteString(hb.w, heartbeatLine)
+	hb.last = time.Now()
+}
+
+func (hb *heartbeatWriter) Write(p []byte) (int, error) {
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+
+	n, err := hb.w.Write(p)
+	if n > 0 {
+		hb.last = time.Now()
+		hb.midLine = p[n-1] != '\n'
+	}
+	return n, err
+}
+
+func (hb *heartbeatWriter) Stop() {
+	select {
+	case <-hb.stop:
+	default:
+		close(hb.stop)
+	}
+	<-hb.done
+}
+
+// lineFilterWriter only writes the lines accepted by the filter, it
+// needs to get whole lines which followLineOutput ensures
+type lineFilterWriter struct {
+	w      io.Writer
+	accept func(line string) bool
+}
+
+func (lf *lineFilterWriter) Write(p []byte) (int, error) {
+	if !lf.accept(string(p)) {
+		return len(p), nil
+	}
+	return lf.w.Write(p)
+}
+
+const (
+	severityDebug = iota
+	severityInfo
+	severityWarn
+)
+
+var (
+	logLevels = map[string]int{
+		"debug": severityDebug,
+		"info":  severityInfo,
+		"warn":  severityWarn,
+	}
+
+	// this is best-effort, osbuild output is mostly unstructured
+	warnLineRegexp  = regexp.MustCompile(`(?i)\b(warning|warn|error|failed|fatal|traceback)\b`)
+	debugLineRegexp = regexp.MustCompile(`(?i)^\s*(debug\b|\[debug\])`)
+)
+
+// lineSeverity guesses the severity of an output line, lines that
+// are not recognized are "info"
+func lineSeverity(line string) int {
+	switch {
+	case warnLineRegexp.MatchString(line):
+		return severityWarn
+	case debugLineRegexp.MatchString(line):
+		return severityDebug
+	default:
+		return severityInfo
+	}
+}
+
+// logLevelFilter returns a filter that accepts all lines with at
+// least the given level, no (or an unknown) level accepts all lines
+func logLevelFilter(level string) func(line string) bool {
+	min, ok := logLevels[level]
+	if !ok {
+		min = severityDebug
+	}
+	return func(line string) bool {
+		return lineSeverity(line) >= min
+	}
+}
+
+var (
+	// osbuild warnings in the stage output are either "WARNING: ..."
+	// or python warnings like "DeprecationWarning: ..."
+	osbuildWarningRegexp = regexp.MustCompile(`^\s*(WARNING|Warning|warning)\b|\b[A-Z]\w*Warning: `)
+)
+
+const (
+	// maxWarnings and maxWarningLength bound the memory that a
+	// chatty build can use for its warnings
+	maxWarnings      = 100
+	maxWarningLength = 1024
+)
+
+// warningCollector collects the warnings of a build that do not fail
+// it but that users care about (e.g. deprecated stages)
+type warningCollector struct {
+	warnings []string
+	dropped  int
+}
+
+func (wc *warningCollector) observe(line string) {
+	line = trimNewline(line)
+	if !osbuildWarningRegexp.MatchString(line) {
+		return
+	}
+	if len(wc.warnings) >= maxWarnings {
+		wc.dropped++
+		return
+	}
+	if len(line) > maxWarningLength {
+		line = line[:maxWarningLength]
+	}
+	wc.warnings = append(wc.warnings, line)
+}
+
+// Warnings returns the collected warnings, the last entry notes the
+// number of dropped warnings
+func (wc *warningCollector) Warnings() []string {
+	if wc.dropped > 0 {
+		return append(wc.warnings, fmt.Sprintf("%v more warnings not shown", wc.dropped))
+	}
+	return wc.warnings
+}
+
+func trimNewline(line string) string {
+	if len(line) > 0 && line[len(line)-1] == '\n' {
+		line = line[:len(line)-1]
+	}
+	return line
+}
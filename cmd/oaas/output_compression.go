@@ -0,0 +1,72 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// outputCompressions maps the Config.OutputCompression values to the
+// output.tar suffix, the tar flag and the http content encoding
+var outputCompressions = map[string]struct {
+	ext      string
+	tarFlag  string
+	encoding string
+}{
+	"gzip": {ext: ".gz", tarFlag: "--gzip", encoding: "gzip"},
+}
+
+// outputTarName returns the name of the packaged output
+func outputTarName(config *Config) string {
+	return "output.tar" + outputCompressions[config.OutputCompression].ext
+}
+
+// storedCompressedOutput returns the path of the compressed output
+// if output.tar is requested but only stored compressed
+func storedCompressedOutput(config *Config, outputDir, resultPath string) string {
+	if config.OutputCompression == "" || resultPath != filepath.Join(outputDir, "output.tar") || fileExists(resultPath) {
+		return ""
+	}
+	stored := filepath.Join(outputDir, outputTarName(config))
+	if !fileExists(stored) {
+		return ""
+	}
+	return stored
+}
+
+// acceptsEncoding checks the Accept-Encoding header of the request,
+// an encoding with q=0 is not accepted
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, item := range strings.Split(header, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+			if name != encoding && name != "*" {
+				continue
+			}
+			q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+			if !ok {
+				return true
+			}
+			weight, err := strconv.ParseFloat(q, 64)
+			return err == nil && weight > 0
+		}
+	}
+	return false
+}
+
+// decompressTo writes the decompressed output, the size is unknown
+// so ranges are not supported
+func decompressTo(w io.Writer, r io.Reader) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	if _, err := io.Copy(w, zr); err != nil {
+		return err
+	}
+	return zr.Close()
+}
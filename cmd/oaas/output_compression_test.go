@@ -0,0 +1,89 @@
+package main_test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+func runCompressedOutputBuild(t *testing.T) (baseURL string) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-output-compression", "gzip")
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+echo "fake-build-result" > %[1]s/build/output/image/disk.img
+`, baseBuildDir))
+	t.Cleanup(restore)
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+
+	assert.FileExists(t, filepath.Join(baseBuildDir, "build/output/output.tar.gz"))
+	assert.NoFileExists(t, filepath.Join(baseBuildDir, "build/output/output.tar"))
+	return baseURL
+}
+
+func assertOutputTar(t *testing.T, r io.Reader) {
+	atar := tar.NewReader(r)
+	var names []string
+	for {
+		hdr, err := atar.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		names = append(names, hdr.Name)
+	}
+	assert.Contains(t, names, "output/image/disk.img")
+}
+
+func getOutputTar(t *testing.T, baseURL, acceptEncoding string) *http.Response {
+	req, err := http.NewRequest(http.MethodGet, baseURL+"api/v1/result/output.tar", nil)
+	assert.NoError(t, err)
+	// an explicit header disables the transparent decompression of
+	// the http client
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	rsp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	t.Cleanup(func() { rsp.Body.Close() })
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Equal(t, "application/x-tar", rsp.Header.Get("Content-Type"))
+	assert.Equal(t, "Accept-Encoding", rsp.Header.Get("Vary"))
+	return rsp
+}
+
+func TestResultCompressedOutputPassThrough(t *testing.T) {
+	baseURL := runCompressedOutputBuild(t)
+
+	rsp := getOutputTar(t, baseURL, "br, gzip")
+	assert.Equal(t, "gzip", rsp.Header.Get("Content-Encoding"))
+	zr, err := gzip.NewReader(rsp.Body)
+	assert.NoError(t, err)
+	assertOutputTar(t, zr)
+}
+
+func TestResultCompressedOutputDecompressed(t *testing.T) {
+	baseURL := runCompressedOutputBuild(t)
+
+	for _, acceptEncoding := range []string{"identity", "gzip;q=0"} {
+		t.Run(acceptEncoding, func(t *testing.T) {
+			rsp := getOutputTar(t, baseURL, acceptEncoding)
+			assert.Equal(t, "", rsp.Header.Get("Content-Encoding"))
+			assertOutputTar(t, rsp.Body)
+		})
+	}
+}
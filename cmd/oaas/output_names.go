@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+var (
+	ErrInvalidOutputName = errors.New("invalid output name")
+)
+
+// validateOutputNames checks the control.json "output_names", the
+// keys are artifact paths below an export and the values are the new
+// file names, the artifacts stay in their directory
+func validateOutputNames(control *controlJSON) error {
+	for from, to := range control.OutputNames {
+		elems := strings.Split(from, "/")
+		if path.Clean(from) != from || len(elems) < 2 || slices.Contains(elems, "..") || !slices.Contains(control.Exports, elems[0]) {
+			return fmt.Errorf("%w: artifact path %q must be below one of the exports", ErrInvalidOutputName, from)
+		}
+		if to == "" || to == "." || to == ".." || strings.Contains(to, "/") {
+			return fmt.Errorf("%w: %q for %q must be a file name", ErrInvalidOutputName, to, from)
+		}
+	}
+	return nil
+}
+
+// renameOutputs renames the exported artifacts after the build, this
+// happens before packaging so the output tar and the result endpoint
+// only know the new names
+func renameOutputs(outputDir string, names map[string]string) error {
+	var froms []string
+	for from := range names {
+		froms = append(froms, from)
+	}
+	// sort to get stable errors
+	sort.Strings(froms)
+	for _, from := range froms {
+		src := filepath.Join(outputDir, filepath.FromSlash(from))
+		dst := filepath.Join(filepath.Dir(src), names[from])
+		if fileExists(dst) {
+			return fmt.Errorf("cannot rename output %v: %v already exists", from, names[from])
+		}
+		if err := os.Rename(src, dst); err != nil {
+			return fmt.Errorf("cannot rename output %v: %w", from, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+func TestFollowLineOutputBinary(t *testing.T) {
+	restore := main.MockMaxLineLength(16)
+	defer restore()
+
+	// no newlines and invalid utf-8
+	input := append([]byte("text\n"), bytes.Repeat([]byte{0x00, 0xff, 0xfe, 0x80}, 100)...)
+	var output bytes.Buffer
+	var lines []string
+	err := main.FollowLineOutput(bytes.NewReader(input), &output, func(line string) {
+		lines = append(lines, line)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, input, output.Bytes())
+	assert.Equal(t, "text\n", lines[0])
+	for _, line := range lines {
+		assert.LessOrEqual(t, len(line), 16)
+	}
+}
+
+func TestBuildBinaryOutputStopsStreaming(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+echo "some text"
+printf 'bin\000\377ary\n'
+echo "more text"
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "some text\nbinary output detected, not streaming the remaining output, see build.log\n", string(body))
+
+	// the log has everything
+	log, err := ioutil.ReadFile(filepath.Join(baseBuildDir, "build/build.log"))
+	assert.NoError(t, err)
+	assert.Equal(t, "some text\nbin\x00\xffary\nmore text\n", string(log))
+}
+
+func TestBuildTextOutputSplitRune(t *testing.T) {
+	restore := main.MockMaxLineLength(16)
+	defer restore()
+	baseURL, baseBuildDir, _ := runTestServer(t)
+
+	// the chunk boundary is in the middle of the "ü"
+	restore = main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+echo "aaaaaaaaaaaaaaaüber"
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "aaaaaaaaaaaaaaaüber\n", string(body))
+}
+
+func TestBuildLogFloodSuppressed(t *testing.T) {
+	for _, tc := range []struct {
+		args          []string
+		expectedStart string
+	}{
+		{[]string{"-max-log-lines", "3"}, "1\n2\n3\n...(9997 lines suppressed)...\n"},
+		{[]string{"-max-log-lines-per-second", "5"}, "1\n2\n3\n4\n5\n...("},
+	} {
+		t.Run(strings.Join(tc.args, " "), func(t *testing.T) {
+			baseURL, baseBuildDir, _ := runTestServer(t, tc.args...)
+
+			restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+seq 10000
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+			defer restore()
+
+			buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+			rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+			assert.NoError(t, err)
+			defer rsp.Body.Close()
+			assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+			body, err := ioutil.ReadAll(rsp.Body)
+			assert.NoError(t, err)
+			assert.True(t, strings.HasPrefix(string(body), tc.expectedStart), string(body))
+			assert.Less(t, strings.Count(string(body), "\n"), 1000)
+
+			// the log is bounded too
+			log, err := ioutil.ReadFile(filepath.Join(baseBuildDir, "build/build.log"))
+			assert.NoError(t, err)
+			assert.Equal(t, string(body), string(log))
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+var (
+	ErrInvalidUpload = errors.New("invalid upload")
+)
+
+func prescanStoreEntry(name string) error {
+	if filepath.Clean(name) != strings.TrimSuffix(name, "/") {
+		return fmt.Errorf("%w: name not clean: %v", ErrInvalidUpload, name)
+	}
+	if !strings.HasPrefix(name, "store/") {
+		return fmt.Errorf("%w: expected store/ prefix, got %v", ErrInvalidUpload, name)
+	}
+	return nil
+}
+
+// prescanTar checks the structure of the upload without writing
+// anything, the content of the entries is checked by the extraction
+func prescanTar(config *Config, atar *tar.Reader) error {
+	hdr, err := nextEntry(atar)
+	if err == io.EOF {
+		return ErrEmptyUpload
+	}
+	if err != nil {
+		return err
+	}
+	if hdr.Name != "control.json" {
+		return fmt.Errorf("%w: expected control.json, got %v", ErrInvalidUpload, hdr.Name)
+	}
+	hdr, err = nextEntry(atar)
+	if err == io.EOF {
+		return fmt.Errorf("%w: missing manifest.json", ErrInvalidUpload)
+	}
+	if err != nil {
+		return err
+	}
+	if hdr.Name != "manifest.json" && hdr.Name != "manifest.yaml" && hdr.Name != "manifest.json.tmpl" {
+		return fmt.Errorf("%w: expected manifest.json, got %v", ErrInvalidUpload, hdr.Name)
+	}
+	for {
+		hdr, err := nextEntry(atar)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case hdr.Name == "manifest.json" || hdr.Name == "manifest.yaml" || hdr.Name == "manifest.json.tmpl":
+			return ErrMultipleManifests
+		case hdr.Name == "build.env" || slices.Contains(config.TrailingEntries, hdr.Name):
+			continue
+		case hdr.Name == "sources.tar":
+			nested := tar.NewReader(atar)
+			for {
+				nhdr, err := nextEntry(nested)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return fmt.Errorf("sources.tar: %w", err)
+				}
+				if err := prescanStoreEntry(nhdr.Name); err != nil {
+					return fmt.Errorf("sources.tar: %w", err)
+				}
+			}
+			continue
+		}
+		if err := prescanStoreEntry(hdr.Name); err != nil {
+			return err
+		}
+	}
+}
+
+// prescanUpload reads the whole upload into an unlinked spill file
+// while checking its structure, so a malformed upload is rejected
+// before the build dir is created and anything is extracted
+func prescanUpload(config *Config, r io.Reader) (*os.File, error) {
+	// the build dir base is only created with the first build
+	if err := os.MkdirAll(config.BuildDirBase, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create build base dir: %w", err)
+	}
+	spill, err := os.CreateTemp(config.BuildDirBase, ".upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create spill file: %w", err)
+	}
+	// nothing stays on disk, not even when the server crashes
+	if err := os.Remove(spill.Name()); err != nil {
+		spill.Close()
+		return nil, err
+	}
+	tee := io.TeeReader(r, spill)
+	err = prescanTar(config, tar.NewReader(tee))
+	if err == nil {
+		// the padding after the end of the archive
+		_, err = io.Copy(io.Discard, tee)
+	}
+	if err == nil {
+		_, err = spill.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spill.Close()
+		return nil, err
+	}
+	return spill, nil
+}
@@ -0,0 +1,100 @@
+package main_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+func TestBuildPrescanRejectsMalformedUploads(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-prescan-upload")
+	endpoint := baseURL + "api/v1/build"
+
+	onlyControl := bytes.NewBuffer(nil)
+	archive := tar.NewWriter(onlyControl)
+	err := writeToTar(archive, "control.json", `{"exports": ["image"]}`)
+	assert.NoError(t, err)
+	err = archive.Close()
+	assert.NoError(t, err)
+
+	for _, tc := range []struct {
+		upload      *bytes.Buffer
+		expectedErr string
+	}{
+		{onlyControl, "invalid upload: missing manifest.json"},
+		{makeTestPostWithEntries(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`, tarEntry{
+			name:    "store/sources/org.osbuild.files/sha256:1234",
+			content: "some-source",
+		}, tarEntry{
+			name:    "store/../../etc/passwd",
+			content: "evil",
+		}), "invalid upload: name not clean: store/../../etc/passwd"},
+		{makeTestPostWithEntries(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`, tarEntry{
+			name:    "README",
+			content: "hello",
+		}), "invalid upload: expected store/ prefix, got README"},
+	} {
+		rsp, err := http.Post(endpoint, "application/x-tar", tc.upload)
+		assert.NoError(t, err)
+		defer rsp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+		body, err := ioutil.ReadAll(rsp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expectedErr+"\n", string(body))
+
+		// nothing was written, not even the first source
+		entries, err := os.ReadDir(baseBuildDir)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 0)
+	}
+}
+
+func TestBuildPrescanExtractsValidUploads(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-prescan-upload")
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+cat %[1]s/build/store/sources/org.osbuild.files/sha256:1234
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPostWithEntries(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`, tarEntry{
+		name:    "store/sources/org.osbuild.files/sha256:1234",
+		content: "some-source",
+	})
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "some-source", string(body))
+}
+
+func TestBuildPrescanFreshBuildPath(t *testing.T) {
+	baseBuildDir := filepath.Join(t.TempDir(), "not-created-yet")
+	baseURL, _, _ := runTestServer(t, "-prescan-upload", "-build-path", baseBuildDir)
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+}
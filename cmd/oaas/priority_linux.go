@@ -0,0 +1,11 @@
+package main
+
+import (
+	"syscall"
+)
+
+// setBuildPriority sets the niceness of the whole osbuild process
+// group, processes started later inherit it
+func setBuildPriority(pgid, nice int) error {
+	return syscall.Setpriority(syscall.PRIO_PGRP, pgid, nice)
+}
@@ -0,0 +1,46 @@
+package main_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+func TestBuildPriority(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-nice", "5", "-ionice-class", "idle")
+	endpoint := baseURL + "api/v1/build"
+
+	// the niceness is set right after the start
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+for i in $(seq 100); do
+    [ "$(nice)" = 5 ] && break
+    sleep 0.01
+done
+echo "nice: $(nice)"
+echo "ionice: $(ionice)"
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), "nice: 5\n")
+	assert.Contains(t, string(body), "ionice: idle\n")
+}
+
+func TestRunInvalidIONiceClass(t *testing.T) {
+	err := main.Run(context.Background(), []string{"-ionice-class", "fast"}, os.Getenv)
+	assert.ErrorContains(t, err, `invalid ionice class "fast"`)
+}
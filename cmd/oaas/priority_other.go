@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+func setBuildPriority(pgid, nice int) error {
+	return errors.New("build priority not supported")
+}
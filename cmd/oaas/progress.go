@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// uploadProgressInterval is the number of bytes between two
+// "uploaded" markers
+var uploadProgressInterval int64 = 1024 * 1024
+
+// countingReader counts the bytes read from the underlying reader
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// uploadProgress streams markers to the client while the upload is
+// received and extracted, a nil uploadProgress reports nothing
+type uploadProgress struct {
+	w        io.Writer
+	counter  *countingReader
+	reported int64
+
+	// extractTotal is zero if the total size of the sources is
+	// not known
+	extracted         int64
+	extractTotal      int64
+	extractedReported int64
+}
+
+// newUploadProgress starts the streamed response, the request body
+// is still read afterwards so the connection must be full duplex
+func newUploadProgress(w http.ResponseWriter, counter *countingReader) (*uploadProgress, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, fmt.Errorf("cannot stream the output")
+	}
+	if err := http.NewResponseController(w).EnableFullDuplex(); err != nil {
+		return nil, fmt.Errorf("cannot enable full duplex: %v", err)
+	}
+	return &uploadProgress{
+		w:       &writeFlusher{w: w, flusher: flusher},
+		counter: counter,
+	}, nil
+}
+
+// uploaded reports the number of received bytes if enough new data
+// arrived since the last report
+func (p *uploadProgress) uploaded() {
+	if p == nil || p.counter.n-p.reported < uploadProgressInterval {
+		return
+	}
+	p.reported = p.counter.n
+	fmt.Fprintf(p.w, "uploaded %v bytes\n", p.counter.n)
+}
+
+func (p *uploadProgress) extracting(name string) {
+	if p == nil {
+		return
+	}
+	fmt.Fprintf(p.w, "extracting source %v\n", name)
+}
+
+// setExtractTotal sets the total number of source bytes, this is
+// only known when the client sends a sources.sizes index
+func (p *uploadProgress) setExtractTotal(total int64) {
+	if p == nil {
+		return
+	}
+	p.extractTotal = total
+}
+
+// addExtracted reports the number of extracted bytes if enough were
+// written since the last report
+func (p *uploadProgress) addExtracted(n int64) {
+	if p == nil {
+		return
+	}
+	p.extracted += n
+	if p.extracted-p.extractedReported < uploadProgressInterval {
+		return
+	}
+	p.reportExtracted()
+}
+
+// extractDone reports the final number of extracted bytes
+func (p *uploadProgress) extractDone() {
+	if p == nil || p.extracted == p.extractedReported {
+		return
+	}
+	p.reportExtracted()
+}
+
+func (p *uploadProgress) reportExtracted() {
+	p.extractedReported = p.extracted
+	if p.extractTotal > 0 {
+		fmt.Fprintf(p.w, "extracted %v/%v bytes\n", p.extracted, p.extractTotal)
+		return
+	}
+	fmt.Fprintf(p.w, "extracted %v bytes\n", p.extracted)
+}
+
+// extractWriter reports the bytes written to w as extracted
+type extractWriter struct {
+	w        io.Writer
+	progress *uploadProgress
+}
+
+func (ew *extractWriter) Write(p []byte) (int, error) {
+	n, err := ew.w.Write(p)
+	ew.progress.addExtracted(int64(n))
+	return n, err
+}
+
+// fail reports an error, the http status is already sent
+func (p *uploadProgress) fail(msg string) {
+	fmt.Fprintln(p.w, msg)
+}
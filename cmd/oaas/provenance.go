@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	provenanceName      = "provenance.json"
+	inTotoStatementType = "https://in-toto.io/Statement/v1"
+	slsaProvenanceType  = "https://slsa.dev/provenance/v1"
+	inTotoPayloadType   = "application/vnd.in-toto+json"
+	oaasBuildType       = "https://github.com/osbuild/oaas/build/v1"
+	oaasBuilderID       = "https://github.com/osbuild/oaas"
+)
+
+type resourceDescriptor struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type provenanceStatement struct {
+	Type          string               `json:"_type"`
+	Subject       []resourceDescriptor `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     slsaProvenance       `json:"predicate"`
+}
+
+type slsaProvenance struct {
+	BuildDefinition struct {
+		BuildType            string                 `json:"buildType"`
+		ExternalParameters   map[string]interface{} `json:"externalParameters"`
+		ResolvedDependencies []resourceDescriptor   `json:"resolvedDependencies"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID      string            `json:"id"`
+			Version map[string]string `json:"version"`
+		} `json:"builder"`
+		Metadata struct {
+			StartedOn  string `json:"startedOn"`
+			FinishedOn string `json:"finishedOn"`
+		} `json:"metadata"`
+	} `json:"runDetails"`
+}
+
+// dsseEnvelope is used for signed provenance
+type dsseEnvelope struct {
+	PayloadType string          `json:"payloadType"`
+	Payload     string          `json:"payload"`
+	Signatures  []dsseSignature `json:"signatures"`
+}
+
+type dsseSignature struct {
+	Sig string `json:"sig"`
+}
+
+func fileDigest(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return map[string]string{"sha256": hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// dirDigests returns the digests of all regular files below dir
+func dirDigests(dir string, skip ...string) ([]resourceDescriptor, error) {
+	var res []resourceDescriptor
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == dir {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		// sources from the base store are linked
+		if info.Mode()&os.ModeSymlink != 0 {
+			if info, err = os.Stat(path); err != nil {
+				return err
+			}
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		for _, s := range skip {
+			if rel == s {
+				return nil
+			}
+		}
+		digest, err := fileDigest(path)
+		if err != nil {
+			return err
+		}
+		res = append(res, resourceDescriptor{Name: filepath.ToSlash(rel), Digest: digest})
+		return nil
+	})
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, err
+}
+
+// referencedSourceDigests returns the digests of the sources in dir
+// that the manifest references, a checkpoint store also contains the
+// sources of earlier builds
+func referencedSourceDigests(manifestPath, dir string) ([]resourceDescriptor, error) {
+	data, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	var manifest manifestSources
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("cannot decode manifest sources: %v", err)
+	}
+	names := make(map[string]bool)
+	for _, source := range manifest.Sources {
+		for name := range source.Items {
+			names[name] = true
+		}
+		for name := range source.URLs {
+			names[name] = true
+		}
+	}
+	var res []resourceDescriptor
+	for name := range names {
+		if !validSourceName(name) {
+			continue
+		}
+		// sources from the base store are linked
+		digest, err := fileDigest(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			// e.g. an inline source
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, resourceDescriptor{Name: name, Digest: digest})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, nil
+}
+
+func newProvenance(config *Config, buildDir, storeDir, outputDir string, control *controlJSON, started, finished time.Time) (*provenanceStatement, error) {
+	st := &provenanceStatement{
+		Type:          inTotoStatementType,
+		PredicateType: slsaProvenanceType,
+	}
+	products, err := dirDigests(outputDir, provenanceName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot compute output digests: %v", err)
+	}
+	st.Subject = products
+
+	manifestDigest, err := fileDigest(filepath.Join(buildDir, "manifest.json"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot compute manifest digest: %v", err)
+	}
+	materials := []resourceDescriptor{{Name: "manifest.json", Digest: manifestDigest}}
+	sources, err := referencedSourceDigests(filepath.Join(buildDir, "manifest.json"), filepath.Join(storeDir, filesSourceDir))
+	if err != nil {
+		return nil, fmt.Errorf("cannot compute source digests: %v", err)
+	}
+	for _, source := range sources {
+		source.Name = filesSourceDir + "/" + source.Name
+		materials = append(materials, source)
+	}
+
+	binary, err := osbuildBinaryFor(config, control)
+	if err != nil {
+		return nil, err
+	}
+	pred := &st.Predicate
+	pred.BuildDefinition.BuildType = oaasBuildType
+	pred.BuildDefinition.ExternalParameters = map[string]interface{}{
+		"exports":         control.Exports,
+		"osbuild_version": control.OsbuildVersion,
+	}
+	pred.BuildDefinition.ResolvedDependencies = materials
+	pred.RunDetails.Builder.ID = oaasBuilderID
+	pred.RunDetails.Builder.Version = map[string]string{"osbuild": osbuildVersion(binary)}
+	pred.RunDetails.Metadata.StartedOn = started.UTC().Format(time.RFC3339)
+	pred.RunDetails.Metadata.FinishedOn = finished.UTC().Format(time.RFC3339)
+	return st, nil
+}
+
+func loadSigningKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("cannot find PEM data in %v", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported signing key type %T", key)
+	}
+	return signer, nil
+}
+
+// dssePAE is the DSSE pre-authentication encoding that gets signed
+func dssePAE(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
+
+func signPayload(signer crypto.Signer, msg []byte) ([]byte, error) {
+	if _, ok := signer.(ed25519.PrivateKey); ok {
+		return signer.Sign(rand.Reader, msg, crypto.Hash(0))
+	}
+	digest := sha256.Sum256(msg)
+	return signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+// writeProvenance writes the provenance to the output dir, with a
+// signing key it is wrapped into a signed DSSE envelope
+func writeProvenance(config *Config, buildDir, storeDir, outputDir string, control *controlJSON, started time.Time) error {
+	st, err := newProvenance(config, buildDir, storeDir, outputDir, control, started, time.Now())
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if config.SigningKey != "" {
+		signer, err := loadSigningKey(config.SigningKey)
+		if err != nil {
+			return fmt.Errorf("cannot load signing key: %v", err)
+		}
+		sig, err := signPayload(signer, dssePAE(inTotoPayloadType, data))
+		if err != nil {
+			return fmt.Errorf("cannot sign provenance: %v", err)
+		}
+		env := dsseEnvelope{
+			PayloadType: inTotoPayloadType,
+			Payload:     base64.StdEncoding.EncodeToString(data),
+			Signatures:  []dsseSignature{{Sig: base64.StdEncoding.EncodeToString(sig)}},
+		}
+		if data, err = json.Marshal(&env); err != nil {
+			return err
+		}
+	}
+	mode := os.FileMode(0644)
+	if config.OutputDirMode != 0 {
+		mode = config.OutputDirMode &^ 0111
+	}
+	return ioutil.WriteFile(filepath.Join(outputDir, provenanceName), data, mode)
+}
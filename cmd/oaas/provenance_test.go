@@ -0,0 +1,169 @@
+package main_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+type testDescriptor struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type testProvenance struct {
+	Type          string           `json:"_type"`
+	Subject       []testDescriptor `json:"subject"`
+	PredicateType string           `json:"predicateType"`
+	Predicate     struct {
+		BuildDefinition struct {
+			ResolvedDependencies []testDescriptor `json:"resolvedDependencies"`
+		} `json:"buildDefinition"`
+		RunDetails struct {
+			Builder struct {
+				Version map[string]string `json:"version"`
+			} `json:"builder"`
+			Metadata struct {
+				StartedOn  string `json:"startedOn"`
+				FinishedOn string `json:"finishedOn"`
+			} `json:"metadata"`
+		} `json:"runDetails"`
+	} `json:"predicate"`
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// provenanceManifest only references one of the uploaded sources
+const provenanceManifest = `{"version": "2", "sources": {"org.osbuild.curl": {"items": {"sha256:ff800c5263b915d8a0776be5620575df2d478332ad35e8dd18def6a8c720f9c7": "https://example.com/file"}}}}`
+
+func runProvenanceBuild(t *testing.T, extraArgs ...string) (provenance []byte, baseBuildDir string) {
+	baseURL, baseBuildDir, _ := runTestServer(t, append([]string{"-provenance"}, extraArgs...)...)
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+if [ "$1" = "--version" ]; then
+    echo "osbuild 42"
+    exit 0
+fi
+mkdir -p %[1]s/build/output/image
+echo "fake-build-result" > %[1]s/build/output/image/disk.img
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, provenanceManifest)
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+
+	rsp, err = http.Get(baseURL + "api/v1/result/provenance.json")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	provenance, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	return provenance, baseBuildDir
+}
+
+func assertProvenanceDigests(t *testing.T, data []byte, baseBuildDir string) {
+	var prov testProvenance
+	err := json.Unmarshal(data, &prov)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://in-toto.io/Statement/v1", prov.Type)
+	assert.Equal(t, "https://slsa.dev/provenance/v1", prov.PredicateType)
+	assert.NotEqual(t, "", prov.Predicate.RunDetails.Metadata.StartedOn)
+	assert.NotEqual(t, "", prov.Predicate.RunDetails.Metadata.FinishedOn)
+	assert.Equal(t, map[string]string{"osbuild": "osbuild 42"}, prov.Predicate.RunDetails.Builder.Version)
+
+	outputTar, err := ioutil.ReadFile(filepath.Join(baseBuildDir, "build/output/output.tar"))
+	assert.NoError(t, err)
+	assert.Equal(t, []testDescriptor{
+		{"image/disk.img", map[string]string{"sha256": sha256Hex([]byte("fake-build-result\n"))}},
+		{"output.tar", map[string]string{"sha256": sha256Hex(outputTar)}},
+	}, prov.Subject)
+	assert.Equal(t, []testDescriptor{
+		{"manifest.json", map[string]string{"sha256": sha256Hex([]byte(provenanceManifest))}},
+		{"sources/org.osbuild.files/sha256:ff800c5263b915d8a0776be5620575df2d478332ad35e8dd18def6a8c720f9c7", map[string]string{"sha256": sha256Hex([]byte("random-data"))}},
+	}, prov.Predicate.BuildDefinition.ResolvedDependencies)
+}
+
+func TestBuildProvenance(t *testing.T) {
+	provenance, baseBuildDir := runProvenanceBuild(t)
+	assertProvenanceDigests(t, provenance, baseBuildDir)
+}
+
+func TestBuildProvenanceDisabled(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t)
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+echo "fake-build-result" > %[1]s/build/output/image/disk.img
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+
+	assert.NoFileExists(t, filepath.Join(baseBuildDir, "build/output/provenance.json"))
+}
+
+func TestBuildProvenanceSigned(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	assert.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "signing.key")
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	assert.NoError(t, err)
+
+	provenance, baseBuildDir := runProvenanceBuild(t, "-signing-key", keyPath)
+	var env struct {
+		PayloadType string `json:"payloadType"`
+		Payload     string `json:"payload"`
+		Signatures  []struct {
+			Sig string `json:"sig"`
+		} `json:"signatures"`
+	}
+	err = json.Unmarshal(provenance, &env)
+	assert.NoError(t, err)
+	assert.Equal(t, "application/vnd.in-toto+json", env.PayloadType)
+	payload, err := base64.StdEncoding.DecodeString(env.Payload)
+	assert.NoError(t, err)
+	assertProvenanceDigests(t, payload, baseBuildDir)
+
+	assert.Len(t, env.Signatures, 1)
+	sig, err := base64.StdEncoding.DecodeString(env.Signatures[0].Sig)
+	assert.NoError(t, err)
+	pae := fmt.Sprintf("DSSEv1 %d %s %d %s", len(env.PayloadType), env.PayloadType, len(payload), payload)
+	assert.True(t, ed25519.Verify(pub, []byte(pae), sig))
+}
+
+func TestRunSigningKeyRequiresProvenance(t *testing.T) {
+	err := main.Run(context.Background(), []string{"-signing-key", "provenance.pem"}, os.Getenv)
+	assert.EqualError(t, err, "-signing-key requires -provenance")
+}
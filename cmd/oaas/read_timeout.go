@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// idleTimeoutReader extends the connection read deadline before
+// every read so that a client that stops sending data is detected
+// while a slow but steady upload still works
+type idleTimeoutReader struct {
+	r       io.Reader
+	rc      *http.ResponseController
+	timeout time.Duration
+
+	timedOut bool
+}
+
+func newIdleTimeoutReader(w http.ResponseWriter, r io.Reader, timeout time.Duration) *idleTimeoutReader {
+	return &idleTimeoutReader{
+		r:       r,
+		rc:      http.NewResponseController(w),
+		timeout: timeout,
+	}
+}
+
+func (ir *idleTimeoutReader) Read(p []byte) (int, error) {
+	if ir.timeout > 0 {
+		if err := ir.rc.SetReadDeadline(time.Now().Add(ir.timeout)); err != nil {
+			return 0, err
+		}
+	}
+	n, err := ir.r.Read(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		ir.timedOut = true
+	}
+	return n, err
+}
+
+// TimedOut returns true if a read failed because the client sent
+// no data for longer than the timeout
+func (ir *idleTimeoutReader) TimedOut() bool {
+	return ir.timedOut
+}
+
+// Done clears the read deadline once the body is fully read
+func (ir *idleTimeoutReader) Done() error {
+	if ir.timeout == 0 {
+		return nil
+	}
+	return ir.rc.SetReadDeadline(time.Time{})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type sharedFile struct {
+	*os.File
+
+	path string
+	refs int
+}
+
+// resultFiles shares the open result files between concurrent
+// downloads and defers the cleanup of the build until the last
+// download has finished
+type resultFiles struct {
+	mu sync.Mutex
+
+	files          map[string]*sharedFile
+	cleanupPending bool
+	cleanup        func()
+
+	// served tracks the byte ranges of the results that were
+	// (partially) downloaded via range requests
+	served       map[string][]byteRange
+	cleanupTimer *time.Timer
+}
+
+func newResultFiles(cleanup func()) *resultFiles {
+	return &resultFiles{
+		files:   make(map[string]*sharedFile),
+		cleanup: cleanup,
+		served:  make(map[string][]byteRange),
+	}
+}
+
+func (rf *resultFiles) Open(path string) (*sharedFile, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if sf, ok := rf.files[path]; ok {
+		sf.refs++
+		return sf, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	sf := &sharedFile{File: f, path: path, refs: 1}
+	rf.files[path] = sf
+	return sf, nil
+}
+
+// Release releases the file, if requestCleanup is set the build
+// gets cleaned up as soon as no more downloads are active
+func (rf *resultFiles) Release(sf *sharedFile, requestCleanup bool) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	sf.refs--
+	if sf.refs == 0 {
+		sf.Close()
+		delete(rf.files, sf.path)
+	}
+	if requestCleanup {
+		rf.cleanupPending = true
+	}
+	rf.maybeCleanup()
+}
+
+func (rf *resultFiles) maybeCleanup() {
+	if rf.cleanupPending && len(rf.files) == 0 {
+		rf.cleanupPending = false
+		if rf.cleanupTimer != nil {
+			rf.cleanupTimer.Stop()
+			rf.cleanupTimer = nil
+		}
+		rf.served = make(map[string][]byteRange)
+		rf.cleanup()
+	}
+}
+
+// CleanupAfter requests the cleanup after the given duration, this
+// is used when the client only downloaded parts of a result and
+// may never resume, stillCurrent prevents removing a newer build
+func (rf *resultFiles) CleanupAfter(d time.Duration, stillCurrent func() bool) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.cleanupTimer != nil {
+		return
+	}
+	rf.cleanupTimer = time.AfterFunc(d, func() {
+		rf.mu.Lock()
+		defer rf.mu.Unlock()
+
+		rf.cleanupTimer = nil
+		if !stillCurrent() {
+			return
+		}
+		rf.cleanupPending = true
+		rf.maybeCleanup()
+	})
+}
+
+// Served records the bytes that the given response delivered and
+// returns true once the whole file was delivered, either by a single
+// response or by a set of range responses, the key must change
+// when the file changes
+func (rf *resultFiles) Served(key string, rr *rangeRecorder, size int64) bool {
+	start, ok := rr.servedStart(size)
+	if !ok {
+		return false
+	}
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	ranges := addByteRange(rf.served[key], byteRange{start, start + rr.written})
+	rf.served[key] = ranges
+	return len(ranges) == 1 && ranges[0].start == 0 && ranges[0].end >= size
+}
+
+// byteRange is the half open interval [start, end)
+type byteRange struct {
+	start, end int64
+}
+
+func addByteRange(ranges []byteRange, br byteRange) []byteRange {
+	if br.end <= br.start {
+		return ranges
+	}
+	ranges = append(ranges, br)
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r.start <= last.end {
+			if r.end > last.end {
+				last.end = r.end
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// rangeRecorder records the status, the Content-Range and the size
+// of the body of a response
+type rangeRecorder struct {
+	http.ResponseWriter
+
+	status  int
+	written int64
+}
+
+func (rr *rangeRecorder) WriteHeader(status int) {
+	rr.status = status
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *rangeRecorder) Write(p []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	n, err := rr.ResponseWriter.Write(p)
+	rr.written += int64(n)
+	return n, err
+}
+
+// servedStart returns the offset in the file of the first byte
+// written, multipart range responses are not tracked
+func (rr *rangeRecorder) servedStart(size int64) (int64, bool) {
+	switch rr.status {
+	case http.StatusOK:
+		return 0, true
+	case http.StatusPartialContent:
+		var start, end, total int64
+		if _, err := fmt.Sscanf(rr.Header().Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total); err != nil || total != size {
+			return 0, false
+		}
+		return start, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	ErrPackagingFailed = errors.New("packaging failed")
+)
+
+// packagingPollInterval is the wait for more data from the running
+// packaging
+var packagingPollInterval = 50 * time.Millisecond
+
+// packagingReader reads the output tar while it is written by the
+// packaging, it ends once the temporary tar got renamed to its final
+// name and fails if the packaging removed it
+type packagingReader struct {
+	ctx       context.Context
+	f         *os.File
+	tmpPath   string
+	finalPath string
+
+	finished bool
+}
+
+func (pr *packagingReader) Read(p []byte) (int, error) {
+	for {
+		n, err := pr.f.Read(p)
+		if n > 0 || err != io.EOF || pr.finished {
+			return n, err
+		}
+		st, err := pr.f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		// the rename happens after tar exited so the rest of
+		// the file is complete
+		if final, err := os.Stat(pr.finalPath); err == nil && os.SameFile(st, final) {
+			pr.finished = true
+			continue
+		}
+		if tmp, err := os.Stat(pr.tmpPath); err != nil || !os.SameFile(st, tmp) {
+			return 0, ErrPackagingFailed
+		}
+		select {
+		case <-pr.ctx.Done():
+			return 0, pr.ctx.Err()
+		case <-time.After(packagingPollInterval):
+		}
+	}
+}
+
+// openPackagingOutput opens the output tar that is currently being
+// packaged, it returns nil if no packaging is running
+func openPackagingOutput(ctx context.Context, config *Config, outputDir string) (*packagingReader, error) {
+	tmpPath := filepath.Join(outputDir, outputTarTmpName)
+	f, err := os.Open(tmpPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &packagingReader{
+		ctx:       ctx,
+		f:         f,
+		tmpPath:   tmpPath,
+		finalPath: filepath.Join(outputDir, outputTarName(config)),
+	}, nil
+}
+
+// streamPackagingOutput sends the output tar to the client while it
+// is packaged, the size is unknown so the response is chunked
+func streamPackagingOutput(w http.ResponseWriter, r *http.Request, config *Config, pr *packagingReader) error {
+	defer pr.f.Close()
+
+	flusher, _ := w.(http.Flusher)
+	wf := &writeFlusher{w: w, flusher: flusher}
+	w.Header().Set("Content-Type", "application/x-tar")
+	if config.OutputCompression == "" {
+		_, err := io.Copy(wf, pr)
+		return err
+	}
+	encoding := outputCompressions[config.OutputCompression].encoding
+	w.Header().Set("Vary", "Accept-Encoding")
+	if acceptsEncoding(r, encoding) {
+		w.Header().Set("Content-Encoding", encoding)
+		_, err := io.Copy(wf, pr)
+		return err
+	}
+	return decompressTo(wf, pr)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+func writeDirTar(w io.Writer, dir string) error {
+	atar := tar.NewWriter(w)
+	base := filepath.Dir(dir)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(name)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := atar.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(atar, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return atar.Close()
+}
+
+// serveDirTar streams the given dir as a tar, the size is not known
+// upfront so the digest is sent as a trailer for the client to
+// verify the download
+func serveDirTar(w http.ResponseWriter, dir string) error {
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Trailer", "X-Content-SHA256")
+	w.WriteHeader(http.StatusOK)
+
+	h := sha256.New()
+	if err := writeDirTar(io.MultiWriter(w, h), dir); err != nil {
+		return err
+	}
+	w.Header().Set("X-Content-SHA256", hex.EncodeToString(h.Sum(nil)))
+	return nil
+}
@@ -7,7 +7,22 @@ import (
 )
 
 func addRoutes(mux *http.ServeMux, logger *logrus.Logger, config *Config) {
-	mux.Handle("/api/v1/build", handleBuild(logger, config))
-	mux.Handle("/api/v1/result/", http.StripPrefix("/api/v1/result/", handleResult(logger, config)))
+	mux.Handle("/api/v1/admin/maintenance", handleCORS(config, handleAdminMaintenance(logger, config)))
+	mux.Handle("/api/v1/build", handleCORS(config, handleBuild(logger, config)))
+	mux.Handle("/api/v1/build/", handleCORS(config, http.StripPrefix("/api/v1/build/", handleBuildEvents(logger, config))))
+	mux.Handle("/api/v1/build/attach", handleCORS(config, handleAttach(logger, config)))
+	mux.Handle("/api/v1/build/control", handleCORS(config, handleBuildControl(logger, config)))
+	mux.Handle("/api/v1/build/log", handleCORS(config, handleBuildLog(logger, config)))
+	mux.Handle("/api/v1/build/summary", handleCORS(config, handleBuildSummary(logger, config)))
+	mux.Handle("/api/v1/builds", handleCORS(config, handleBuilds(logger, config)))
+	mux.Handle("/api/v1/manifest/diff", handleCORS(config, handleManifestDiff(logger, config)))
+	mux.Handle("/api/v1/sources/signature/", handleCORS(config, http.StripPrefix("/api/v1/sources/signature/", handleSourceSignature(logger, config))))
+	mux.Handle(byDigestURLPath, handleCORS(config, http.StripPrefix(byDigestURLPath, handleResultByDigest(logger, config))))
+	mux.Handle("/api/v1/result/oci.tar", handleCORS(config, handleResultOCI(logger, config)))
+	mux.Handle("/api/v1/result/list", handleCORS(config, handleResultList(logger, config)))
+	mux.Handle("/api/v1/result/", handleCORS(config, http.StripPrefix("/api/v1/result/", handleResult(logger, config))))
+	mux.Handle("/healthz", handleHealthz(logger, config))
+	mux.Handle("/metrics", handleMetrics(logger, config))
+	mux.Handle("/ui/", http.StripPrefix("/ui/", handleUI(logger, config)))
 	mux.Handle("/", handleRoot(logger, config))
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+//go:embed data/control-schema.json
+var controlSchemaJSON []byte
+
+var controlSchema = mustParseSchema(controlSchemaJSON)
+
+// jsonSchema implements the subset of JSON schema that is needed to
+// validate control.json
+type jsonSchema struct {
+	Type                 string                 `json:"type"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	AdditionalProperties *additionalProperties  `json:"additionalProperties"`
+	Required             []string               `json:"required"`
+	Items                *jsonSchema            `json:"items"`
+	Enum                 []interface{}          `json:"enum"`
+}
+
+// additionalProperties is either a boolean or a schema that all
+// properties not listed in "properties" must match
+type additionalProperties struct {
+	allowed bool
+	schema  *jsonSchema
+}
+
+func (a *additionalProperties) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &a.allowed); err == nil {
+		return nil
+	}
+	a.allowed = true
+	return json.Unmarshal(data, &a.schema)
+}
+
+func mustParseSchema(data []byte) *jsonSchema {
+	var schema jsonSchema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		panic(fmt.Sprintf("cannot parse schema: %v", err))
+	}
+	return &schema
+}
+
+type schemaError struct {
+	path string
+	msg  string
+}
+
+func (e *schemaError) Error() string {
+	if e.path == "" {
+		return e.msg
+	}
+	return e.path + ": " + e.msg
+}
+
+func jsonTypeOf(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == float64(int64(v)) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// enumContains only supports scalar values which is all that
+// control.json needs
+func enumContains(enum []interface{}, v interface{}) bool {
+	for _, e := range enum {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+func joinPath(path, elem string) string {
+	if path == "" {
+		return elem
+	}
+	return path + "." + elem
+}
+
+func (s *jsonSchema) validate(path string, v interface{}) error {
+	typ := jsonTypeOf(v)
+	if s.Type != "" && s.Type != typ && !(s.Type == "number" && typ == "integer") {
+		return &schemaError{path, fmt.Sprintf("expected %v, got %v", s.Type, typ)}
+	}
+
+	if len(s.Enum) > 0 && !enumContains(s.Enum, v) {
+		return &schemaError{path, fmt.Sprintf("must be one of %v, got %v", s.Enum, v)}
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, req := range s.Required {
+			if _, ok := v[req]; !ok {
+				return &schemaError{joinPath(path, req), "required"}
+			}
+		}
+		// sort to get stable errors
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			prop, ok := s.Properties[k]
+			if !ok && s.AdditionalProperties != nil {
+				if !s.AdditionalProperties.allowed {
+					return &schemaError{joinPath(path, k), "unknown field"}
+				}
+				prop = s.AdditionalProperties.schema
+			}
+			// null is the same as not setting the field, just
+			// like when decoding into the control struct
+			if prop == nil || v[k] == nil {
+				continue
+			}
+			if err := prop.validate(joinPath(path, k), v[k]); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if s.Items == nil {
+			return nil
+		}
+		for i, item := range v {
+			if err := s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateControlJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	return controlSchema.validate("", v)
+}
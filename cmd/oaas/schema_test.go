@@ -0,0 +1,125 @@
+package main_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+type testSchema struct {
+	Type       string                 `json:"type"`
+	Properties map[string]*testSchema `json:"properties"`
+}
+
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func assertSchemaMatchesType(t *testing.T, schema *testSchema, typ reflect.Type) {
+	fields := jsonFields(typ)
+	assert.Equal(t, sortedKeys(fields), sortedKeys(schema.Properties), "schema out of sync with %v", typ)
+	for name, ftyp := range fields {
+		if ftyp.Kind() == reflect.Pointer && ftyp.Elem().Kind() == reflect.Struct {
+			assert.Equal(t, "object", schema.Properties[name].Type)
+			assertSchemaMatchesType(t, schema.Properties[name], ftyp.Elem())
+		}
+	}
+}
+
+func TestControlSchemaInSyncWithStruct(t *testing.T) {
+	var schema testSchema
+	err := json.Unmarshal(main.ControlSchemaJSON, &schema)
+	assert.NoError(t, err)
+	assertSchemaMatchesType(t, &schema, main.ControlJSONType)
+}
+
+func TestBuildControlSchemaErrors(t *testing.T) {
+	baseURL, _, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	for _, tc := range []struct {
+		control  string
+		expected string
+	}{
+		{`{"exports": "image"}`, "exports: expected array, got string"},
+		{`{"exports": ["image", 1]}`, "exports[1]: expected string, got integer"},
+		{`{"result_upload": {"url": "https://s3.example.com"}}`, "result_upload.credentials: required"},
+		{`["image"]`, "expected object, got array"},
+		{`{"log_level": "verbose"}`, "log_level: must be one of [debug info warn], got verbose"},
+		{`{"variables": {"release": 9}}`, "variables.release: expected string, got integer"},
+	} {
+		buf := makeTestPost(t, tc.control, `{"fake": "manifest"}`)
+		rsp, err := http.Post(endpoint, "application/x-tar", buf)
+		assert.NoError(t, err)
+		defer rsp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+		body, err := ioutil.ReadAll(rsp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "invalid control.json: "+tc.expected+"\n", string(body))
+	}
+}
+
+func TestBuildControlSchemaValid(t *testing.T) {
+	baseURL, _, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, `#!/bin/sh
+echo "valid"
+`)
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"], "environments": ["MY=env"], "osbuild_version": ""}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+}
+
+func TestBuildControlSchemaNullAndUnknownFields(t *testing.T) {
+	baseURL, _, _ := runTestServer(t)
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, `#!/bin/sh
+echo "valid"
+`)
+	defer restore()
+
+	// null is the same as a missing field
+	buf := makeTestPost(t, `{"exports": null}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "no exports requested\n", string(body))
+
+	buf = makeTestPost(t, `{"exports": ["image"], "log_level": null, "from_newer_client": true}`, `{"fake": "manifest"}`)
+	rsp, err = http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+}
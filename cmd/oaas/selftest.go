@@ -0,0 +1,110 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	_ "embed"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//go:embed data/selftest-manifest.json
+var selftestManifest []byte
+
+var selftestControl = []byte(`{"exports": ["tree"]}`)
+
+func makeSelftestTar() (*bytes.Buffer, error) {
+	buf := bytes.NewBuffer(nil)
+	atar := tar.NewWriter(buf)
+	for _, entry := range []struct {
+		name    string
+		content []byte
+	}{
+		{"control.json", selftestControl},
+		{"manifest.json", selftestManifest},
+	} {
+		hdr := &tar.Header{
+			Name:    entry.name,
+			Mode:    0644,
+			Size:    int64(len(entry.content)),
+			ModTime: time.Now(),
+		}
+		if err := atar.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := atar.Write(entry.content); err != nil {
+			return nil, err
+		}
+	}
+	if err := atar.Close(); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// runSelftest runs a build of a tiny manifest against an in-process
+// server, the build output is written to output
+func runSelftest(ctx context.Context, logger *logrus.Logger, config *Config, output io.Writer) error {
+	// never touch the build dir of a (potentially) running service
+	selftestConfig := *config
+	tmpdir, err := ioutil.TempDir("", "oaas-selftest-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+	selftestConfig.BuildDirBase = tmpdir
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	httpServer := &http.Server{Handler: newServer(logger, &selftestConfig)}
+	go httpServer.Serve(ln)
+	defer httpServer.Close()
+	baseURL := fmt.Sprintf("http://%s/", ln.Addr())
+
+	buf, err := makeSelftestTar()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL+"api/v1/build", buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-tar")
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("selftest build failed: %v", err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusCreated {
+		body, _ := ioutil.ReadAll(rsp.Body)
+		return fmt.Errorf("selftest build failed: %v: %s", rsp.Status, body)
+	}
+	if _, err := io.Copy(output, rsp.Body); err != nil {
+		return fmt.Errorf("selftest build failed: %v", err)
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"api/v1/result/output.tar", nil)
+	if err != nil {
+		return err
+	}
+	rsp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("selftest result failed: %v", err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("selftest result failed: %v", rsp.Status)
+	}
+	fmt.Fprintf(output, "\nselftest passed\n")
+	return nil
+}
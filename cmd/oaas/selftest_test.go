@@ -0,0 +1,56 @@
+package main_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+// mockOsbuildOutput is a fake osbuild that creates the "tree" export
+// in the dir passed via --output-dir
+const mockOsbuildOutput = `#!/bin/sh -e
+while [ $# -gt 0 ]; do
+    case "$1" in
+    --output-dir)
+        output_dir="$2"
+        shift
+        ;;
+    esac
+    shift
+done
+mkdir -p "$output_dir/tree"
+echo "fake-tree" > "$output_dir/tree/file"
+`
+
+func TestSelftestSuccess(t *testing.T) {
+	restore := main.MockOsbuildBinary(t, mockOsbuildOutput)
+	defer restore()
+
+	buildBaseDir := t.TempDir()
+	err := main.Run(context.Background(), []string{"-build-path", buildBaseDir, "selftest"}, os.Getenv)
+	assert.NoError(t, err)
+	// the configured build path is not used by the selftest
+	entries, err := os.ReadDir(buildBaseDir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 0)
+}
+
+func TestSelftestFailure(t *testing.T) {
+	restore := main.MockOsbuildBinary(t, `#!/bin/sh
+echo "broken osbuild"
+exit 1
+`)
+	defer restore()
+
+	err := main.Run(context.Background(), []string{"selftest"}, os.Getenv)
+	assert.EqualError(t, err, "selftest result failed: 400 Bad Request")
+}
+
+func TestRunUnknownCommand(t *testing.T) {
+	err := main.Run(context.Background(), []string{"random"}, os.Getenv)
+	assert.EqualError(t, err, `unknown command ["random"]`)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+var (
+	ErrSourceHostNotAllowed = errors.New("source host not allowed")
+)
+
+// manifestSources is the part of an osbuild manifest (v1 and v2)
+// that references sources
+type manifestSources struct {
+	Sources map[string]struct {
+		// v2
+		Items map[string]json.RawMessage `json:"items"`
+		// v1 org.osbuild.files
+		URLs map[string]json.RawMessage `json:"urls"`
+		// org.osbuild.librepo
+		Mirrors map[string]json.RawMessage `json:"mirrors"`
+	} `json:"sources"`
+}
+
+// sourceURL decodes a source that is either just an url or an object
+// with an "url" key
+func sourceURL(raw json.RawMessage) (string, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, nil
+	}
+	var obj struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return "", err
+	}
+	return obj.URL, nil
+}
+
+// containerRegistry returns the registry of a container image name
+// following the docker conventions
+func containerRegistry(name string) string {
+	first, _, found := strings.Cut(name, "/")
+	if found && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		return first
+	}
+	return "docker.io"
+}
+
+// sourceURLsFor returns the urls of the items of the given source
+// type, unknown source types have no urls
+func sourceURLsFor(sourceType string, items map[string]json.RawMessage) ([]string, error) {
+	var urls []string
+	for _, raw := range items {
+		switch sourceType {
+		case "org.osbuild.curl", "org.osbuild.files", "org.osbuild.librepo":
+			u, err := sourceURL(raw)
+			if err != nil {
+				return nil, fmt.Errorf("cannot decode %v source: %v", sourceType, err)
+			}
+			urls = append(urls, u)
+		case "org.osbuild.ostree":
+			var item struct {
+				Remote struct {
+					URL string `json:"url"`
+				} `json:"remote"`
+			}
+			if err := json.Unmarshal(raw, &item); err != nil {
+				return nil, fmt.Errorf("cannot decode %v source: %v", sourceType, err)
+			}
+			urls = append(urls, item.Remote.URL)
+		case "org.osbuild.skopeo", "org.osbuild.skopeo-index":
+			var item struct {
+				Image struct {
+					Name string `json:"name"`
+				} `json:"image"`
+			}
+			if err := json.Unmarshal(raw, &item); err != nil {
+				return nil, fmt.Errorf("cannot decode %v source: %v", sourceType, err)
+			}
+			ref := item.Image.Name
+			if registry := containerRegistry(ref); !strings.HasPrefix(ref, registry+"/") {
+				ref = registry + "/" + ref
+			}
+			urls = append(urls, "docker://"+ref)
+		}
+	}
+	return urls, nil
+}
+
+func urlHost(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// checkManifestSources ensures that the manifest only fetches sources
+// from the allowed hosts, no allowed hosts means no restriction
+func checkManifestSources(config *Config, manifestPath string) error {
+	if len(config.AllowedSourceHosts) == 0 {
+		return nil
+	}
+	data, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+	var manifest manifestSources
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("cannot decode manifest sources: %v", err)
+	}
+
+	// sort to get stable errors
+	var sourceTypes []string
+	for sourceType := range manifest.Sources {
+		sourceTypes = append(sourceTypes, sourceType)
+	}
+	sort.Strings(sourceTypes)
+	for _, sourceType := range sourceTypes {
+		source := manifest.Sources[sourceType]
+		var urls []string
+		for _, items := range []map[string]json.RawMessage{source.Items, source.URLs, source.Mirrors} {
+			u, err := sourceURLsFor(sourceType, items)
+			if err != nil {
+				return err
+			}
+			urls = append(urls, u...)
+		}
+		sort.Strings(urls)
+		for _, u := range urls {
+			// local sources do not need the network
+			if strings.HasPrefix(u, "file:") {
+				continue
+			}
+			if !slices.Contains(config.AllowedSourceHosts, urlHost(u)) {
+				return fmt.Errorf("%w: %v", ErrSourceHostNotAllowed, u)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+const manifestWithSources = `{
+  "version": "2",
+  "sources": {
+    "org.osbuild.curl": {
+      "items": {
+        "sha256:aaaa": "https://mirror.example.com/fedora/pkg-a.rpm",
+        "sha256:bbbb": {"url": "https://%s/fedora/pkg-b.rpm"}
+      }
+    },
+    "org.osbuild.ostree": {
+      "items": {
+        "abcdef": {"remote": {"url": "https://ostree.example.com/repo"}}
+      }
+    },
+    "org.osbuild.skopeo": {
+      "items": {
+        "sha256:cccc": {"image": {"name": "registry.example.com/base/image", "digest": "sha256:cccc"}}
+      }
+    },
+    "org.osbuild.inline": {
+      "items": {
+        "sha256:dddd": {"encoding": "base64", "data": "aGVsbG8="}
+      }
+    }
+  }
+}`
+
+func TestBuildSourceHostsAllowed(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-allowed-source-hosts", "mirror.example.com,ostree.example.com,registry.example.com")
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, fmt.Sprintf(manifestWithSources, "mirror.example.com"))
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+}
+
+func TestBuildSourceHostsNotAllowed(t *testing.T) {
+	baseURL, baseBuildDir, _ := runTestServer(t, "-allowed-source-hosts", "mirror.example.com,ostree.example.com,registry.example.com")
+	endpoint := baseURL + "api/v1/build"
+
+	for _, tc := range []struct {
+		manifest string
+		expected string
+	}{
+		{fmt.Sprintf(manifestWithSources, "evil.example.com"), "source host not allowed: https://evil.example.com/fedora/pkg-b.rpm\n"},
+		{`{"sources": {"org.osbuild.skopeo": {"items": {"sha256:cccc": {"image": {"name": "fedora:latest"}}}}}}`, "source host not allowed: docker://docker.io/fedora:latest\n"},
+		{`{"sources": {"org.osbuild.files": {"urls": {"sha256:eeee": "http://other.example.com/file"}}}}`, "source host not allowed: http://other.example.com/file\n"},
+	} {
+		buf := makeTestPost(t, `{"exports": ["image"]}`, tc.manifest)
+		rsp, err := http.Post(endpoint, "application/x-tar", buf)
+		assert.NoError(t, err)
+		defer rsp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, rsp.StatusCode)
+		body, err := ioutil.ReadAll(rsp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, string(body))
+		// the build never starts
+		assert.NoDirExists(t, filepath.Join(baseBuildDir, "build"))
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// sourceSizesName is the optional index of the expected source sizes,
+// it must be sent before the sources it describes
+const sourceSizesName = "store/sources.sizes"
+
+var (
+	ErrSizeMismatch       = errors.New("size mismatch")
+	ErrSourceTypeTooLarge = errors.New("sources too large")
+)
+
+// sourceSizes maps the source file name (i.e. the digest) to its
+// expected size, the digest itself can only be verified once the
+// full file is written but a truncated source is caught early
+type sourceSizes map[string]int64
+
+func (s sourceSizes) read(r io.Reader) error {
+	var sizes map[string]int64
+	if err := json.NewDecoder(r).Decode(&sizes); err != nil {
+		return fmt.Errorf("cannot decode %v: %v", sourceSizesName, err)
+	}
+	for name, size := range sizes {
+		if size < 0 {
+			return fmt.Errorf("invalid size %v for %v in %v", size, name, sourceSizesName)
+		}
+		s[name] = size
+	}
+	return nil
+}
+
+func (s sourceSizes) total() int64 {
+	var total int64
+	for _, size := range s {
+		total += size
+	}
+	return total
+}
+
+// check must be called before the source is written
+func (s sourceSizes) check(name string, size int64) error {
+	expected, ok := s[filepath.Base(name)]
+	if !ok {
+		return nil
+	}
+	if size != expected {
+		return fmt.Errorf("%w: %v has %v bytes, expected %v", ErrSizeMismatch, name, size, expected)
+	}
+	return nil
+}
+
+// sourceTypeSizes sums up the extracted sources per source type to
+// enforce Config.MaxSourceSizeByType
+type sourceTypeSizes map[string]int64
+
+// add must be called before the source is written
+func (s sourceTypeSizes) add(config *Config, name string, size int64) error {
+	rest, ok := strings.CutPrefix(filepath.Clean(name), "store/sources/")
+	if !ok {
+		return nil
+	}
+	typ, _, _ := strings.Cut(rest, "/")
+	max, ok := config.MaxSourceSizeByType[typ]
+	if !ok {
+		return nil
+	}
+	s[typ] += size
+	if s[typ] > max {
+		return fmt.Errorf("%w: sources of type %v exceed %v bytes", ErrSourceTypeTooLarge, typ, max)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrUnknownSourceType = errors.New("unknown source type")
+	ErrInvalidSource     = errors.New("invalid source")
+)
+
+// sourceValidator checks a store/sources/<type>/ entry, the name is
+// relative to the source type dir and empty for the dir itself
+type sourceValidator func(name string, hdr *tar.Header) error
+
+// sourceValidators are the supported osbuild source types, keyed by
+// their dir below store/sources
+var sourceValidators = map[string]sourceValidator{
+	"org.osbuild.files":      validateFilesSource,
+	"org.osbuild.containers": validateContainersSource,
+	"org.osbuild.ostree":     validateOSTreeSource,
+}
+
+// sourceDigestRegexp matches the "<algorithm>:<digest>" names of the
+// sources, the digest is only verified where the content is known
+// (e.g. for decompressed or delta sources)
+var sourceDigestRegexp = regexp.MustCompile(`^[a-z0-9]+:[^/]+$`)
+
+func invalidSource(hdr *tar.Header, format string, a ...interface{}) error {
+	return fmt.Errorf("%w %v: %v", ErrInvalidSource, hdr.Name, fmt.Sprintf(format, a...))
+}
+
+// validateFilesSource allows only the (possibly compressed or delta)
+// files directly in the source dir
+func validateFilesSource(name string, hdr *tar.Header) error {
+	if name == "" {
+		return nil
+	}
+	if strings.Contains(name, "/") {
+		return invalidSource(hdr, "files sources cannot have subdirs")
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return invalidSource(hdr, "files sources must be regular files")
+	}
+	if !sourceDigestRegexp.MatchString(name) {
+		return invalidSource(hdr, "expected <algorithm>:<digest> name")
+	}
+	return nil
+}
+
+// validateContainersSource allows one dir per image digest, the
+// image itself is checked by osbuild
+func validateContainersSource(name string, hdr *tar.Header) error {
+	if name == "" {
+		return nil
+	}
+	image, _, _ := strings.Cut(name, "/")
+	if !sourceDigestRegexp.MatchString(image) {
+		return invalidSource(hdr, "expected <algorithm>:<digest> image dir")
+	}
+	if image == name && hdr.Typeflag != tar.TypeDir {
+		return invalidSource(hdr, "container images must be dirs")
+	}
+	return nil
+}
+
+// validateOSTreeSource allows only the ostree repo
+func validateOSTreeSource(name string, hdr *tar.Header) error {
+	if name == "" || name == "repo" || strings.HasPrefix(name, "repo/") {
+		return nil
+	}
+	return invalidSource(hdr, "expected ostree repo/")
+}
+
+// validateSourceEntry dispatches the store/sources/ entries to the
+// validator of their source type, other store/ entries are not
+// checked
+func validateSourceEntry(hdr *tar.Header) error {
+	rest, ok := strings.CutPrefix(filepath.Clean(hdr.Name), "store/sources/")
+	if !ok {
+		return nil
+	}
+	typ, name, _ := strings.Cut(rest, "/")
+	validate, ok := sourceValidators[typ]
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownSourceType, typ)
+	}
+	return validate(name, hdr)
+}
@@ -0,0 +1,81 @@
+package main_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+func makeSourcesTar(t *testing.T, dirs []string, entries ...tarEntry) *tar.Reader {
+	buf := bytes.NewBuffer(nil)
+	atar := tar.NewWriter(buf)
+	for _, dir := range dirs {
+		err := atar.WriteHeader(&tar.Header{Name: dir, Mode: 0755, Typeflag: tar.TypeDir})
+		assert.NoError(t, err)
+	}
+	for _, entry := range entries {
+		err := writeToTar(atar, entry.name, entry.content)
+		assert.NoError(t, err)
+	}
+	return tar.NewReader(buf)
+}
+
+func TestSourceTypeValidation(t *testing.T) {
+	for _, tc := range []struct {
+		dirs        []string
+		entries     []tarEntry
+		expectedErr string
+	}{
+		{nil, []tarEntry{{"store/sources/org.osbuild.files/sha256:1234", "data"}}, ""},
+		{nil, []tarEntry{{"store/sources/org.osbuild.files/random", "data"}}, "invalid source store/sources/org.osbuild.files/random: expected <algorithm>:<digest> name"},
+		{[]string{"store/sources/org.osbuild.files/sha256:1234/"}, nil, "invalid source store/sources/org.osbuild.files/sha256:1234/: files sources must be regular files"},
+		{[]string{"store/sources/org.osbuild.containers/sha256:1234/"}, []tarEntry{{"store/sources/org.osbuild.containers/sha256:1234/manifest.json", "{}"}}, ""},
+		{nil, []tarEntry{{"store/sources/org.osbuild.containers/sha256:1234", "data"}}, "invalid source store/sources/org.osbuild.containers/sha256:1234: container images must be dirs"},
+		{nil, []tarEntry{{"store/sources/org.osbuild.ostree/repo/config", "data"}}, ""},
+		{nil, []tarEntry{{"store/sources/org.osbuild.ostree/other", "data"}}, "invalid source store/sources/org.osbuild.ostree/other: expected ostree repo/"},
+		{[]string{"store/sources/org.example.unknown/"}, nil, `unknown source type "org.example.unknown"`},
+	} {
+		err := main.HandleIncludedSources(&main.Config{}, makeSourcesTar(t, tc.dirs, tc.entries...), t.TempDir(), nil)
+		if tc.expectedErr == "" {
+			assert.NoError(t, err)
+		} else {
+			assert.EqualError(t, err, tc.expectedErr)
+		}
+	}
+}
+
+func TestSourceTypeValidatorDispatch(t *testing.T) {
+	var validated []string
+	restore := main.MockSourceValidator("org.example.fake", func(name string, hdr *tar.Header) error {
+		validated = append(validated, name)
+		return nil
+	})
+	defer restore()
+
+	dirs := []string{"store/sources/org.example.fake/"}
+	err := main.HandleIncludedSources(&main.Config{}, makeSourcesTar(t, dirs, tarEntry{"store/sources/org.example.fake/item", "data"}), t.TempDir(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"", "item"}, validated)
+}
+
+func TestSourceTypeSizeCap(t *testing.T) {
+	config := &main.Config{MaxSourceSizeByType: map[string]int64{"org.osbuild.files": 8}}
+	dirs := []string{"store/sources/org.osbuild.containers/sha256:1234/"}
+	sources := []tarEntry{
+		{"store/sources/org.osbuild.files/sha256:1111", "1234"},
+		{"store/sources/org.osbuild.files/sha256:2222", "5678"},
+		// other types are not limited
+		{"store/sources/org.osbuild.containers/sha256:1234/layer", "a-much-bigger-layer"},
+	}
+	err := main.HandleIncludedSources(config, makeSourcesTar(t, dirs, sources...), t.TempDir(), nil)
+	assert.NoError(t, err)
+
+	sources = append(sources, tarEntry{"store/sources/org.osbuild.files/sha256:3333", "9"})
+	err = main.HandleIncludedSources(config, makeSourcesTar(t, dirs, sources...), t.TempDir(), nil)
+	assert.ErrorIs(t, err, main.ErrSourceTypeTooLarge)
+	assert.EqualError(t, err, "sources too large: sources of type org.osbuild.files exceed 8 bytes")
+}
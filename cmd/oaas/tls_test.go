@@ -0,0 +1,89 @@
+package main_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+// makeSelfSignedClientCert returns a client certificate and its PEM
+// encoding so that it can be used as its own CA
+func makeSelfSignedClientCert(t *testing.T, cn string) (tls.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestClientCertificateAuth(t *testing.T) {
+	knownCert, knownPEM := makeSelfSignedClientCert(t, "known-client")
+	unknownCert, _ := makeSelfSignedClientCert(t, "unknown-client")
+	caFile := filepath.Join(t.TempDir(), "client-ca.pem")
+	err := ioutil.WriteFile(caFile, knownPEM, 0644)
+	assert.NoError(t, err)
+
+	tlsConfig, err := main.NewTLSConfig(&main.Config{ClientCAFile: caFile})
+	assert.NoError(t, err)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, main.ClientID(r))
+	}))
+	srv.TLS = tlsConfig
+	srv.StartTLS()
+	defer srv.Close()
+
+	clientWithCert := func(cert *tls.Certificate) *http.Client {
+		client := srv.Client()
+		transport := client.Transport.(*http.Transport).Clone()
+		if cert != nil {
+			transport.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+		}
+		client.Transport = transport
+		return client
+	}
+
+	rsp, err := clientWithCert(&knownCert).Get(srv.URL)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "known-client", string(body))
+
+	for _, cert := range []*tls.Certificate{&unknownCert, nil} {
+		_, err = clientWithCert(cert).Get(srv.URL)
+		assert.Error(t, err)
+	}
+}
+
+func TestRunClientCARequiresTLSCert(t *testing.T) {
+	err := main.Run(context.Background(), []string{"-client-ca", "/some/ca.pem"}, os.Getenv)
+	assert.EqualError(t, err, "-client-ca requires -tls-cert and -tls-key")
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxTrailingEntrySize limits the trailing entries, they only carry
+// metadata
+const maxTrailingEntrySize = 64 * 1024
+
+var (
+	ErrInvalidTrailingEntry = errors.New("invalid trailing entry")
+)
+
+// validTrailingEntryName checks the names of Config.TrailingEntries,
+// the entries that have a meaning in the upload cannot be used
+func validTrailingEntryName(name string) bool {
+	switch name {
+	case "control.json", "manifest.json", "manifest.yaml", "manifest.json.tmpl", "build.env", "sources.tar", "store":
+		return false
+	}
+	return name != "" && !strings.Contains(name, "/") && !strings.HasPrefix(name, ".")
+}
+
+// verifyManifestSignature checks a trailing "signature" entry, it
+// contains the "sha256:<hex>" digest of the manifest.json so that the
+// client can bind the metadata to the build inputs
+func verifyManifestSignature(buildDir string, data []byte) error {
+	digest, err := fileDigest(filepath.Join(buildDir, "manifest.json"))
+	if err != nil {
+		return err
+	}
+	expected := "sha256:" + digest["sha256"]
+	if got := string(bytes.TrimSpace(data)); got != expected {
+		return fmt.Errorf("%w: signature %q does not match the manifest %v", ErrInvalidTrailingEntry, got, expected)
+	}
+	return nil
+}
+
+// handleTrailingEntry keeps the allowed trailing entries in the
+// "trailing" dir of the build dir (e.g. for the post build hook)
+func handleTrailingEntry(atar *tar.Reader, hdr *tar.Header, buildDir string) error {
+	if hdr.Typeflag != tar.TypeReg {
+		return fmt.Errorf("%w: %v must be a regular file", ErrInvalidTrailingEntry, hdr.Name)
+	}
+	if hdr.Size > maxTrailingEntrySize {
+		return fmt.Errorf("%w: %v is bigger than %v bytes", ErrInvalidTrailingEntry, hdr.Name, maxTrailingEntrySize)
+	}
+	data, err := io.ReadAll(atar)
+	if err != nil {
+		return fmt.Errorf("cannot read %v: %w", hdr.Name, err)
+	}
+	if hdr.Name == "signature" {
+		if err := verifyManifestSignature(buildDir, data); err != nil {
+			return err
+		}
+	}
+	dir := filepath.Join(buildDir, "trailing")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, hdr.Name), data, 0600)
+}
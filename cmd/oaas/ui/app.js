@@ -0,0 +1,70 @@
+"use strict";
+
+// tarEntry creates a ustar entry (header plus padded data) for a
+// single regular file
+function tarEntry(name, content) {
+  const enc = new TextEncoder();
+  const data = enc.encode(content);
+  const hdr = new Uint8Array(512);
+  const put = (off, len, str) => hdr.set(enc.encode(str).slice(0, len), off);
+  const octal = (n, len) => n.toString(8).padStart(len - 1, "0");
+
+  put(0, 100, name);
+  put(100, 8, octal(0o644, 8));
+  put(108, 8, octal(0, 8));
+  put(116, 8, octal(0, 8));
+  put(124, 12, octal(data.length, 12));
+  put(136, 12, octal(Math.floor(Date.now() / 1000), 12));
+  put(148, 8, "        ");
+  put(156, 1, "0");
+  put(257, 6, "ustar\0");
+  put(263, 2, "00");
+  let sum = 0;
+  for (const b of hdr) {
+    sum += b;
+  }
+  put(148, 7, octal(sum, 7) + "\0");
+
+  const padded = new Uint8Array(Math.ceil(data.length / 512) * 512);
+  padded.set(data);
+  return [hdr, padded];
+}
+
+async function submitBuild(ev) {
+  ev.preventDefault();
+  const output = document.getElementById("output");
+  const tarfile = document.getElementById("tarfile").files[0];
+  if (!tarfile) {
+    output.textContent = "no tar file selected";
+    return;
+  }
+  const split = (s, sep) => s.split(sep).map((v) => v.trim()).filter((v) => v !== "");
+  const control = {
+    exports: split(document.getElementById("exports").value, ","),
+    environments: split(document.getElementById("environments").value, "\n"),
+  };
+
+  // control.json must be the first entry, the selected tar is
+  // appended as is
+  const body = new Blob([...tarEntry("control.json", JSON.stringify(control)), tarfile]);
+  output.textContent = "";
+  const rsp = await fetch("/api/v1/build", {
+    method: "POST",
+    headers: { "Content-Type": "application/x-tar" },
+    body: body,
+  });
+  const reader = rsp.body.getReader();
+  const dec = new TextDecoder();
+  for (;;) {
+    const { done, value } = await reader.read();
+    if (done) {
+      break;
+    }
+    output.textContent += dec.decode(value, { stream: true });
+  }
+  if (rsp.status === 201) {
+    output.textContent += "\n\ndownload the result from /api/v1/result/output.tar";
+  }
+}
+
+document.getElementById("build-form").addEventListener("submit", submitBuild);
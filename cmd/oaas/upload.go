@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+var (
+	ErrUploadHostNotAllowed = errors.New("upload host not allowed")
+)
+
+type resultUpload struct {
+	URL         string `json:"url"`
+	Credentials string `json:"credentials"`
+}
+
+// uploadCredentials is the on-disk format for the files in
+// Config.UploadCredentialsDir
+type uploadCredentials struct {
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	Region          string `json:"region"`
+}
+
+type uploadRecord struct {
+	URLs []string `json:"urls"`
+}
+
+func loadUploadCredentials(config *Config, name string) (*uploadCredentials, error) {
+	if config.UploadCredentialsDir == "" {
+		return nil, fmt.Errorf("no upload credentials configured")
+	}
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("invalid credentials reference %q", name)
+	}
+	f, err := os.Open(filepath.Join(config.UploadCredentialsDir, name))
+	if err != nil {
+		return nil, fmt.Errorf("cannot open credentials %q: %v", name, err)
+	}
+	defer f.Close()
+
+	var creds uploadCredentials
+	if err := json.NewDecoder(f).Decode(&creds); err != nil {
+		return nil, fmt.Errorf("cannot decode credentials %q: %v", name, err)
+	}
+	if creds.Region == "" {
+		creds.Region = "us-east-1"
+	}
+	return &creds, nil
+}
+
+// validateResultUpload is run before the build starts so that
+// clients get an error before any work is done
+func validateResultUpload(config *Config, upload *resultUpload) error {
+	u, err := url.Parse(upload.URL)
+	if err != nil {
+		return fmt.Errorf("cannot parse upload url: %v", err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return fmt.Errorf("unsupported upload url scheme %q", u.Scheme)
+	}
+	if !slices.Contains(config.UploadHosts, u.Hostname()) {
+		return fmt.Errorf("%w: %v", ErrUploadHostNotAllowed, u.Hostname())
+	}
+	_, err = loadUploadCredentials(config, upload.Credentials)
+	return err
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signS3Request signs the request with AWS signature version 4, the
+// payload is not part of the signature so that it can be streamed
+func signS3Request(req *http.Request, creds *uploadCredentials, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := now.UTC().Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", "UNSIGNED-PAYLOAD")
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:UNSIGNED-PAYLOAD",
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	scope := strings.Join([]string{date, creds.Region, "s3", "aws4_request"}, "/")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, creds.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// uploadResult uploads the given file below the upload url and
+// returns the url of the created object, a stalled upload must not
+// keep the build forever
+func uploadResult(ctx context.Context, config *Config, upload *resultUpload, path string) (string, error) {
+	if config.UploadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.UploadTimeout)
+		defer cancel()
+	}
+	creds, err := loadUploadCredentials(config, upload.Credentials)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	objectURL := strings.TrimSuffix(upload.URL, "/") + "/" + filepath.Base(path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, objectURL, f)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = st.Size()
+	signS3Request(req, creds, time.Now())
+
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("cannot upload %v: %v", objectURL, err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(rsp.Body)
+		return "", fmt.Errorf("cannot upload %v: %v: %s", objectURL, rsp.Status, body)
+	}
+
+	return objectURL, nil
+}
+
+func writeUploadRecord(buildDir string, urls []string) error {
+	data, err := json.Marshal(&uploadRecord{URLs: urls})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(buildDir, "upload.json"), data, 0600)
+}
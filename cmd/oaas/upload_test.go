@@ -0,0 +1,139 @@
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+type fakeS3 struct {
+	sync.Mutex
+
+	auth    string
+	objects map[string][]byte
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	s3 := &fakeS3{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "only PUT supported", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+
+		s3.Lock()
+		defer s3.Unlock()
+		s3.auth = r.Header.Get("Authorization")
+		s3.objects[r.URL.Path] = body
+	}))
+	t.Cleanup(srv.Close)
+	return s3, srv
+}
+
+func makeUploadCredentials(t *testing.T) string {
+	credsDir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(credsDir, "my-bucket"), []byte(`{"access_key_id": "AKID", "secret_access_key": "secret", "region": "eu-central-1"}`), 0600)
+	assert.NoError(t, err)
+	return credsDir
+}
+
+func TestBuildResultUpload(t *testing.T) {
+	s3, s3srv := newFakeS3(t)
+	baseURL, baseBuildDir, _ := runTestServer(t, "-upload-hosts", "127.0.0.1", "-upload-credentials-dir", makeUploadCredentials(t))
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+echo "fake-build-result" > %[1]s/build/output/image/disk.img
+`, baseBuildDir))
+	defer restore()
+
+	control := fmt.Sprintf(`{"exports": ["tree"], "result_upload": {"url": "%s/bucket/builds/", "credentials": "my-bucket"}}`, s3srv.URL)
+	buf := makeTestPost(t, control, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	objectURL := s3srv.URL + "/bucket/builds/output.tar"
+	assert.Equal(t, fmt.Sprintf("result uploaded to %s\n", objectURL), string(body))
+
+	s3.Lock()
+	assert.True(t, strings.HasPrefix(s3.auth, "AWS4-HMAC-SHA256 Credential=AKID/"), s3.auth)
+	assert.Contains(t, s3.auth, "/eu-central-1/s3/aws4_request")
+	uploaded := s3.objects["/bucket/builds/output.tar"]
+	s3.Unlock()
+	localTar, err := ioutil.ReadFile(filepath.Join(baseBuildDir, "build/output/output.tar"))
+	assert.NoError(t, err)
+	assert.Equal(t, localTar, uploaded)
+
+	// the result endpoint points to the uploaded object
+	rsp, err = http.Get(baseURL + "api/v1/result/output.tar")
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	var record struct {
+		URLs []string `json:"urls"`
+	}
+	err = json.NewDecoder(rsp.Body).Decode(&record)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{objectURL}, record.URLs)
+}
+
+func TestBuildResultUploadTimeout(t *testing.T) {
+	stalled := make(chan struct{})
+	s3srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stalled
+	}))
+	t.Cleanup(s3srv.Close)
+	// runs before the server is closed
+	t.Cleanup(func() { close(stalled) })
+	baseURL, baseBuildDir, _ := runTestServer(t, "-upload-hosts", "127.0.0.1", "-upload-credentials-dir", makeUploadCredentials(t), "-upload-timeout", "200ms")
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+mkdir -p %[1]s/build/output/image
+`, baseBuildDir))
+	defer restore()
+
+	startTime := time.Now()
+	control := fmt.Sprintf(`{"exports": ["tree"], "result_upload": {"url": "%s/bucket/builds/", "credentials": "my-bucket"}}`, s3srv.URL)
+	buf := makeTestPost(t, control, `{"fake": "manifest"}`)
+	rsp, err := http.Post(baseURL+"api/v1/build", "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.True(t, time.Since(startTime) < 10*time.Second)
+	assert.Contains(t, string(body), "cannot upload "+s3srv.URL+"/bucket/builds/output.tar: ")
+	assert.Contains(t, string(body), "context deadline exceeded")
+}
+
+func TestBuildResultUploadHostNotAllowed(t *testing.T) {
+	baseURL, _, _ := runTestServer(t, "-upload-hosts", "s3.example.com", "-upload-credentials-dir", makeUploadCredentials(t))
+	endpoint := baseURL + "api/v1/build"
+
+	control := `{"exports": ["tree"], "result_upload": {"url": "https://evil.example.com/bucket", "credentials": "my-bucket"}}`
+	buf := makeTestPost(t, control, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "result upload: upload host not allowed: evil.example.com\n", string(body))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+)
+
+var (
+	ErrUserNamespaceUnsupported = errors.New("user namespaces not supported")
+)
+
+// readSysctl returns the value of the given /proc/sys file, missing
+// files give an empty value as not every kernel has all knobs
+func readSysctl(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// checkUserNamespace detects the common reasons why osbuild cannot
+// be started in a user namespace so that they are reported at
+// startup instead of failing every build
+func checkUserNamespace() error {
+	if !fileExists("/proc/self/ns/user") {
+		return fmt.Errorf("%w: kernel has no user namespace support", ErrUserNamespaceUnsupported)
+	}
+	if readSysctl("/proc/sys/user/max_user_namespaces") == "0" {
+		return fmt.Errorf("%w: user.max_user_namespaces is 0", ErrUserNamespaceUnsupported)
+	}
+	if os.Getuid() == 0 {
+		return nil
+	}
+	if readSysctl("/proc/sys/kernel/unprivileged_userns_clone") == "0" {
+		return fmt.Errorf("%w: kernel.unprivileged_userns_clone is 0", ErrUserNamespaceUnsupported)
+	}
+	if readSysctl("/proc/sys/kernel/apparmor_restrict_unprivileged_userns") == "1" {
+		return fmt.Errorf("%w: kernel.apparmor_restrict_unprivileged_userns is 1", ErrUserNamespaceUnsupported)
+	}
+	return nil
+}
+
+// useUserNamespace starts the process in a new user namespace where
+// the user of the server is root, this is what "unshare
+// --map-root-user" does
+func useUserNamespace(attr *syscall.SysProcAttr) {
+	attr.Cloneflags |= syscall.CLONE_NEWUSER
+	attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+	attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	// an unprivileged user can only map its gid without setgroups
+	attr.GidMappingsEnableSetgroups = false
+}
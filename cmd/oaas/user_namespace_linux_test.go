@@ -0,0 +1,47 @@
+package main_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/osbuild/oaas/cmd/oaas"
+)
+
+func TestBuildUserNamespace(t *testing.T) {
+	if data, err := ioutil.ReadFile("/proc/sys/user/max_user_namespaces"); err != nil || strings.TrimSpace(string(data)) == "0" {
+		t.Skip("user namespaces not available")
+	}
+	baseURL, baseBuildDir, _ := runTestServer(t, "-user-namespace")
+	endpoint := baseURL + "api/v1/build"
+
+	restore := main.MockOsbuildBinary(t, fmt.Sprintf(`#!/bin/sh -e
+echo "uid: $(id -u)"
+echo "uid_map: $(cat /proc/self/uid_map)"
+mkdir -p %[1]s/build/output/image
+echo "fake-build-result" > %[1]s/build/output/image/disk.img
+`, baseBuildDir))
+	defer restore()
+
+	buf := makeTestPost(t, `{"exports": ["image"]}`, `{"fake": "manifest"}`)
+	rsp, err := http.Post(endpoint, "application/x-tar", buf)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusCreated, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), "uid: 0\n")
+	// only the server user is mapped
+	var uidMap string
+	for _, line := range strings.Split(string(body), "\n") {
+		if m, ok := strings.CutPrefix(line, "uid_map: "); ok {
+			uidMap = strings.Join(strings.Fields(m), " ")
+		}
+	}
+	assert.Equal(t, fmt.Sprintf("0 %d 1", os.Getuid()), uidMap)
+}
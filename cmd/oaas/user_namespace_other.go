@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+var (
+	ErrUserNamespaceUnsupported = errors.New("user namespaces not supported")
+)
+
+func checkUserNamespace() error {
+	return ErrUserNamespaceUnsupported
+}
+
+func useUserNamespace(attr *syscall.SysProcAttr) {
+}